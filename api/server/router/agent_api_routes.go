@@ -0,0 +1,350 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caoyingjunz/pixiulib/httputils"
+	"github.com/gin-gonic/gin"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util/errors"
+)
+
+const agentNameKey = "agentName"
+
+// agentAuthentication 校验 api 模式下 agent 的凭证，注册接口使用引导凭证单独校验
+func (cr *rainbowRouter) agentAuthentication(c *gin.Context) {
+	agentName := c.GetHeader(types.AgentNameHeader)
+	credential := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if err := cr.c.Server().AuthenticateAgent(c, agentName, credential); err != nil {
+		httputils.AbortFailedWithCode(c, http.StatusUnauthorized, err)
+		return
+	}
+
+	c.Set(agentNameKey, agentName)
+}
+
+func (cr *rainbowRouter) registerAgent(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req types.RegisterAgentRequest
+		err error
+	)
+	if err = httputils.ShouldBindAny(c, &req, nil, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().RegisterAgent(c, &req); err != nil {
+		httputils.SetFailedWithCode(c, resp, http.StatusUnauthorized, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) agentHeartbeat(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req types.AgentHeartbeatRequest
+		err error
+	)
+	if err = httputils.ShouldBindAny(c, &req, nil, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().AgentHeartbeat(c, c.GetString(agentNameKey), &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) getAgentSelf(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var err error
+	if resp.Result, err = cr.c.Server().GetAgentSelf(c, c.GetString(agentNameKey)); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) updateAgentUsage(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req types.UpdateAgentUsageRequest
+		err error
+	)
+	if err = httputils.ShouldBindAny(c, &req, nil, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().UpdateAgentUsage(c, c.GetString(agentNameKey), &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) listAgentTasks(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var err error
+	if resp.Result, err = cr.c.Server().ListAgentTasks(c, c.GetString(agentNameKey)); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) listOwnedAgentTasks(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req types.ListOwnedAgentTasksRequest
+		err error
+	)
+	if err = httputils.ShouldBindAny(c, &req, nil, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().ListOwnedAgentTasks(c, c.GetString(agentNameKey), &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) claimAgentTask(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req    types.ClaimAgentTaskRequest
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().ClaimAgentTask(c, c.GetString(agentNameKey), idMeta.ID, &req); err != nil {
+		if errors.IsNotUpdated(err) {
+			httputils.SetFailedWithCode(c, resp, http.StatusConflict, err)
+			return
+		}
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) releaseAgentTask(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req    types.ReleaseAgentTaskRequest
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().ReleaseAgentTask(c, c.GetString(agentNameKey), idMeta.ID, &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) updateAgentTaskStatus(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req    types.UpdateAgentTaskStatusRequest
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().UpdateAgentTaskStatus(c, c.GetString(agentNameKey), idMeta.ID, &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) createAgentTaskMessage(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req    types.CreateTaskMessageRequest
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	req.Id = idMeta.ID
+	if err = cr.c.Server().CreateAgentTaskMessage(c, c.GetString(agentNameKey), req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) getAgentTaskConfig(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, nil, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().GetAgentTaskConfig(c, c.GetString(agentNameKey), idMeta.ID); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) issueAgentPluginToken(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, nil, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().IssueAgentPluginToken(c, c.GetString(agentNameKey), idMeta.ID); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) revokeAgentPluginToken(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, nil, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().RevokeAgentPluginToken(c, c.GetString(agentNameKey), idMeta.ID); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+// getPluginTaskConfig runner 使用任务凭证获取 plugin 配置
+func (cr *rainbowRouter) getPluginTaskConfig(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, nil, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if resp.Result, err = cr.c.Server().GetPluginTaskConfig(c, idMeta.ID, token); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+// issuePluginDockerhubToken runner 使用任务凭证申请 dockerhub 仓库的拉取 token
+func (cr *rainbowRouter) issuePluginDockerhubToken(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		idMeta types.IdMeta
+		req    types.DockerhubTokenRequest
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if resp.Result, err = cr.c.Server().IssuePluginDockerhubToken(c, idMeta.ID, token, &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) acquireAgentAccount(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req types.AcquireAccountRequest
+		err error
+	)
+	if err = httputils.ShouldBindAny(c, &req, nil, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if resp.Result, err = cr.c.Server().AcquireAgentAccount(c, c.GetString(agentNameKey), &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
+
+func (cr *rainbowRouter) reportAgentAccountUsage(c *gin.Context) {
+	resp := httputils.NewResponse()
+
+	var (
+		req    types.ReportAccountUsageRequest
+		idMeta types.IdMeta
+		err    error
+	)
+	if err = httputils.ShouldBindAny(c, &req, &idMeta, nil); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+	if err = cr.c.Server().ReportAgentAccountUsage(c, c.GetString(agentNameKey), idMeta.ID, &req); err != nil {
+		httputils.SetFailed(c, resp, err)
+		return
+	}
+
+	httputils.SetSuccess(c, resp)
+}
@@ -17,6 +17,7 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/caoyingjunz/rainbow/cmd/app/options"
+	"github.com/caoyingjunz/rainbow/pkg/types"
 	"github.com/caoyingjunz/rainbow/pkg/util/signatureutil"
 )
 
@@ -58,6 +59,10 @@ func Authentication(o *options.ServerOptions) gin.HandlerFunc {
 		if isPublicPath(c.Request.URL.Path) {
 			return
 		}
+		// agent 接口使用 agent 凭证单独认证，runner 接口使用任务凭证单独认证
+		if strings.HasPrefix(c.Request.URL.Path, types.AgentAPIPrefix) || strings.HasPrefix(c.Request.URL.Path, types.PluginAPIPrefix) {
+			return
+		}
 
 		accessKey := c.GetHeader("accessKey")
 		if accessKey != auth.AccessKey {
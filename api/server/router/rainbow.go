@@ -5,6 +5,7 @@ import (
 
 	"github.com/caoyingjunz/rainbow/cmd/app/options"
 	"github.com/caoyingjunz/rainbow/pkg/controller"
+	"github.com/caoyingjunz/rainbow/pkg/types"
 )
 
 type rainbowRouter struct {
@@ -27,6 +28,8 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 		metricsRoute := routeV2.Group("/metrics")
 		{
 			metricsRoute.GET("/active-users/daily", cr.getDailyMetrics)
+			metricsRoute.GET("/remote-calls", cr.listRemoteCallMetrics)
+			metricsRoute.GET("/search-cache", cr.listSearchCacheMetrics)
 		}
 
 		// 通过 ak 获取用户信息
@@ -62,6 +65,7 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 			searchRoute.GET("/repositories", cr.searchRepositories)
 			searchRoute.GET("/repositories/tags", cr.searchRepositoryTags)
 			searchRoute.GET("/repositories/:namespace/:name/tags/:tag", cr.getRepositoryTagInfo)
+			searchRoute.GET("/repositories/:namespace/:name/tags/:tag/inspect", cr.inspectRepositoryTag)
 		}
 
 		// 客户端下载
@@ -87,6 +91,7 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 
 		taskRoute.POST("/:Id/messages", cr.createTaskMessage)
 		taskRoute.GET(":Id/messages", cr.listTaskMessages)
+		taskRoute.GET("/:Id/run", cr.getTaskRun)
 	}
 
 	archRoute := httpEngine.Group("/rainbow/architectures")
@@ -132,11 +137,46 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 		agentRoute.PUT("/:Name", cr.updateAgent)
 		agentRoute.DELETE("/:Id", cr.deleteAgent)
 		agentRoute.GET("/:Id", cr.getAgent)
+		agentRoute.GET("/:Id/usages", cr.listAgentUsages)
 		agentRoute.GET("", cr.listAgents)
 		agentRoute.PUT("/status", cr.updateAgentStatus)
 
 		// 指定 agent 创建 repo
 		agentRoute.POST("/:Name/repos", cr.createAgentRepo)
+
+		// api 模式下 agent 凭证的轮换和吊销
+		agentRoute.POST("/:Name/credentials/rotate", cr.rotateAgentCredential)
+		agentRoute.POST("/:Name/credentials/revoke", cr.revokeAgentCredential)
+	}
+
+	// api 模式下 agent 调用的接口，除注册外均使用 agent 凭证认证
+	agentAPIRoute := httpEngine.Group(types.AgentAPIPrefix)
+	{
+		agentAPIRoute.POST("/register", cr.registerAgent)
+
+		agentAPIRoute.PUT("/heartbeat", cr.agentAuthentication, cr.agentHeartbeat)
+		agentAPIRoute.GET("/self", cr.agentAuthentication, cr.getAgentSelf)
+		agentAPIRoute.PUT("/usage", cr.agentAuthentication, cr.updateAgentUsage)
+
+		agentAPIRoute.GET("/tasks", cr.agentAuthentication, cr.listAgentTasks)
+		agentAPIRoute.POST("/tasks/owned", cr.agentAuthentication, cr.listOwnedAgentTasks)
+		agentAPIRoute.POST("/tasks/:Id/claim", cr.agentAuthentication, cr.claimAgentTask)
+		agentAPIRoute.POST("/tasks/:Id/release", cr.agentAuthentication, cr.releaseAgentTask)
+		agentAPIRoute.PUT("/tasks/:Id/status", cr.agentAuthentication, cr.updateAgentTaskStatus)
+		agentAPIRoute.POST("/tasks/:Id/messages", cr.agentAuthentication, cr.createAgentTaskMessage)
+		agentAPIRoute.GET("/tasks/:Id/config", cr.agentAuthentication, cr.getAgentTaskConfig)
+		agentAPIRoute.POST("/tasks/:Id/plugin-token", cr.agentAuthentication, cr.issueAgentPluginToken)
+		agentAPIRoute.DELETE("/tasks/:Id/plugin-token", cr.agentAuthentication, cr.revokeAgentPluginToken)
+
+		agentAPIRoute.POST("/accounts/acquire", cr.agentAuthentication, cr.acquireAgentAccount)
+		agentAPIRoute.PUT("/accounts/:Id/usage", cr.agentAuthentication, cr.reportAgentAccountUsage)
+	}
+
+	// runner 使用任务凭证调用的接口
+	pluginAPIRoute := httpEngine.Group(types.PluginAPIPrefix)
+	{
+		pluginAPIRoute.GET("/tasks/:Id/config", cr.getPluginTaskConfig)
+		pluginAPIRoute.POST("/tasks/:Id/dockerhub-token", cr.issuePluginDockerhubToken)
 	}
 
 	imageRoute := httpEngine.Group("/rainbow/images")
@@ -153,6 +193,16 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 		imageRoute.GET("/:Id/tags", cr.listImageTags)
 		imageRoute.DELETE("/:Id/tags/:TagId", cr.deleteImageTag)
 		imageRoute.GET("/:Id/tags/:TagId", cr.getImageTag)
+		imageRoute.GET("/:Id/tags/:TagId/inspect", cr.inspectImageTag)
+		imageRoute.POST("/:Id/tags/:TagId/scan", cr.scanImageTag)
+		imageRoute.GET("/:Id/tags/:TagId/scan", cr.getImageTagScan)
+
+		// 镜像和版本锁定 API
+		imageRoute.POST("/:Id/lock", cr.lockImage)
+		imageRoute.POST("/:Id/unlock", cr.unlockImage)
+		imageRoute.POST("/:Id/tags/:TagId/lock", cr.lockImageTag)
+		imageRoute.POST("/:Id/tags/:TagId/unlock", cr.unlockImageTag)
+		imageRoute.GET("/:Id/lock-events", cr.listLockEvents)
 
 		// 镜像关联 Label API
 		imageRoute.POST("/:Id/labels", cr.bindImageLabels)
@@ -171,6 +221,7 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 	searchRoute := httpEngine.Group("/rainbow/search")
 	{
 		searchRoute.GET("/images", cr.searchImages)
+		searchRoute.GET("/catalog", cr.searchCatalog)
 	}
 
 	collectRoute := httpEngine.Group("/rainbow/collections")
@@ -236,6 +287,8 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 		overviewRoute.GET("/downflow/daily", cr.downflow)
 		overviewRoute.GET("/store/daily", cr.store)
 		overviewRoute.GET("/image/daily", cr.getImageDownflow)
+		overviewRoute.GET("/image/top", cr.topImagePulls)
+		overviewRoute.GET("/image/trending", cr.trendingImagePulls)
 	}
 
 	repoRoute := httpEngine.Group("/rainbow/search")
@@ -243,6 +296,7 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 		repoRoute.GET("/repositories", cr.searchRepositories)
 		repoRoute.GET("/repositories/tags", cr.searchRepositoryTags)
 		repoRoute.GET("/repositories/:namespace/:name/tags/:tag", cr.getRepositoryTagInfo)
+		repoRoute.GET("/repositories/:namespace/:name/tags/:tag/inspect", cr.inspectRepositoryTag)
 	}
 
 	notifyRoute := httpEngine.Group("/rainbow/notifications")
@@ -306,7 +360,53 @@ func (cr *rainbowRouter) initRoutes(httpEngine *gin.Engine) {
 
 	rainbowdRoute := httpEngine.Group("/rainbow/rainbowds")
 	{
+		rainbowdRoute.POST("", cr.createRainbowd)
+		rainbowdRoute.PUT("/:Id", cr.updateRainbowd)
+		rainbowdRoute.DELETE("/:Id", cr.deleteRainbowd)
+		rainbowdRoute.GET("/:Id", cr.getRainbowd)
 		rainbowdRoute.GET("", cr.listRainbowds)
+
+		rainbowdRoute.GET("/:Id/events", cr.listRainbowdEvents)
+		rainbowdRoute.POST("/:Id/rekey", cr.rekeyRainbowd)
+	}
+
+	// agent 分批升级计划
+	agentUpgradeRoute := httpEngine.Group("/rainbow/agentupgrades")
+	{
+		agentUpgradeRoute.POST("", cr.createAgentUpgrade)
+		agentUpgradeRoute.DELETE("/:Id", cr.deleteAgentUpgrade)
+		agentUpgradeRoute.GET("/:Id", cr.getAgentUpgrade)
+		agentUpgradeRoute.GET("", cr.listAgentUpgrades)
+
+		agentUpgradeRoute.POST("/:Id/pause", cr.pauseAgentUpgrade)
+		agentUpgradeRoute.POST("/:Id/resume", cr.resumeAgentUpgrade)
+		agentUpgradeRoute.POST("/:Id/rollback", cr.rollbackAgentUpgrade)
+	}
+
+	// 镜像源账号池，用于认证访问 dockerhub
+	accountRoute := httpEngine.Group("/rainbow/accounts")
+	{
+		accountRoute.POST("", cr.createAccount)
+		accountRoute.PUT("/:Id", cr.updateAccount)
+		accountRoute.DELETE("/:Id", cr.deleteAccount)
+		accountRoute.GET("/:Id", cr.getAccount)
+		accountRoute.GET("", cr.listAccounts)
+	}
+
+	// 版本不可变规则，如 v* 版本同步完成后不允许删除和覆盖
+	immutableRuleRoute := httpEngine.Group("/rainbow/immutable-rules")
+	{
+		immutableRuleRoute.POST("", cr.createImmutableRule)
+		immutableRuleRoute.DELETE("/:Id", cr.deleteImmutableRule)
+		immutableRuleRoute.GET("", cr.listImmutableRules)
+	}
+
+	// 校验镜像签名的公钥
+	signingKeyRoute := httpEngine.Group("/rainbow/signing-keys")
+	{
+		signingKeyRoute.POST("", cr.createSigningKey)
+		signingKeyRoute.DELETE("/:Id", cr.deleteSigningKey)
+		signingKeyRoute.GET("", cr.listSigningKeys)
 	}
 
 	// 设置资源状态API
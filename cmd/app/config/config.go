@@ -8,6 +8,30 @@ const (
 	DefaultUserRateLimitQuantum        = 10
 	DefaultUserRateLimitCapacity       = 100
 
+	defaultSubscribeResyncInterval    = 60
+	defaultSubscribeMaxFailTimes      = 5
+	defaultSubscribeBackoffBase       = 60
+	defaultSubscribeBackoffMax        = 6 * 3600
+	defaultSubscribeProbeInterval     = 3600
+	defaultSubscribeMessageRetains    = 50
+	defaultSubscribeMessageRetainDays = 14
+
+	defaultRemoteTimeout = 60
+
+	defaultSearchCacheTTL         = 300
+	defaultSearchCacheStaleTTL    = 3600
+	defaultSearchCacheNotFoundTTL = 60
+
+	defaultScannerWorkers        = 2
+	defaultScannerTimeout        = 600
+	defaultScannerResyncInterval = 600
+
+	defaultGCInterval     = 900
+	defaultGCMaxDiskUsage = 10 * 1024
+
+	defaultBudgetMonthly   = 16
+	defaultBudgetSoftRatio = 0.8
+
 	defaultRainbowdTemplateDir = "/data/template"
 	defaultDownloadDir         = "/data/pixiuctl"
 )
@@ -35,6 +59,17 @@ func (c *Config) SetDefaults() {
 	if len(c.Server.DownloadDir) == 0 {
 		c.Server.DownloadDir = defaultDownloadDir
 	}
+	c.Subscribe.SetDefaults()
+	if len(c.Remote.Transport) == 0 {
+		c.Remote.Transport = RemoteTransportRedis
+	}
+	if c.Remote.Timeout <= 0 {
+		c.Remote.Timeout = defaultRemoteTimeout
+	}
+	c.Budget.SetDefaults()
+	c.Agent.GC.SetDefaults()
+	c.SearchCache.SetDefaults()
+	c.Scanner.SetDefaults()
 }
 
 type Config struct {
@@ -59,6 +94,36 @@ type Config struct {
 	Agent AgentOption `yaml:"agent"`
 
 	RateLimit RateLimitOption `yaml:"rate_limit"`
+
+	Subscribe SubscribeOption `yaml:"subscribe"`
+
+	Tunnel TunnelOption `yaml:"tunnel"`
+
+	// server 与 agent 之间远程调用的传输方式
+	Remote RemoteOption `yaml:"remote"`
+
+	// 通用 OCI 镜像源，按 hub 名称配置，同名时覆盖内置镜像源
+	Hubs []HubOption `yaml:"hubs,omitempty"`
+
+	// agent 的 GitHub Actions 开销预算
+	Budget BudgetOption `yaml:"budget"`
+
+	// 远端镜像搜索结果的缓存，减少对镜像源的请求
+	SearchCache SearchCacheOption `yaml:"search_cache"`
+
+	// 已同步镜像的漏洞扫描，未配置扫描器时不扫描
+	Scanner ScannerOption `yaml:"scanner"`
+
+	// 镜像目录搜索
+	Catalog CatalogOption `yaml:"catalog"`
+}
+
+type HubOption struct {
+	Name     string `yaml:"name"`     // hub 名称，如 ghcr.io
+	Endpoint string `yaml:"endpoint"` // 镜像仓库地址，如 https://ghcr.io
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty"`
 }
 
 type DefaultOption struct {
@@ -75,6 +140,7 @@ type ServerOption struct {
 	DownloadDir string `yaml:"download_dir"`
 	Auth        Auth   `yaml:"auth"`
 	Harbor      Harbor `yaml:"harbor"`
+	EncryptKey  string `yaml:"encrypt_key"` // 加密保存 rainbowd ssh 密码的密钥，修改后需重新设置密码
 }
 
 type RainbowdOption struct {
@@ -83,12 +149,27 @@ type RainbowdOption struct {
 	DataDir     string     `yaml:"data_dir"`
 	AgentImage  string     `yaml:"agent_image"`
 	Nodes       []NodeSpec `yaml:"nodes,omitempty"`
+
+	// 以 kubernetes 工作负载部署 agent 时使用的集群
+	Kubernetes AgentKubernetesOption `yaml:"kubernetes,omitempty"`
+}
+
+type AgentKubernetesOption struct {
+	Kubeconfig string   `yaml:"kubeconfig,omitempty"` // 为空时使用 in-cluster 配置
+	Namespace  string   `yaml:"namespace,omitempty"`  // agent 部署的命名空间，默认 rainbow
+	Command    []string `yaml:"command,omitempty"`    // agent 容器的启动命令，默认 /data/agent --configFile /etc/rainbow/config.yaml
+
+	// agent 数据目录使用的 PVC，保存 plugin 仓库和注册后颁发的 agent 凭证，pod 重建后无需重新注册
+	StorageClass string `yaml:"storage_class,omitempty"` // 为空时使用集群默认的 StorageClass
+	StorageSize  string `yaml:"storage_size,omitempty"`  // 默认 10Gi
 }
 
 type NodeSpec struct {
-	Name string `yaml:"name,omitempty"`
-	Host string `yaml:"host,omitempty"`
-	Port int    `yaml:"port,omitempty"`
+	Name       string `yaml:"name,omitempty"`
+	Host       string `yaml:"host,omitempty"`
+	Port       int    `yaml:"port,omitempty"`
+	User       string `yaml:"user,omitempty"`
+	PrivateKey string `yaml:"private_key,omitempty"` // server 上的私钥路径，密码需通过接口设置
 }
 
 type RocketmqOption struct {
@@ -132,6 +213,17 @@ type PluginOption struct {
 	Synced     bool   `yaml:"synced"`
 	Driver     string `yaml:"driver"`
 	Arch       string `yaml:"arch"`
+	// Token 任务凭证，用于获取任务配置和申请 dockerhub 的拉取 token，流水线结束后吊销
+	Token string `yaml:"token,omitempty"`
+
+	Signature SignatureOption `yaml:"signature"`
+}
+
+// SignatureOption 镜像签名、证明和 SBOM 的同步策略
+type SignatureOption struct {
+	Copy       bool     `yaml:"copy"`                  // 通过 referrers API 和 cosign tag 发现关联制品并复制到目标仓库
+	Verify     bool     `yaml:"verify"`                // 同步前校验 cosign 签名，校验失败不同步
+	PublicKeys []string `yaml:"public_keys,omitempty"` // PEM 格式的公钥，任一公钥校验通过即可
 }
 
 type BuildOption struct {
@@ -164,10 +256,181 @@ type RedisOption struct {
 	Db       int    `yaml:"db"`
 }
 
+const (
+	AgentModeDirect = "direct"
+	AgentModeAPI    = "api"
+)
+
 type AgentOption struct {
 	Name       string `yaml:"name"`
 	DataDir    string `yaml:"data_dir"`
 	RetainDays int    `yaml:"retain_days"`
+
+	Mode           string `yaml:"mode,omitempty"`            // 运行模式，direct 直连 mysql 和 redis，api 仅通过 server 接口交互，默认 direct
+	Server         string `yaml:"server,omitempty"`          // api 模式下的 server 地址，如 http://127.0.0.1:8090
+	BootstrapToken string `yaml:"bootstrap_token,omitempty"` // api 模式下首次注册使用的引导凭证，注册成功后失效
+	CredentialFile string `yaml:"credential_file,omitempty"` // 注册后颁发的 agent 凭证保存路径，默认为 data_dir/credential
+
+	Image string `yaml:"image,omitempty"` // 部署 agent 使用的镜像，由 server 渲染配置时写入，心跳时上报用于确认升级生效
+
+	// 任务目录、镜像和远端分支的回收策略，任务目录按 retain_days 保留
+	GC GCOption `yaml:"gc"`
+}
+
+type GCOption struct {
+	Interval           int   `yaml:"interval"`             // 回收间隔，单位秒
+	MaxDiskUsage       int64 `yaml:"max_disk_usage"`       // data_dir 下任务目录的最大占用，单位 MB，超出时从最早的任务开始回收
+	DisableImagePrune  bool  `yaml:"disable_image_prune"`  // 不清理 rainbow 构建镜像后产生的悬空镜像，docker 驱动拉取的镜像由插件在同步结束后删除
+	DisableBranchPrune bool  `yaml:"disable_branch_prune"` // 不删除远端遗留的任务分支
+}
+
+func (g *GCOption) SetDefaults() {
+	if g.Interval <= 0 {
+		g.Interval = defaultGCInterval
+	}
+	if g.MaxDiskUsage <= 0 {
+		g.MaxDiskUsage = defaultGCMaxDiskUsage
+	}
+}
+
+func (a *AgentOption) IsAPIMode() bool {
+	return a.Mode == AgentModeAPI
+}
+
+type SubscribeOption struct {
+	ResyncInterval    int `yaml:"resync_interval"`     // 订阅控制器巡检间隔，单位秒
+	MaxFailTimes      int `yaml:"max_fail_times"`      // 连续失败超过该次数后暂停订阅，等待探测恢复
+	BackoffBase       int `yaml:"backoff_base"`        // 失败退避基础时间，单位秒，按失败次数指数增长
+	BackoffMax        int `yaml:"backoff_max"`         // 失败退避最大时间，单位秒
+	ProbeInterval     int `yaml:"probe_interval"`      // 暂停订阅的探测间隔，单位秒
+	MessageRetains    int `yaml:"message_retains"`     // 订阅事件至少保留的条数
+	MessageRetainDays int `yaml:"message_retain_days"` // 订阅事件至少保留的天数
+}
+
+func (s *SubscribeOption) SetDefaults() {
+	if s.ResyncInterval <= 0 {
+		s.ResyncInterval = defaultSubscribeResyncInterval
+	}
+	if s.MaxFailTimes <= 0 {
+		s.MaxFailTimes = defaultSubscribeMaxFailTimes
+	}
+	if s.BackoffBase <= 0 {
+		s.BackoffBase = defaultSubscribeBackoffBase
+	}
+	if s.BackoffMax <= 0 {
+		s.BackoffMax = defaultSubscribeBackoffMax
+	}
+	if s.ProbeInterval <= 0 {
+		s.ProbeInterval = defaultSubscribeProbeInterval
+	}
+	if s.MessageRetains <= 0 {
+		s.MessageRetains = defaultSubscribeMessageRetains
+	}
+	if s.MessageRetainDays <= 0 {
+		s.MessageRetainDays = defaultSubscribeMessageRetainDays
+	}
+}
+
+type BudgetOption struct {
+	Monthly   float64 `yaml:"monthly"`    // 每个 agent 每月的默认预算，单位美金，可按 agent 单独设置
+	SoftRatio float64 `yaml:"soft_ratio"` // 开销达到预算的该比例后降低调度优先级，达到预算后自动下线
+}
+
+func (b *BudgetOption) SetDefaults() {
+	if b.Monthly <= 0 {
+		b.Monthly = defaultBudgetMonthly
+	}
+	if b.SoftRatio <= 0 || b.SoftRatio > 1 {
+		b.SoftRatio = defaultBudgetSoftRatio
+	}
+}
+
+type SearchCacheOption struct {
+	Disable     bool           `yaml:"disable"`
+	TTL         int            `yaml:"ttl"`               // 缓存有效期，单位秒
+	StaleTTL    int            `yaml:"stale_ttl"`         // 过期后仍返回旧结果并后台刷新的时长，单位秒
+	NotFoundTTL int            `yaml:"not_found_ttl"`     // 远端镜像不存在的结果缓存时长，单位秒
+	HubTTL      map[string]int `yaml:"hub_ttl,omitempty"` // 按镜像源覆盖缓存有效期，如 dockerhub: 600
+}
+
+func (o *SearchCacheOption) SetDefaults() {
+	if o.TTL <= 0 {
+		o.TTL = defaultSearchCacheTTL
+	}
+	if o.StaleTTL <= 0 {
+		o.StaleTTL = defaultSearchCacheStaleTTL
+	}
+	if o.NotFoundTTL <= 0 {
+		o.NotFoundTTL = defaultSearchCacheNotFoundTTL
+	}
+}
+
+type ScannerOption struct {
+	Type     string `yaml:"type"`     // 扫描器类型，目前支持 trivy
+	Endpoint string `yaml:"endpoint"` // 扫描服务地址，如 trivy server 的 http://127.0.0.1:4954
+	Token    string `yaml:"token,omitempty"`
+	Binary   string `yaml:"binary,omitempty"` // 扫描客户端路径，trivy 默认从 PATH 查找
+
+	Workers        int  `yaml:"workers"`         // 并发扫描数
+	Timeout        int  `yaml:"timeout"`         // 单个 tag 的扫描超时，单位秒
+	ResyncInterval int  `yaml:"resync_interval"` // 检查漏洞库更新和补扫遗漏 tag 的间隔，单位秒
+	BlockCritical  bool `yaml:"block_critical"`  // 禁止 pixiuctl 拉取存在严重漏洞的 tag
+}
+
+func (o *ScannerOption) SetDefaults() {
+	if o.Workers <= 0 {
+		o.Workers = defaultScannerWorkers
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultScannerTimeout
+	}
+	if o.ResyncInterval <= 0 {
+		o.ResyncInterval = defaultScannerResyncInterval
+	}
+}
+
+type CatalogOption struct {
+	// 使用 MySQL 全文索引搜索镜像名称和描述，启动时自动创建 ngram 全文索引
+	FullText bool `yaml:"full_text"`
+}
+
+// HubCacheTTL 获取镜像源的缓存有效期，未单独配置时使用 TTL
+func (o *SearchCacheOption) HubCacheTTL(hub string) int {
+	if ttl, ok := o.HubTTL[hub]; ok && ttl > 0 {
+		return ttl
+	}
+	return o.TTL
+}
+
+type TunnelOption struct {
+	Listen  int    `yaml:"listen"`  // server 端 gRPC 隧道监听端口，为 0 时不启用
+	Address string `yaml:"address"` // agent 端连接的 server 隧道地址，如 127.0.0.1:8091，为空时不启用
+	Token   string `yaml:"token"`   // agent 隧道认证凭证，与 agent 记录中的凭证对应
+
+	// server 端为证书和私钥，agent 端为客户端证书和私钥（可选）
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// agent 端用于校验 server 证书的 CA，为空时使用系统 CA
+	CAFile     string `yaml:"ca_file"`
+	ServerName string `yaml:"server_name"`
+	// 未配置证书时隧道凭证会明文传输，默认拒绝，仅在测试环境下开启
+	AllowInsecure bool `yaml:"allow_insecure"`
+}
+
+// TLSEnabled 隧道是否使用 TLS，agent 端只需配置 CA 或开启 TLS 即可
+func (o TunnelOption) TLSEnabled() bool {
+	return len(o.CertFile) != 0 || len(o.CAFile) != 0 || len(o.ServerName) != 0
+}
+
+const (
+	RemoteTransportRedis    = "redis"
+	RemoteTransportRocketmq = "rocketmq"
+	RemoteTransportGRPC     = "grpc"
+)
+
+type RemoteOption struct {
+	Transport string `yaml:"transport"` // 传输方式，支持 redis, rocketmq, grpc，默认 redis
+	Timeout   int    `yaml:"timeout"`   // 远程调用超时时间，单位秒
 }
 
 type RateLimitOption struct {
@@ -203,6 +466,9 @@ type Image struct {
 	Id   int64    `yaml:"id"`
 	Path string   `yaml:"path"`
 	Tags []string `yaml:"tags"`
+
+	// 版本已锁定，目标仓库已存在时不允许覆盖
+	Immutable bool `yaml:"immutable,omitempty"`
 }
 
 func (i Image) GetMap(repo, ns string) map[string]string {
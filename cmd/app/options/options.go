@@ -74,6 +74,9 @@ func (o *Options) Complete() error {
 		klog.Fatal(err)
 	}
 
+	// 设置配置默认值
+	o.ComponentConfig.SetDefaults()
+
 	if len(o.ComponentConfig.Agent.DataDir) == 0 {
 		o.ComponentConfig.Agent.DataDir = defaultDataDir
 	}
@@ -83,6 +86,12 @@ func (o *Options) Complete() error {
 	if o.ComponentConfig.Default.Listen == 0 {
 		o.ComponentConfig.Default.Listen = defaultListen
 	}
+	if o.ComponentConfig.Agent.IsAPIMode() {
+		// api 模式下 agent 仅通过 server 接口交互，不连接 mysql 和 redis
+		o.Controller = controller.New(o.ComponentConfig, nil, nil, nil, nil)
+		return nil
+	}
+
 	// 注册依赖组件
 	if err := o.register(); err != nil {
 		return err
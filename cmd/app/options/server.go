@@ -76,9 +76,12 @@ func (o *ServerOptions) Complete() error {
 	if err := o.registerRedis(); err != nil {
 		return err
 	}
-	//if err := o.registerProducer(); err != nil {
-	//	return err
-	//}
+	// 远程调用使用 rocketmq 时注册生产者
+	if o.ComponentConfig.Remote.Transport == rainbowconfig.RemoteTransportRocketmq {
+		if err := o.registerProducer(); err != nil {
+			return err
+		}
+	}
 
 	// 注册 chart repo 客户端
 	if err := o.registerChartAPI(); err != nil {
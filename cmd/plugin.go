@@ -12,12 +12,23 @@ import (
 
 var (
 	pluginFile = flag.String("configFile", "./config.yaml", "config file")
+
+	// workflow_dispatch 触发时使用任务凭证从 server 获取配置，写入 configFile
+	taskId   = flag.Int64("taskId", 0, "task id")
+	token    = flag.String("token", "", "task token issued by agent")
+	callback = flag.String("callback", "", "rainbow server address")
 )
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 
+	if len(*token) != 0 {
+		if err := plugin.FetchConfig(*callback, *taskId, *token, *pluginFile); err != nil {
+			klog.Fatal(err)
+		}
+	}
+
 	c := config.New()
 	c.SetConfigFile(*pluginFile)
 	c.SetConfigType("yaml")
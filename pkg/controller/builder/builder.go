@@ -13,6 +13,7 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/types"
 	"github.com/caoyingjunz/rainbow/pkg/util"
 )
 
@@ -91,7 +92,7 @@ func (b *BuildController) BuildAndPushImage() error {
 	b.SyncBuildStatus("开始构建上传镜像")
 	klog.Infof("Starting build image %s", imageName)
 
-	buildAndPushCmd := b.exec.Command("docker", "buildx", "build", "--platform", b.Arch, "-f", b.DockerfilePath, "-t", imageName, "--push", ".")
+	buildAndPushCmd := b.exec.Command("docker", "buildx", "build", "--platform", b.Arch, "-f", b.DockerfilePath, "-t", imageName, "--label", types.RainbowImageLabel+"=true", "--push", ".")
 	if err := b.runCmdAndStream(buildAndPushCmd); err != nil {
 		b.SyncBuildStatus("镜像构建上传失败")
 		return fmt.Errorf("failed to build and push image: %w", err)
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	rainbowtypes "github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	dockerhubTokenTimeout = 30 * time.Second
+	// token 在过期前提前重新申请，避免拉取过程中过期
+	dockerhubTokenRefreshBefore = 30 * time.Second
+
+	redactedValue = "******"
+)
+
+// 命令中紧随其后的参数为凭证，打印日志前需要隐藏
+var credentialFlags = map[string]bool{
+	"-p":                   true,
+	"--password":           true,
+	"--creds":              true,
+	"--src-creds":          true,
+	"--dest-creds":         true,
+	"--registry-token":     true,
+	"--src-registry-token": true,
+}
+
+type cachedToken struct {
+	token      string
+	expireTime time.Time
+}
+
+// dockerhubTokens 按仓库缓存 server 签发的拉取 token，并发同步时共用
+type dockerhubTokens struct {
+	lock   sync.Mutex
+	tokens map[string]cachedToken
+}
+
+// useDockerhubAccount 下发了任务凭证且源镜像来自 dockerhub 时，使用账号池申请的 token 拉取
+func (p *PluginController) useDockerhubAccount(image string) bool {
+	if len(p.Cfg.Plugin.Token) == 0 {
+		return false
+	}
+
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || parts[0] == "docker.io" {
+		return true
+	}
+	// 第一段不是域名时为 dockerhub 的命名空间
+	return !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost"
+}
+
+// dockerhubToken 使用任务凭证向 server 申请仓库的拉取 token，账号密码不下发到 runner，返回空时匿名拉取
+func (p *PluginController) dockerhubToken(image string) (string, error) {
+	_, repo, _ := parseImageReference(image)
+
+	p.dockerhub.lock.Lock()
+	defer p.dockerhub.lock.Unlock()
+	if cached, ok := p.dockerhub.tokens[repo]; ok && time.Now().Add(dockerhubTokenRefreshBefore).Before(cached.expireTime) {
+		return cached.token, nil
+	}
+
+	var resp struct {
+		Code    int                               `json:"code"`
+		Result  rainbowtypes.DockerhubTokenResult `json:"result,omitempty"`
+		Message string                            `json:"message,omitempty"`
+	}
+	body, err := util.BuildHttpBody(rainbowtypes.DockerhubTokenRequest{Repository: repo})
+	if err != nil {
+		return "", err
+	}
+	httpClient := util.HttpClientV2{URL: fmt.Sprintf("%s%s/tasks/%d/dockerhub-token", strings.TrimSuffix(p.Callback, "/"), rainbowtypes.PluginAPIPrefix, p.TaskId)}
+	if err = httpClient.Method(http.MethodPost).
+		WithTimeout(dockerhubTokenTimeout).
+		WithHeader(map[string]string{"Content-Type": "application/json", "Authorization": "Bearer " + p.Cfg.Plugin.Token}).
+		WithBody(body).
+		Do(&resp); err != nil {
+		return "", err
+	}
+	if resp.Code != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Message)
+	}
+
+	if p.dockerhub.tokens == nil {
+		p.dockerhub.tokens = make(map[string]cachedToken)
+	}
+	p.dockerhub.tokens[repo] = cachedToken{
+		token:      resp.Result.Token,
+		expireTime: time.Now().Add(time.Duration(resp.Result.ExpiresIn) * time.Second),
+	}
+	if len(resp.Result.Token) == 0 {
+		klog.Infof("未分配到 dockerhub 账号，匿名拉取 %s", repo)
+	}
+	return resp.Result.Token, nil
+}
+
+// sourceToken 源镜像来自 dockerhub 时申请拉取 token，申请失败时匿名拉取
+func (p *PluginController) sourceToken(image string) string {
+	if !p.useDockerhubAccount(image) {
+		return ""
+	}
+	token, err := p.dockerhubToken(image)
+	if err != nil {
+		klog.Warningf("申请镜像 %s 的拉取 token 失败，使用匿名拉取: %v", image, err)
+		return ""
+	}
+	return token
+}
+
+// redactArgs 隐藏命令中的密码和 token
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && credentialFlags[args[i-1]] {
+			redacted[i] = redactedValue
+			continue
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -56,6 +57,13 @@ type PluginController struct {
 	Registry config.Registry
 	Images   []config.Image
 
+	// dockerhub 拉取 token 的缓存
+	dockerhub dockerhubTokens
+
+	// docker 驱动拉取和打标签产生的镜像，拉取的镜像不带 rainbow 标签，agent 回收时无法识别，结束时由插件删除
+	imageLock    sync.Mutex
+	pulledImages []string
+
 	Runners []Runner
 }
 
@@ -248,10 +256,31 @@ func (p *PluginController) Complete() error {
 
 func (p *PluginController) Close() {
 	if p.docker != nil {
+		p.removePulledImages()
 		_ = p.docker.Close()
 	}
 }
 
+func (p *PluginController) trackPulledImages(images ...string) {
+	p.imageLock.Lock()
+	defer p.imageLock.Unlock()
+
+	p.pulledImages = append(p.pulledImages, images...)
+}
+
+// removePulledImages 删除 docker 驱动同步过程中拉取和打标签的镜像，镜像的最后一个标签删除后镜像层随之回收
+func (p *PluginController) removePulledImages() {
+	p.imageLock.Lock()
+	defer p.imageLock.Unlock()
+
+	for _, image := range p.pulledImages {
+		if _, err := p.docker.ImageRemove(context.TODO(), image, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+			klog.Warningf("删除同步镜像 %s 失败 %v", image, err)
+		}
+	}
+	p.pulledImages = nil
+}
+
 func (p *PluginController) getKubeadmVersion() (string, error) {
 	if _, err := p.exec.LookPath(Kubeadm); err != nil {
 		return "", fmt.Errorf("failed to find %s %v", Kubeadm, err)
@@ -316,6 +345,9 @@ func (p *PluginController) sync(imageToPush string, targetImage string, img conf
 	case SkopeoDriver:
 		klog.Infof("use skopeo to copying image: %s", targetImage)
 		cmd1 := []string{"skopeo", "login", "-u", p.Registry.Username, "-p", p.Registry.Password, p.Registry.Repository, ">", "/dev/null", "2>&1", "&&", "skopeo", "copy", "docker://" + imageToPush, "docker://" + targetImage}
+		if token := p.sourceToken(imageToPush); len(token) != 0 {
+			cmd1 = append(cmd1, "--src-registry-token", token)
+		}
 
 		// p.Cfg.Plugin.Arch 解析平台架构配置，格式为: 操作系统/架构/变体 (如: linux/amd64/8)
 		// 支持两种格式:
@@ -336,10 +368,19 @@ func (p *PluginController) sync(imageToPush string, targetImage string, img conf
 		}
 
 		cmd = []string{"docker", "run", "--network", "host", "pixiuio/skopeo:1.17.0", "sh", "-c", strings.Join(cmd1, " ")}
-		klog.Infof("即将执行命令(%s)进行同步", cmd)
+		klog.Infof("即将执行命令(%s)进行同步", strings.Join(redactArgs(cmd1), " "))
 	case DockerDriver:
 		klog.Infof("Pulling image: %s", imageToPush)
-		reader, err := p.docker.ImagePull(context.TODO(), imageToPush, types.ImagePullOptions{})
+		pullOptions := types.ImagePullOptions{}
+		if token := p.sourceToken(imageToPush); len(token) != 0 {
+			auth, err := json.Marshal(types.AuthConfig{RegistryToken: token})
+			if err != nil {
+				return err
+			}
+			pullOptions.RegistryAuth = base64.URLEncoding.EncodeToString(auth)
+		}
+		p.trackPulledImages(imageToPush, targetImage)
+		reader, err := p.docker.ImagePull(context.TODO(), imageToPush, pullOptions)
 		if err != nil {
 			klog.Errorf("Failed to pull image %s: %v", imageToPush, err)
 			return fmt.Errorf("failed to pull image %s: %v", imageToPush, err)
@@ -372,20 +413,75 @@ func (p *PluginController) doPushImage(img config.Image) error {
 	imageMap := img.GetMap(p.Registry.Repository, p.Registry.Namespace)
 
 	for imageToPush, targetImage := range imageMap {
+		// 锁定的版本已存在于目标仓库时跳过，不修改版本状态
+		if img.Immutable {
+			exists, err := p.targetExists(targetImage)
+			if err != nil {
+				p.SyncImageStatus(targetImage, rainbowtypes.SyncImageError, err.Error(), img)
+				p.CreateTaskMessage(fmt.Sprintf("镜像 %s 已锁定，检查目标仓库失败，原因: %v", targetImage, err))
+				continue
+			}
+			if exists {
+				klog.Infof("镜像 %s 已锁定且目标仓库已存在，跳过覆盖", targetImage)
+				p.CreateTaskMessage(fmt.Sprintf("镜像 %s 已锁定且目标仓库已存在，跳过覆盖", targetImage))
+				continue
+			}
+		}
+
 		p.SyncImageStatus(targetImage, rainbowtypes.SyncImageRunning, "", img)
-		err := p.sync(imageToPush, targetImage, img)
+
+		// 开启签名校验时，校验未通过的镜像不同步
+		sig, err := p.checkSignature(imageToPush)
+		if err != nil {
+			p.syncImageStatus(targetImage, rainbowtypes.SyncImageError, err.Error(), img, sig)
+			p.CreateTaskMessage(fmt.Sprintf("镜像 %s 签名校验失败，原因: %v", imageToPush, err))
+			continue
+		}
+
+		// 校验通过后按校验的 digest 复制，确保推送的镜像就是校验过的镜像
+		source := imageToPush
+		if sig != nil && len(sig.Digest) != 0 {
+			source = pinDigest(imageToPush, sig.Digest)
+		}
+		err = p.sync(source, targetImage, img)
 		if err != nil {
 			p.SyncImageStatus(targetImage, rainbowtypes.SyncImageError, err.Error(), img)
 			p.CreateTaskMessage(fmt.Sprintf("镜像 %s 同步失败，原因: %v", imageToPush, err))
 			continue
 		}
-		p.SyncImageStatus(targetImage, rainbowtypes.SyncImageComplete, "", img)
+
+		if p.Cfg.Plugin.Signature.Copy {
+			count, err := p.copyArtifacts(source, targetImage)
+			if sig == nil {
+				sig = &signatureResult{Status: model.SignatureUnverified}
+			}
+			sig.Artifacts = count
+			if err != nil {
+				// 镜像已同步，制品复制失败不影响镜像状态
+				klog.Errorf("复制镜像(%s)的签名等制品失败 %v", imageToPush, err)
+				sig.Message = fmt.Sprintf("复制签名等制品失败 %v", err)
+				p.CreateTaskMessage(fmt.Sprintf("镜像 %s 的签名等制品复制失败，原因: %v", imageToPush, err))
+			}
+		}
+		p.syncImageStatus(targetImage, rainbowtypes.SyncImageComplete, "", img, sig)
 		p.CreateTaskMessage(fmt.Sprintf("镜像 %s 同步完成", imageToPush))
 	}
 
 	return nil
 }
 
+// targetExists 目标仓库是否已存在该镜像版本
+func (p *PluginController) targetExists(target string) (bool, error) {
+	client, repo, reference := p.targetClient(target)
+	if _, err := client.HeadManifest(repo, reference); err != nil {
+		if err == errManifestNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (p *PluginController) getImagesFromFile() ([]string, error) {
 	var imgs []string
 	return imgs, nil
@@ -447,7 +543,7 @@ func (p *PluginController) Run() error {
 	default:
 	}
 
-	p.SyncTaskStatus("镜像同步完成", "镜像全部同步完成", 2)
+	p.SyncTaskStatus(rainbowtypes.TaskSyncSucceededStatus, "镜像全部同步完成", 2)
 	p.CreateTaskMessage("镜像任务执行完成")
 	return nil
 }
@@ -479,24 +575,35 @@ func (p *PluginController) SyncTaskStatus(status string, msg string, process int
 }
 
 func (p *PluginController) SyncImageStatus(target string, status string, msg string, img config.Image) {
+	p.syncImageStatus(target, status, msg, img, nil)
+}
+
+// syncImageStatus 回调镜像状态，sig 不为空时同时记录签名校验和制品复制的结果
+func (p *PluginController) syncImageStatus(target string, status string, msg string, img config.Image, sig *signatureResult) {
 	if !p.Synced {
 		klog.Infof("未启用镜像回调同步功能")
 		return
 	}
 
+	data := map[string]interface{}{
+		"name":        img.Name,
+		"image_id":    img.Id,
+		"task_id":     p.TaskId,
+		"registry_id": p.RegistryId,
+		"status":      status,
+		"message":     msg,
+		"target":      target,
+	}
+	if sig != nil {
+		data["signature_status"] = sig.Status
+		data["signature_message"] = sig.Message
+		data["artifact_count"] = sig.Artifacts
+	}
 	for i := 0; i < 3; i++ {
 		err := p.httpClient.Put(
 			fmt.Sprintf("%s/rainbow/images/status", p.Callback),
 			nil,
-			map[string]interface{}{
-				"name":        img.Name,
-				"image_id":    img.Id,
-				"task_id":     p.TaskId,
-				"registry_id": p.RegistryId,
-				"status":      status,
-				"message":     msg,
-				"target":      target,
-			})
+			data)
 		if err == nil {
 			klog.Infof("同步镜像(%d) 状态(%s) 信息(%s) mirror(%s) 成功", p.TaskId, status, msg, target, err)
 			return
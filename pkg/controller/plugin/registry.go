@@ -0,0 +1,339 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerhubDomain   = "docker.io"
+	dockerhubRegistry = "registry-1.docker.io"
+
+	mediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	manifestAcceptHeaderValues = mediaTypeOCIIndex + "," + mediaTypeOCIManifest + "," + mediaTypeDockerList + "," + mediaTypeDockerManifest
+)
+
+var errManifestNotFound = fmt.Errorf("manifest not found")
+
+type descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// manifest 兼容镜像 manifest 和 index，用于遍历需要复制的 blob 和子 manifest
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config,omitempty"`
+	Layers    []descriptor `json:"layers,omitempty"`
+	Manifests []descriptor `json:"manifests,omitempty"`
+}
+
+// registryClient 通过 registry v2 接口读写 manifest 和 blob，用于复制 docker/skopeo 无法处理的签名等制品
+type registryClient struct {
+	endpoint string
+	username string
+	password string
+
+	client *http.Client
+
+	lock   sync.Mutex
+	tokens map[string]string // 按仓库缓存 bearer token
+}
+
+func newRegistryClient(host string, username string, password string) *registryClient {
+	if host == dockerhubDomain {
+		host = dockerhubRegistry
+	}
+	return &registryClient{
+		endpoint: "https://" + host,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		tokens:   make(map[string]string),
+	}
+}
+
+// parseImageReference 解析镜像地址为仓库域名、仓库名称和 tag(或 digest)
+func parseImageReference(image string) (string, string, string) {
+	host, remain := dockerhubDomain, image
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, remain = parts[0], parts[1]
+	}
+
+	repo, reference := remain, "latest"
+	if idx := strings.Index(remain, "@"); idx != -1 {
+		repo, reference = remain[:idx], remain[idx+1:]
+	} else if idx := strings.LastIndex(remain, ":"); idx != -1 && !strings.Contains(remain[idx:], "/") {
+		repo, reference = remain[:idx], remain[idx+1:]
+	}
+	if host == dockerhubDomain && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return host, repo, reference
+}
+
+func (c *registryClient) do(method string, u string, repo string, push bool, header map[string]string, body []byte) (*http.Response, error) {
+	resp, err := c.doOnce(method, u, repo, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+	if err = c.authorize(challenge, repo, push); err != nil {
+		return nil, err
+	}
+	return c.doOnce(method, u, repo, header, body)
+}
+
+func (c *registryClient) doOnce(method string, u string, repo string, header map[string]string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	c.lock.Lock()
+	token, ok := c.tokens[repo]
+	c.lock.Unlock()
+	switch {
+	case ok && len(token) != 0:
+		req.Header.Set("Authorization", "Bearer "+token)
+	case ok && len(c.username) != 0:
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.client.Do(req)
+}
+
+// authorize 根据 401 返回的认证方式获取 token，basic 认证时直接使用账号密码
+func (c *registryClient) authorize(challenge string, repo string, push bool) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		c.lock.Lock()
+		c.tokens[repo] = ""
+		c.lock.Unlock()
+		return nil
+	}
+
+	actions := "pull"
+	if push {
+		actions = "pull,push"
+	}
+	query := url.Values{}
+	query.Set("scope", fmt.Sprintf("repository:%s:%s", repo, actions))
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if len(c.username) != 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("获取仓库(%s)的 token 失败，状态码 %d", repo, resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	if len(token.Token) == 0 {
+		token.Token = token.AccessToken
+	}
+	c.lock.Lock()
+	c.tokens[repo] = token.Token
+	c.lock.Unlock()
+	return nil
+}
+
+// parseChallenge 解析 WWW-Authenticate，如 Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+	for _, kv := range strings.Split(parts[1], ",") {
+		pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(pair) == 2 {
+			params[strings.ToLower(pair[0])] = strings.Trim(pair[1], `"`)
+		}
+	}
+	return parts[0], params
+}
+
+// HeadManifest 获取 manifest 的 digest，不存在时返回 errManifestNotFound
+func (c *registryClient) HeadManifest(repo string, reference string) (string, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.endpoint, repo, reference)
+	resp, err := c.do(http.MethodHead, u, repo, false, map[string]string{"Accept": manifestAcceptHeaderValues}, nil)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errManifestNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("获取 manifest(%s:%s)失败，状态码 %d", repo, reference, resp.StatusCode)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); len(digest) != 0 {
+		return digest, nil
+	}
+
+	// 部分仓库 HEAD 不返回 digest，通过内容计算
+	_, _, digest, err := c.GetManifest(repo, reference)
+	return digest, err
+}
+
+// GetManifest 获取 manifest 原始内容、类型和 digest
+func (c *registryClient) GetManifest(repo string, reference string) ([]byte, string, string, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.endpoint, repo, reference)
+	resp, err := c.do(http.MethodGet, u, repo, false, map[string]string{"Accept": manifestAcceptHeaderValues}, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", "", errManifestNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("获取 manifest(%s:%s)失败，状态码 %d", repo, reference, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, resp.Header.Get("Content-Type"), "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (c *registryClient) PutManifest(repo string, reference string, mediaType string, data []byte) error {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.endpoint, repo, reference)
+	resp, err := c.do(http.MethodPut, u, repo, true, map[string]string{"Content-Type": mediaType}, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("推送 manifest(%s:%s)失败，状态码 %d %s", repo, reference, resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+// GetBlob 签名、证明和 SBOM 体积较小，直接读入内存
+func (c *registryClient) GetBlob(repo string, digest string) ([]byte, error) {
+	u := fmt.Sprintf("%s/v2/%s/blobs/%s", c.endpoint, repo, digest)
+	resp, err := c.do(http.MethodGet, u, repo, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取 blob(%s@%s)失败，状态码 %d", repo, digest, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (c *registryClient) BlobExists(repo string, digest string) (bool, error) {
+	u := fmt.Sprintf("%s/v2/%s/blobs/%s", c.endpoint, repo, digest)
+	resp, err := c.do(http.MethodHead, u, repo, true, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// PutBlob 单次上传 blob
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#post-then-put
+func (c *registryClient) PutBlob(repo string, digest string, data []byte) error {
+	u := fmt.Sprintf("%s/v2/%s/blobs/uploads/", c.endpoint, repo)
+	resp, err := c.do(http.MethodPost, u, repo, true, nil, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("创建 blob 上传失败，状态码 %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	base, _ := url.Parse(c.endpoint)
+	uploadURL := base.ResolveReference(location)
+	query := uploadURL.Query()
+	query.Set("digest", digest)
+	uploadURL.RawQuery = query.Encode()
+
+	resp, err = c.do(http.MethodPut, uploadURL.String(), repo, true, map[string]string{"Content-Type": "application/octet-stream"}, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("上传 blob(%s)失败，状态码 %d %s", digest, resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+// Referrers 通过 referrers API 获取关联到 digest 的制品，仓库不支持时返回空
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func (c *registryClient) Referrers(repo string, digest string) ([]descriptor, error) {
+	u := fmt.Sprintf("%s/v2/%s/referrers/%s", c.endpoint, repo, digest)
+	resp, err := c.do(http.MethodGet, u, repo, false, map[string]string{"Accept": mediaTypeOCIIndex}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取 referrers(%s@%s)失败，状态码 %d", repo, digest, resp.StatusCode)
+	}
+
+	var index manifest
+	if err = json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/cmd/app/config"
+	rainbowtypes "github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const fetchConfigTimeout = 30 * time.Second
+
+type configResponse struct {
+	Code    int             `json:"code"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// FetchConfig 使用任务凭证从 server 获取任务配置并写入 file，workflow_dispatch 触发时配置不经过 workflow 输入
+func FetchConfig(callback string, taskId int64, token string, file string) error {
+	callback = strings.TrimSuffix(callback, "/")
+	if len(callback) == 0 || taskId == 0 || len(token) == 0 {
+		return fmt.Errorf("获取任务配置需指定 callback, taskId 和 token")
+	}
+
+	httpClient := util.HttpClientV2{URL: fmt.Sprintf("%s%s/tasks/%d/config", callback, rainbowtypes.PluginAPIPrefix, taskId)}
+	httpClient.Method(http.MethodGet).WithTimeout(fetchConfigTimeout).WithHeader(map[string]string{"Authorization": "Bearer " + token})
+
+	var resp configResponse
+	if err := httpClient.Do(&resp); err != nil {
+		return err
+	}
+	if resp.Code != http.StatusOK {
+		return errors.New(resp.Message)
+	}
+
+	var cfg config.PluginTemplateConfig
+	if err := json.Unmarshal(resp.Result, &cfg); err != nil {
+		return err
+	}
+	// 回调地址使用 runner 访问 server 的地址
+	cfg.Plugin.Callback = callback
+	cfg.Plugin.Token = token
+
+	data, err := yaml.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	klog.Infof("已获取任务(%d)的配置", taskId)
+	return nil
+}
@@ -0,0 +1,284 @@
+package plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// referrers 只复制两层，覆盖签名和对 SBOM 等制品的签名
+	maxReferrerDepth = 2
+)
+
+// cosign 基于 tag 的关联制品，tag 格式为 sha256-<digest>.<suffix>
+var cosignTagSuffixes = []string{"sig", "att", "sbom"}
+
+// signatureResult 镜像签名的校验和复制结果，随镜像状态回调给 server 记录在 tag 上
+type signatureResult struct {
+	Status    string
+	Message   string
+	Artifacts int
+	// Digest 校验的源镜像 digest，同步时按 digest 复制，避免校验后 tag 被覆盖
+	Digest string
+}
+
+// cosignPayload cosign simple signing 的签名内容
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+func cosignTag(digest string, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + "." + suffix
+}
+
+// sourceClient 源镜像所在仓库的客户端，dockerhub 镜像使用账号池申请的拉取 token
+func (p *PluginController) sourceClient(image string) (*registryClient, string, string) {
+	host, repo, reference := parseImageReference(image)
+	client := newRegistryClient(host, "", "")
+	if token := p.sourceToken(image); len(token) != 0 {
+		client.tokens[repo] = token
+	}
+	return client, repo, reference
+}
+
+func (p *PluginController) targetClient(image string) (*registryClient, string, string) {
+	host, repo, reference := parseImageReference(image)
+	return newRegistryClient(host, p.Registry.Username, p.Registry.Password), repo, reference
+}
+
+// verifySignature 使用配置的公钥校验源镜像的 cosign 签名，任一签名被任一公钥校验通过即为通过
+func (p *PluginController) verifySignature(image string) (*signatureResult, error) {
+	keys, err := parsePublicKeys(p.Cfg.Plugin.Signature.PublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	client, repo, reference := p.sourceClient(image)
+	digest, err := client.HeadManifest(repo, reference)
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像 digest 失败 %v", err)
+	}
+
+	data, _, _, err := client.GetManifest(repo, cosignTag(digest, "sig"))
+	if err != nil {
+		if err == errManifestNotFound {
+			return &signatureResult{Status: model.SignatureUnsigned, Message: fmt.Sprintf("镜像(%s)未签名", digest), Digest: digest}, nil
+		}
+		return nil, fmt.Errorf("获取镜像签名失败 %v", err)
+	}
+	var sigManifest manifest
+	if err = json.Unmarshal(data, &sigManifest); err != nil {
+		return nil, err
+	}
+
+	for _, layer := range sigManifest.Layers {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		payload, err := client.GetBlob(repo, layer.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("获取签名内容失败 %v", err)
+		}
+		var signed cosignPayload
+		if err = json.Unmarshal(payload, &signed); err != nil || signed.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range keys {
+			if verifyPayload(key, payload, sig) {
+				return &signatureResult{Status: model.SignatureVerified, Message: fmt.Sprintf("镜像(%s)签名校验通过", digest), Digest: digest}, nil
+			}
+		}
+	}
+	return &signatureResult{Status: model.SignatureInvalid, Message: fmt.Sprintf("镜像(%s)的签名无法被已配置的公钥校验", digest), Digest: digest}, nil
+}
+
+func parsePublicKeys(pems []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, p := range pems {
+		block, _ := pem.Decode([]byte(p))
+		if block == nil {
+			return nil, fmt.Errorf("公钥不是合法的 PEM 格式")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析公钥失败 %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("未配置签名校验公钥")
+	}
+	return keys, nil
+}
+
+// verifyPayload 与 cosign 的默认校验方式一致，ecdsa 和 rsa 校验 sha256 摘要，ed25519 校验原文
+func verifyPayload(key crypto.PublicKey, payload []byte, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
+
+// copyArtifacts 复制源镜像的签名、证明和 SBOM 到目标仓库，返回复制的制品数量
+// 同时查找源镜像和目标镜像的 digest，单架构同步时目标 digest 为对应平台的 manifest
+func (p *PluginController) copyArtifacts(source string, target string) (int, error) {
+	src, srcRepo, srcRef := p.sourceClient(source)
+	dst, dstRepo, dstRef := p.targetClient(target)
+
+	srcDigest, err := src.HeadManifest(srcRepo, srcRef)
+	if err != nil {
+		return 0, fmt.Errorf("获取源镜像 digest 失败 %v", err)
+	}
+	dstDigest, err := dst.HeadManifest(dstRepo, dstRef)
+	if err != nil {
+		return 0, fmt.Errorf("获取目标镜像 digest 失败 %v", err)
+	}
+	digests := []string{srcDigest}
+	if dstDigest != srcDigest {
+		digests = append(digests, dstDigest)
+	}
+
+	var count int
+	for _, digest := range digests {
+		for _, suffix := range cosignTagSuffixes {
+			tag := cosignTag(digest, suffix)
+			if err = copyManifest(src, srcRepo, dst, dstRepo, tag); err != nil {
+				if err == errManifestNotFound {
+					continue
+				}
+				return count, fmt.Errorf("复制 %s 失败 %v", tag, err)
+			}
+			klog.Infof("已复制镜像(%s)的 %s", source, tag)
+			count++
+		}
+
+		n, err := copyReferrers(src, srcRepo, dst, dstRepo, digest, maxReferrerDepth)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func copyReferrers(src *registryClient, srcRepo string, dst *registryClient, dstRepo string, digest string, depth int) (int, error) {
+	if depth == 0 {
+		return 0, nil
+	}
+	referrers, err := src.Referrers(srcRepo, digest)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, ref := range referrers {
+		if err = copyManifest(src, srcRepo, dst, dstRepo, ref.Digest); err != nil {
+			return count, fmt.Errorf("复制制品(%s %s)失败 %v", ref.ArtifactType, ref.Digest, err)
+		}
+		klog.Infof("已复制 %s 的关联制品 %s(%s)", digest, ref.Digest, ref.ArtifactType)
+		count++
+
+		n, err := copyReferrers(src, srcRepo, dst, dstRepo, ref.Digest, depth-1)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// copyManifest 复制 manifest 及其引用的 blob，index 递归复制子 manifest
+func copyManifest(src *registryClient, srcRepo string, dst *registryClient, dstRepo string, reference string) error {
+	data, mediaType, _, err := src.GetManifest(srcRepo, reference)
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if len(m.MediaType) != 0 {
+		mediaType = m.MediaType
+	}
+
+	for _, child := range m.Manifests {
+		if err = copyManifest(src, srcRepo, dst, dstRepo, child.Digest); err != nil {
+			return err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, blob := range blobs {
+		exists, err := dst.BlobExists(dstRepo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		content, err := src.GetBlob(srcRepo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if err = dst.PutBlob(dstRepo, blob.Digest, content); err != nil {
+			return err
+		}
+	}
+
+	return dst.PutManifest(dstRepo, reference, mediaType, data)
+}
+
+// pinDigest 将镜像地址的 tag 替换为 digest，如 nginx:1.27 替换为 nginx@sha256:...
+func pinDigest(image string, digest string) string {
+	if idx := strings.Index(image, "@"); idx != -1 {
+		image = image[:idx]
+	} else if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		image = image[:idx]
+	}
+	return image + "@" + digest
+}
+
+// checkSignature 未开启校验时返回空，校验未通过时返回错误和校验结果
+func (p *PluginController) checkSignature(image string) (*signatureResult, error) {
+	if !p.Cfg.Plugin.Signature.Verify {
+		return nil, nil
+	}
+	sig, err := p.verifySignature(image)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Status != model.SignatureVerified {
+		return sig, fmt.Errorf("%s", sig.Message)
+	}
+	return sig, nil
+}
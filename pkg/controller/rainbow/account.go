@@ -0,0 +1,422 @@
+package rainbow
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	accountRefreshInterval = time.Minute
+	// token 在过期前提前刷新
+	accountTokenRefreshBefore = 10 * time.Minute
+	// 解析不到 token 有效期时使用的默认值
+	accountDefaultTokenTTL = 30 * time.Minute
+	// 响应头中没有限流窗口时，耗尽的账号默认 6 小时后恢复
+	accountDefaultResetWindow = 6 * time.Hour
+
+	dockerhubLoginURL = "https://hub.docker.com/v2/users/login"
+	// 官方用于查询拉取限额的镜像，HEAD 请求不消耗次数
+	dockerhubRateLimitTokenURL = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:ratelimitpreview/test:pull"
+	dockerhubRateLimitURL      = "https://registry-1.docker.io/v2/ratelimitpreview/test/manifests/latest"
+	dockerhubRegistryTokenURL  = "https://auth.docker.io/token"
+	dockerhubRegistryService   = "registry.docker.io"
+)
+
+var errNoAvailableAccount = errors.New("没有可用的账号")
+
+func (s *ServerController) CreateAccount(ctx context.Context, req *types.CreateAccountRequest) error {
+	if len(req.Type) == 0 {
+		req.Type = model.DockerhubAccountType
+	}
+	if req.Type != model.DockerhubAccountType {
+		return fmt.Errorf("不支持的账号类型 %s", req.Type)
+	}
+	olds, err := s.factory.Account().List(ctx, db.WithType(req.Type), db.WithUserName(req.UserName))
+	if err != nil {
+		return err
+	}
+	if len(olds) != 0 {
+		return fmt.Errorf("账号(%s)已存在", req.UserName)
+	}
+
+	password, err := s.encryptSecret(req.Password)
+	if err != nil {
+		return err
+	}
+	account, err := s.factory.Account().Create(ctx, &model.Account{
+		Type:            req.Type,
+		UserName:        req.UserName,
+		Password:        password,
+		RetainTimes:     -1,
+		PullRetainTimes: -1,
+		Status:          model.AccountErrorStatus,
+		Message:         "等待登陆",
+	})
+	if err != nil {
+		return err
+	}
+
+	// 创建后立即登陆，失败时由后台定期重试
+	s.refreshAccount(ctx, account)
+	return nil
+}
+
+func (s *ServerController) UpdateAccount(ctx context.Context, req *types.UpdateAccountRequest) error {
+	account, err := s.factory.Account().Get(ctx, req.Id)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]interface{})
+	if len(req.Password) != 0 {
+		password, err := s.encryptSecret(req.Password)
+		if err != nil {
+			return err
+		}
+		updates["password"] = password
+		account.Password = password
+	}
+	switch {
+	case req.Disable:
+		updates["status"] = model.AccountDisabledStatus
+		updates["message"] = "账号已停用"
+	case account.Status == model.AccountDisabledStatus || len(req.Password) != 0:
+		// 启用或修改密码后重新登陆
+		updates["status"] = model.AccountErrorStatus
+		updates["message"] = "等待登陆"
+		updates["token"] = ""
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if err = s.factory.Account().Update(ctx, req.Id, updates); err != nil {
+		return err
+	}
+
+	if !req.Disable && updates["status"] == model.AccountErrorStatus {
+		s.refreshAccount(ctx, account)
+	}
+	return nil
+}
+
+func (s *ServerController) DeleteAccount(ctx context.Context, accountId int64) error {
+	return s.factory.Account().Delete(ctx, accountId)
+}
+
+func (s *ServerController) GetAccount(ctx context.Context, accountId int64) (interface{}, error) {
+	account, err := s.factory.Account().Get(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	return maskAccount(*account), nil
+}
+
+func (s *ServerController) ListAccounts(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
+	accounts, err := s.factory.Account().List(ctx, db.WithOrderByDesc())
+	if err != nil {
+		return nil, err
+	}
+	for i := range accounts {
+		accounts[i] = maskAccount(accounts[i])
+	}
+	return accounts, nil
+}
+
+// maskAccount 接口不返回账号的密码和 token
+func maskAccount(account model.Account) model.Account {
+	account.Password = ""
+	account.Token = ""
+	return account
+}
+
+// startAccountRefresher 定期登陆即将过期的账号，并恢复已过限流窗口的账号
+func (s *ServerController) startAccountRefresher(ctx context.Context) {
+	klog.Infof("starting account refresher")
+
+	ticker := time.NewTicker(accountRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		accounts, err := s.factory.Account().List(ctx, db.WithType(model.DockerhubAccountType))
+		if err != nil {
+			klog.Errorf("获取账号列表失败 %v", err)
+			continue
+		}
+
+		now := time.Now()
+		for i := range accounts {
+			account := &accounts[i]
+			switch account.Status {
+			case model.AccountDisabledStatus:
+				continue
+			case model.AccountErrorStatus:
+				// 登陆失败的账号降低重试频率，避免频繁登陆被锁定
+				if now.Sub(account.GmtModified) < accountTokenRefreshBefore {
+					continue
+				}
+			case model.AccountExhaustedStatus:
+				if account.ResetTime != nil && now.Before(*account.ResetTime) {
+					continue
+				}
+			case model.AccountHealthyStatus:
+				if now.Add(accountTokenRefreshBefore).Before(account.TokenExpireTime) {
+					continue
+				}
+			}
+			s.refreshAccount(ctx, account)
+		}
+	}
+}
+
+// refreshAccount 重新登陆获取 token 并查询剩余的拉取次数
+func (s *ServerController) refreshAccount(ctx context.Context, account *model.Account) {
+	password, err := s.decryptSecret(account.Password)
+	if err != nil {
+		klog.Errorf("解密账号(%s)的密码失败 %v", account.UserName, err)
+		if err2 := s.factory.Account().Update(ctx, account.Id, map[string]interface{}{
+			"status":  model.AccountErrorStatus,
+			"message": "密码解密失败，请重新设置密码",
+		}); err2 != nil {
+			klog.Errorf("更新账号(%s)状态失败 %v", account.UserName, err2)
+		}
+		return
+	}
+
+	token, expireTime, err := dockerhubLogin(account.UserName, password)
+	if err != nil {
+		klog.Errorf("账号(%s)登陆失败 %v", account.UserName, err)
+		if err2 := s.factory.Account().Update(ctx, account.Id, map[string]interface{}{
+			"status":  model.AccountErrorStatus,
+			"message": fmt.Sprintf("登陆失败: %v", err),
+		}); err2 != nil {
+			klog.Errorf("更新账号(%s)状态失败 %v", account.UserName, err2)
+		}
+		return
+	}
+
+	updates := map[string]interface{}{
+		"token":             token,
+		"token_expire_time": expireTime,
+		"status":            model.AccountHealthyStatus,
+		"message":           "",
+	}
+	// 已过 hub api 的限流窗口时恢复，剩余次数由后续请求的响应头更新
+	if account.Status == model.AccountExhaustedStatus {
+		updates["retain_times"] = -1
+		updates["reset_time"] = nil
+	}
+	usage, err := probeDockerhubRateLimit(account.UserName, password)
+	if err != nil {
+		// 查询限额失败不影响使用，剩余次数在分配时扣减
+		klog.Warningf("查询账号(%s)的拉取限额失败 %v", account.UserName, err)
+	} else {
+		updates["pull_retain_times"] = usage.Remaining
+		updates["pull_rate_limit"] = usage.Limit
+		updates["pull_reset_time"] = nil
+		if usage.Remaining <= 0 {
+			updates["pull_reset_time"] = accountResetTime(usage.Window)
+		}
+	}
+
+	if err = s.factory.Account().Update(ctx, account.Id, updates); err != nil {
+		klog.Errorf("更新账号(%s)的 token 失败 %v", account.UserName, err)
+		return
+	}
+	klog.V(1).Infof("账号(%s)已刷新，状态 %v", account.UserName, updates["status"])
+}
+
+// acquireAccount 分配一个可用账号，direct 模式的 agent 和 server 共用
+func acquireAccount(ctx context.Context, f db.ShareDaoFactory, accountType string) (*model.Account, error) {
+	account, err := f.Account().Acquire(ctx, accountType)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errNoAvailableAccount
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+// reportAccountUsage 根据 hub api 响应头的限流信息更新剩余次数，耗尽时移出分配直到限流窗口结束
+func reportAccountUsage(ctx context.Context, f db.ShareDaoFactory, accountId int64, req *types.ReportAccountUsageRequest) error {
+	updates := map[string]interface{}{"retain_times": req.Remaining}
+	if req.Limit > 0 {
+		updates["rate_limit"] = req.Limit
+	}
+	if req.Remaining <= 0 {
+		updates["status"] = model.AccountExhaustedStatus
+		updates["message"] = "hub api 次数已耗尽"
+		updates["reset_time"] = accountResetTime(req.Window)
+		klog.Warningf("账号(%d)的 hub api 次数已耗尽，暂停分配", accountId)
+	}
+	return f.Account().Update(ctx, accountId, updates)
+}
+
+// issueDockerhubPullToken 使用账号池的账号为 plugin 申请仓库的拉取 token，账号密码不离开 server，没有可用账号时返回空 token 匿名拉取
+func (s *ServerController) issueDockerhubPullToken(ctx context.Context, repository string) (*types.DockerhubTokenResult, error) {
+	account, err := s.factory.Account().AcquireForPull(ctx, model.DockerhubAccountType)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &types.DockerhubTokenResult{}, nil
+		}
+		return nil, err
+	}
+	password, err := s.decryptSecret(account.Password)
+	if err != nil {
+		return nil, fmt.Errorf("解密账号(%s)的密码失败 %v", account.UserName, err)
+	}
+
+	query := url.Values{}
+	query.Set("service", dockerhubRegistryService)
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", repository))
+	var tokenResp struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	httpClient := util.HttpClientV2{URL: dockerhubRegistryTokenURL + "?" + query.Encode()}
+	if err := httpClient.Method(http.MethodGet).
+		WithTimeout(30*time.Second).
+		WithAuth(account.UserName, password).
+		Do(&tokenResp); err != nil {
+		return nil, fmt.Errorf("账号(%s)申请仓库(%s)的拉取 token 失败 %v", account.UserName, repository, err)
+	}
+	klog.V(1).Infof("账号(%s)已申请仓库(%s)的拉取 token", account.UserName, repository)
+	return &types.DockerhubTokenResult{Token: tokenResp.Token, ExpiresIn: tokenResp.ExpiresIn}, nil
+}
+
+func accountResetTime(window int) time.Time {
+	if window <= 0 {
+		return time.Now().Add(accountDefaultResetWindow)
+	}
+	return time.Now().Add(time.Duration(window) * time.Second)
+}
+
+// dockerhubLogin 登陆 dockerhub 获取 hub api 的 token，有效期从 JWT 的 exp 中解析
+func dockerhubLogin(username, password string) (string, time.Time, error) {
+	body, err := util.BuildHttpBody(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	httpClient := util.HttpClientV2{URL: dockerhubLoginURL}
+	if err := httpClient.Method(http.MethodPost).
+		WithTimeout(30 * time.Second).
+		WithHeader(map[string]string{"Content-Type": "application/json"}).
+		WithBody(body).
+		Do(&resp); err != nil {
+		return "", time.Time{}, err
+	}
+	if len(resp.Token) == 0 {
+		return "", time.Time{}, fmt.Errorf("登陆结果中没有 token")
+	}
+
+	return resp.Token, parseTokenExpireTime(resp.Token), nil
+}
+
+func parseTokenExpireTime(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		data, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if err = json.Unmarshal(data, &claims); err == nil && claims.Exp != 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return time.Now().Add(accountDefaultTokenTTL)
+}
+
+// probeDockerhubRateLimit 使用账号凭证查询 registry 的剩余拉取次数
+func probeDockerhubRateLimit(username, password string) (*types.ReportAccountUsageRequest, error) {
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	httpClient := util.HttpClientV2{URL: dockerhubRateLimitTokenURL}
+	if err := httpClient.Method(http.MethodGet).
+		WithTimeout(30*time.Second).
+		WithAuth(username, password).
+		Do(&tokenResp); err != nil {
+		return nil, err
+	}
+
+	var header http.Header
+	probeClient := util.HttpClientV2{URL: dockerhubRateLimitURL}
+	if err := probeClient.Method(http.MethodHead).
+		WithTimeout(30 * time.Second).
+		WithHeader(map[string]string{"Authorization": "Bearer " + tokenResp.Token}).
+		WithResponseHeader(&header).
+		Do(nil); err != nil {
+		return nil, err
+	}
+
+	usage, ok := parseRateLimitHeader(header)
+	if !ok {
+		return nil, fmt.Errorf("响应中没有限流信息")
+	}
+	return usage, nil
+}
+
+// parseRateLimitHeader 解析限流响应头，兼容 registry 的 ratelimit-remaining: 76;w=21600
+// 和 hub api 的 x-ratelimit-remaining、x-ratelimit-reset(unix 时间戳)
+func parseRateLimitHeader(header http.Header) (*types.ReportAccountUsageRequest, bool) {
+	if remaining, window, ok := parseRateLimitValue(header.Get("ratelimit-remaining")); ok {
+		limit, _, _ := parseRateLimitValue(header.Get("ratelimit-limit"))
+		return &types.ReportAccountUsageRequest{Remaining: remaining, Limit: limit, Window: window}, true
+	}
+
+	remaining, _, ok := parseRateLimitValue(header.Get("x-ratelimit-remaining"))
+	if !ok {
+		return nil, false
+	}
+	usage := &types.ReportAccountUsageRequest{Remaining: remaining}
+	usage.Limit, _, _ = parseRateLimitValue(header.Get("x-ratelimit-limit"))
+	if reset, err := strconv.ParseInt(header.Get("x-ratelimit-reset"), 10, 64); err == nil {
+		if window := reset - time.Now().Unix(); window > 0 {
+			usage.Window = int(window)
+		}
+	}
+	return usage, true
+}
+
+// parseRateLimitValue 解析 100;w=21600 格式的值
+func parseRateLimitValue(value string) (int, int, bool) {
+	if len(value) == 0 {
+		return 0, 0, false
+	}
+
+	parts := strings.Split(value, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window int
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "w=") {
+			window, _ = strconv.Atoi(strings.TrimPrefix(part, "w="))
+		}
+	}
+	return count, window, true
+}
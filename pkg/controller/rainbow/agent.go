@@ -4,20 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"math"
 	"math/rand"
-	"net/http"
-	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/apache/rocketmq-client-go/v2"
 	"github.com/apache/rocketmq-client-go/v2/consumer"
 	"github.com/apache/rocketmq-client-go/v2/primitive"
 	"github.com/caoyingjunz/pixiulib/exec"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
@@ -40,10 +40,21 @@ type Interface interface {
 	Subscribe(ctx context.Context, msgs ...*primitive.MessageExt) (consumer.ConsumeResult, error)
 }
 
+// RequestHandler agent 处理远程调用的统一入口，redis、rocketmq 和 gRPC 隧道收到的请求均交由其分发
+type RequestHandler interface {
+	Handle(ctx context.Context, reqMeta *types.CallMetaRequest) types.CallResult
+}
+
+var _ RequestHandler = &AgentController{}
+
+// 任务处理失败后的最大重试次数，超过后标记任务失败
+const maxTaskRetries = 5
+
 type AgentController struct {
 	factory     db.ShareDaoFactory
 	cfg         rainbowconfig.Config
 	redisClient *redis.Client
+	backend     agentBackend
 
 	queue workqueue.RateLimitingInterface
 	exec  exec.Interface
@@ -52,6 +63,20 @@ type AgentController struct {
 	callback string
 	baseDir  string
 	token    string
+
+	// 上报的能力清单和最近任务结果
+	inventory agentInventory
+
+	// holder 本进程持有任务租约的标识
+	holder string
+
+	taskLock sync.Mutex
+	// pending 已入队、处理中或等待重试的任务，避免定时拉取时重复入队
+	pending sets.String
+	// taskErrors 任务每次重试的失败原因，超过重试次数后汇总记录
+	taskErrors map[string][]error
+	// tracking 流水线仍在运行中的任务，回收时跳过
+	tracking sets.String
 }
 
 func NewAgent(f db.ShareDaoFactory, cfg rainbowconfig.Config, redisClient *redis.Client) *AgentController {
@@ -59,11 +84,16 @@ func NewAgent(f db.ShareDaoFactory, cfg rainbowconfig.Config, redisClient *redis
 		factory:     f,
 		cfg:         cfg,
 		redisClient: redisClient,
+		backend:     newAgentBackend(f, cfg),
 		name:        cfg.Agent.Name,
 		baseDir:     cfg.Agent.DataDir,
 		callback:    cfg.Plugin.Callback,
-		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "rainbow-agent"),
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(5*time.Second, 5*time.Minute), "rainbow-agent"),
 		exec:        exec.New(),
+		holder:      cfg.Agent.Name + "-" + uuid.NewString()[:8],
+		pending:     sets.NewString(),
+		tracking:    sets.NewString(),
+		taskErrors:  make(map[string][]error),
 	}
 }
 
@@ -74,7 +104,7 @@ func (s *AgentController) GetAgentToken(ctx context.Context) (string, error) {
 	}
 
 	klog.Infof("缓存中token不存在，尝试从库中获取")
-	agent, err := s.factory.Agent().GetByName(ctx, s.name)
+	agent, err := s.backend.GetAgent(ctx)
 	if err != nil {
 		klog.Errorf("获取 agent(%s)属性失败 %v", s.name, err)
 		return "", err
@@ -105,27 +135,7 @@ func (s *AgentController) process(ctx context.Context, date []byte) error {
 		return err
 	}
 
-	var (
-		result []byte
-		err    error
-	)
-	switch reqMeta.Type {
-	case types.CallGithubType:
-		result, err = s.ProcessGithub(ctx, reqMeta.CallGithubRequest)
-	case types.CallKubernetesTagType:
-		result, err = s.ProcessKubernetesTags(ctx, reqMeta.CallKubernetesTagRequest)
-	case types.CallSearchType:
-		result, err = s.ProcessSearch(ctx, reqMeta.CallSearchRequest)
-	default:
-		return fmt.Errorf("unsupported req call type %d", reqMeta.Type)
-	}
-
-	statusCode, errMessage := 0, ""
-	if err != nil {
-		statusCode, errMessage = 1, err.Error()
-		klog.Errorf("远程调用失败 %v", err)
-	}
-	data, err := json.Marshal(types.SearchResult{Result: result, ErrMessage: errMessage, StatusCode: statusCode})
+	data, err := json.Marshal(s.Handle(ctx, &reqMeta))
 	if err != nil {
 		klog.Errorf("序列化调用结果失败 %v", err)
 		return fmt.Errorf("序列化调用结果失败 %v", err)
@@ -145,17 +155,64 @@ func (s *AgentController) process(ctx context.Context, date []byte) error {
 	return nil
 }
 
+// Handle 按调用类型分发远程调用，不同的传输方式共用
+func (s *AgentController) Handle(ctx context.Context, reqMeta *types.CallMetaRequest) types.CallResult {
+	var (
+		result []byte
+		err    error
+	)
+	switch reqMeta.Type {
+	case types.CallGithubType:
+		result, err = s.ProcessGithub(ctx, reqMeta.CallGithubRequest)
+	case types.CallKubernetesTagType:
+		result, err = s.ProcessKubernetesTags(ctx, reqMeta.CallKubernetesTagRequest)
+	case types.CallSearchType:
+		result, err = s.ProcessSearch(ctx, reqMeta.CallSearchRequest)
+	default:
+		err = fmt.Errorf("unsupported req call type %d", reqMeta.Type)
+	}
+	if err != nil {
+		klog.Errorf("远程调用失败 %v", err)
+		return types.CallResult{ErrMessage: err.Error(), StatusCode: 1}
+	}
+
+	return types.CallResult{Result: result}
+}
+
 func (s *AgentController) Run(ctx context.Context, workers int) error {
+	// api 模式下不连接 redis 和 rocketmq，只能通过隧道接收远程调用
+	if s.cfg.Agent.IsAPIMode() && s.cfg.Remote.Transport != rainbowconfig.RemoteTransportGRPC {
+		return fmt.Errorf("api 模式下远程调用需使用 grpc")
+	}
+
 	// 注册 rainbow 代理
 	if err := s.RegisterAgentIfNotExist(ctx); err != nil {
 		return err
 	}
+	// 注册后立即上报能力清单，便于 server 调度
+	if err := s.backend.Heartbeat(ctx, s.getInventory(ctx)); err != nil {
+		klog.Errorf("上报 agent(%s) 能力清单失败 %v", s.name, err)
+	}
 
 	go s.startHeartbeat(ctx)
 	go s.getNextWorkItems(ctx)
 	go s.startSyncActionUsage(ctx)
 	go s.startGC(ctx)
-	go s.startSubscribe(ctx)
+
+	// 按配置的传输方式接收 server 的远程调用
+	switch s.cfg.Remote.Transport {
+	case rainbowconfig.RemoteTransportRocketmq:
+		if err := s.startConsumer(ctx); err != nil {
+			return err
+		}
+	case rainbowconfig.RemoteTransportGRPC:
+		if len(s.cfg.Tunnel.Address) == 0 {
+			return fmt.Errorf("远程调用使用 grpc 时需配置 tunnel.address")
+		}
+		go s.startTunnel(ctx)
+	default:
+		go s.startSubscribe(ctx)
+	}
 
 	for i := 0; i < workers; i++ {
 		go wait.UntilWithContext(ctx, s.worker, 1*time.Second)
@@ -204,50 +261,35 @@ func (s *AgentController) startSubscribe(ctx context.Context) {
 	}
 }
 
-func (s *AgentController) startGC(ctx context.Context) {
-	// 1小时尝试回收一次
-	ticker := time.NewTicker(900 * time.Second)
-	defer ticker.Stop()
+// startConsumer 订阅 rocketmq 中下发给自身或者未指定 agent 的请求
+func (s *AgentController) startConsumer(ctx context.Context) error {
+	klog.Infof("Starting rocketmq consumer")
 
-	for range ticker.C {
-		if err := s.GarbageCollect(ctx); err != nil {
-			klog.Errorf("GarbageCollect 失败: %v", err)
-			continue
-		}
-		klog.Infof("GarbageCollect 完成")
-	}
-}
-
-func (s *AgentController) GarbageCollect(ctx context.Context) error {
-	entries, err := os.ReadDir(s.baseDir)
+	rocketmqCfg := s.cfg.Rocketmq
+	c, err := rocketmq.NewPushConsumer(
+		consumer.WithNameServer(rocketmqCfg.NameServers), // NameServer地址
+		consumer.WithCredentials(primitive.Credentials{AccessKey: rocketmqCfg.Credential.AccessKey, SecretKey: rocketmqCfg.Credential.SecretKey}),
+		consumer.WithGroupName(rocketmqCfg.GroupName),
+		consumer.WithConsumeFromWhere(consumer.ConsumeFromLastOffset),
+	)
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
+		return fmt.Errorf("new rocketmq consumer error: %v", err)
 	}
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		if entry.Name() == "plugin" {
-			continue
-		}
 
-		fileInfo, err := entry.Info()
-		if err != nil {
-			klog.Errorf("获取文件夹(%s)信息失败 %v, 忽略", entry.Name(), err)
-			continue
-		}
-
-		// 回收指定时间的文件
-		now := time.Now()
-		if now.Sub(fileInfo.ModTime()) > 30*time.Minute {
-			removeDir := filepath.Join(s.baseDir, fileInfo.Name())
-			util.RemoveFile(removeDir)
-			klog.Infof("任务文件 %s 已被回收", removeDir)
-		} else {
-			klog.Infof("任务文件 %s 还在有效期内，暂不回收", fileInfo.Name())
-		}
+	if err = c.Subscribe(rocketmqCfg.Topic, consumer.MessageSelector{
+		Type:       consumer.TAG,
+		Expression: fmt.Sprintf("%s || all", s.name), // 只订阅指定自身或者未指定的agent
+	}, s.Subscribe); err != nil {
+		return fmt.Errorf("订阅主题失败: %v", err)
+	}
+	if err = c.Start(); err != nil {
+		return fmt.Errorf("启动消费者失败: %v", err)
 	}
 
+	go func() {
+		<-ctx.Done()
+		_ = c.Shutdown()
+	}()
 	return nil
 }
 
@@ -259,13 +301,13 @@ func (s *AgentController) startSyncActionUsage(ctx context.Context) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		agent, err := s.factory.Agent().GetByName(ctx, s.name)
+		agent, err := s.backend.GetAgent(ctx)
 		if err != nil {
 			klog.Errorf("获取 agent 失败 %v 等待下次同步", err)
 			continue
 		}
 		if len(agent.GithubUser) == 0 || len(agent.GithubRepository) == 0 || len(agent.GithubToken) == 0 {
-			klog.Infof("agent(%s) 的 github 属性存在空值，忽略", agent.Name)
+			klog.Infof("agent(%s) 的 CI 账号属性存在空值，忽略", agent.Name)
 			continue
 		}
 		if agent.Status != model.RunAgentType {
@@ -283,53 +325,24 @@ func (s *AgentController) startSyncActionUsage(ctx context.Context) {
 	}
 }
 
+// syncActionUsage 按 agent 的 CI 后端同步当月开销
 func (s *AgentController) syncActionUsage(ctx context.Context, agent model.Agent) error {
-	month := time.Now().Format("1")
-
-	url := fmt.Sprintf("https://api.github.com/users/%s/settings/billing/usage?month=%s", agent.GithubUser, month)
-	klog.Infof("当前 %s 月, 将通过请求 %s 获取本月账单", month, url)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	request, err := http.NewRequest("", url, nil)
+	executor, err := newCIExecutor(&agent)
 	if err != nil {
 		return err
 	}
-	request.Header.Set("Accept", "application/vnd.github+json")
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", agent.GithubToken))
-	request.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-
-	resp, err := client.Do(request)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error resp %s", resp.Status)
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
+	rounded, err := executor.MonthlyUsage(ctx)
 	if err != nil {
 		return err
 	}
-	var ud UsageData
-	if err = json.Unmarshal(data, &ud); err != nil {
-		return err
-	}
-
-	var grossAmount float64 = 0
-	for _, item := range ud.UsageItems {
-		grossAmount += item.GrossAmount
-	}
 
-	rounded := math.Round(grossAmount*1000) / 1000
-	klog.Infof("Agent(%s)当月截止目前已经使用 %d 美金", agent.Name, rounded)
-	if agent.GrossAmount == rounded {
+	klog.Infof("Agent(%s)当月截止目前已经使用 %.3f 美金", agent.Name, rounded)
+	if agent.GrossAmount == rounded && agent.UsageMonth == time.Now().Format(usageMonthLayout) {
 		klog.Infof("agent(%s) 的 grossAmount 未发生变化，等待下一次同步", agent.Name)
 		return nil
 	}
 
-	return s.factory.Agent().UpdateByName(ctx, agent.Name, map[string]interface{}{"gross_amount": rounded})
+	return s.backend.UpdateGrossAmount(ctx, rounded)
 }
 
 type UsageData struct {
@@ -356,24 +369,10 @@ func (s *AgentController) startHeartbeat(ctx context.Context) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		old, err := s.factory.Agent().GetByName(ctx, s.name)
-		if err != nil {
-			klog.Error("failed to get agent status %v", err)
-			continue
-		}
-
-		updates := map[string]interface{}{"last_transition_time": time.Now()}
-		if old.Status != model.UnRunAgentType {
-			if old.Status == model.UnknownAgentType {
-				updates["status"] = model.RunAgentType
-				updates["message"] = "Agent started posting status"
-			}
-		}
-
-		if err = s.factory.Agent().UpdateByName(ctx, s.name, updates); err != nil {
-			klog.Error("同步 agent(%s) 心跳失败%v", s.name, err)
+		if err := s.backend.Heartbeat(ctx, s.getInventory(ctx)); err != nil {
+			klog.Errorf("同步 agent(%s) 心跳失败 %v", s.name, err)
 		} else {
-			klog.V(2).Infof("同步 agent(%s) 心跳成功 %v", s.name, updates)
+			klog.V(2).Infof("同步 agent(%s) 心跳成功", s.name)
 		}
 	}
 }
@@ -383,18 +382,20 @@ func (s *AgentController) getNextWorkItems(ctx context.Context) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		// 获取未处理
-		tasks, err := s.factory.Task().ListWithAgent(ctx, s.name, 0)
+		// 获取未处理或租约已过期的任务
+		tasks, err := s.backend.ListTasks(ctx)
 		if err != nil {
-			klog.Error("failed to list tasks %v", err)
-			continue
-		}
-		if len(tasks) == 0 {
+			klog.Errorf("failed to list tasks %v", err)
 			continue
 		}
 
 		for _, task := range tasks {
-			s.queue.Add(fmt.Sprintf("%d/%d", task.Id, task.ResourceVersion))
+			key := fmt.Sprintf("%d", task.Id)
+			// 处理中或等待重试的任务由工作队列负责，不重复入队
+			if !s.markPending(key) {
+				continue
+			}
+			s.queue.Add(key)
 		}
 	}
 }
@@ -412,143 +413,71 @@ func (s *AgentController) processNextWorkItem(ctx context.Context) bool {
 	defer s.queue.Done(key)
 
 	klog.Infof("任务(%v)被调度到本节点，即将开始处理", key)
-	taskId, resourceVersion, err := KeyFunc(key)
+	taskId, err := KeyFunc(key)
 	if err != nil {
-		s.handleErr(ctx, err, key)
-	} else {
-		_ = s.factory.Task().UpdateDirectly(ctx, taskId, map[string]interface{}{"status": "镜像初始化", "message": "初始化环境中", "process": 1})
-		if err = s.factory.Task().CreateTaskMessage(ctx, &model.TaskMessage{TaskId: taskId, Message: "节点调度完成"}); err != nil {
-			klog.Errorf("记录节点调度失败 %v", err)
-		}
-		if err = s.sync(ctx, taskId, resourceVersion); err != nil {
-			if msgErr := s.factory.Task().CreateTaskMessage(ctx, &model.TaskMessage{TaskId: taskId, Message: fmt.Sprintf("同步失败，原因: %v", err)}); msgErr != nil {
-				klog.Errorf("记录同步失败 %v", msgErr)
-			}
-			s.handleErr(ctx, err, key)
-		}
+		klog.Errorf("无效的任务 key(%v) %v", key, err)
+		s.forget(key)
+		return true
 	}
-	return true
-}
 
-func (s *AgentController) GetOneAdminRegistry(ctx context.Context) (*model.Registry, error) {
-	regs, err := s.factory.Registry().GetAdminRegistries(ctx)
-	if err != nil {
-		klog.Errorf("获取默认镜像仓库失败: %v", err)
-		return nil, err
-	}
-	if len(regs) == 0 {
-		klog.Errorf("no admin or default registry found")
-		return nil, fmt.Errorf("no admin or default registry found")
-	}
-
-	// 随机分，暂时不考虑负载情况，后续优化
-	rand.Seed(time.Now().UnixNano())
-	x := rand.Intn(len(regs))
-	t := regs[x]
-	return &t, err
+	s.handleErr(ctx, s.sync(ctx, taskId), key, taskId)
+	return true
 }
 
-func (s *AgentController) makePluginConfig(ctx context.Context, task model.Task) (*rainbowconfig.PluginTemplateConfig, error) {
-	taskId := task.Id
-
-	var (
-		registry *model.Registry
-		err      error
-	)
-	// 未指定自定义参考时，使用默认仓库
-	if task.RegisterId == 0 {
-		registry, err = s.GetOneAdminRegistry(ctx)
-	} else {
-		registry, err = s.factory.Registry().Get(ctx, task.RegisterId)
-	}
+func (s *AgentController) sync(ctx context.Context, taskId int64) (err error) {
+	// 获取任务租约，避免多个 worker 或 agent 重复处理
+	task, err := s.backend.ClaimTask(ctx, taskId, s.holder)
 	if err != nil {
-		klog.Error("failed to get registry %v", err)
-		return nil, fmt.Errorf("failed to get registry %v", err)
-	}
-
-	pluginTemplateConfig := &rainbowconfig.PluginTemplateConfig{
-		Default: rainbowconfig.DefaultOption{
-			Time: time.Now().Unix(), // 注入时间戳，确保每次内容都不相同
-		},
-		Plugin: rainbowconfig.PluginOption{
-			Callback:   s.callback,
-			TaskId:     taskId,
-			RegistryId: registry.Id,
-			Synced:     true,
-			Driver:     task.Driver,
-			Arch:       task.Architecture,
-		},
-		Registry: rainbowconfig.Registry{
-			Repository: registry.Repository,
-			Namespace:  registry.Namespace,
-			Username:   registry.Username,
-			Password:   registry.Password,
-		},
-	}
-
-	// 根据type判断是镜像列表推送还是k8s镜像组推送
-	switch task.Type {
-	case 0:
-		tags, err := s.factory.Image().ListTags(ctx, db.WithTaskLike(taskId), db.WithErrorTask(task.OnlyPushError))
-		if err != nil {
-			klog.Errorf("获取任务所属 tags 失败 %v", err)
-			return nil, err
-		}
-
-		var imageIds []int64
-		for _, tag := range tags {
-			imageIds = append(imageIds, tag.ImageId)
+		if errors.IsNotUpdated(err) {
+			klog.Infof("任务(%d)已由其他节点处理，忽略", taskId)
+			return nil
 		}
-		images, err := s.factory.Image().List(ctx, db.WithIDIn(imageIds...))
+		return fmt.Errorf("failted to claim task %d %v", taskId, err)
+	}
+	defer func() {
+		s.inventory.recordOutcome(taskId, err)
 		if err != nil {
-			klog.Errorf("获取任务所属镜像失败 %v", err)
-			return nil, err
-		}
-
-		iNameMap := make(map[int64]string)
-		for _, image := range images {
-			iNameMap[image.Id] = image.Name
-		}
-		var img []rainbowconfig.Image
-		for _, tag := range tags {
-			name, ok := iNameMap[tag.ImageId]
-			if !ok {
-				klog.Warningf("未能找到镜像(%s)的名称，忽略", tag.ImageId)
-				continue
+			if msgErr := s.backend.CreateTaskMessage(ctx, taskId, fmt.Sprintf("同步失败，原因: %v", err)); msgErr != nil {
+				klog.Errorf("记录同步失败 %v", msgErr)
 			}
-			img = append(img, rainbowconfig.Image{
-				Name: name,
-				Id:   tag.ImageId,
-				Path: tag.Path,
-				Tags: []string{tag.Name},
-			})
+			return
 		}
+		// 任务已交由 plugin 执行，释放租约
+		if releaseErr := s.backend.ReleaseTask(ctx, taskId, s.holder); releaseErr != nil {
+			klog.Errorf("释放任务(%d)租约失败 %v", taskId, releaseErr)
+		}
+	}()
 
-		pluginTemplateConfig.Default.PushImages = true
-		pluginTemplateConfig.Images = img
-	case 1:
-		pluginTemplateConfig.Default.PushKubernetes = true
-		pluginTemplateConfig.Kubernetes.Version = task.KubernetesVersion
+	_ = s.backend.UpdateTaskStatus(ctx, taskId, "镜像初始化", "初始化环境中", 1)
+	if err = s.backend.CreateTaskMessage(ctx, taskId, "节点调度完成"); err != nil {
+		klog.Errorf("记录节点调度失败 %v", err)
 	}
+	klog.Infof("开始处理任务(%s),任务ID(%d)", task.Name, taskId)
 
-	return pluginTemplateConfig, err
-}
-
-func (s *AgentController) sync(ctx context.Context, taskId int64, resourceVersion int64) error {
-	task, err := s.factory.Task().GetOne(ctx, taskId, resourceVersion)
+	executor, err := s.ciExecutor(ctx)
 	if err != nil {
-		if errors.IsNotUpdated(err) {
-			return nil
-		}
-		return fmt.Errorf("failted to get one task %d %v", taskId, err)
+		return err
 	}
-	klog.Infof("开始处理任务(%s),任务ID(%d)", task.Name, taskId)
+	run := newCIRun(s.baseDir, taskId)
 
-	tplCfg, err := s.makePluginConfig(ctx, *task)
-	cfg, err := yaml.Marshal(tplCfg)
-	if err != nil {
+	// 任务凭证用于 runner 获取配置和申请 dockerhub 的拉取 token，流水线结束后吊销
+	if run.Token, err = s.backend.IssuePluginToken(ctx, taskId); err != nil {
 		return err
 	}
+	// runner 自行获取配置时只下发任务凭证，避免仓库凭证出现在 CI 后端的输入参数中
+	var cfg []byte
+	if executor.RemoteConfig() {
+		run.Callback = s.callback
+	} else {
+		tplCfg, err := s.backend.GetPluginConfig(ctx, *task)
+		if err != nil {
+			return err
+		}
+		tplCfg.Plugin.Token = run.Token
+		if cfg, err = yaml.Marshal(tplCfg); err != nil {
+			return err
+		}
+	}
 
 	taskIdStr := fmt.Sprintf("%d", taskId)
 
@@ -562,59 +491,114 @@ func (s *AgentController) sync(ctx context.Context, taskId int64, resourceVersio
 		}
 	}
 
-	git := util.NewGit(destDir+"/plugin", taskIdStr, taskIdStr+"-"+time.Now().String())
-	if err = git.Checkout(); err != nil {
-		return err
-	}
-	if err = util.WriteIntoFile(string(cfg), destDir+"/plugin/config.yaml"); err != nil {
-		return err
-	}
-	if err = git.Push(); err != nil {
+	run.TriggerTime = time.Now()
+	if err = executor.TriggerRun(ctx, run, cfg); err != nil {
 		return err
 	}
+
+	// 跟踪流水线运行状态，不阻塞任务处理
+	s.setTracking(taskId, true)
+	go s.trackCIRun(context.Background(), executor, run)
 	return nil
 }
 
-// TODO
-func (s *AgentController) handleErr(ctx context.Context, err error, key interface{}) {
+// ciExecutor 按 agent 当前配置获取 CI 后端
+func (s *AgentController) ciExecutor(ctx context.Context) (CIExecutor, error) {
+	agent, err := s.backend.GetAgent(ctx)
+	if err != nil {
+		klog.Errorf("获取 agent(%s)属性失败 %v", s.name, err)
+		return nil, err
+	}
+	return newCIExecutor(agent)
+}
+
+// handleErr 处理成功时清理重试记录，失败时限速重试，超过最大重试次数后标记任务失败
+func (s *AgentController) handleErr(ctx context.Context, err error, key interface{}, taskId int64) {
 	if err == nil {
+		s.forget(key)
 		return
 	}
-	klog.Error(err)
+
+	errs := s.recordTaskError(key, err)
+	if s.queue.NumRequeues(key) < maxTaskRetries {
+		klog.Warningf("任务(%d)处理失败，等待重试(%d/%d) %v", taskId, s.queue.NumRequeues(key)+1, maxTaskRetries, err)
+		s.queue.AddRateLimited(key)
+		return
+	}
+
+	aggErr := utilerrors.NewAggregate(errs)
+	klog.Errorf("任务(%d)重试 %d 次后仍失败 %v", taskId, maxTaskRetries, aggErr)
+	s.forget(key)
+
+	if err = s.backend.UpdateTaskStatus(ctx, taskId, TaskFailedStatus, aggErr.Error(), 3); err != nil {
+		klog.Errorf("标记任务(%d)失败状态失败 %v", taskId, err)
+	}
+	if err = s.backend.CreateTaskMessage(ctx, taskId, fmt.Sprintf("重试 %d 次后仍失败，任务已终止", maxTaskRetries)); err != nil {
+		klog.Errorf("记录任务(%d)终止失败 %v", taskId, err)
+	}
+	if err = s.backend.ReleaseTask(ctx, taskId, s.holder); err != nil {
+		klog.Errorf("释放任务(%d)租约失败 %v", taskId, err)
+	}
+}
+
+// markPending 标记任务已入队，已在处理中时返回 false
+func (s *AgentController) markPending(key string) bool {
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+
+	if s.pending.Has(key) {
+		return false
+	}
+	s.pending.Insert(key)
+	return true
+}
+
+func (s *AgentController) recordTaskError(key interface{}, err error) []error {
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+
+	k := fmt.Sprintf("%v", key)
+	s.taskErrors[k] = append(s.taskErrors[k], err)
+	return s.taskErrors[k]
+}
+
+// forget 任务处理结束，清理限速和重试记录
+func (s *AgentController) forget(key interface{}) {
+	s.queue.Forget(key)
+
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+
+	k := fmt.Sprintf("%v", key)
+	s.pending.Delete(k)
+	delete(s.taskErrors, k)
 }
 
 func (s *AgentController) RegisterAgentIfNotExist(ctx context.Context) error {
 	if len(s.name) == 0 {
 		return fmt.Errorf("agent name missing")
 	}
+	return s.backend.Register(ctx)
+}
 
-	var err error
-	_, err = s.factory.Agent().GetByName(ctx, s.name)
-	if err == nil {
-		return nil
+// tunnelToken api 模式下使用颁发的 agent 凭证建立隧道
+func (s *AgentController) tunnelToken() string {
+	if b, ok := s.backend.(*apiBackend); ok {
+		return b.getCredential()
 	}
-	_, err = s.factory.Agent().Create(ctx, &model.Agent{Name: s.name, Status: model.RunAgentType, Type: model.PublicAgentType, Message: "Agent started posting status"})
-	return err
+	return s.cfg.Tunnel.Token
 }
 
-func KeyFunc(key interface{}) (int64, int64, error) {
+// KeyFunc 从工作队列 key 中解析任务 ID
+func KeyFunc(key interface{}) (int64, error) {
 	str, ok := key.(string)
 	if !ok {
-		return 0, 0, fmt.Errorf("failed to convert %v to string", key)
-	}
-	parts := strings.Split(str, "/")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("parts length not 2")
+		return 0, fmt.Errorf("failed to convert %v to string", key)
 	}
 
-	taskId, err := strutil.ParseInt64(parts[0])
+	taskId, err := strutil.ParseInt64(str)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to Parse taskId to Int64 %v", err)
+		return 0, fmt.Errorf("failed to Parse taskId to Int64 %v", err)
 	}
-	resourceVersion, err := strutil.ParseInt64(parts[1])
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to Parse resourceVersion to Int64 %v", err)
-	}
-
-	return taskId, resourceVersion, nil
+	return taskId, nil
 }
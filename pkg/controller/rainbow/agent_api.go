@@ -0,0 +1,211 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	agentBootstrapTokenPrefix = "rbt-"
+	agentCredentialPrefix     = "rac-"
+
+	// 引导凭证有效期
+	agentBootstrapTokenTTL = 24 * time.Hour
+)
+
+// CreateAgentBootstrapToken 为 agent 生成新的引导凭证，同时吊销已颁发的 agent 凭证，用于凭证轮换
+func (s *ServerController) CreateAgentBootstrapToken(ctx context.Context, agentName string) (interface{}, error) {
+	agent, err := s.factory.Agent().GetByName(ctx, agentName)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueAgentBootstrapToken(ctx, agent.Name)
+}
+
+func (s *ServerController) issueAgentBootstrapToken(ctx context.Context, agentName string) (*types.AgentBootstrapToken, error) {
+	token, err := util.GenerateToken(agentBootstrapTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	expireTime := time.Now().Add(agentBootstrapTokenTTL)
+	if err = s.factory.Agent().UpdateByName(ctx, agentName, map[string]interface{}{
+		"bootstrap_token":       util.HashToken(token),
+		"bootstrap_expire_time": expireTime,
+		"credential":            "",
+		"credential_issue_time": nil,
+	}); err != nil {
+		klog.Errorf("生成 agent(%s) 引导凭证失败 %v", agentName, err)
+		return nil, err
+	}
+	klog.Infof("agent(%s) 已生成新的引导凭证，原凭证已吊销", agentName)
+
+	return &types.AgentBootstrapToken{AgentName: agentName, BootstrapToken: token, ExpireTime: expireTime}, nil
+}
+
+// RevokeAgentCredential 吊销 agent 的引导凭证和 agent 凭证，agent 需重新生成引导凭证后才能注册
+func (s *ServerController) RevokeAgentCredential(ctx context.Context, agentName string) error {
+	agent, err := s.factory.Agent().GetByName(ctx, agentName)
+	if err != nil {
+		return err
+	}
+	if err = s.factory.Agent().UpdateByName(ctx, agent.Name, map[string]interface{}{
+		"bootstrap_token":       "",
+		"bootstrap_expire_time": nil,
+		"credential":            "",
+		"credential_issue_time": nil,
+	}); err != nil {
+		return err
+	}
+
+	klog.Infof("agent(%s) 的凭证已吊销", agent.Name)
+	return nil
+}
+
+// RegisterAgent agent 使用引导凭证注册，成功后颁发 agent 凭证，引导凭证随即失效
+func (s *ServerController) RegisterAgent(ctx context.Context, req *types.RegisterAgentRequest) (interface{}, error) {
+	agent, err := s.factory.Agent().GetByName(ctx, req.AgentName)
+	if err != nil {
+		return nil, fmt.Errorf("agent(%s) 不存在", req.AgentName)
+	}
+	if len(agent.BootstrapToken) == 0 || subtle.ConstantTimeCompare([]byte(agent.BootstrapToken), []byte(util.HashToken(req.BootstrapToken))) != 1 {
+		return nil, fmt.Errorf("agent(%s) 引导凭证校验失败", req.AgentName)
+	}
+	if agent.BootstrapExpireTime == nil || time.Now().After(*agent.BootstrapExpireTime) {
+		return nil, fmt.Errorf("agent(%s) 引导凭证已过期", req.AgentName)
+	}
+
+	credential, err := util.GenerateToken(agentCredentialPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err = s.factory.Agent().UpdateByName(ctx, agent.Name, map[string]interface{}{
+		"bootstrap_token":       "",
+		"bootstrap_expire_time": nil,
+		"credential":            util.HashToken(credential),
+		"credential_issue_time": now,
+		"last_transition_time":  now,
+	}); err != nil {
+		return nil, err
+	}
+	klog.Infof("agent(%s) 注册成功，已颁发 agent 凭证", agent.Name)
+
+	return &types.AgentCredential{AgentName: agent.Name, Credential: credential}, nil
+}
+
+// AuthenticateAgent 校验 agent 凭证
+func (s *ServerController) AuthenticateAgent(ctx context.Context, agentName string, credential string) error {
+	if len(agentName) == 0 || len(credential) == 0 {
+		return fmt.Errorf("agent 名称或凭证为空")
+	}
+	agent, err := s.factory.Agent().GetByName(ctx, agentName)
+	if err != nil {
+		return fmt.Errorf("agent(%s) 不存在", agentName)
+	}
+	if len(agent.Credential) == 0 || subtle.ConstantTimeCompare([]byte(agent.Credential), []byte(util.HashToken(credential))) != 1 {
+		return fmt.Errorf("agent(%s) 凭证校验失败", agentName)
+	}
+
+	return nil
+}
+
+func (s *ServerController) AgentHeartbeat(ctx context.Context, agentName string, req *types.AgentHeartbeatRequest) error {
+	return heartbeatAgent(ctx, s.factory, agentName, req.Inventory)
+}
+
+func (s *ServerController) GetAgentSelf(ctx context.Context, agentName string) (interface{}, error) {
+	return s.factory.Agent().GetByName(ctx, agentName)
+}
+
+func (s *ServerController) UpdateAgentUsage(ctx context.Context, agentName string, req *types.UpdateAgentUsageRequest) error {
+	return updateAgentUsage(ctx, s.factory, agentName, req.GrossAmount)
+}
+
+// ListAgentTasks 获取已分配给 agent 且可获取租约的任务
+func (s *ServerController) ListAgentTasks(ctx context.Context, agentName string) (interface{}, error) {
+	return s.factory.Task().ListLeasable(ctx, agentName)
+}
+
+// getAgentTask 获取任务，并校验任务属于该 agent
+func (s *ServerController) getAgentTask(ctx context.Context, agentName string, taskId int64) (*model.Task, error) {
+	task, err := s.factory.Task().Get(ctx, taskId)
+	if err != nil {
+		return nil, err
+	}
+	if task.AgentName != agentName {
+		return nil, fmt.Errorf("任务(%d)未分配给 agent(%s)", taskId, agentName)
+	}
+	return task, nil
+}
+
+// ClaimAgentTask agent 获取任务租约，任务已由其他持有者处理时返回 ErrRecordNotUpdate
+func (s *ServerController) ClaimAgentTask(ctx context.Context, agentName string, taskId int64, req *types.ClaimAgentTaskRequest) (interface{}, error) {
+	if _, err := s.getAgentTask(ctx, agentName, taskId); err != nil {
+		return nil, err
+	}
+	return s.factory.Task().Lease(ctx, taskId, agentName, req.Holder, agentTaskLeaseTTL)
+}
+
+func (s *ServerController) ListOwnedAgentTasks(ctx context.Context, agentName string, req *types.ListOwnedAgentTasksRequest) (interface{}, error) {
+	return listOwnedTasks(ctx, s.factory, agentName, req.TaskIds)
+}
+
+func (s *ServerController) ReleaseAgentTask(ctx context.Context, agentName string, taskId int64, req *types.ReleaseAgentTaskRequest) error {
+	if _, err := s.getAgentTask(ctx, agentName, taskId); err != nil {
+		return err
+	}
+	return s.factory.Task().ReleaseLease(ctx, taskId, req.Holder)
+}
+
+func (s *ServerController) UpdateAgentTaskStatus(ctx context.Context, agentName string, taskId int64, req *types.UpdateAgentTaskStatusRequest) error {
+	if _, err := s.getAgentTask(ctx, agentName, taskId); err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"status": req.Status, "message": req.Message, "process": req.Process}
+	if req.OnlyIfRunning {
+		_, err := s.factory.Task().UpdateIfProcess(ctx, taskId, 1, updates)
+		return err
+	}
+	return s.factory.Task().UpdateDirectly(ctx, taskId, updates)
+}
+
+func (s *ServerController) CreateAgentTaskMessage(ctx context.Context, agentName string, req types.CreateTaskMessageRequest) error {
+	if _, err := s.getAgentTask(ctx, agentName, req.Id); err != nil {
+		return err
+	}
+	return s.factory.Task().CreateTaskMessage(ctx, &model.TaskMessage{TaskId: req.Id, Message: req.Message})
+}
+
+// GetAgentTaskConfig 渲染任务的 plugin 配置，回调地址由 agent 本地填充
+func (s *ServerController) GetAgentTaskConfig(ctx context.Context, agentName string, taskId int64) (interface{}, error) {
+	task, err := s.getAgentTask(ctx, agentName, taskId)
+	if err != nil {
+		return nil, err
+	}
+	return makePluginConfig(ctx, s.factory, "", *task)
+}
+
+// AcquireAgentAccount 为 agent 分配账号，agent 仅使用 token 访问 hub api，不下发密码
+func (s *ServerController) AcquireAgentAccount(ctx context.Context, agentName string, req *types.AcquireAccountRequest) (interface{}, error) {
+	account, err := acquireAccount(ctx, s.factory, req.Type)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(1).Infof("agent(%s) 分配到账号(%s)", agentName, account.UserName)
+
+	account.Password = ""
+	return account, nil
+}
+
+func (s *ServerController) ReportAgentAccountUsage(ctx context.Context, agentName string, accountId int64, req *types.ReportAccountUsageRequest) error {
+	return reportAccountUsage(ctx, s.factory, accountId, req)
+}
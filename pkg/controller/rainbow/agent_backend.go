@@ -0,0 +1,301 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+// agentTaskLeaseTTL agent 处理任务的租约有效期，agent 异常退出后任务在租约过期后可被重新处理
+const agentTaskLeaseTTL = 10 * time.Minute
+
+// agentBackend agent 读写 server 数据的方式，direct 模式直连数据库，api 模式通过 server 接口
+type agentBackend interface {
+	// Register 注册 agent，已存在时忽略
+	Register(ctx context.Context) error
+	GetAgent(ctx context.Context) (*model.Agent, error)
+	// Heartbeat 更新心跳，inventory 不为空时同时更新能力清单
+	Heartbeat(ctx context.Context, inventory *model.AgentInventory) error
+	UpdateGrossAmount(ctx context.Context, grossAmount float64) error
+
+	// ListTasks 获取已分配给本 agent 且可获取租约的任务
+	ListTasks(ctx context.Context) ([]model.Task, error)
+	// ClaimTask 获取任务租约，任务已由其他持有者处理时返回 ErrRecordNotUpdate
+	ClaimTask(ctx context.Context, taskId int64, holder string) (*model.Task, error)
+	// ListOwnedTasks 从 taskIds 中过滤出分配给本 agent 的任务
+	ListOwnedTasks(ctx context.Context, taskIds []int64) ([]int64, error)
+	// ReleaseTask 任务处理结束后释放租约
+	ReleaseTask(ctx context.Context, taskId int64, holder string) error
+	UpdateTaskStatus(ctx context.Context, taskId int64, status string, message string, process int) error
+	// FailRunningTask 任务仍在运行中时标记为失败，plugin 已上报结果时忽略
+	FailRunningTask(ctx context.Context, taskId int64, message string) error
+	CreateTaskMessage(ctx context.Context, taskId int64, message string) error
+	GetPluginConfig(ctx context.Context, task model.Task) (*rainbowconfig.PluginTemplateConfig, error)
+	// IssuePluginToken 生成 runner 获取任务配置的凭证，RevokePluginToken 在流水线结束后吊销
+	IssuePluginToken(ctx context.Context, taskId int64) (string, error)
+	RevokePluginToken(ctx context.Context, taskId int64) error
+
+	// AcquireAccount 从账号池分配账号，没有可用账号时返回错误，调用方匿名访问
+	AcquireAccount(ctx context.Context, accountType string) (*model.Account, error)
+	// ReportAccountUsage 上报响应头中的剩余次数
+	ReportAccountUsage(ctx context.Context, accountId int64, req *types.ReportAccountUsageRequest) error
+}
+
+func newAgentBackend(f db.ShareDaoFactory, cfg rainbowconfig.Config) agentBackend {
+	if cfg.Agent.IsAPIMode() {
+		return newAPIBackend(cfg)
+	}
+	return &directBackend{factory: f, cfg: cfg, name: cfg.Agent.Name}
+}
+
+type directBackend struct {
+	factory db.ShareDaoFactory
+	cfg     rainbowconfig.Config
+	name    string
+}
+
+func (b *directBackend) Register(ctx context.Context) error {
+	tunnelToken := util.HashToken(b.cfg.Tunnel.Token)
+	old, err := b.factory.Agent().GetByName(ctx, b.name)
+	if err == nil {
+		// 首次配置隧道凭证时写入
+		if len(old.TunnelToken) == 0 && len(tunnelToken) != 0 {
+			return b.factory.Agent().UpdateByName(ctx, b.name, map[string]interface{}{"tunnel_token": tunnelToken})
+		}
+		return nil
+	}
+	_, err = b.factory.Agent().Create(ctx, &model.Agent{Name: b.name, Status: model.RunAgentType, Type: model.PublicAgentType, Message: "Agent started posting status", TunnelToken: tunnelToken})
+	return err
+}
+
+func (b *directBackend) GetAgent(ctx context.Context) (*model.Agent, error) {
+	return b.factory.Agent().GetByName(ctx, b.name)
+}
+
+func (b *directBackend) Heartbeat(ctx context.Context, inventory *model.AgentInventory) error {
+	return heartbeatAgent(ctx, b.factory, b.name, inventory)
+}
+
+func (b *directBackend) UpdateGrossAmount(ctx context.Context, grossAmount float64) error {
+	return updateAgentUsage(ctx, b.factory, b.name, grossAmount)
+}
+
+func (b *directBackend) ListTasks(ctx context.Context) ([]model.Task, error) {
+	return b.factory.Task().ListLeasable(ctx, b.name)
+}
+
+func (b *directBackend) ClaimTask(ctx context.Context, taskId int64, holder string) (*model.Task, error) {
+	return b.factory.Task().Lease(ctx, taskId, b.name, holder, agentTaskLeaseTTL)
+}
+
+func (b *directBackend) ListOwnedTasks(ctx context.Context, taskIds []int64) ([]int64, error) {
+	return listOwnedTasks(ctx, b.factory, b.name, taskIds)
+}
+
+func (b *directBackend) ReleaseTask(ctx context.Context, taskId int64, holder string) error {
+	return b.factory.Task().ReleaseLease(ctx, taskId, holder)
+}
+
+func (b *directBackend) UpdateTaskStatus(ctx context.Context, taskId int64, status string, message string, process int) error {
+	return b.factory.Task().UpdateDirectly(ctx, taskId, map[string]interface{}{"status": status, "message": message, "process": process})
+}
+
+func (b *directBackend) FailRunningTask(ctx context.Context, taskId int64, message string) error {
+	_, err := b.factory.Task().UpdateIfProcess(ctx, taskId, 1, map[string]interface{}{"status": TaskFailedStatus, "message": message, "process": 3})
+	return err
+}
+
+func (b *directBackend) CreateTaskMessage(ctx context.Context, taskId int64, message string) error {
+	return b.factory.Task().CreateTaskMessage(ctx, &model.TaskMessage{TaskId: taskId, Message: message})
+}
+
+func (b *directBackend) GetPluginConfig(ctx context.Context, task model.Task) (*rainbowconfig.PluginTemplateConfig, error) {
+	return makePluginConfig(ctx, b.factory, b.cfg.Plugin.Callback, task)
+}
+
+func (b *directBackend) IssuePluginToken(ctx context.Context, taskId int64) (string, error) {
+	return issuePluginToken(ctx, b.factory, taskId)
+}
+
+func (b *directBackend) RevokePluginToken(ctx context.Context, taskId int64) error {
+	return revokePluginToken(ctx, b.factory, taskId)
+}
+
+func (b *directBackend) AcquireAccount(ctx context.Context, accountType string) (*model.Account, error) {
+	return acquireAccount(ctx, b.factory, accountType)
+}
+
+func (b *directBackend) ReportAccountUsage(ctx context.Context, accountId int64, req *types.ReportAccountUsageRequest) error {
+	return reportAccountUsage(ctx, b.factory, accountId, req)
+}
+
+// listOwnedTasks 多个 agent 可能共用同一个 CI 仓库，按任务的 agent 过滤
+func listOwnedTasks(ctx context.Context, f db.ShareDaoFactory, name string, taskIds []int64) ([]int64, error) {
+	if len(name) == 0 || len(taskIds) == 0 {
+		return nil, nil
+	}
+	tasks, err := f.Task().List(ctx, db.WithIDIn(taskIds...), db.WithAgent(name))
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		owned = append(owned, task.Id)
+	}
+	return owned, nil
+}
+
+// heartbeatAgent 更新 agent 心跳时间和能力清单，未知状态的 agent 恢复为在线
+func heartbeatAgent(ctx context.Context, f db.ShareDaoFactory, name string, inventory *model.AgentInventory) error {
+	old, err := f.Agent().GetByName(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get agent status %v", err)
+	}
+
+	updates := map[string]interface{}{"last_transition_time": time.Now()}
+	if old.Status != model.UnRunAgentType {
+		if old.Status == model.UnknownAgentType {
+			updates["status"] = model.RunAgentType
+			updates["message"] = "Agent started posting status"
+		}
+	}
+	if inventory != nil {
+		updates["inventory"] = inventory
+	}
+
+	return f.Agent().UpdateByName(ctx, name, updates)
+}
+
+// updateAgentUsage 更新 agent 当月的开销金额，预算由 server 检查
+func updateAgentUsage(ctx context.Context, f db.ShareDaoFactory, name string, grossAmount float64) error {
+	return f.Agent().UpdateByName(ctx, name, map[string]interface{}{
+		"gross_amount": grossAmount,
+		"usage_month":  time.Now().Format(usageMonthLayout),
+	})
+}
+
+func getOneAdminRegistry(ctx context.Context, f db.ShareDaoFactory) (*model.Registry, error) {
+	regs, err := f.Registry().GetAdminRegistries(ctx)
+	if err != nil {
+		klog.Errorf("获取默认镜像仓库失败: %v", err)
+		return nil, err
+	}
+	if len(regs) == 0 {
+		klog.Errorf("no admin or default registry found")
+		return nil, fmt.Errorf("no admin or default registry found")
+	}
+
+	// 随机分，暂时不考虑负载情况，后续优化
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Intn(len(regs))
+	t := regs[x]
+	return &t, err
+}
+
+// makePluginConfig 渲染任务的 plugin 配置，api 模式下由 server 渲染后下发给 agent
+func makePluginConfig(ctx context.Context, f db.ShareDaoFactory, callback string, task model.Task) (*rainbowconfig.PluginTemplateConfig, error) {
+	taskId := task.Id
+
+	var (
+		registry *model.Registry
+		err      error
+	)
+	// 未指定自定义参考时，使用默认仓库
+	if task.RegisterId == 0 {
+		registry, err = getOneAdminRegistry(ctx, f)
+	} else {
+		registry, err = f.Registry().Get(ctx, task.RegisterId)
+	}
+	if err != nil {
+		klog.Errorf("failed to get registry %v", err)
+		return nil, fmt.Errorf("failed to get registry %v", err)
+	}
+
+	pluginTemplateConfig := &rainbowconfig.PluginTemplateConfig{
+		Default: rainbowconfig.DefaultOption{
+			Time: time.Now().Unix(), // 注入时间戳，确保每次内容都不相同
+		},
+		Plugin: rainbowconfig.PluginOption{
+			Callback:   callback,
+			TaskId:     taskId,
+			RegistryId: registry.Id,
+			Synced:     true,
+			Driver:     task.Driver,
+			Arch:       task.Architecture,
+		},
+		Registry: rainbowconfig.Registry{
+			Repository: registry.Repository,
+			Namespace:  registry.Namespace,
+			Username:   registry.Username,
+			Password:   registry.Password,
+		},
+	}
+
+	if pluginTemplateConfig.Plugin.Signature, err = makeSignatureOption(ctx, f, task); err != nil {
+		return nil, err
+	}
+
+	// 根据type判断是镜像列表推送还是k8s镜像组推送
+	switch task.Type {
+	case 0:
+		tags, err := f.Image().ListTags(ctx, db.WithTaskLike(taskId), db.WithErrorTask(task.OnlyPushError))
+		if err != nil {
+			klog.Errorf("获取任务所属 tags 失败 %v", err)
+			return nil, err
+		}
+
+		var imageIds []int64
+		for _, tag := range tags {
+			imageIds = append(imageIds, tag.ImageId)
+		}
+		images, err := f.Image().List(ctx, db.WithIDIn(imageIds...))
+		if err != nil {
+			klog.Errorf("获取任务所属镜像失败 %v", err)
+			return nil, err
+		}
+
+		iNameMap := make(map[int64]string)
+		for _, image := range images {
+			iNameMap[image.Id] = image.Name
+		}
+		immutable, err := makeImmutableImages(ctx, f, images, tags)
+		if err != nil {
+			klog.Errorf("获取任务所属 tags 的锁定状态失败 %v", err)
+			return nil, err
+		}
+		var img []rainbowconfig.Image
+		for _, tag := range tags {
+			name, ok := iNameMap[tag.ImageId]
+			if !ok {
+				klog.Warningf("未能找到镜像(%d)的名称，忽略", tag.ImageId)
+				continue
+			}
+			img = append(img, rainbowconfig.Image{
+				Name: name,
+				Id:   tag.ImageId,
+				Path: tag.Path,
+				Tags: []string{tag.Name},
+
+				Immutable: immutable[tag.Id],
+			})
+		}
+
+		pluginTemplateConfig.Default.PushImages = true
+		pluginTemplateConfig.Images = img
+	case 1:
+		pluginTemplateConfig.Default.PushKubernetes = true
+		pluginTemplateConfig.Kubernetes.Version = task.KubernetesVersion
+	}
+
+	return pluginTemplateConfig, err
+}
@@ -0,0 +1,129 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	usageMonthLayout = "2006-01"
+
+	agentBudgetInterval = 5 * time.Minute
+)
+
+// ListAgentUsages 获取 agent 每月的开销记录
+func (s *ServerController) ListAgentUsages(ctx context.Context, agentId int64) (interface{}, error) {
+	agent, err := s.factory.Agent().Get(ctx, agentId)
+	if err != nil {
+		return nil, err
+	}
+	return s.factory.Agent().ListUsages(ctx, agent.Name)
+}
+
+// agentBudget 获取 agent 的每月预算，未单独设置时使用全局配置
+func (s *ServerController) agentBudget(agent model.Agent) float64 {
+	if agent.MonthlyBudget > 0 {
+		return agent.MonthlyBudget
+	}
+	return s.cfg.Budget.Monthly
+}
+
+// agentMonthlySpend 获取 agent 当月的开销，开销不属于当月时视为 0
+func agentMonthlySpend(agent model.Agent, month string) float64 {
+	if agent.UsageMonth != month {
+		return 0
+	}
+	return agent.GrossAmount
+}
+
+// isOverSoftBudget 当月开销达到软阈值的 agent 降低调度优先级
+func (s *ServerController) isOverSoftBudget(agent model.Agent) bool {
+	spend := agentMonthlySpend(agent, time.Now().Format(usageMonthLayout))
+	return spend >= s.agentBudget(agent)*s.cfg.Budget.SoftRatio
+}
+
+func (s *ServerController) startAgentBudgetController(ctx context.Context) {
+	klog.Infof("starting agent budget controller")
+
+	ticker := time.NewTicker(agentBudgetInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		agents, err := s.factory.Agent().List(ctx)
+		if err != nil {
+			klog.Warningf("获取 agents 列表失败，等待下一次重试 %v", err)
+			continue
+		}
+		for _, agent := range agents {
+			if err = s.reconcileAgentBudget(ctx, agent); err != nil {
+				klog.Errorf("检查 agent(%s) 预算失败 %v", agent.Name, err)
+			}
+		}
+	}
+}
+
+// reconcileAgentBudget 记录当月开销，超出预算时下线 agent，跨月后恢复上线
+func (s *ServerController) reconcileAgentBudget(ctx context.Context, agent model.Agent) error {
+	month := time.Now().Format(usageMonthLayout)
+	budget := s.agentBudget(agent)
+
+	if len(agent.UsageMonth) != 0 {
+		if err := s.factory.Agent().CreateOrUpdateUsage(ctx, &model.AgentUsage{
+			AgentName:   agent.Name,
+			Month:       agent.UsageMonth,
+			GrossAmount: agent.GrossAmount,
+			Budget:      budget,
+		}); err != nil {
+			klog.Errorf("记录 agent(%s) 开销失败 %v", agent.Name, err)
+		}
+	}
+
+	// 跨月后恢复因超出预算下线的 agent
+	if len(agent.SuspendedMonth) != 0 && agent.SuspendedMonth != month {
+		updates := map[string]interface{}{"suspended_month": ""}
+		if agent.Status == model.UnRunAgentType {
+			updates["status"] = model.RunAgentType
+			updates["message"] = "新的计费月份，agent 自动恢复上线"
+		}
+		if err := s.factory.Agent().UpdateByName(ctx, agent.Name, updates); err != nil {
+			return err
+		}
+		klog.Infof("agent(%s) 已进入新的计费月份，自动恢复上线", agent.Name)
+		s.notifyAgentBudget(ctx, fmt.Sprintf("agent(%s) 已进入新的计费月份，自动恢复上线", agent.Name))
+		return nil
+	}
+
+	spend := agentMonthlySpend(agent, month)
+	if len(agent.SuspendedMonth) != 0 || agent.Status != model.RunAgentType || spend < budget {
+		return nil
+	}
+
+	message := fmt.Sprintf("本月 GitHub Actions 开销 %.3f 美金已达到预算 %.3f 美金，自动下线", spend, budget)
+	if err := s.factory.Agent().UpdateByName(ctx, agent.Name, map[string]interface{}{
+		"status":          model.UnRunAgentType,
+		"message":         message,
+		"suspended_month": month,
+	}); err != nil {
+		return err
+	}
+	klog.Warningf("agent(%s) %s", agent.Name, message)
+	s.notifyAgentBudget(ctx, fmt.Sprintf("agent(%s) %s", agent.Name, message))
+	return nil
+}
+
+func (s *ServerController) notifyAgentBudget(ctx context.Context, content string) {
+	if err := s.SendNotify(ctx, &types.SendNotificationRequest{
+		Content: content,
+		CreateNotificationRequest: types.CreateNotificationRequest{
+			Role: types.SystemNotifyRole,
+		},
+	}); err != nil {
+		klog.Errorf("发送 agent 预算通知失败 %v", err)
+	}
+}
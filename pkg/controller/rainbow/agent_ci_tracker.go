@@ -0,0 +1,126 @@
+package rainbow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	ciTrackInterval = 30 * time.Second
+	// 触发后超过该时间仍未查到运行记录，视为触发失败
+	ciRunNotFoundTimeout = 10 * time.Minute
+	ciTrackTimeout       = 3 * time.Hour
+
+	// 日志只保留末尾部分写入任务消息
+	maxCIRunLogSize = 16 * 1024
+)
+
+// trackCIRun 跟踪任务的流水线运行，记录运行地址和日志，运行失败且 plugin 未上报结果时标记任务失败，结束后清理远端分支
+func (s *AgentController) trackCIRun(ctx context.Context, executor CIExecutor, run *CIRun) {
+	defer s.setTracking(run.TaskId, false)
+
+	defer func() {
+		if err := executor.Cleanup(ctx, run); err != nil {
+			klog.Warningf("删除任务(%d)远端分支失败 %v", run.TaskId, err)
+		}
+		if len(run.Token) != 0 {
+			if err := s.backend.RevokePluginToken(ctx, run.TaskId); err != nil {
+				klog.Warningf("吊销任务(%d)凭证失败 %v", run.TaskId, err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(ciTrackInterval)
+	defer ticker.Stop()
+
+	var (
+		start    = time.Now()
+		reported bool
+	)
+	for range ticker.C {
+		if time.Since(start) > ciTrackTimeout {
+			s.failCIRun(ctx, run.TaskId, fmt.Sprintf("流水线运行超过 %v 未结束", ciTrackTimeout))
+			return
+		}
+
+		result, err := executor.GetRun(ctx, run)
+		if err != nil {
+			klog.Warningf("获取任务(%d)流水线状态失败 %v", run.TaskId, err)
+			continue
+		}
+
+		switch result.Status {
+		case types.CIRunNotFound:
+			if time.Since(start) > ciRunNotFoundTimeout {
+				s.failCIRun(ctx, run.TaskId, fmt.Sprintf("触发后 %v 内未查询到流水线运行", ciRunNotFoundTimeout))
+				return
+			}
+			continue
+		case types.CIRunPending, types.CIRunRunning:
+			if !reported && len(result.URL) != 0 {
+				reported = true
+				s.createTaskMessage(ctx, run.TaskId, fmt.Sprintf("流水线已启动: %s", result.URL))
+			}
+			continue
+		}
+
+		s.attachCIRunLogs(ctx, executor, run, result)
+		if result.Status == types.CIRunFailed {
+			s.failCIRun(ctx, run.TaskId, fmt.Sprintf("流水线运行失败: %s", result.URL))
+		}
+		return
+	}
+}
+
+func (s *AgentController) attachCIRunLogs(ctx context.Context, executor CIExecutor, run *CIRun, result *types.CIRunResult) {
+	logs, err := executor.GetRunLogs(ctx, run, result)
+	if errors.Is(err, errCIRunLogsUnsupported) {
+		s.createTaskMessage(ctx, run.TaskId, fmt.Sprintf("%v，请在运行页面查看: %s", err, result.URL))
+		return
+	}
+	if err != nil {
+		klog.Warningf("获取任务(%d)流水线日志失败 %v", run.TaskId, err)
+		return
+	}
+	if len(logs) == 0 {
+		return
+	}
+	if len(logs) > maxCIRunLogSize {
+		logs = "...\n" + logs[len(logs)-maxCIRunLogSize:]
+	}
+	s.createTaskMessage(ctx, run.TaskId, fmt.Sprintf("流水线日志(%s):\n%s", result.URL, logs))
+}
+
+// failCIRun plugin 已上报结果时不覆盖任务状态
+func (s *AgentController) failCIRun(ctx context.Context, taskId int64, message string) {
+	klog.Warningf("任务(%d) %s", taskId, message)
+	if err := s.backend.FailRunningTask(ctx, taskId, message); err != nil {
+		klog.Errorf("标记任务(%d)失败出错 %v", taskId, err)
+	}
+	s.createTaskMessage(ctx, taskId, message)
+}
+
+func (s *AgentController) createTaskMessage(ctx context.Context, taskId int64, message string) {
+	if err := s.backend.CreateTaskMessage(ctx, taskId, message); err != nil {
+		klog.Errorf("记录任务(%d)消息失败 %v", taskId, err)
+	}
+}
+
+func (s *AgentController) setTracking(taskId int64, tracking bool) {
+	key := fmt.Sprintf("%d", taskId)
+
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+
+	if tracking {
+		s.tracking.Insert(key)
+	} else {
+		s.tracking.Delete(key)
+	}
+}
@@ -0,0 +1,270 @@
+package rainbow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+	utilerrors "github.com/caoyingjunz/rainbow/pkg/util/errors"
+)
+
+const agentAPITimeout = 30 * time.Second
+
+var errAgentUnauthorized = errors.New("agent 认证失败")
+
+type agentAPIResponse struct {
+	Code    int             `json:"code"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// apiBackend api 模式下 agent 仅通过 server 接口交互，使用引导凭证注册后换取 agent 凭证
+type apiBackend struct {
+	server         string
+	name           string
+	bootstrapToken string
+	credentialFile string
+	callback       string
+
+	lock       sync.RWMutex
+	credential string
+
+	// 避免凭证失效时并发重复注册
+	registerLock sync.Mutex
+}
+
+func newAPIBackend(cfg rainbowconfig.Config) *apiBackend {
+	credentialFile := cfg.Agent.CredentialFile
+	if len(credentialFile) == 0 {
+		credentialFile = filepath.Join(cfg.Agent.DataDir, "credential")
+	}
+
+	return &apiBackend{
+		server:         strings.TrimSuffix(cfg.Agent.Server, "/"),
+		name:           cfg.Agent.Name,
+		bootstrapToken: cfg.Agent.BootstrapToken,
+		credentialFile: credentialFile,
+		callback:       cfg.Plugin.Callback,
+	}
+}
+
+func (b *apiBackend) getCredential() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.credential
+}
+
+func (b *apiBackend) setCredential(credential string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.credential = credential
+}
+
+// Register 优先使用已保存的 agent 凭证，不存在时使用引导凭证注册
+func (b *apiBackend) Register(ctx context.Context) error {
+	if len(b.server) == 0 {
+		return fmt.Errorf("api 模式需配置 agent.server")
+	}
+
+	data, err := os.ReadFile(b.credentialFile)
+	if err == nil && len(strings.TrimSpace(string(data))) != 0 {
+		b.setCredential(strings.TrimSpace(string(data)))
+		// 通过心跳校验已保存的凭证，失效时会自动重新注册
+		return b.Heartbeat(ctx, nil)
+	}
+
+	return b.register(ctx, "")
+}
+
+// register 使用引导凭证换取 agent 凭证，staled 为已失效的凭证，其他协程已完成注册时直接返回
+func (b *apiBackend) register(ctx context.Context, staled string) error {
+	b.registerLock.Lock()
+	defer b.registerLock.Unlock()
+
+	if current := b.getCredential(); len(current) != 0 && current != staled {
+		return nil
+	}
+	if len(b.bootstrapToken) == 0 {
+		return fmt.Errorf("agent(%s) 未配置引导凭证，无法注册", b.name)
+	}
+
+	var cred types.AgentCredential
+	if err := b.request(http.MethodPost, "/register", "", &types.RegisterAgentRequest{
+		AgentName:      b.name,
+		BootstrapToken: b.bootstrapToken,
+	}, &cred); err != nil {
+		return fmt.Errorf("agent(%s) 注册失败 %v", b.name, err)
+	}
+
+	if err := os.WriteFile(b.credentialFile, []byte(cred.Credential), 0600); err != nil {
+		klog.Errorf("保存 agent 凭证到 %s 失败 %v", b.credentialFile, err)
+	}
+	b.setCredential(cred.Credential)
+	klog.Infof("agent(%s) 注册成功", b.name)
+	return nil
+}
+
+// do 使用 agent 凭证调用 server 接口，凭证失效时尝试使用引导凭证重新注册
+func (b *apiBackend) do(ctx context.Context, method string, path string, body interface{}, val interface{}) error {
+	credential := b.getCredential()
+	err := b.request(method, path, credential, body, val)
+	if !errors.Is(err, errAgentUnauthorized) {
+		return err
+	}
+
+	klog.Warningf("agent(%s) 凭证已失效，尝试重新注册", b.name)
+	if err = b.register(ctx, credential); err != nil {
+		return err
+	}
+	return b.request(method, path, b.getCredential(), body, val)
+}
+
+func (b *apiBackend) request(method string, path string, credential string, body interface{}, val interface{}) error {
+	headers := map[string]string{"Content-Type": "application/json", types.AgentNameHeader: b.name}
+	if len(credential) != 0 {
+		headers["Authorization"] = "Bearer " + credential
+	}
+
+	httpClient := util.HttpClientV2{URL: b.server + types.AgentAPIPrefix + path}
+	httpClient.Method(method).WithTimeout(agentAPITimeout).WithHeader(headers)
+	if body != nil {
+		buf, err := util.BuildHttpBody(body)
+		if err != nil {
+			return err
+		}
+		httpClient.WithBody(buf)
+	}
+
+	var resp agentAPIResponse
+	if err := httpClient.Do(&resp); err != nil {
+		return err
+	}
+	switch resp.Code {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%w: %s", errAgentUnauthorized, resp.Message)
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s", utilerrors.ErrRecordNotUpdate, resp.Message)
+	default:
+		return errors.New(resp.Message)
+	}
+
+	if val != nil && len(resp.Result) != 0 {
+		return json.Unmarshal(resp.Result, val)
+	}
+	return nil
+}
+
+func (b *apiBackend) GetAgent(ctx context.Context) (*model.Agent, error) {
+	var agent model.Agent
+	if err := b.do(ctx, http.MethodGet, "/self", nil, &agent); err != nil {
+		return nil, err
+	}
+	return &agent, nil
+}
+
+func (b *apiBackend) Heartbeat(ctx context.Context, inventory *model.AgentInventory) error {
+	return b.do(ctx, http.MethodPut, "/heartbeat", &types.AgentHeartbeatRequest{Inventory: inventory}, nil)
+}
+
+func (b *apiBackend) UpdateGrossAmount(ctx context.Context, grossAmount float64) error {
+	return b.do(ctx, http.MethodPut, "/usage", &types.UpdateAgentUsageRequest{GrossAmount: grossAmount}, nil)
+}
+
+func (b *apiBackend) ListTasks(ctx context.Context) ([]model.Task, error) {
+	var tasks []model.Task
+	if err := b.do(ctx, http.MethodGet, "/tasks", nil, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (b *apiBackend) ClaimTask(ctx context.Context, taskId int64, holder string) (*model.Task, error) {
+	var task model.Task
+	if err := b.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/claim", taskId), &types.ClaimAgentTaskRequest{Holder: holder}, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (b *apiBackend) ListOwnedTasks(ctx context.Context, taskIds []int64) ([]int64, error) {
+	var owned []int64
+	if err := b.do(ctx, http.MethodPost, "/tasks/owned", &types.ListOwnedAgentTasksRequest{TaskIds: taskIds}, &owned); err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
+
+func (b *apiBackend) ReleaseTask(ctx context.Context, taskId int64, holder string) error {
+	return b.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/release", taskId), &types.ReleaseAgentTaskRequest{Holder: holder}, nil)
+}
+
+func (b *apiBackend) UpdateTaskStatus(ctx context.Context, taskId int64, status string, message string, process int) error {
+	return b.do(ctx, http.MethodPut, fmt.Sprintf("/tasks/%d/status", taskId), &types.UpdateAgentTaskStatusRequest{
+		Status:  status,
+		Message: message,
+		Process: process,
+	}, nil)
+}
+
+func (b *apiBackend) FailRunningTask(ctx context.Context, taskId int64, message string) error {
+	return b.do(ctx, http.MethodPut, fmt.Sprintf("/tasks/%d/status", taskId), &types.UpdateAgentTaskStatusRequest{
+		Status:        TaskFailedStatus,
+		Message:       message,
+		Process:       3,
+		OnlyIfRunning: true,
+	}, nil)
+}
+
+func (b *apiBackend) CreateTaskMessage(ctx context.Context, taskId int64, message string) error {
+	return b.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/messages", taskId), &types.CreateTaskMessageRequest{Message: message}, nil)
+}
+
+// GetPluginConfig 由 server 渲染任务配置，回调地址使用 agent 本地配置
+func (b *apiBackend) GetPluginConfig(ctx context.Context, task model.Task) (*rainbowconfig.PluginTemplateConfig, error) {
+	var cfg rainbowconfig.PluginTemplateConfig
+	if err := b.do(ctx, http.MethodGet, fmt.Sprintf("/tasks/%d/config", task.Id), nil, &cfg); err != nil {
+		return nil, err
+	}
+	if len(b.callback) != 0 {
+		cfg.Plugin.Callback = b.callback
+	}
+	return &cfg, nil
+}
+
+func (b *apiBackend) IssuePluginToken(ctx context.Context, taskId int64) (string, error) {
+	var token string
+	if err := b.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/plugin-token", taskId), nil, &token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (b *apiBackend) RevokePluginToken(ctx context.Context, taskId int64) error {
+	return b.do(ctx, http.MethodDelete, fmt.Sprintf("/tasks/%d/plugin-token", taskId), nil, nil)
+}
+
+func (b *apiBackend) AcquireAccount(ctx context.Context, accountType string) (*model.Account, error) {
+	var account model.Account
+	if err := b.do(ctx, http.MethodPost, "/accounts/acquire", &types.AcquireAccountRequest{Type: accountType}, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (b *apiBackend) ReportAccountUsage(ctx context.Context, accountId int64, req *types.ReportAccountUsageRequest) error {
+	return b.do(ctx, http.MethodPut, fmt.Sprintf("/accounts/%d/usage", accountId), req, nil)
+}
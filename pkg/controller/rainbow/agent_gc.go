@@ -0,0 +1,238 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caoyingjunz/pixiulib/strutil"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const pluginDirName = "plugin"
+
+// taskDir data_dir 下的任务目录
+type taskDir struct {
+	name    string
+	path    string
+	size    uint64
+	modTime time.Time
+}
+
+func (s *AgentController) startGC(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.cfg.Agent.GC.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := s.GarbageCollect(ctx)
+		s.inventory.recordGC(report)
+		klog.Infof("GarbageCollect 完成, 回收目录 %d 个, 释放 %d 字节, 删除分支 %d 个, 错误 %d 个",
+			len(report.RemovedDirs), report.FreedBytes, len(report.DeletedBranches), len(report.Errors))
+	}
+}
+
+// GarbageCollect 按保留天数和磁盘占用回收任务目录，跳过处理中的任务，并清理悬空镜像和遗留的远端分支
+func (s *AgentController) GarbageCollect(ctx context.Context) *model.AgentGCReport {
+	report := &model.AgentGCReport{StartTime: time.Now()}
+	defer func() {
+		report.Duration = time.Since(report.StartTime).Milliseconds()
+	}()
+
+	s.collectTaskDirs(ctx, report)
+	if !s.cfg.Agent.GC.DisableImagePrune {
+		s.pruneImages(ctx, report)
+	}
+	if !s.cfg.Agent.GC.DisableBranchPrune {
+		s.pruneBranches(ctx, report)
+	}
+	return report
+}
+
+func (s *AgentController) collectTaskDirs(ctx context.Context, report *model.AgentGCReport) {
+	dirs, err := s.listTaskDirs()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	var usage uint64
+	for _, dir := range dirs {
+		usage += dir.size
+	}
+
+	maxUsage := uint64(s.cfg.Agent.GC.MaxDiskUsage) * 1024 * 1024
+	deadline := time.Now().AddDate(0, 0, -s.cfg.Agent.RetainDays)
+	// 从最早的任务开始回收，超过保留天数或磁盘占用超限时回收
+	for _, dir := range dirs {
+		expired := dir.modTime.Before(deadline)
+		if !expired && usage <= maxUsage {
+			continue
+		}
+		if s.isTaskActive(dir.name) {
+			report.SkippedDirs = append(report.SkippedDirs, dir.name)
+			continue
+		}
+
+		s.cleanupCIRun(ctx, dir.name)
+		if err = os.RemoveAll(dir.path); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("回收任务目录 %s 失败 %v", dir.path, err))
+			continue
+		}
+		klog.Infof("任务文件 %s 已被回收, 过期 %v, 占用 %d 字节", dir.path, expired, dir.size)
+
+		usage -= dir.size
+		report.FreedBytes += dir.size
+		report.RemovedDirs = append(report.RemovedDirs, dir.name)
+	}
+	report.DiskUsage = usage
+}
+
+// listTaskDirs 获取任务目录及其占用，按修改时间从早到晚排序
+func (s *AgentController) listTaskDirs() ([]taskDir, error) {
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var dirs []taskDir
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == pluginDirName {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			klog.Errorf("获取文件夹(%s)信息失败 %v, 忽略", entry.Name(), err)
+			continue
+		}
+
+		path := filepath.Join(s.baseDir, entry.Name())
+		dirs = append(dirs, taskDir{name: entry.Name(), path: path, size: dirSize(path), modTime: fileInfo.ModTime()})
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].modTime.Before(dirs[j].modTime)
+	})
+	return dirs, nil
+}
+
+func dirSize(path string) uint64 {
+	var size uint64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+// isTaskActive 任务在队列中、处理中或流水线仍在运行
+func (s *AgentController) isTaskActive(name string) bool {
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+
+	return s.pending.Has(name) || s.tracking.Has(name)
+}
+
+// pruneImages 清理 rainbow 构建产生的悬空镜像，只清理带有 rainbow 标签且超过保留天数的镜像，不影响主机上的其他镜像
+func (s *AgentController) pruneImages(ctx context.Context, report *model.AgentGCReport) {
+	if _, err := s.exec.LookPath("docker"); err != nil {
+		return
+	}
+
+	until := fmt.Sprintf("until=%dh", s.cfg.Agent.RetainDays*24)
+	out, err := s.exec.CommandContext(ctx, "docker", "image", "prune", "--force", "--filter", until, "--filter", "label="+types.RainbowImageLabel).CombinedOutput()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("清理悬空镜像失败 %v %s", err, string(out)))
+		return
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Total reclaimed space:") {
+			report.ImageReclaimed = strings.TrimSpace(strings.TrimPrefix(line, "Total reclaimed space:"))
+		}
+	}
+}
+
+// pruneBranches 删除本地已无任务目录且不在处理中的远端任务分支，只处理分配给本 agent 的任务
+func (s *AgentController) pruneBranches(ctx context.Context, report *model.AgentGCReport) {
+	pluginDir := filepath.Join(s.baseDir, pluginDirName)
+	if !util.IsDirectoryExists(pluginDir) {
+		return
+	}
+	branches, err := util.NewGit(pluginDir, "", "").RemoteBranches()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("获取远端分支失败 %v", err))
+		return
+	}
+
+	// 任务分支以任务 ID 命名
+	var candidates []int64
+	for _, branch := range branches {
+		taskId, err := strutil.ParseInt64(branch)
+		if err != nil {
+			continue
+		}
+		if s.isTaskActive(branch) || util.IsDirectoryExists(filepath.Join(s.baseDir, branch)) {
+			continue
+		}
+		candidates = append(candidates, taskId)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	// 多个 agent 可能共用同一个仓库，只删除分配给本 agent 的任务分支
+	owned, err := s.backend.ListOwnedTasks(ctx, candidates)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("获取本节点的任务失败 %v", err))
+		return
+	}
+
+	var executor CIExecutor
+	for _, taskId := range owned {
+		branch := fmt.Sprintf("%d", taskId)
+		if executor == nil {
+			if executor, err = s.ciExecutor(ctx); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("获取 CI 后端失败 %v", err))
+				return
+			}
+		}
+		if err = executor.Cleanup(ctx, &CIRun{TaskId: taskId, Branch: branch, RepoDir: pluginDir}); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("删除远端分支 %s 失败 %v", branch, err))
+			continue
+		}
+		report.DeletedBranches = append(report.DeletedBranches, branch)
+	}
+}
+
+// cleanupCIRun 回收任务目录前删除远端的任务分支
+func (s *AgentController) cleanupCIRun(ctx context.Context, name string) {
+	taskId, err := strutil.ParseInt64(name)
+	if err != nil {
+		return
+	}
+	run := newCIRun(s.baseDir, taskId)
+	if !util.IsDirectoryExists(run.RepoDir) {
+		return
+	}
+
+	executor, err := s.ciExecutor(ctx)
+	if err != nil {
+		klog.Errorf("获取 CI 后端失败 %v", err)
+		return
+	}
+	if err = executor.Cleanup(ctx, run); err != nil {
+		klog.Warningf("删除任务(%d)远端分支失败 %v", taskId, err)
+	}
+}
@@ -0,0 +1,220 @@
+package rainbow
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	// 工具和网络探测较慢，按间隔刷新，磁盘和任务结果每次心跳刷新
+	inventoryProbeInterval = 10 * time.Minute
+	inventoryProbeTimeout  = 10 * time.Second
+
+	recentTaskOutcomes = 10
+)
+
+// agentInventory 缓存 agent 的能力清单，并记录最近的任务结果
+type agentInventory struct {
+	lock sync.Mutex
+
+	probed    *model.AgentInventory
+	probeTime time.Time
+	outcomes  []model.AgentTaskOutcome
+	gcReport  *model.AgentGCReport
+}
+
+func (i *agentInventory) recordOutcome(taskId int64, err error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	outcome := model.AgentTaskOutcome{TaskId: taskId, Success: err == nil, Time: time.Now()}
+	if err != nil {
+		outcome.Message = err.Error()
+	}
+	i.outcomes = append(i.outcomes, outcome)
+	if len(i.outcomes) > recentTaskOutcomes {
+		i.outcomes = i.outcomes[len(i.outcomes)-recentTaskOutcomes:]
+	}
+}
+
+func (i *agentInventory) recordGC(report *model.AgentGCReport) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.gcReport = report
+}
+
+// getInventory 获取上报的能力清单，超过探测间隔时重新探测工具和网络
+func (s *AgentController) getInventory(ctx context.Context) *model.AgentInventory {
+	s.inventory.lock.Lock()
+	defer s.inventory.lock.Unlock()
+
+	if s.inventory.probed == nil || time.Since(s.inventory.probeTime) > inventoryProbeInterval {
+		s.inventory.probed = s.probeInventory(ctx)
+		s.inventory.probeTime = time.Now()
+	}
+
+	inventory := *s.inventory.probed
+	inventory.Disk = probeDisk(s.baseDir)
+	inventory.RecentTasks = append([]model.AgentTaskOutcome{}, s.inventory.outcomes...)
+	inventory.GC = s.inventory.gcReport
+	return &inventory
+}
+
+func (s *AgentController) probeInventory(ctx context.Context) *model.AgentInventory {
+	inventory := &model.AgentInventory{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		ProbeTime: time.Now(),
+	}
+
+	docker := s.probeTool(ctx, "docker", "docker", "version", "--format", "{{.Server.Version}}")
+	skopeo := s.probeTool(ctx, "skopeo", "skopeo", "--version")
+	buildx := s.probeTool(ctx, "buildx", "docker", "buildx", "version")
+	git := s.probeTool(ctx, "git", "git", "--version")
+	inventory.Tools = []model.AgentTool{docker, skopeo, buildx, git}
+
+	if docker.Available {
+		inventory.Drivers = append(inventory.Drivers, "docker")
+	}
+	if skopeo.Available {
+		inventory.Drivers = append(inventory.Drivers, "skopeo")
+	}
+	if buildx.Available {
+		inventory.Architectures = s.probeBuildxPlatforms(ctx)
+	}
+	inventory.Reachability = s.probeReachability(ctx)
+
+	// 上报部署的镜像和程序摘要，server 据此确认升级后的 agent 已生效
+	inventory.Image = s.cfg.Agent.Image
+	if binary, err := os.Executable(); err == nil {
+		if inventory.BinaryDigest, err = util.FileDigest(binary); err != nil {
+			klog.V(2).Infof("计算 agent 程序摘要失败 %v", err)
+		}
+	}
+
+	klog.V(1).Infof("agent(%s) 能力探测完成, 驱动 %v, 平台 %v", s.name, inventory.Drivers, inventory.Architectures)
+	return inventory
+}
+
+func (s *AgentController) probeTool(ctx context.Context, name string, cmd string, args ...string) model.AgentTool {
+	probeCtx, cancel := context.WithTimeout(ctx, inventoryProbeTimeout)
+	defer cancel()
+
+	out, err := s.exec.CommandContext(probeCtx, cmd, args...).Output()
+	if err != nil {
+		klog.V(2).Infof("探测工具 %s 失败 %v", name, err)
+		return model.AgentTool{Name: name}
+	}
+	return model.AgentTool{Name: name, Version: strings.TrimSpace(string(out)), Available: true}
+}
+
+// probeBuildxPlatforms 解析 docker buildx inspect 输出中的 Platforms 行
+func (s *AgentController) probeBuildxPlatforms(ctx context.Context) []string {
+	probeCtx, cancel := context.WithTimeout(ctx, inventoryProbeTimeout)
+	defer cancel()
+
+	out, err := s.exec.CommandContext(probeCtx, "docker", "buildx", "inspect").Output()
+	if err != nil {
+		klog.V(2).Infof("获取 buildx 平台失败 %v", err)
+		return nil
+	}
+
+	var platforms []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "Platforms:") {
+			continue
+		}
+		for _, p := range strings.Split(strings.TrimPrefix(line, "Platforms:"), ",") {
+			// 去除自动探测平台的 * 标记
+			p = strings.TrimSuffix(strings.TrimSpace(p), "*")
+			if len(p) != 0 {
+				platforms = append(platforms, p)
+			}
+		}
+	}
+	return platforms
+}
+
+// probeReachability 并发探测内置和已配置镜像源的连通性，能收到 http 响应即视为可达
+func (s *AgentController) probeReachability(ctx context.Context) []model.AgentReachability {
+	targets := map[string]string{
+		types.ImageHubDocker: "https://registry-1.docker.io",
+		"github":             types.GithubAPIBase,
+	}
+	for name, endpoint := range types.DefaultOCIRegistries {
+		targets[name] = endpoint
+	}
+	for _, hub := range s.cfg.Hubs {
+		if len(hub.Name) != 0 && len(hub.Endpoint) != 0 {
+			targets[hub.Name] = strings.TrimSuffix(hub.Endpoint, "/")
+		}
+	}
+
+	client := &http.Client{Timeout: inventoryProbeTimeout}
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		results []model.AgentReachability
+	)
+	for name, endpoint := range targets {
+		wg.Add(1)
+		go func(name, endpoint string) {
+			defer wg.Done()
+			result := probeEndpoint(ctx, client, name, endpoint)
+
+			lock.Lock()
+			defer lock.Unlock()
+			results = append(results, result)
+		}(name, endpoint)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Target < results[j].Target
+	})
+	return results
+}
+
+func probeEndpoint(ctx context.Context, client *http.Client, name string, endpoint string) model.AgentReachability {
+	result := model.AgentReachability{Target: name}
+
+	url := endpoint
+	if name != "github" {
+		url = endpoint + "/v2/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		result.Error = resp.Status
+		return result
+	}
+	result.Reachable = true
+	return result
+}
@@ -0,0 +1,22 @@
+package rainbow
+
+import (
+	"syscall"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+func probeDisk(path string) model.AgentDisk {
+	disk := model.AgentDisk{Path: path}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		klog.Errorf("获取目录(%s)磁盘信息失败 %v", path, err)
+		return disk
+	}
+	disk.Total = stat.Blocks * uint64(stat.Bsize)
+	disk.Free = stat.Bavail * uint64(stat.Bsize)
+	return disk
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package rainbow
+
+import (
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+// probeDisk 非 linux 平台不采集磁盘信息，调度时不按磁盘空间过滤
+func probeDisk(path string) model.AgentDisk {
+	return model.AgentDisk{Path: path}
+}
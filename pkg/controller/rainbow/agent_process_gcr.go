@@ -0,0 +1,173 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+// gcrProvider gcr 和 artifact registry 的 tags/list 额外返回子仓库和各 manifest 的大小、上传时间
+// https://cloud.google.com/artifact-registry/docs/docker/reference
+type gcrProvider struct {
+	registry types.OCIRegistry
+}
+
+func (p *gcrProvider) tagsList(ctx context.Context, client *ociClient, repo string) (*types.SearchGCRResult, error) {
+	var result types.SearchGCRResult
+	if err := client.GetJSON(ctx, fmt.Sprintf("%s/v2/%s/tags/list", p.registry.Endpoint, repo), repo, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SearchRepositories gcr 没有搜索接口，列出命名空间下的子仓库后按名称过滤
+func (p *gcrProvider) SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error) {
+	namespace := req.Namespace
+	if len(namespace) == 0 && strings.HasSuffix(p.registry.Endpoint, types.ImageHubGCR) {
+		namespace = types.DefaultGCRNamespace
+	}
+	if len(namespace) == 0 {
+		return nil, fmt.Errorf("镜像源(%s)搜索仓库需指定命名空间", p.registry.Name)
+	}
+	klog.Infof("搜索镜像源(%s)命名空间(%s)镜像 %v", p.registry.Name, namespace, req.Query)
+
+	result, err := p.tagsList(ctx, newOCIClient(p.registry), namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, child := range result.Child {
+		if strings.Contains(child, req.Query) {
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+
+	var css []types.CommonSearchRepositoryResult
+	for _, name := range PaginateTagSlice(names, req.Page, req.PageSize) {
+		css = append(css, types.CommonSearchRepositoryResult{
+			Name:     fmt.Sprintf("%s/%s", namespace, name),
+			Registry: req.Hub,
+		})
+	}
+	return css, nil
+}
+
+func (p *gcrProvider) ListTags(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagResult, error) {
+	repo := ociRepoName(req)
+	query, arch := tagSearchOption(req)
+	klog.Infof("搜索镜像源(%s)镜像(%s) tags, arch %s query %s", p.registry.Name, repo, arch, query)
+
+	client := newOCIClient(p.registry)
+	result, err := p.tagsList(ctx, client, repo)
+	if err != nil {
+		klog.Errorf("获取镜像(%s) tags 失败 %v", repo, err)
+		return nil, err
+	}
+	// 不返回 manifest 信息时按通用镜像源处理
+	if len(result.Manifest) == 0 {
+		return (&ociProvider{registry: p.registry}).ListTags(ctx, req)
+	}
+
+	type gcrTag struct {
+		types.CommonTag
+		uploaded time.Time
+	}
+	var tags []gcrTag
+	for digest, m := range result.Manifest {
+		size, _ := strconv.ParseInt(m.ImageSizeBytes, 10, 64)
+		uploaded := parseMillis(m.TimeUploadedMs)
+		for _, name := range m.Tag {
+			if len(query) != 0 && !strings.Contains(name, query) {
+				continue
+			}
+			tags = append(tags, gcrTag{
+				CommonTag: types.CommonTag{
+					Name:           name,
+					Size:           size,
+					LastModified:   uploaded.String(),
+					ManifestDigest: digest,
+				},
+				uploaded: uploaded,
+			})
+		}
+	}
+	// 按上传时间倒序
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].uploaded.Equal(tags[j].uploaded) {
+			return tags[i].Name > tags[j].Name
+		}
+		return tags[i].uploaded.After(tags[j].uploaded)
+	})
+
+	var (
+		cts   []types.CommonTag
+		start = (req.Page - 1) * req.PageSize
+	)
+	for i := start; i >= 0 && i < len(tags) && i < start+req.PageSize; i++ {
+		ct := tags[i].CommonTag
+		// 多架构镜像的大小为 0，需从 manifest 获取
+		if len(arch) != 0 || ct.Size == 0 {
+			tag, err := buildCommonTagForOCI(ctx, client, repo, ct, arch)
+			if err != nil {
+				klog.Warningf("获取镜像(%s:%s) manifest 失败 %v", repo, ct.Name, err)
+				continue
+			}
+			if tag == nil {
+				continue
+			}
+			ct = *tag
+		}
+		cts = append(cts, ct)
+	}
+
+	return &types.CommonSearchTagResult{
+		Hub:        req.Hub,
+		Namespace:  req.Namespace,
+		Repository: req.Repository,
+		Total:      len(tags),
+		PageSize:   req.PageSize,
+		Page:       req.Page,
+		TagResult:  cts,
+	}, nil
+}
+
+func (p *gcrProvider) GetTagInfo(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagInfoResult, error) {
+	return getOCITagInfo(ctx, newOCIClient(p.registry), ociRepoName(req), req.Tag)
+}
+
+// GetRepository gcr 没有仓库元数据，最近修改时间取最新上传的 manifest
+func (p *gcrProvider) GetRepository(ctx context.Context, req *types.CallSearchRequest) (*types.CommonRepositoryResult, error) {
+	result, err := p.tagsList(ctx, newOCIClient(p.registry), ociRepoName(req))
+	if err != nil {
+		return nil, err
+	}
+
+	var latest time.Time
+	for _, m := range result.Manifest {
+		if uploaded := parseMillis(m.TimeUploadedMs); uploaded.After(latest) {
+			latest = uploaded
+		}
+	}
+	repo := &types.CommonRepositoryResult{Hub: req.Hub, Namespace: req.Namespace, Name: req.Repository}
+	if !latest.IsZero() {
+		repo.LastModified = latest.String()
+	}
+	return repo, nil
+}
+
+func parseMillis(ms string) time.Time {
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || v == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(v)
+}
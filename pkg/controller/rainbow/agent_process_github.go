@@ -3,115 +3,90 @@ package rainbow
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"net/http"
 	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/caoyingjunz/rainbow/pkg/types"
-	"github.com/caoyingjunz/rainbow/pkg/util"
 )
 
+// ProcessGithub 处理 server 下发的仓库和流水线操作，按 agent 配置的 CI 后端执行
 func (s *AgentController) ProcessGithub(ctx context.Context, req *types.CallGithubRequest) ([]byte, error) {
+	executor, err := s.ciExecutor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	switch req.Op {
 	case types.OpGetAction:
-		return s.GetGithubRepo(ctx, req)
+		return nil, nil
 	case types.OpCreateAction:
-		return s.CreateGithubRepo(ctx, req)
+		return nil, s.CreateRepo(ctx, executor, req.Repo)
 	case types.OpCreateIfNotAction:
-		return s.CreateAgentReposIfNot(ctx, req)
+		return nil, s.CreateAgentReposIfNot(ctx, executor, req.Repos)
+	case types.OpGetRunAction:
+		return s.GetTaskRun(ctx, executor, req.TaskId)
 	default:
 		return nil, fmt.Errorf("unSupported github op %d", req.Op)
 	}
 }
 
-func (s *AgentController) CreateAgentReposIfNot(ctx context.Context, req *types.CallGithubRequest) ([]byte, error) {
-	repos, err := s.getGithubRepos(ctx, req)
+func (s *AgentController) CreateAgentReposIfNot(ctx context.Context, executor CIExecutor, repos []string) error {
+	existsRepos, err := executor.ListRepos(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	existsRepoMap := make(map[string]bool)
-	for _, repo := range repos {
-		existsRepoMap[repo.Name] = true
+	for _, repo := range existsRepos {
+		existsRepoMap[repo] = true
 	}
 	klog.V(1).Infof("已存在 repo %v", existsRepoMap)
 
-	for _, repo := range req.Repos {
+	for _, repo := range repos {
 		if existsRepoMap[repo] {
 			klog.Infof("repo %s 已存在，跳过创建", repo)
 			continue
 		}
 
 		klog.Infof("即将创建 repo %s", repo)
-		if _, err = s.CreateGithubRepo(ctx, &types.CallGithubRequest{
-			Repo: repo,
-		}); err != nil {
-			klog.Errorf("创建 repo（%s）失败 %v", repo, err)
-			return nil, err
+		if err = s.CreateRepo(ctx, executor, repo); err != nil {
+			return err
 		}
 	}
 
 	klog.Infof("repo 全部同步完成")
-	return nil, nil
+	return nil
 }
 
-func (s *AgentController) getGithubRepos(ctx context.Context, req *types.CallGithubRequest) ([]types.GitHubRepository, error) {
-	token, err := s.GetAgentToken(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	var repos []types.GitHubRepository
-	httpClient := util.HttpClientV2{URL: types.GithubAPIBase + "/user/repos"}
-	err1 := httpClient.Method(http.MethodGet).
-		WithTimeout(30 * time.Second).
-		WithHeader(map[string]string{
-			"Accept":               "application/vnd.github+json",
-			"Authorization":        fmt.Sprintf("Bearer %s", token),
-			"X-GitHub-Api-Version": "2022-11-28",
-		}).
-		Do(&repos)
-	if err1 != nil {
-		return nil, err
+func (s *AgentController) CreateRepo(ctx context.Context, executor CIExecutor, repo string) error {
+	if err := executor.PrepareRepo(ctx, repo); err != nil {
+		klog.Errorf("创建 repo(%s) 失败 %v", repo, err)
+		return err
 	}
-
-	return repos, nil
+	return nil
 }
 
-func (s *AgentController) GetGithubRepo(ctx context.Context, req *types.CallGithubRequest) ([]byte, error) {
-	return nil, nil
-}
-
-func (s *AgentController) CreateGithubRepo(ctx context.Context, req *types.CallGithubRequest) ([]byte, error) {
-	token, err := s.GetAgentToken(ctx)
+// GetTaskRun 获取任务流水线的状态，运行结束后附带日志
+func (s *AgentController) GetTaskRun(ctx context.Context, executor CIExecutor, taskId int64) ([]byte, error) {
+	run := newCIRun(s.baseDir, taskId)
+	result, err := executor.GetRun(ctx, run)
 	if err != nil {
 		return nil, err
 	}
 
-	// 创建 github 项目
-	body, err := util.BuildHttpBody(map[string]interface{}{"name": req.Repo, "private": true})
-	if err != nil {
-		return nil, err
-	}
-	httpClient := util.HttpClientV2{URL: types.GithubAPIBase + "/user/repos"}
-	err1 := httpClient.Method(http.MethodPost).
-		WithTimeout(30 * time.Second).
-		WithHeader(map[string]string{
-			"Content-Type":         "application/json",
-			"Accept":               "application/vnd.github+json",
-			"Authorization":        fmt.Sprintf("Bearer %s", token),
-			"X-GitHub-Api-Version": "2022-11-28",
-		}).
-		WithBody(body).
-		Do(nil)
-	if err1 != nil {
-		klog.Errorf("创建 repo(%s) 失败 %v", s.name, err1)
-		return nil, err1
+	if result.Status == types.CIRunSucceeded || result.Status == types.CIRunFailed {
+		logs, err := executor.GetRunLogs(ctx, run, result)
+		if err != nil {
+			klog.Warningf("获取任务(%d)流水线日志失败 %v", taskId, err)
+			result.Logs = err.Error()
+		} else {
+			result.Logs = logs
+		}
 	}
-
-	return nil, nil
+	return json.Marshal(result)
 }
 
 func (s *AgentController) ProcessKubernetesTags(ctx context.Context, req *types.CallKubernetesTagRequest) ([]byte, error) {
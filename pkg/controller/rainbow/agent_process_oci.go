@@ -0,0 +1,509 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	ociTagsPageSize = 1000
+
+	mediaTypeOCIIndex            = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest         = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifestV2    = "application/vnd.docker.distribution.manifest.v2+json"
+	ociManifestAcceptHeaderValue = mediaTypeOCIIndex + "," + mediaTypeOCIManifest + "," + mediaTypeDockerManifestList + "," + mediaTypeDockerManifestV2
+)
+
+var (
+	linkNextRegexp  = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+	challengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// ociTagList /v2/<name>/tags/list 返回结构
+type ociTagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ociManifest 兼容 OCI index/manifest 和 docker manifest list/v2
+type ociManifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Manifests     []types.Manifest `json:"manifests,omitempty"`
+	Config        ociDescriptor    `json:"config"`
+	Layers        []ociDescriptor  `json:"layers,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+func (m ociManifest) isIndex() bool {
+	return m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerManifestList || len(m.Manifests) != 0
+}
+
+// ociClient 通用 OCI distribution 客户端，支持匿名 token 认证
+type ociClient struct {
+	registry types.OCIRegistry
+	client   *http.Client
+	tokens   map[string]string
+}
+
+func newOCIClient(reg types.OCIRegistry) *ociClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if reg.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &ociClient{
+		registry: reg,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		tokens:   make(map[string]string),
+	}
+}
+
+// do 发起请求，遇到 401 时根据 WWW-Authenticate 获取 token 后重试一次
+func (c *ociClient) do(ctx context.Context, method string, u string, repo string, header map[string]string) (*http.Response, error) {
+	resp, err := c.doOnce(ctx, method, u, repo, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err = c.authorize(ctx, challenge, repo); err != nil {
+		return nil, err
+	}
+	return c.doOnce(ctx, method, u, repo, header)
+}
+
+func (c *ociClient) doOnce(ctx context.Context, method string, u string, repo string, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if token, ok := c.tokens[repo]; ok {
+		req.Header.Set("Authorization", token)
+	} else if len(c.registry.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.registry.Token)
+	} else if len(c.registry.Username) != 0 {
+		req.SetBasicAuth(c.registry.Username, c.registry.Password)
+	}
+
+	return c.client.Do(req)
+}
+
+// authorize 解析认证挑战，Bearer 则向 realm 申请 pull 权限的 token
+func (c *ociClient) authorize(ctx context.Context, challenge string, repo string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "bearer":
+	case "basic":
+		if len(c.registry.Username) == 0 {
+			return fmt.Errorf("镜像源(%s)需要账号认证", c.registry.Name)
+		}
+		return fmt.Errorf("镜像源(%s)账号认证失败", c.registry.Name)
+	default:
+		return fmt.Errorf("镜像源(%s)不支持的认证方式(%s)", c.registry.Name, challenge)
+	}
+
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return fmt.Errorf("镜像源(%s)认证信息缺少 realm", c.registry.Name)
+	}
+	query := url.Values{}
+	if service := params["service"]; len(service) != 0 {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", repo))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if len(c.registry.Username) != 0 {
+		req.SetBasicAuth(c.registry.Username, c.registry.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("获取镜像源(%s) token 失败 error resp %s", c.registry.Name, resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return err
+	}
+	token := tokenResp.Token
+	if len(token) == 0 {
+		token = tokenResp.AccessToken
+	}
+	if len(token) == 0 {
+		return fmt.Errorf("镜像源(%s)返回空 token", c.registry.Name)
+	}
+
+	c.tokens[repo] = "Bearer " + token
+	return nil
+}
+
+// PullToken 使用账号申请仓库的 pull token，镜像源允许匿名访问时返回空
+func (c *ociClient) PullToken(ctx context.Context, repo string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.registry.Endpoint+"/v2/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if scheme, _ := parseChallenge(challenge); !strings.EqualFold(scheme, "bearer") {
+		return "", fmt.Errorf("镜像源(%s)不支持 token 认证，无法申请仓库级 token", c.registry.Name)
+	}
+	if err = c.authorize(ctx, challenge, repo); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(c.tokens[repo], "Bearer "), nil
+}
+
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+	for _, match := range challengeRegexp.FindAllStringSubmatch(parts[1], -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	return parts[0], params
+}
+
+// ListTags 获取镜像全部 tag，按 Link 头分页
+func (c *ociClient) ListTags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+
+	next := fmt.Sprintf("%s/v2/%s/tags/list?n=%d", c.registry.Endpoint, repo, ociTagsPageSize)
+	for len(next) != 0 {
+		resp, err := c.do(ctx, http.MethodGet, next, repo, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error resp %s", resp.Status)
+		}
+
+		var tl ociTagList
+		err = json.NewDecoder(resp.Body).Decode(&tl)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tl.Tags...)
+
+		next = ""
+		if match := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link")); len(match) == 2 {
+			next = match[1]
+			if strings.HasPrefix(next, "/") {
+				next = c.registry.Endpoint + next
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+// GetJSON 获取镜像源扩展接口的 JSON 结果，如 gcr 带 manifest 信息的 tags/list
+func (c *ociClient) GetJSON(ctx context.Context, u string, repo string, val interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, u, repo, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error resp %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(val)
+}
+
+// HeadManifest 通过 HEAD 请求获取 manifest 的 digest 和大小
+func (c *ociClient) HeadManifest(ctx context.Context, repo string, reference string) (string, int64, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.registry.Endpoint, repo, reference)
+	resp, err := c.do(ctx, http.MethodHead, u, repo, map[string]string{"Accept": ociManifestAcceptHeaderValue})
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("error resp %s", resp.Status)
+	}
+
+	return resp.Header.Get("Docker-Content-Digest"), resp.ContentLength, nil
+}
+
+// GetManifest 获取 manifest 内容及 digest
+func (c *ociClient) GetManifest(ctx context.Context, repo string, reference string) (*ociManifest, string, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", c.registry.Endpoint, repo, reference)
+	resp, err := c.do(ctx, http.MethodGet, u, repo, map[string]string{"Accept": ociManifestAcceptHeaderValue})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error resp %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var m ociManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, "", err
+	}
+	if len(m.MediaType) == 0 {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+	return &m, digest, nil
+}
+
+// GetBlob 获取 JSON 格式的 blob，如镜像 config，blob 可能重定向到对象存储
+func (c *ociClient) GetBlob(ctx context.Context, repo string, digest string, val interface{}) error {
+	return c.GetJSON(ctx, fmt.Sprintf("%s/v2/%s/blobs/%s", c.registry.Endpoint, repo, digest), repo, val)
+}
+
+// ociRepoName 通用镜像源不区分命名空间，拼接为完整的仓库名
+func ociRepoName(req *types.CallSearchRequest) string {
+	if len(req.Namespace) == 0 {
+		return req.Repository
+	}
+	return req.Namespace + "/" + req.Repository
+}
+
+// sortOCITags 通用镜像源的 tag 不带时间信息，按版本号倒序，无法解析的版本排在后面
+func sortOCITags(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, erri := version.ParseGeneric(tags[i])
+		vj, errj := version.ParseGeneric(tags[j])
+		switch {
+		case erri == nil && errj == nil:
+			if vi.EqualTo(vj) {
+				return tags[i] > tags[j]
+			}
+			return vj.LessThan(vi)
+		case erri == nil:
+			return true
+		case errj == nil:
+			return false
+		default:
+			return tags[i] > tags[j]
+		}
+	})
+}
+
+// ociProvider 通用 OCI distribution 镜像源，不支持搜索仓库
+type ociProvider struct {
+	registry types.OCIRegistry
+}
+
+func (p *ociProvider) SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error) {
+	return nil, fmt.Errorf("镜像源(%s)不支持搜索仓库", p.registry.Name)
+}
+
+func (p *ociProvider) ListTags(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagResult, error) {
+	repo := ociRepoName(req)
+	query, arch := tagSearchOption(req)
+	klog.Infof("搜索镜像源(%s)镜像(%s) tags", p.registry.Name, repo)
+
+	client := newOCIClient(p.registry)
+	allTags, err := client.ListTags(ctx, repo)
+	if err != nil {
+		klog.Errorf("获取镜像(%s) tags 失败 %v", repo, err)
+		return nil, err
+	}
+
+	// tags/list 不支持按名称过滤，对已查询结果进行过滤
+	var tags []string
+	for _, tag := range allTags {
+		if len(query) != 0 && !strings.Contains(tag, query) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sortOCITags(tags)
+
+	var cts []types.CommonTag
+	for _, tag := range PaginateTagSlice(tags, req.Page, req.PageSize) {
+		ct, err := buildCommonTagForOCI(ctx, client, repo, types.CommonTag{Name: tag}, arch)
+		if err != nil {
+			klog.Warningf("获取镜像(%s:%s) manifest 失败 %v", repo, tag, err)
+			continue
+		}
+		if ct == nil {
+			continue
+		}
+		cts = append(cts, *ct)
+	}
+
+	return &types.CommonSearchTagResult{
+		Hub:        req.Hub,
+		Namespace:  req.Namespace,
+		Repository: req.Repository,
+		Total:      len(tags),
+		PageSize:   req.PageSize,
+		Page:       req.Page,
+		TagResult:  cts,
+	}, nil
+}
+
+func (p *ociProvider) GetTagInfo(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagInfoResult, error) {
+	return getOCITagInfo(ctx, newOCIClient(p.registry), ociRepoName(req), req.Tag)
+}
+
+// GetRepository 通用镜像源没有仓库元数据，仅确认仓库存在
+func (p *ociProvider) GetRepository(ctx context.Context, req *types.CallSearchRequest) (*types.CommonRepositoryResult, error) {
+	repo := ociRepoName(req)
+	if _, err := newOCIClient(p.registry).ListTags(ctx, repo); err != nil {
+		return nil, err
+	}
+	return &types.CommonRepositoryResult{Hub: req.Hub, Namespace: req.Namespace, Name: req.Repository}, nil
+}
+
+// buildCommonTagForOCI 补全 tag 的 digest 和大小，未指定架构且没有 digest 时仅 HEAD 获取，
+// 其他情况需获取 manifest，指定架构时过滤不包含该架构的 tag，不匹配返回 nil
+func buildCommonTagForOCI(ctx context.Context, client *ociClient, repo string, ct types.CommonTag, arch string) (*types.CommonTag, error) {
+	if len(arch) == 0 && ct.Size != 0 && len(ct.ManifestDigest) != 0 {
+		return &ct, nil
+	}
+	if len(arch) == 0 && len(ct.ManifestDigest) == 0 {
+		digest, size, err := client.HeadManifest(ctx, repo, ct.Name)
+		if err != nil {
+			return nil, err
+		}
+		ct.ManifestDigest = digest
+		if ct.Size == 0 {
+			ct.Size = size
+		}
+		return &ct, nil
+	}
+
+	m, digest, err := client.GetManifest(ctx, repo, ct.Name)
+	if err != nil {
+		return nil, err
+	}
+	images := buildImagesForOCI(m)
+	// 单架构镜像无法从 manifest 直接判断架构，保留
+	if m.isIndex() && !matchImageArch(arch, images) {
+		return nil, nil
+	}
+
+	ct.ManifestDigest, ct.Images = digest, images
+	if ct.Size == 0 {
+		ct.Size = manifestSize(m)
+	}
+	return &ct, nil
+}
+
+func getOCITagInfo(ctx context.Context, client *ociClient, repo string, tag string) (*types.CommonSearchTagInfoResult, error) {
+	m, digest, err := client.GetManifest(ctx, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.CommonSearchTagInfoResult{
+		Name:     tag,
+		FullSize: manifestSize(m),
+		Digest:   digest,
+		Images:   buildImagesForOCI(m),
+	}, nil
+}
+
+func buildImagesForOCI(m *ociManifest) []types.Image {
+	var images []types.Image
+	for _, mf := range m.Manifests {
+		// 忽略 attestation 等非镜像 manifest
+		if mf.Platform.OS == "unknown" {
+			continue
+		}
+		images = append(images, types.Image{
+			Digest:       mf.Digest,
+			OS:           mf.Platform.OS,
+			Architecture: mf.Platform.Architecture,
+			Variant:      mf.Platform.Variant,
+			OSVersion:    mf.Platform.OSVersion,
+			Size:         int64(mf.Size),
+		})
+	}
+	return images
+}
+
+func matchImageArch(arch string, images []types.Image) bool {
+	parts := strings.Split(arch, "/")
+	if len(parts) < 2 {
+		return true
+	}
+	for _, image := range images {
+		if image.OS == parts[0] && image.Architecture == parts[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func manifestSize(m *ociManifest) int64 {
+	var size int64
+	if m.isIndex() {
+		for _, mf := range m.Manifests {
+			size += int64(mf.Size)
+		}
+		return size
+	}
+
+	size = m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size
+}
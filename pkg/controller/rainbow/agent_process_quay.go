@@ -0,0 +1,139 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+// quay api 的最后修改时间格式
+const quayTimeLayout = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// quayProvider 通过 quay api 搜索仓库和 tag，manifest 通过 registry 接口获取
+// https://docs.projectquay.io/api_quay.html
+type quayProvider struct {
+	registry types.OCIRegistry
+}
+
+func (p *quayProvider) get(u string, val interface{}) error {
+	httpClient := util.HttpClientV2{URL: p.registry.Endpoint + "/api/v1" + u}
+	if err := httpClient.Method(http.MethodGet).WithTimeout(30 * time.Second).Do(val); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *quayProvider) SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error) {
+	klog.Infof("搜索 quay.io 镜像 %v", req.Query)
+
+	var quayResult types.SearchQuayResult
+	if err := p.get(fmt.Sprintf("/find/repositories?query=%s&page=%d", url.QueryEscape(req.Query), req.Page), &quayResult); err != nil {
+		return nil, err
+	}
+
+	var css []types.CommonSearchRepositoryResult
+	for _, rep := range quayResult.Results {
+		if rep.Kind != "" && rep.Kind != "repository" {
+			continue
+		}
+		css = append(css, types.CommonSearchRepositoryResult{
+			Name:         fmt.Sprintf("%s/%s", rep.Namespace.Name, rep.Name),
+			Registry:     req.Hub,
+			ShortDesc:    rep.Description,
+			Stars:        rep.Stars,
+			LastModified: rep.LastModified,
+		})
+	}
+	return css, nil
+}
+
+func (p *quayProvider) ListTags(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagResult, error) {
+	repo := ociRepoName(req)
+	query, arch := tagSearchOption(req)
+	klog.Infof("搜索 quay.io 镜像(%s) tags, arch %s query %s", repo, arch, query)
+
+	u := fmt.Sprintf("/repository/%s/tag/?page=%d&limit=%d&onlyActiveTags=true", repo, req.Page, req.PageSize)
+	if len(query) != 0 {
+		switch req.SearchType {
+		case types.AccurateSearch:
+			u = fmt.Sprintf("%s&specificTag=%s", u, url.QueryEscape(query))
+		default:
+			// 默认模糊搜索
+			u = fmt.Sprintf("%s&filter_tag_name=%s", u, url.QueryEscape("like:"+query))
+		}
+	}
+	var tagResult types.QuaySearchTagResult
+	if err := p.get(u, &tagResult); err != nil {
+		return nil, err
+	}
+
+	client := newOCIClient(p.registry)
+	var cts []types.CommonTag
+	for _, t := range tagResult.Tags {
+		ct := types.CommonTag{Name: t.Name, ManifestDigest: t.ManifestDigest}
+		if t.Size != nil {
+			ct.Size = *t.Size
+		}
+		if pt, err := time.Parse(quayTimeLayout, t.LastModified); err == nil {
+			ct.LastModified = pt.String()
+		}
+
+		// 多架构镜像 quay 不返回大小，需从 manifest 获取
+		if len(arch) != 0 || t.IsManifestList {
+			tag, err := buildCommonTagForOCI(ctx, client, repo, ct, arch)
+			if err != nil {
+				klog.Warningf("获取镜像(%s:%s) manifest 失败 %v", repo, t.Name, err)
+				continue
+			}
+			if tag == nil {
+				continue
+			}
+			ct = *tag
+		}
+		cts = append(cts, ct)
+	}
+
+	// quay 不返回总数，存在下一页时总数加一以便继续翻页
+	total := (req.Page-1)*req.PageSize + len(tagResult.Tags)
+	if tagResult.HasAdditional {
+		total++
+	}
+	return &types.CommonSearchTagResult{
+		Hub:        req.Hub,
+		Namespace:  req.Namespace,
+		Repository: req.Repository,
+		Total:      total,
+		PageSize:   req.PageSize,
+		Page:       req.Page,
+		TagResult:  cts,
+	}, nil
+}
+
+func (p *quayProvider) GetTagInfo(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagInfoResult, error) {
+	return getOCITagInfo(ctx, newOCIClient(p.registry), ociRepoName(req), req.Tag)
+}
+
+func (p *quayProvider) GetRepository(ctx context.Context, req *types.CallSearchRequest) (*types.CommonRepositoryResult, error) {
+	var repo types.QuayRepositoryResult
+	if err := p.get(fmt.Sprintf("/repository/%s?includeTags=false", ociRepoName(req)), &repo); err != nil {
+		return nil, err
+	}
+
+	result := &types.CommonRepositoryResult{
+		Hub:       req.Hub,
+		Namespace: repo.Namespace,
+		Name:      repo.Name,
+		IsPrivate: !repo.IsPublic,
+	}
+	if repo.Description != nil {
+		result.Description = *repo.Description
+	}
+	return result, nil
+}
@@ -5,103 +5,103 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"k8s.io/klog/v2"
 
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
 	"github.com/caoyingjunz/rainbow/pkg/types"
 	"github.com/caoyingjunz/rainbow/pkg/util"
 )
 
-func (s *AgentController) ProcessSearch(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	switch req.TargetType {
-	case types.SearchTypeRepo:
-		return s.SearchRepositories(ctx, req)
-	case types.SearchTypeTag:
-		return s.SearchRepositoryTags(ctx, req)
-	case types.SearchTypeTagInfo:
-		return s.GetRepositoryTagInfo(ctx, req)
-	case types.GetTypeRepo:
-		// 获取镜像具体信息
-		return s.GetRepository(ctx, req)
-	}
-
-	return nil, fmt.Errorf("unsupported search target type")
+// HubProvider 镜像源的搜索能力，不同镜像源的结果统一为 CommonSearch* 结构返回给 server
+type HubProvider interface {
+	// SearchRepositories 按关键字搜索仓库
+	SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error)
+	// ListTags 分页获取仓库的 tag，指定架构时过滤不包含该架构的 tag
+	ListTags(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagResult, error)
+	// GetTagInfo 获取 tag 详情，包含各架构的 digest 和大小
+	GetTagInfo(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagInfoResult, error)
+	// GetRepository 获取仓库信息
+	GetRepository(ctx context.Context, req *types.CallSearchRequest) (*types.CommonRepositoryResult, error)
 }
 
-func (s *AgentController) SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	var (
-		css []types.CommonSearchRepositoryResult
-		err error
-	)
-
-	switch req.Hub {
-	case types.ImageHubDocker:
-		css, err = s.SearchDockerHubRepositories(ctx, req)
-	default:
-		return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
+// hubProvider 根据镜像源选择实现，非 dockerhub 的镜像源由 server 下发 registry 配置
+func (s *AgentController) hubProvider(req *types.CallSearchRequest) (HubProvider, error) {
+	if req.Hub == types.ImageHubDocker {
+		return &dockerhubProvider{s: s}, nil
 	}
-	if err != nil {
-		return nil, err
+	if req.Registry == nil {
+		return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
 	}
 
-	return json.Marshal(css)
-}
-
-func (s *AgentController) GetRepository(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	switch req.Hub {
-	case types.ImageHubDocker:
-		return s.GetDockerRepository(ctx, req)
+	host := req.Registry.Endpoint
+	if u, err := url.Parse(req.Registry.Endpoint); err == nil && len(u.Host) != 0 {
+		host = u.Host
 	}
-
-	return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
+	switch {
+	case host == types.ImageHubQuay:
+		return &quayProvider{registry: *req.Registry}, nil
+	case host == types.ImageHubGCR || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev"):
+		return &gcrProvider{registry: *req.Registry}, nil
+	}
+	return &ociProvider{registry: *req.Registry}, nil
 }
 
-func (s *AgentController) GetDockerRepository(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	klog.Infof("获取 dockerhub 镜像 %s/%s", req.Namespace, req.Repository)
-	url := fmt.Sprintf("https://hub.docker.com/v2/namespaces/%s/repositories/%s", req.Namespace, req.Repository)
-
-	var searchResp types.GetRepositoryResult
-	httpClient := util.HttpClientV2{URL: url}
-	err := httpClient.Method(http.MethodGet).
-		WithTimeout(30 * time.Second).
-		Do(&searchResp)
+func (s *AgentController) ProcessSearch(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
+	provider, err := s.hubProvider(req)
 	if err != nil {
 		return nil, err
 	}
 
-	return json.Marshal(searchResp)
-}
-
-func (s *AgentController) SearchRepositoryTags(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	switch req.Hub {
-	case types.ImageHubDocker:
-		return s.SearchDockerhubTags(ctx, req)
+	var result interface{}
+	switch req.TargetType {
+	case types.SearchTypeRepo:
+		result, err = provider.SearchRepositories(ctx, req)
+	case types.SearchTypeTag:
+		result, err = provider.ListTags(ctx, req)
+	case types.SearchTypeTagInfo:
+		result, err = provider.GetTagInfo(ctx, req)
+	case types.GetTypeRepo:
+		// 获取镜像具体信息
+		result, err = provider.GetRepository(ctx, req)
+	case types.InspectTypeTag:
+		result, err = s.InspectTag(ctx, req)
+	default:
+		return nil, fmt.Errorf("unsupported search target type")
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
+	return json.Marshal(result)
 }
 
-func (s *AgentController) GetRepositoryTagInfo(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	switch req.Hub {
-	case types.ImageHubDocker:
-		return s.GetDockerhubTagInfo(ctx, req)
+// tagSearchOption 获取 tag 搜索的过滤条件，订阅场景的策略优先于查询条件
+func tagSearchOption(req *types.CallSearchRequest) (string, string) {
+	query, arch := req.Query, ""
+	if req.CustomConfig != nil {
+		if len(req.CustomConfig.Policy) != 0 {
+			query = req.CustomConfig.Policy
+		}
+		arch = req.CustomConfig.Arch
 	}
+	return query, arch
+}
 
-	return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
+// dockerhubProvider 通过 hub api 搜索 dockerhub，使用账号池分配的账号认证
+type dockerhubProvider struct {
+	s *AgentController
 }
 
-func (s *AgentController) SearchDockerHubRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error) {
+func (p *dockerhubProvider) SearchRepositories(ctx context.Context, req *types.CallSearchRequest) ([]types.CommonSearchRepositoryResult, error) {
 	klog.Infof("搜索 dockerhub 镜像 %v", req.Query)
 
-	url := fmt.Sprintf("https://hub.docker.com/v2/search/repositories?query=%s&page=%d&page_size=%d", req.Query, req.Page, req.PageSize)
+	u := fmt.Sprintf("https://hub.docker.com/v2/search/repositories?query=%s&page=%d&page_size=%d", url.QueryEscape(req.Query), req.Page, req.PageSize)
 	var searchResp types.HubSearchResponse
-	httpClient := util.HttpClientV2{URL: url}
-	err := httpClient.Method(http.MethodGet).
-		WithTimeout(30 * time.Second).
-		Do(&searchResp)
-	if err != nil {
+	if err := p.s.dockerhubGet(ctx, u, &searchResp); err != nil {
 		return nil, err
 	}
 
@@ -121,102 +121,115 @@ func (s *AgentController) SearchDockerHubRepositories(ctx context.Context, req *
 	return css, nil
 }
 
-func (s *AgentController) SearchDockerhubTags(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	// https://docs.docker.com/reference/api/registry/latest/#tag/Manifests
+func (p *dockerhubProvider) ListTags(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagResult, error) {
 	// https://docs.docker.com/reference/api/hub/latest/#tag/repositories/operation/GetRepositoryTag
-	// repo=langgenius/dify-api
-	// token="$(curl -fsSL "https://auth.docker.io/token?service=registry.docker.io&scope=repository:$repo:pull" | jq --raw-output '.token')"
-	// curl -s -H "Authorization: Bearer $token" "https://registry-1.docker.io/v2/$repo/tags/list"
-	// curl -H "Authorization: Bearer $token" -H "Accept: application/vnd.docker.distribution.manifest.v2+json" https://registry-1.docker.io/v2/$repo/manifests/latest
-
-	// 获取 token
 	repo := fmt.Sprintf("%s/%s", req.Namespace, req.Repository)
-	klog.Infof("搜索 dockerhub 镜像(%s) tags", repo)
-
-	arch := ""
-	if req.CustomConfig != nil {
-		if len(req.CustomConfig.Policy) != 0 {
-			req.Query = req.CustomConfig.Policy
-		}
-		if len(req.CustomConfig.Arch) != 0 {
-			arch = req.CustomConfig.Arch
-		}
-	}
-	klog.Infof("arch %s query %s", arch, req.Query)
+	query, arch := tagSearchOption(req)
+	klog.Infof("搜索 dockerhub 镜像(%s) tags, arch %s query %s", repo, arch, query)
 
 	var ds types.HubTagResponse
-	url := fmt.Sprintf("https://hub.docker.com/v2/namespaces/%s/repositories/%s/tags?page=%d&page_size=%d&name=%s", req.Namespace, req.Repository, req.Page, req.PageSize, req.Query)
-	klog.Infof("url %s", url)
-	httpClient := util.HttpClientV2{URL: url}
-	if err := httpClient.Method(http.MethodGet).
-		WithTimeout(30 * time.Second).
-		Do(&ds); err != nil {
+	u := fmt.Sprintf("https://hub.docker.com/v2/namespaces/%s/repositories/%s/tags?page=%d&page_size=%d&name=%s", req.Namespace, req.Repository, req.Page, req.PageSize, url.QueryEscape(query))
+	if err := p.s.dockerhubGet(ctx, u, &ds); err != nil {
 		klog.Errorf("获取镜像tags失败 %v", err)
 		return nil, err
 	}
 
 	// arch 不支持直接 API 查询，对已查询结果进行过滤
-	return json.Marshal(types.CommonSearchTagResult{
+	var cts []types.CommonTag
+	for _, t := range ds.Results {
+		if len(arch) != 0 && !matchImageArch(arch, t.Images) {
+			continue
+		}
+		cts = append(cts, types.CommonTag{
+			Name:           t.Name,
+			Size:           t.FullSize,
+			LastModified:   t.LastUpdated.String(),
+			ManifestDigest: t.Digest,
+			Images:         t.Images,
+		})
+	}
+
+	return &types.CommonSearchTagResult{
 		Hub:        types.ImageHubDocker,
 		Namespace:  req.Namespace,
 		Repository: req.Repository,
 		Total:      ds.Count,
 		PageSize:   req.PageSize,
 		Page:       req.Page,
-		TagResult:  s.buildCommonTagForDockerhub(s.FilterTagsByArch(arch, ds.Results)),
-	})
+		TagResult:  cts,
+	}, nil
 }
 
-func (s *AgentController) FilterTagsByArch(arch string, tags []types.TagResult) []types.TagResult {
-	if len(arch) == 0 {
-		return tags
-	}
+func (p *dockerhubProvider) GetTagInfo(ctx context.Context, req *types.CallSearchRequest) (*types.CommonSearchTagInfoResult, error) {
+	u := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/%s/tags/%s/", req.Namespace, req.Repository, req.Tag)
 
-	parts := strings.Split(arch, "/")
-	if len(parts) != 2 {
-		return tags
+	var tagInfo types.SearchDockerhubTagInfoResult
+	if err := p.s.dockerhubGet(ctx, u, &tagInfo); err != nil {
+		return nil, err
 	}
-	os, architecture := parts[0], parts[1]
 
-	var filterTags []types.TagResult
-	for _, tag := range tags {
-		for _, image := range tag.Images {
-			if image.Architecture == architecture && image.OS == os {
-				filterTags = append(filterTags, tag)
-			}
-		}
-	}
-	return filterTags
+	return &types.CommonSearchTagInfoResult{
+		Name:     req.Tag,
+		FullSize: tagInfo.FullSize,
+		Digest:   tagInfo.Digest,
+		Images:   tagInfo.Images,
+	}, nil
 }
 
-func (s *AgentController) GetDockerhubTagInfo(ctx context.Context, req *types.CallSearchRequest) ([]byte, error) {
-	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/%s/tags/%s/", req.Namespace, req.Repository, req.Tag)
+func (p *dockerhubProvider) GetRepository(ctx context.Context, req *types.CallSearchRequest) (*types.CommonRepositoryResult, error) {
+	klog.Infof("获取 dockerhub 镜像 %s/%s", req.Namespace, req.Repository)
+	u := fmt.Sprintf("https://hub.docker.com/v2/namespaces/%s/repositories/%s", req.Namespace, req.Repository)
 
-	var searchDockerhubImageResult types.SearchDockerhubTagInfoResult
-	httpClient := util.HttpClientV2{URL: url}
-	if err := httpClient.Method(http.MethodGet).WithTimeout(30 * time.Second).Do(&searchDockerhubImageResult); err != nil {
+	var repo types.GetRepositoryResult
+	if err := p.s.dockerhubGet(ctx, u, &repo); err != nil {
 		return nil, err
 	}
 
-	return json.Marshal(types.CommonSearchTagInfoResult{
-		Name:     req.Tag,
-		FullSize: searchDockerhubImageResult.FullSize,
-		Digest:   searchDockerhubImageResult.Digest,
-		Images:   searchDockerhubImageResult.Images,
-	})
+	return &types.CommonRepositoryResult{
+		Hub:          types.ImageHubDocker,
+		Namespace:    repo.Namespace,
+		Name:         repo.Name,
+		Description:  repo.Description,
+		IsPrivate:    repo.IsPrivate,
+		StarCount:    repo.StarCount,
+		PullCount:    repo.PullCount,
+		LastModified: repo.LastModified,
+		Categories:   repo.Categories,
+	}, nil
 }
 
-func (s *AgentController) buildCommonTagForDockerhub(tags []types.TagResult) []types.CommonTag {
-	var cts []types.CommonTag
-	for _, t := range tags {
-		cts = append(cts, types.CommonTag{
-			Name:           t.Name,
-			Size:           t.FullSize,
-			LastModified:   t.LastUpdated.String(),
-			ManifestDigest: t.Digest,
-			Images:         t.Images,
-		})
+// dockerhubGet 使用账号池分配的账号访问 hub api，没有可用账号时匿名访问，并上报响应头中的剩余次数
+func (s *AgentController) dockerhubGet(ctx context.Context, url string, val interface{}) error {
+	account, err := s.backend.AcquireAccount(ctx, model.DockerhubAccountType)
+	if err != nil {
+		klog.V(1).Infof("未分配到 dockerhub 账号，使用匿名访问: %v", err)
+		account = nil
+	}
+
+	var header http.Header
+	httpClient := util.HttpClientV2{URL: url}
+	httpClient.Method(http.MethodGet).WithTimeout(30 * time.Second).WithResponseHeader(&header)
+	if account != nil && len(account.Token) != 0 {
+		httpClient.WithHeader(map[string]string{"Authorization": "Bearer " + account.Token})
 	}
+	httpErr := httpClient.Do(val)
 
-	return cts
+	if account != nil {
+		usage, ok := parseRateLimitHeader(header)
+		if !ok && httpErr != nil && httpErr.Code == http.StatusTooManyRequests {
+			usage, ok = &types.ReportAccountUsageRequest{Remaining: 0}, true
+		}
+		if ok {
+			go func(accountId int64) {
+				if err := s.backend.ReportAccountUsage(context.Background(), accountId, usage); err != nil {
+					klog.Warningf("上报账号(%d)的剩余次数失败 %v", accountId, err)
+				}
+			}(account.Id)
+		}
+	}
+
+	if httpErr != nil {
+		return httpErr
+	}
+	return nil
 }
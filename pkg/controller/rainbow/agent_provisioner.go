@@ -0,0 +1,95 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/util/sshutil"
+)
+
+// agentProvisioner 管理 agent 的运行环境，按 agent 的 provisioner 选择
+type agentProvisioner interface {
+	// Install 刷新配置并重新部署 agent
+	Install(ctx context.Context, agent *model.Agent) error
+	// Uninstall 删除 agent 的运行环境
+	Uninstall(ctx context.Context, agent *model.Agent) error
+	Start(ctx context.Context, agent *model.Agent) error
+	Stop(ctx context.Context, agent *model.Agent) error
+	Restart(ctx context.Context, agent *model.Agent) error
+	// UpgradeBinary 仅升级 agent 程序，不刷新配置
+	UpgradeBinary(ctx context.Context, agent *model.Agent) error
+}
+
+func validateAgentProvisioner(provisioner string, rainbowdName string) error {
+	switch provisioner {
+	case "", model.SSHProvisioner:
+		return nil
+	case model.KubernetesProvisioner:
+		if len(rainbowdName) != 0 {
+			return fmt.Errorf("kubernetes 部署的 agent 无需指定 rainbowd")
+		}
+		return nil
+	default:
+		return fmt.Errorf("不支持的部署方式 %s", provisioner)
+	}
+}
+
+func (s *ServerController) agentProvisioner(ctx context.Context, agent *model.Agent) (agentProvisioner, error) {
+	switch agent.Provisioner {
+	case "", model.SSHProvisioner:
+		sshConfig, err := s.getRainbowdSSHConfig(ctx, agent.RainbowdName)
+		if err != nil {
+			return nil, err
+		}
+		return &sshProvisioner{s: s, sshConfig: sshConfig}, nil
+	case model.KubernetesProvisioner:
+		p, err := s.newKubernetesProvisioner()
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported provisioner %s", agent.Provisioner)
+	}
+}
+
+// sshProvisioner 通过 ssh 在 rainbowd 节点上以 docker 容器运行 agent
+type sshProvisioner struct {
+	s         *ServerController
+	sshConfig *sshutil.SSHConfig
+}
+
+func (p *sshProvisioner) Install(ctx context.Context, agent *model.Agent) error {
+	old, err := p.s.GetAgentContainer(p.sshConfig, agent.Name)
+	if err != nil {
+		return fmt.Errorf("获取 agent 容器失败 %v", err)
+	}
+	if old != nil {
+		// 先卸载原有容器，然后刷新配置，重新启动
+		if err = p.s.UninstallAgentContainer(p.sshConfig, agent); err != nil {
+			return fmt.Errorf("卸载 agent(%s) 失败 %v", agent.Name, err)
+		}
+	}
+	return p.s.InstallAgentContainer(p.sshConfig, agent)
+}
+
+func (p *sshProvisioner) Uninstall(ctx context.Context, agent *model.Agent) error {
+	return p.s.UninstallAgentContainer(p.sshConfig, agent)
+}
+
+func (p *sshProvisioner) Start(ctx context.Context, agent *model.Agent) error {
+	return p.s.StartAgentContainer(p.sshConfig, agent)
+}
+
+func (p *sshProvisioner) Stop(ctx context.Context, agent *model.Agent) error {
+	return p.s.StopAgentContainer(p.sshConfig, agent)
+}
+
+func (p *sshProvisioner) Restart(ctx context.Context, agent *model.Agent) error {
+	return p.s.RestartAgentContainer(p.sshConfig, agent)
+}
+
+func (p *sshProvisioner) UpgradeBinary(ctx context.Context, agent *model.Agent) error {
+	return p.s.UpgradeAgentBinaryContainer(p.sshConfig, agent)
+}
@@ -0,0 +1,532 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+const (
+	defaultAgentNamespace = "rainbow"
+
+	agentAppLabel        = "rainbow-agent"
+	agentWorkloadLabel   = "rainbow.io/agent"
+	agentConfigHashKey   = "rainbow.io/config-hash"
+	agentRestartedAtKey  = "rainbow.io/restartedAt"
+	agentConfigMountPath = "/etc/rainbow"
+	agentBootstrapPath   = "/etc/rainbow-bootstrap"
+	agentDataPath        = "/data"
+
+	// agent 镜像中的程序路径，bootstrap 时拷贝到数据目录，与 ssh 部署的 /data/agent 保持一致
+	agentImageBinaryPath = "/usr/local/bin/agent"
+
+	defaultAgentStorageSize = "10Gi"
+
+	agentWorkloadSyncInterval = 60 * time.Second
+)
+
+// agentBootstrapScript 拷贝镜像中的 agent 程序，初始化 plugin 仓库，git 用户写入仓库配置，任务目录拷贝后仍然有效
+const agentBootstrapScript = `set -e
+if [ ! -x ` + agentImageBinaryPath + ` ]; then
+  echo "agent 镜像中不存在 ` + agentImageBinaryPath + `" >&2
+  exit 1
+fi
+cp ` + agentImageBinaryPath + ` /data/agent
+chmod 0755 /data/agent
+if [ ! -d /data/plugin/.git ]; then
+  git init /data/plugin
+fi
+cp /etc/rainbow/git-config /data/plugin/.git/config
+git -C /data/plugin config user.name "$GIT_USER"
+git -C /data/plugin config user.email "$GIT_EMAIL"
+git -C /data/plugin pull origin "$GIT_REF"
+`
+
+var (
+	kubeClientLock sync.Mutex
+	kubeClient     kubernetes.Interface
+)
+
+// kubernetesClient 获取部署 agent 的集群客户端，ServerController 每次调用都会重建，客户端在进程内复用
+func (s *ServerController) kubernetesClient() (kubernetes.Interface, error) {
+	kubeClientLock.Lock()
+	defer kubeClientLock.Unlock()
+
+	if kubeClient != nil {
+		return kubeClient, nil
+	}
+
+	var (
+		restConfig *rest.Config
+		err        error
+	)
+	if kubeconfig := s.cfg.Rainbowd.Kubernetes.Kubeconfig; len(kubeconfig) != 0 {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("加载 kubernetes 配置失败 %v", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeClient = client
+	return kubeClient, nil
+}
+
+// kubernetesProvisioner 以 Deployment 运行 agent，配置文件和仓库凭证保存在 Secret 中，数据目录使用 PVC
+type kubernetesProvisioner struct {
+	s         *ServerController
+	client    kubernetes.Interface
+	namespace string
+	command   []string
+
+	storageClass string
+	storageSize  string
+}
+
+func (s *ServerController) newKubernetesProvisioner() (*kubernetesProvisioner, error) {
+	client, err := s.kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	opt := s.cfg.Rainbowd.Kubernetes
+	p := &kubernetesProvisioner{s: s, client: client, namespace: opt.Namespace, command: opt.Command, storageClass: opt.StorageClass, storageSize: opt.StorageSize}
+	if len(p.namespace) == 0 {
+		p.namespace = defaultAgentNamespace
+	}
+	if len(p.command) == 0 {
+		p.command = []string{agentDataPath + "/agent", "--configFile", agentConfigMountPath + "/config.yaml"}
+	}
+	if len(p.storageSize) == 0 {
+		p.storageSize = defaultAgentStorageSize
+	}
+	return p, nil
+}
+
+// agentWorkloadName 将 agent 名称转换为合法的 kubernetes 资源名称
+func agentWorkloadName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	workload := strings.Trim(agentAppLabel+"-"+b.String(), "-")
+	if len(workload) > 63 {
+		workload = strings.TrimRight(workload[:63], "-")
+	}
+	return workload
+}
+
+// agentDeployImage 指定 agent 版本时以版本作为镜像 tag，升级时滚动更新镜像
+func (s *ServerController) agentDeployImage(agent *model.Agent) string {
+	image := s.agentImage(agent)
+	if len(agent.BinaryVersion) == 0 {
+		return image
+	}
+	// 去除已有的 tag，端口中的冒号不处理
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + agent.BinaryVersion
+}
+
+// agentCIRef plugin 仓库使用的分支
+func agentCIRef(agent *model.Agent) string {
+	if len(agent.CIRef) != 0 {
+		return agent.CIRef
+	}
+	return defaultCIRef
+}
+
+func (p *kubernetesProvisioner) objectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: p.namespace,
+		Labels:    map[string]string{"app": agentAppLabel, agentWorkloadLabel: name},
+	}
+}
+
+func (p *kubernetesProvisioner) Install(ctx context.Context, agent *model.Agent) error {
+	cfgData, err := p.s.renderAgentConfig(agent)
+	if err != nil {
+		return err
+	}
+	gitConfig, err := renderAgentGitConfig(agent)
+	if err != nil {
+		return err
+	}
+
+	name := agentWorkloadName(agent.Name)
+	if err = p.applySecret(ctx, &corev1.Secret{
+		ObjectMeta: p.objectMeta(name),
+		Type:       corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"config.yaml": cfgData,
+			"git-config":  gitConfig,
+		},
+	}); err != nil {
+		return fmt.Errorf("同步 agent(%s) secret 失败 %v", agent.Name, err)
+	}
+	if err = p.applyConfigMap(ctx, &corev1.ConfigMap{
+		ObjectMeta: p.objectMeta(name),
+		Data: map[string]string{
+			"bootstrap.sh": agentBootstrapScript,
+			"git-user":     agent.GithubUser,
+			"git-email":    agent.GithubEmail,
+			"git-ref":      agentCIRef(agent),
+		},
+	}); err != nil {
+		return fmt.Errorf("同步 agent(%s) configmap 失败 %v", agent.Name, err)
+	}
+	if err = p.ensurePVC(ctx, name); err != nil {
+		return fmt.Errorf("创建 agent(%s) 数据卷失败 %v", agent.Name, err)
+	}
+
+	// 配置变化时修改 pod 注解，触发滚动更新
+	hash := fmt.Sprintf("%x", sha256.Sum256(append(cfgData, gitConfig...)))
+	if err = p.applyDeployment(ctx, p.renderDeployment(agent, name, hash)); err != nil {
+		return fmt.Errorf("同步 agent(%s) deployment 失败 %v", agent.Name, err)
+	}
+	klog.Infof("agent(%s) 已部署到 kubernetes %s/%s", agent.Name, p.namespace, name)
+	return nil
+}
+
+func (p *kubernetesProvisioner) renderDeployment(agent *model.Agent, name string, hash string) *appsv1.Deployment {
+	replicas := int32(1)
+	meta := p.objectMeta(name)
+	image := p.s.agentDeployImage(agent)
+
+	configMapRef := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		}}
+	}
+	mounts := []corev1.VolumeMount{
+		{Name: "data", MountPath: agentDataPath},
+		{Name: "config", MountPath: agentConfigMountPath, ReadOnly: true},
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: meta.Labels},
+			// 同名 agent 不能同时运行
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      meta.Labels,
+					Annotations: map[string]string{agentConfigHashKey: hash},
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{
+						Name:    "bootstrap",
+						Image:   image,
+						Command: []string{"sh", agentBootstrapPath + "/bootstrap.sh"},
+						Env: []corev1.EnvVar{
+							{Name: "GIT_USER", ValueFrom: configMapRef("git-user")},
+							{Name: "GIT_EMAIL", ValueFrom: configMapRef("git-email")},
+							{Name: "GIT_REF", ValueFrom: configMapRef("git-ref")},
+						},
+						VolumeMounts: append(mounts, corev1.VolumeMount{Name: "bootstrap", MountPath: agentBootstrapPath, ReadOnly: true}),
+					}},
+					Containers: []corev1.Container{{
+						Name:            "agent",
+						Image:           image,
+						ImagePullPolicy: corev1.PullAlways,
+						Command:         p.command,
+						VolumeMounts:    mounts,
+					}},
+					Volumes: []corev1.Volume{
+						{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name}}},
+						{Name: "config", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name}}},
+						{Name: "bootstrap", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: name},
+						}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// ensurePVC 创建 agent 数据目录的 PVC，已存在时不修改，Recreate 策略下同一时间只有一个 pod 挂载
+func (p *kubernetesProvisioner) ensurePVC(ctx context.Context, name string) error {
+	_, err := p.client.CoreV1().PersistentVolumeClaims(p.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil || !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	size, err := resource.ParseQuantity(p.storageSize)
+	if err != nil {
+		return fmt.Errorf("数据卷大小(%s)不合法 %v", p.storageSize, err)
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: p.objectMeta(name),
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if len(p.storageClass) != 0 {
+		pvc.Spec.StorageClassName = &p.storageClass
+	}
+	_, err = p.client.CoreV1().PersistentVolumeClaims(p.namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	return err
+}
+
+func (p *kubernetesProvisioner) applySecret(ctx context.Context, secret *corev1.Secret) error {
+	old, err := p.client.CoreV1().Secrets(p.namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		_, err = p.client.CoreV1().Secrets(p.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	secret.ResourceVersion = old.ResourceVersion
+	_, err = p.client.CoreV1().Secrets(p.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+func (p *kubernetesProvisioner) applyConfigMap(ctx context.Context, configMap *corev1.ConfigMap) error {
+	old, err := p.client.CoreV1().ConfigMaps(p.namespace).Get(ctx, configMap.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		_, err = p.client.CoreV1().ConfigMaps(p.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	configMap.ResourceVersion = old.ResourceVersion
+	_, err = p.client.CoreV1().ConfigMaps(p.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// applyDeployment 不存在时以 1 个副本创建，已存在时更新配置，副本数由 Start/Stop 维护
+func (p *kubernetesProvisioner) applyDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	old, err := p.client.AppsV1().Deployments(p.namespace).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		_, err = p.client.AppsV1().Deployments(p.namespace).Create(ctx, deployment, metav1.CreateOptions{})
+		return err
+	}
+	// 保留已有副本数，避免重新部署时拉起已被停止的 agent
+	deployment.Spec.Replicas = old.Spec.Replicas
+	deployment.ResourceVersion = old.ResourceVersion
+	_, err = p.client.AppsV1().Deployments(p.namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+	return err
+}
+
+func (p *kubernetesProvisioner) Uninstall(ctx context.Context, agent *model.Agent) error {
+	name := agentWorkloadName(agent.Name)
+	if err := p.client.AppsV1().Deployments(p.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := p.client.CoreV1().ConfigMaps(p.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := p.client.CoreV1().Secrets(p.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := p.client.CoreV1().PersistentVolumeClaims(p.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Start 扩容到 1 个副本，工作负载不存在时重新部署
+func (p *kubernetesProvisioner) Start(ctx context.Context, agent *model.Agent) error {
+	err := p.scale(ctx, agent, 1)
+	if apierrors.IsNotFound(err) {
+		return p.Install(ctx, agent)
+	}
+	return err
+}
+
+// Stop 缩容到 0 个副本，保留配置
+func (p *kubernetesProvisioner) Stop(ctx context.Context, agent *model.Agent) error {
+	return p.scale(ctx, agent, 0)
+}
+
+func (p *kubernetesProvisioner) scale(ctx context.Context, agent *model.Agent, replicas int32) error {
+	name := agentWorkloadName(agent.Name)
+	scale, err := p.client.AppsV1().Deployments(p.namespace).GetScale(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	scale.Spec.Replicas = replicas
+	_, err = p.client.AppsV1().Deployments(p.namespace).UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+	return err
+}
+
+// Restart 修改 pod 模板注解触发滚动重启，同 kubectl rollout restart
+func (p *kubernetesProvisioner) Restart(ctx context.Context, agent *model.Agent) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"%s":"%s"}}}}}`, agentRestartedAtKey, time.Now().Format(time.RFC3339))
+	_, err := p.client.AppsV1().Deployments(p.namespace).Patch(ctx, agentWorkloadName(agent.Name), k8stypes.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
+// UpgradeBinary agent 程序随镜像发布，将 bootstrap 和 agent 容器滚动到 agent 版本对应的镜像，
+// 未指定版本时镜像不变，重启时重新拉取镜像，bootstrap 拷贝新的程序
+func (p *kubernetesProvisioner) UpgradeBinary(ctx context.Context, agent *model.Agent) error {
+	name := agentWorkloadName(agent.Name)
+	image := p.s.agentDeployImage(agent)
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"%s":"%s"}},"spec":{"initContainers":[{"name":"bootstrap","image":"%s"}],"containers":[{"name":"agent","image":"%s"}]}}}}`,
+		agentRestartedAtKey, time.Now().Format(time.RFC3339), image, image)
+	if _, err := p.client.AppsV1().Deployments(p.namespace).Patch(ctx, name, k8stypes.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	klog.Infof("agent(%s) 已滚动更新到镜像 %s", agent.Name, image)
+	return nil
+}
+
+// workloadStatus 获取 agent 工作负载和 pod 的状态
+func (p *kubernetesProvisioner) workloadStatus(ctx context.Context, agent *model.Agent) (*model.AgentWorkload, error) {
+	name := agentWorkloadName(agent.Name)
+	workload := &model.AgentWorkload{Namespace: p.namespace, Name: name, UpdateTime: time.Now()}
+
+	deployment, err := p.client.AppsV1().Deployments(p.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			workload.Message = "工作负载不存在"
+			return workload, nil
+		}
+		return nil, err
+	}
+	if deployment.Spec.Replicas != nil {
+		workload.Replicas = *deployment.Spec.Replicas
+	}
+	workload.ReadyReplicas = deployment.Status.ReadyReplicas
+
+	pods, err := p.client.CoreV1().Pods(p.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: metav1.FormatLabelSelector(deployment.Spec.Selector),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		workload.Pods = append(workload.Pods, agentPodStatus(pod))
+	}
+	return workload, nil
+}
+
+func agentPodStatus(pod corev1.Pod) model.AgentPod {
+	status := model.AgentPod{Name: pod.Name, Node: pod.Spec.NodeName, Phase: string(pod.Status.Phase), Ready: true}
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !cs.Ready {
+			status.Ready = false
+		}
+	}
+	if len(pod.Status.ContainerStatuses) == 0 {
+		status.Ready = false
+	}
+	for _, cs := range statuses {
+		status.Restarts += cs.RestartCount
+		if len(status.Reason) != 0 {
+			continue
+		}
+		if cs.State.Waiting != nil && len(cs.State.Waiting.Reason) != 0 {
+			status.Reason = cs.State.Waiting.Reason
+		} else if cs.State.Terminated != nil && cs.State.Terminated.ExitCode != 0 {
+			status.Reason = cs.State.Terminated.Reason
+		}
+	}
+	return status
+}
+
+// startAgentWorkloadSync 定期将 kubernetes 部署的 agent 的 pod 状态同步到 agent 记录
+func (s *ServerController) startAgentWorkloadSync(ctx context.Context) {
+	ticker := time.NewTicker(agentWorkloadSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		agents, err := s.factory.Agent().List(ctx)
+		if err != nil {
+			klog.Errorf("获取 agents 列表失败 %v，等待下一次同步", err)
+			continue
+		}
+		for i := range agents {
+			if agents[i].Provisioner != model.KubernetesProvisioner {
+				continue
+			}
+			if err = s.syncAgentWorkload(ctx, &agents[i]); err != nil {
+				klog.Errorf("同步 agent(%s) 工作负载状态失败 %v", agents[i].Name, err)
+			}
+		}
+	}
+}
+
+func (s *ServerController) syncAgentWorkload(ctx context.Context, agent *model.Agent) error {
+	p, err := s.newKubernetesProvisioner()
+	if err != nil {
+		return err
+	}
+	workload, err := p.workloadStatus(ctx, agent)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"workload": workload}
+	if status, message := agentWorkloadAgentStatus(agent, workload); len(status) != 0 {
+		updates["status"] = status
+		updates["message"] = message
+	}
+	return s.factory.Agent().UpdateByName(ctx, agent.Name, updates)
+}
+
+// agentWorkloadAgentStatus 根据工作负载状态更新 agent 状态，操作进行中或已手动下线的 agent 不处理，
+// 在线状态仍由心跳维护，工作负载异常时标记为异常，恢复后标记为在线
+func agentWorkloadAgentStatus(agent *model.Agent, workload *model.AgentWorkload) (string, string) {
+	switch agent.Status {
+	case model.RunAgentType, model.UnknownAgentType, model.ErrorAgentType:
+	default:
+		return "", ""
+	}
+
+	if len(workload.Message) != 0 {
+		return model.ErrorAgentType, workload.Message
+	}
+	if workload.Replicas != 0 && workload.ReadyReplicas == 0 {
+		for _, pod := range workload.Pods {
+			if len(pod.Reason) != 0 {
+				return model.ErrorAgentType, fmt.Sprintf("pod(%s) %s", pod.Name, pod.Reason)
+			}
+		}
+	}
+	if agent.Status == model.ErrorAgentType && workload.ReadyReplicas != 0 {
+		return model.RunAgentType, "Agent workload is ready"
+	}
+	return "", ""
+}
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"text/template"
 
-	guuid "github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 	"k8s.io/klog/v2"
 
@@ -52,40 +51,25 @@ func (s *ServerController) GetAgent(ctx context.Context, agentId int64) (interfa
 	return s.factory.Agent().Get(ctx, agentId)
 }
 
-func (s *ServerController) ReconcileAgent(ctx context.Context, sshConfig *sshutil.SSHConfig, agent *model.Agent) error {
-	agentName := agent.Name
-	old, err := s.GetAgentContainer(sshConfig, agentName)
-	if err != nil {
-		klog.Errorf("获取 agent 容器失败 %v", err)
-		return err
-	}
-	if old == nil {
-		klog.V(1).Infof("agent 容器(%s)不存在", agentName)
-	}
-
-	klog.Infof("agent(%s)正在%s", agentName, agent.Status)
+func (s *ServerController) ReconcileAgent(ctx context.Context, provisioner agentProvisioner, agent *model.Agent) error {
+	klog.Infof("agent(%s)正在%s", agent.Name, agent.Status)
 
+	var err error
 	destStatus := model.RunAgentType
 	switch agent.Status {
 	case model.RestartingAgentType:
-		err = s.RestartAgentContainer(sshConfig, agent)
+		err = provisioner.Restart(ctx, agent)
 	case model.StartingAgentType:
-		err = s.StartAgentContainer(sshConfig, agent)
+		err = provisioner.Start(ctx, agent)
 	case model.StoppingAgentType:
-		err = s.StopAgentContainer(sshConfig, agent)
+		err = provisioner.Stop(ctx, agent)
 	case model.UpgradeAgentType, model.RunAgentType:
-		if old != nil {
-			// 先卸载原有容器，然后刷新配置，重新启动
-			if err1 := s.UninstallAgentContainer(sshConfig, agent); err1 != nil {
-				return fmt.Errorf("卸载 agent(%s) 失败 %v", agentName, err1)
-			}
-		}
-		err = s.InstallAgentContainer(sshConfig, agent)
+		err = provisioner.Install(ctx, agent)
 	case model.OfflineAgentType, model.DeletingAgentType:
-		err = s.UninstallAgentContainer(sshConfig, agent)
+		err = provisioner.Uninstall(ctx, agent)
 		destStatus = model.UnRunAgentType
 	case model.UpgradeAgentBinaryType:
-		err = s.UpgradeAgentBinaryContainer(sshConfig, agent)
+		err = provisioner.UpgradeBinary(ctx, agent)
 	default:
 		klog.Infof("未命中 agent(%s) 状态(%s) 等待下次协同", agent.Name, agent.Status)
 		return nil
@@ -98,6 +82,11 @@ func (s *ServerController) ReconcileAgent(ctx context.Context, sshConfig *sshuti
 	if err = s.factory.Agent().Update(context.TODO(), agent.Id, agent.ResourceVersion, map[string]interface{}{"status": destStatus}); err != nil {
 		return err
 	}
+	if agent.Provisioner == model.KubernetesProvisioner {
+		if err = s.syncAgentWorkload(ctx, agent); err != nil {
+			klog.Warningf("同步 agent(%s) 工作负载状态失败 %v", agent.Name, err)
+		}
+	}
 	klog.Infof("agent(%s) 执行完成", agent.Name)
 	return nil
 }
@@ -132,17 +121,7 @@ func (s *ServerController) ResetAgentMetadata(sshConfig *sshutil.SSHConfig, agen
 	}
 
 	// 配置文件 config.yaml
-	data, err := util.ReadFromFile(s.cfg.Rainbowd.TemplateDir + "/config.yaml")
-	if err != nil {
-		return err
-	}
-	var cfg rainbowconfig.Config
-	if err = yaml.Unmarshal(data, &cfg); err != nil {
-		return err
-	}
-	// 追加差异化配置
-	cfg.Agent.Name = containerName
-	cfgData, err := yaml.Marshal(cfg)
+	cfgData, err := s.renderAgentConfig(agent)
 	if err != nil {
 		return err
 	}
@@ -155,7 +134,7 @@ func (s *ServerController) ResetAgentMetadata(sshConfig *sshutil.SSHConfig, agen
 		return err
 	}
 	// 拷贝 agent 每次都重置最新
-	if err = sshClient.UploadFile(s.cfg.Rainbowd.TemplateDir+"/agent", destDir+"/agent", "0755"); err != nil {
+	if err = sshClient.UploadFile(s.agentBinaryPath(agent), destDir+"/agent", "0755"); err != nil {
 		klog.Errorf("传输 agent 二进制文件失败 %v", err)
 		return err
 	}
@@ -168,6 +147,71 @@ func (s *ServerController) ResetAgentMetadata(sshConfig *sshutil.SSHConfig, agen
 	return nil
 }
 
+// agentImage agent 指定镜像时优先使用，否则使用 rainbowd 配置的镜像
+func (s *ServerController) agentImage(agent *model.Agent) string {
+	if len(agent.Image) != 0 {
+		return agent.Image
+	}
+	return s.cfg.Rainbowd.AgentImage
+}
+
+// agentRunImage agent 实际运行的镜像，kubernetes 部署时以 agent 版本作为镜像 tag
+func (s *ServerController) agentRunImage(agent *model.Agent) string {
+	if agent.Provisioner == model.KubernetesProvisioner {
+		return s.agentDeployImage(agent)
+	}
+	return s.agentImage(agent)
+}
+
+// agentBinaryPath agent 指定版本时使用模板目录的 agent-<version>，否则使用 agent
+func (s *ServerController) agentBinaryPath(agent *model.Agent) string {
+	if len(agent.BinaryVersion) != 0 {
+		return filepath.Join(s.cfg.Rainbowd.TemplateDir, "agent-"+agent.BinaryVersion)
+	}
+	return filepath.Join(s.cfg.Rainbowd.TemplateDir, "agent")
+}
+
+// renderAgentConfig 基于模板目录的 config.yaml 渲染 agent 的配置文件
+func (s *ServerController) renderAgentConfig(agent *model.Agent) ([]byte, error) {
+	data, err := util.ReadFromFile(s.cfg.Rainbowd.TemplateDir + "/config.yaml")
+	if err != nil {
+		return nil, err
+	}
+	var cfg rainbowconfig.Config
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	// 追加差异化配置
+	cfg.Agent.Name = agent.Name
+	cfg.Agent.Image = s.agentRunImage(agent)
+	if cfg.Agent.IsAPIMode() {
+		// api 模式下不下发数据库和 redis 配置，由引导凭证完成注册
+		token, err := s.issueAgentBootstrapToken(context.TODO(), agent.Name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Agent.BootstrapToken = token.BootstrapToken
+		cfg.Mysql = rainbowconfig.MysqlOptions{}
+		cfg.Redis = rainbowconfig.RedisOption{}
+	}
+	return yaml.Marshal(cfg)
+}
+
+// renderAgentGitConfig 渲染 plugin 仓库的 git 配置，远端地址包含认证信息
+func renderAgentGitConfig(agent *model.Agent) ([]byte, error) {
+	remoteURL, err := ciRemoteURL(agent)
+	if err != nil {
+		return nil, err
+	}
+	gc := struct{ URL string }{URL: remoteURL}
+	t := template.Must(template.New(agent.Name).Parse(GitConfig))
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, gc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (s *ServerController) UpdateAgentStatus(ctx context.Context, req *types.UpdateAgentStatusRequest) error {
 	if req.Status == "强制在线" || req.Status == "强制离线" {
 		realStatus := strings.Replace(req.Status, "强制", "", -1)
@@ -186,9 +230,9 @@ func (s *ServerController) UpdateAgentStatus(ctx context.Context, req *types.Upd
 		return fmt.Errorf("agent(%s)状态为(%s), 请稍后再试", req.AgentName, old.Status)
 	}
 
-	sshConfig, ok := s.sshConfigMap[old.RainbowdName]
-	if !ok {
-		return fmt.Errorf("未加载 rainbow node(%s)", old.RainbowdName)
+	provisioner, err := s.agentProvisioner(ctx, old)
+	if err != nil {
+		return err
 	}
 
 	if err := s.factory.Agent().UpdateByName(ctx, req.AgentName, map[string]interface{}{"status": req.Status, "message": fmt.Sprintf("Agent has been set to %s", req.Status)}); err != nil {
@@ -201,7 +245,7 @@ func (s *ServerController) UpdateAgentStatus(ctx context.Context, req *types.Upd
 	}
 
 	go func() {
-		if err = s.ReconcileAgent(ctx, &sshConfig, newAgent); err != nil {
+		if err = s.ReconcileAgent(ctx, provisioner, newAgent); err != nil {
 			klog.Errorf("远程更新agent失败 %v", err)
 		}
 	}()
@@ -209,9 +253,15 @@ func (s *ServerController) UpdateAgentStatus(ctx context.Context, req *types.Upd
 }
 
 func (s *ServerController) UpdateAgent(ctx context.Context, req *types.UpdateAgentRequest) error {
+	if err := validateAgentCI(req.CIType, req.CIEndpoint, req.CITrigger); err != nil {
+		return err
+	}
+	if err := validateAgentProvisioner(req.Provisioner, req.RainbowdName); err != nil {
+		return err
+	}
 	repo := req.GithubRepository
 	if len(repo) == 0 {
-		repo = fmt.Sprintf("https://github.com/%s/plugin.git", req.GithubUser)
+		repo = ciRepositoryURL(req.CIType, req.CIEndpoint, req.GithubUser)
 	}
 
 	updates := make(map[string]interface{})
@@ -220,6 +270,16 @@ func (s *ServerController) UpdateAgent(ctx context.Context, req *types.UpdateAge
 	updates["github_token"] = req.GithubToken
 	updates["github_email"] = req.GithubEmail
 	updates["rainbowd_name"] = req.RainbowdName
+	updates["monthly_budget"] = req.MonthlyBudget
+	updates["ci_type"] = req.CIType
+	updates["ci_endpoint"] = req.CIEndpoint
+	updates["ci_trigger"] = req.CITrigger
+	updates["ci_workflow"] = req.CIWorkflow
+	updates["ci_ref"] = req.CIRef
+	updates["provisioner"] = req.Provisioner
+	updates["image"] = req.Image
+	updates["binary_version"] = req.BinaryVersion
+	updates["labels"] = model.AgentLabels(req.Labels)
 	return s.factory.Agent().UpdateByName(ctx, req.AgentName, updates)
 }
 
@@ -309,7 +369,7 @@ func (s *ServerController) RunAgentContainer(sshConfig *sshutil.SSHConfig, agent
 	cmd1 := []string{"docker", "run", "-d", "--name", agent.Name,
 		"-v", fmt.Sprintf("%s:/data", s.cfg.Rainbowd.DataDir+"/"+agent.Name),
 		"-v", "/etc/localtime:/etc/localtime:ro",
-		"--network", "host", s.cfg.Rainbowd.AgentImage, "/data/agent", "--configFile", "/data/config.yaml"}
+		"--network", "host", s.agentImage(agent), "/data/agent", "--configFile", "/data/config.yaml"}
 	// 输入 github 的配置
 	cmd2 := []string{"docker", "exec", agent.Name, "git", "config", "--global", "user.name", agent.GithubUser}
 	cmd3 := []string{"docker", "exec", agent.Name, "git", "config", "--global", "user.email", agent.GithubEmail}
@@ -336,7 +396,7 @@ func (s *ServerController) BootstrapAgentContainer(sshConfig *sshutil.SSHConfig,
 	containerName := agent.Name + uuid.NewRandName("-upgrade-", 8)
 	pluginDir := "/data/plugin/"
 
-	cmd1 := []string{"docker", "run", "-d", "--name", containerName, "-v", fmt.Sprintf("%s:/data", s.cfg.Rainbowd.DataDir+"/"+agent.Name), "-v", "/etc/localtime:/etc/localtime:ro", "--network", "host", s.cfg.Rainbowd.AgentImage, "sleep", "infinity"}
+	cmd1 := []string{"docker", "run", "-d", "--name", containerName, "-v", fmt.Sprintf("%s:/data", s.cfg.Rainbowd.DataDir+"/"+agent.Name), "-v", "/etc/localtime:/etc/localtime:ro", "--network", "host", s.agentImage(agent), "sleep", "infinity"}
 	cmd2 := []string{"docker", "exec", containerName, "git", "init", pluginDir}
 	cmd3 := []string{"docker", "exec", containerName, "git", "config", "--global", "user.name", agent.GithubUser}
 	cmd4 := []string{"docker", "exec", containerName, "git", "config", "--global", "user.email", agent.GithubEmail}
@@ -352,15 +412,12 @@ func (s *ServerController) BootstrapAgentContainer(sshConfig *sshutil.SSHConfig,
 	}
 	klog.Infof("agent 初始环境准备完成")
 
-	gc := struct{ URL string }{URL: fmt.Sprintf("https://%s:%s@github.com/%s/plugin.git", agent.GithubUser, agent.GithubToken, agent.GithubUser)}
-	tpl := template.New(containerName)
-	t := template.Must(tpl.Parse(GitConfig))
-	var buf bytes.Buffer
-	if err = t.Execute(&buf, gc); err != nil {
+	gitConfig, err := renderAgentGitConfig(agent)
+	if err != nil {
 		return err
 	}
 	destDir := filepath.Join(s.cfg.Rainbowd.DataDir, agent.Name)
-	if err = ioutil.WriteFile(s.cfg.Rainbowd.TemplateDir+fmt.Sprintf("/%s-git-config", containerName), buf.Bytes(), 0644); err != nil {
+	if err = ioutil.WriteFile(s.cfg.Rainbowd.TemplateDir+fmt.Sprintf("/%s-git-config", containerName), gitConfig, 0644); err != nil {
 		return fmt.Errorf("生成 git config 文件失败 %v", err)
 	}
 	klog.V(0).Infof("传输文件 %s 至 %s", s.cfg.Rainbowd.TemplateDir+fmt.Sprintf("/%s-git-config", containerName), destDir+"/plugin/.git/config")
@@ -403,7 +460,7 @@ func (s *ServerController) UpgradeAgentBinaryContainer(sshConfig *sshutil.SSHCon
 	containerName := agent.Name
 	destDir := filepath.Join(s.cfg.Rainbowd.DataDir, containerName)
 	// 替换 agent 二进制
-	if err = sshClient.UploadFile(s.cfg.Rainbowd.TemplateDir+"/agent", destDir+"/agent", "0755"); err != nil {
+	if err = sshClient.UploadFile(s.agentBinaryPath(agent), destDir+"/agent", "0755"); err != nil {
 		klog.Errorf("传输 agent 二进制文件失败 %v", err)
 		return err
 	}
@@ -502,33 +559,53 @@ func (s *ServerController) parseDockerJSONOutput(output string) ([]ContainerInfo
 }
 
 func (s *ServerController) CreateAgentRepo(ctx context.Context, req *types.CallGithubRequest) (interface{}, error) {
-	key := guuid.NewString()
 	req.Op = types.OpCreateAction
-	data, err := json.Marshal(types.CallMetaRequest{
+	_, err := s.CallRemote(ctx, req.ClientId, types.CallMetaRequest{
 		Type:              types.CallGithubType,
-		Uid:               key,
 		CallGithubRequest: req,
 	})
-
-	_, err = s.Call(ctx, req.ClientId, key, data)
 	if err != nil {
-		klog.Errorf("创建 agent github repo（%s）失败：%v", req.Repo, err)
+		klog.Errorf("创建 agent repo（%s）失败：%v", req.Repo, err)
 		return nil, err
 	}
-	klog.Errorf("创建 agent github repo（%s）成功：%v", req.Repo)
+	klog.Infof("创建 agent repo（%s）成功", req.Repo)
 	return nil, nil
 }
 
+// GetTaskRun 获取任务在 agent CI 后端的流水线状态和日志
+func (s *ServerController) GetTaskRun(ctx context.Context, taskId int64) (interface{}, error) {
+	task, err := s.factory.Task().Get(ctx, taskId)
+	if err != nil {
+		return nil, err
+	}
+	if len(task.AgentName) == 0 {
+		return nil, fmt.Errorf("任务(%d)尚未调度到 agent", taskId)
+	}
+
+	data, err := s.CallRemote(ctx, task.AgentName, types.CallMetaRequest{
+		Type: types.CallGithubType,
+		CallGithubRequest: &types.CallGithubRequest{
+			Op:     types.OpGetRunAction,
+			TaskId: taskId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result types.CIRunResult
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (s *ServerController) CreateAgentReposIfNot(ctx context.Context, req *types.CallGithubRequest) error {
-	key := guuid.NewString()
 	req.Op = types.OpCreateIfNotAction
-	data, err := json.Marshal(types.CallMetaRequest{
+	_, err := s.CallRemote(ctx, req.ClientId, types.CallMetaRequest{
 		Type:              types.CallGithubType,
-		Uid:               key,
 		CallGithubRequest: req,
 	})
-
-	_, err = s.Call(ctx, req.ClientId, key, data)
 	if err != nil {
 		klog.Errorf("创建 agentRepos（%s）失败：%v", req.Repo, err)
 		return err
@@ -0,0 +1,199 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	pb "github.com/caoyingjunz/rainbow/api/rpc/proto"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	tunnelHeartbeatInterval = 30 * time.Second
+	tunnelMinBackoff        = 1 * time.Second
+	tunnelMaxBackoff        = 60 * time.Second
+	tunnelStableDuration    = 60 * time.Second // 连接保持超过该时间后重置退避
+)
+
+type agentTunnel struct {
+	name   string
+	stream pb.Tunnel_ConnectClient
+
+	// grpc stream 不支持并发 Send
+	lock sync.Mutex
+}
+
+func (t *agentTunnel) send(msg types.TunnelMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stream.Send(&pb.Request{ClientId: t.name, Payload: data})
+}
+
+// startTunnel 主动连接 server 隧道，断开后按指数退避重连
+func (s *AgentController) startTunnel(ctx context.Context) {
+	klog.Infof("starting tunnel client to %s", s.cfg.Tunnel.Address)
+
+	backoff := tunnelMinBackoff
+	for {
+		start := time.Now()
+		err := s.runTunnel(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > tunnelStableDuration {
+			backoff = tunnelMinBackoff
+		}
+
+		delay := wait.Jitter(backoff, 0.5)
+		klog.Warningf("隧道已断开 %v，%v 后重连", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+// tunnelCredentials 隧道的传输凭证，未启用 TLS 时除非显式允许，否则拒绝明文发送隧道凭证
+func (s *AgentController) tunnelCredentials() (credentials.TransportCredentials, error) {
+	opt := s.cfg.Tunnel
+	if !opt.TLSEnabled() {
+		if !opt.AllowInsecure {
+			return nil, fmt.Errorf("隧道未配置 TLS，拒绝明文发送 agent 凭证，如需在测试环境中使用请开启 tunnel.allow_insecure")
+		}
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: opt.ServerName, MinVersion: tls.VersionTLS12}
+	if len(opt.CAFile) != 0 {
+		data, err := os.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取隧道 CA(%s) 失败 %v", opt.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("解析隧道 CA(%s) 失败", opt.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(opt.CertFile) != 0 && len(opt.KeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载隧道客户端证书失败 %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func (s *AgentController) runTunnel(ctx context.Context) error {
+	creds, err := s.tunnelCredentials()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.NewClient(s.cfg.Tunnel.Address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: tunnelHeartbeatInterval, Timeout: 10 * time.Second, PermitWithoutStream: true}),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pb.NewTunnelClient(conn).Connect(streamCtx)
+	if err != nil {
+		return err
+	}
+
+	tunnel := &agentTunnel{name: s.name, stream: stream}
+	if err = tunnel.send(types.TunnelMessage{Type: types.TunnelRegisterType, Token: s.tunnelToken()}); err != nil {
+		return err
+	}
+	klog.Infof("agent(%s) 隧道已连接", s.name)
+
+	go func() {
+		ticker := time.NewTicker(tunnelHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := tunnel.send(types.TunnelMessage{Type: types.TunnelHeartbeatType}); err != nil {
+					klog.Errorf("隧道心跳失败 %v", err)
+					cancel()
+					return
+				}
+			case <-streamCtx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		var msg types.TunnelMessage
+		if err = json.Unmarshal(resp.Result, &msg); err != nil {
+			klog.Errorf("反序列化隧道消息失败 %v", err)
+			continue
+		}
+		if msg.Type != types.TunnelCallType {
+			continue
+		}
+		go s.handleTunnelCall(streamCtx, tunnel, msg)
+	}
+}
+
+// handleTunnelCall 在调用截止时间内执行远程调用，并通过隧道返回结果
+func (s *AgentController) handleTunnelCall(ctx context.Context, tunnel *agentTunnel, msg types.TunnelMessage) {
+	deadline := time.Now().Add(time.Duration(s.cfg.Remote.Timeout) * time.Second)
+	if msg.Deadline != 0 {
+		deadline = time.UnixMilli(msg.Deadline)
+	}
+	callCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var (
+		reqMeta types.CallMetaRequest
+		result  types.CallResult
+	)
+	if err := json.Unmarshal(msg.Payload, &reqMeta); err != nil {
+		klog.Errorf("failed to unmarshal remote meta request %v", err)
+		result = types.CallResult{StatusCode: 1, ErrMessage: err.Error()}
+	} else {
+		result = s.Handle(callCtx, &reqMeta)
+	}
+
+	if err := tunnel.send(types.TunnelMessage{Id: msg.Id, Type: types.TunnelResultType, CallResult: result}); err != nil {
+		klog.Errorf("隧道返回调用(%s)结果失败 %v", msg.Id, err)
+		return
+	}
+	klog.V(4).Infof("调用结果已通过隧道返回, 调用ID(%s)", msg.Id)
+}
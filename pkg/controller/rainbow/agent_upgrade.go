@@ -0,0 +1,566 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	agentUpgradeInterval = 15 * time.Second
+
+	defaultUpgradeHealthTimeout = 600
+)
+
+func (s *ServerController) CreateAgentUpgrade(ctx context.Context, req *types.CreateAgentUpgradeRequest) error {
+	if err := s.preCreateAgentUpgrade(ctx, req); err != nil {
+		return err
+	}
+
+	agents, err := s.selectUpgradeAgents(ctx, req)
+	if err != nil {
+		return err
+	}
+	if len(agents) == 0 {
+		return fmt.Errorf("没有需要升级的在线 agent")
+	}
+
+	// 第一批为金丝雀批次，其余按批次大小划分
+	targets := make([]model.AgentUpgradeTarget, 0, len(agents))
+	batchNum := 0
+	for i, agent := range agents {
+		batch := 0
+		if i >= req.CanarySize {
+			batch = 1 + (i-req.CanarySize)/req.BatchSize
+		}
+		if batch+1 > batchNum {
+			batchNum = batch + 1
+		}
+		targets = append(targets, model.AgentUpgradeTarget{
+			AgentName:         agent.Name,
+			Batch:             batch,
+			PrevImage:         agent.Image,
+			PrevBinaryVersion: agent.BinaryVersion,
+			Status:            model.UpgradeTargetPending,
+		})
+	}
+
+	now := time.Now()
+	_, err = s.factory.AgentUpgrade().Create(ctx, &model.AgentUpgrade{
+		Name:          req.Name,
+		Type:          req.Type,
+		Image:         req.Image,
+		BinaryVersion: req.BinaryVersion,
+		Selector:      req.Selector,
+		RainbowdName:  req.RainbowdName,
+		CanarySize:    req.CanarySize,
+		BatchSize:     req.BatchSize,
+		RequireTask:   req.RequireTask,
+		HealthTimeout: req.HealthTimeout,
+		FailurePolicy: req.FailurePolicy,
+		Status:        model.UpgradeRunningStatus,
+		Message:       fmt.Sprintf("共 %d 个 agent，分 %d 批升级", len(targets), batchNum),
+		BatchNum:      batchNum,
+		StartTime:     &now,
+	}, targets)
+	return err
+}
+
+func (s *ServerController) preCreateAgentUpgrade(ctx context.Context, req *types.CreateAgentUpgradeRequest) error {
+	switch req.Type {
+	case model.ImageAgentUpgrade:
+		if len(req.Image) == 0 {
+			return fmt.Errorf("镜像升级需指定 image")
+		}
+		// 镜像升级完整使用指定的镜像，kubernetes 部署的 agent 升级时清空版本，避免以版本覆盖镜像 tag
+		req.BinaryVersion = ""
+	case model.BinaryAgentUpgrade:
+		if len(req.BinaryVersion) == 0 {
+			return fmt.Errorf("进程升级需指定 binary_version")
+		}
+		binary := s.agentBinaryPath(&model.Agent{BinaryVersion: req.BinaryVersion})
+		if !util.IsFileExists(binary) {
+			return fmt.Errorf("agent 二进制文件 %s 不存在", binary)
+		}
+	default:
+		return fmt.Errorf("不支持的升级类型 %s", req.Type)
+	}
+
+	switch req.FailurePolicy {
+	case "":
+		req.FailurePolicy = model.PauseUpgradePolicy
+	case model.PauseUpgradePolicy, model.RollbackUpgradePolicy:
+	default:
+		return fmt.Errorf("不支持的失败处理策略 %s", req.FailurePolicy)
+	}
+	if req.CanarySize <= 0 {
+		req.CanarySize = 1
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 1
+	}
+	if req.HealthTimeout <= 0 {
+		req.HealthTimeout = defaultUpgradeHealthTimeout
+	}
+
+	// 同一时间只允许一个未结束的升级计划，避免互相覆盖 agent 版本
+	for _, status := range []string{model.UpgradeRunningStatus, model.UpgradePausedStatus, model.UpgradeRollingBackStatus} {
+		total, err := s.factory.AgentUpgrade().Count(ctx, db.WithStatus(status))
+		if err != nil {
+			return err
+		}
+		if total != 0 {
+			return fmt.Errorf("存在%s的升级计划，请结束后再试", status)
+		}
+	}
+	return nil
+}
+
+// selectUpgradeAgents 按节点和标签选择在线的 agent，跳过已是目标版本的 agent
+func (s *ServerController) selectUpgradeAgents(ctx context.Context, req *types.CreateAgentUpgradeRequest) ([]model.Agent, error) {
+	agents, err := s.factory.Agent().List(ctx, db.WithRainbowdName(req.RainbowdName), db.WithStatus(model.RunAgentType))
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []model.Agent
+	for _, agent := range agents {
+		if !agent.Labels.Matches(req.Selector) {
+			continue
+		}
+		if req.Type == model.ImageAgentUpgrade && s.agentRunImage(&agent) == req.Image {
+			continue
+		}
+		if req.Type == model.BinaryAgentUpgrade {
+			// kubernetes 部署的 agent 程序随镜像发布
+			if agent.Provisioner == model.KubernetesProvisioner {
+				klog.Infof("agent(%s) 为 kubernetes 部署，不参与进程升级", agent.Name)
+				continue
+			}
+			if agent.BinaryVersion == req.BinaryVersion {
+				continue
+			}
+		}
+		selected = append(selected, agent)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Name < selected[j].Name
+	})
+	return selected, nil
+}
+
+func (s *ServerController) DeleteAgentUpgrade(ctx context.Context, upgradeId int64) error {
+	old, err := s.factory.AgentUpgrade().Get(ctx, upgradeId)
+	if err != nil {
+		return err
+	}
+	if old.Status == model.UpgradeRunningStatus || old.Status == model.UpgradeRollingBackStatus {
+		return fmt.Errorf("升级计划%s，请暂停后再删除", old.Status)
+	}
+	return s.factory.AgentUpgrade().Delete(ctx, upgradeId)
+}
+
+func (s *ServerController) GetAgentUpgrade(ctx context.Context, upgradeId int64) (interface{}, error) {
+	object, err := s.factory.AgentUpgrade().Get(ctx, upgradeId)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.factory.AgentUpgrade().ListTargets(ctx, db.WithUpgrade(upgradeId), db.WithOrderByASC())
+	if err != nil {
+		return nil, err
+	}
+	return types.AgentUpgradeDetail{AgentUpgrade: *object, Targets: targets}, nil
+}
+
+func (s *ServerController) ListAgentUpgrades(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
+	listOption.SetDefaultPageOption()
+
+	pageResult := types.PageResult{
+		PageRequest: types.PageRequest{
+			Page:  listOption.Page,
+			Limit: listOption.Limit,
+		},
+	}
+	opts := []db.Options{
+		db.WithNameLike(listOption.NameSelector),
+	}
+
+	var err error
+	pageResult.Total, err = s.factory.AgentUpgrade().Count(ctx, opts...)
+	if err != nil {
+		klog.Errorf("获取升级计划总数失败 %v", err)
+		pageResult.Message = err.Error()
+	}
+	offset := (listOption.Page - 1) * listOption.Limit
+	opts = append(opts, []db.Options{
+		db.WithOrderByDesc(),
+		db.WithOffset(offset),
+		db.WithLimit(listOption.Limit),
+	}...)
+	pageResult.Items, err = s.factory.AgentUpgrade().List(ctx, opts...)
+	if err != nil {
+		klog.Errorf("获取升级计划列表失败 %v", err)
+		pageResult.Message = err.Error()
+		return pageResult, err
+	}
+
+	return pageResult, nil
+}
+
+func (s *ServerController) PauseAgentUpgrade(ctx context.Context, upgradeId int64) error {
+	old, err := s.factory.AgentUpgrade().Get(ctx, upgradeId)
+	if err != nil {
+		return err
+	}
+	if old.Status != model.UpgradeRunningStatus {
+		return fmt.Errorf("升级计划%s，无法暂停", old.Status)
+	}
+	return s.factory.AgentUpgrade().Update(ctx, upgradeId, map[string]interface{}{"status": model.UpgradePausedStatus, "message": "已手动暂停"})
+}
+
+// ResumeAgentUpgrade 继续执行暂停的升级计划，当前批次失败的 agent 重新升级
+func (s *ServerController) ResumeAgentUpgrade(ctx context.Context, upgradeId int64) error {
+	old, err := s.factory.AgentUpgrade().Get(ctx, upgradeId)
+	if err != nil {
+		return err
+	}
+	if old.Status != model.UpgradePausedStatus {
+		return fmt.Errorf("升级计划%s，无法继续", old.Status)
+	}
+
+	targets, err := s.factory.AgentUpgrade().ListTargets(ctx, db.WithUpgrade(upgradeId))
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if target.Batch != old.Batch || target.Status != model.UpgradeTargetFailed {
+			continue
+		}
+		if err = s.factory.AgentUpgrade().UpdateTarget(ctx, target.Id, map[string]interface{}{"status": model.UpgradeTargetPending, "message": "重新升级", "wait_time": nil}); err != nil {
+			return err
+		}
+	}
+	return s.factory.AgentUpgrade().Update(ctx, upgradeId, map[string]interface{}{"status": model.UpgradeRunningStatus, "message": "已手动继续"})
+}
+
+// RollbackAgentUpgrade 将已升级的 agent 恢复到升级前的版本
+func (s *ServerController) RollbackAgentUpgrade(ctx context.Context, upgradeId int64) error {
+	old, err := s.factory.AgentUpgrade().Get(ctx, upgradeId)
+	if err != nil {
+		return err
+	}
+	if old.Status == model.UpgradeRollingBackStatus || old.Status == model.UpgradeRolledBackStatus {
+		return fmt.Errorf("升级计划%s", old.Status)
+	}
+	return s.factory.AgentUpgrade().Update(ctx, upgradeId, map[string]interface{}{"status": model.UpgradeRollingBackStatus, "message": "已手动回滚"})
+}
+
+// startAgentUpgradeController 按数据库中的状态推进升级计划，server 重启后可继续执行
+func (s *ServerController) startAgentUpgradeController(ctx context.Context) {
+	klog.Infof("starting agent upgrade controller")
+
+	ticker := time.NewTicker(agentUpgradeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, status := range []string{model.UpgradeRunningStatus, model.UpgradeRollingBackStatus} {
+			upgrades, err := s.factory.AgentUpgrade().List(ctx, db.WithStatus(status))
+			if err != nil {
+				klog.Errorf("获取%s的升级计划失败 %v", status, err)
+				continue
+			}
+			for i := range upgrades {
+				s.reconcileAgentUpgrade(ctx, &upgrades[i])
+			}
+		}
+	}
+}
+
+func (s *ServerController) reconcileAgentUpgrade(ctx context.Context, upgrade *model.AgentUpgrade) {
+	targets, err := s.factory.AgentUpgrade().ListTargets(ctx, db.WithUpgrade(upgrade.Id))
+	if err != nil {
+		klog.Errorf("获取升级计划(%s)的 agent 失败 %v", upgrade.Name, err)
+		return
+	}
+	if upgrade.Status == model.UpgradeRollingBackStatus {
+		s.rollbackAgentUpgrade(ctx, upgrade, targets)
+		return
+	}
+
+	var (
+		wg      sync.WaitGroup
+		current []*model.AgentUpgradeTarget
+	)
+	for i := range targets {
+		target := &targets[i]
+		if target.Batch != upgrade.Batch {
+			continue
+		}
+		current = append(current, target)
+
+		switch target.Status {
+		case model.UpgradeTargetPending:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.upgradeAgentTarget(ctx, upgrade, target)
+			}()
+		case model.UpgradeTargetChecking:
+			s.checkAgentTarget(ctx, upgrade, target)
+		}
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, target := range current {
+		switch target.Status {
+		case model.UpgradeTargetPending, model.UpgradeTargetChecking:
+			return
+		case model.UpgradeTargetFailed:
+			failed = append(failed, fmt.Sprintf("%s: %s", target.AgentName, target.Message))
+		}
+	}
+
+	batchName := fmt.Sprintf("第 %d 批", upgrade.Batch+1)
+	if upgrade.Batch == 0 {
+		batchName = "金丝雀批次"
+	}
+	if len(failed) != 0 {
+		message := fmt.Sprintf("%s升级失败 %s", batchName, strings.Join(failed, "; "))
+		status := model.UpgradePausedStatus
+		if upgrade.FailurePolicy == model.RollbackUpgradePolicy {
+			status = model.UpgradeRollingBackStatus
+		}
+		s.updateAgentUpgrade(ctx, upgrade, map[string]interface{}{"status": status, "message": message})
+		return
+	}
+
+	if upgrade.Batch+1 >= upgrade.BatchNum {
+		now := time.Now()
+		s.updateAgentUpgrade(ctx, upgrade, map[string]interface{}{"status": model.UpgradeCompletedStatus, "message": "全部升级完成", "end_time": &now})
+		return
+	}
+	s.updateAgentUpgrade(ctx, upgrade, map[string]interface{}{"batch": upgrade.Batch + 1, "message": fmt.Sprintf("%s升级完成", batchName)})
+}
+
+// upgradeAgentTarget 修改 agent 的目标版本并执行升级，完成后进入健康检查
+func (s *ServerController) upgradeAgentTarget(ctx context.Context, upgrade *model.AgentUpgrade, target *model.AgentUpgradeTarget) {
+	agent, err := s.factory.Agent().GetByName(ctx, target.AgentName)
+	if err != nil {
+		s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": fmt.Sprintf("获取 agent 失败 %v", err)})
+		return
+	}
+	// agent 有进行中的操作时，等待下次协同，超过健康检查超时时间仍未空闲视为失败
+	if s.IsAgentRunningStatus(agent.Status) {
+		if target.WaitTime == nil {
+			now := time.Now()
+			target.WaitTime = &now
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"message": fmt.Sprintf("agent 状态为%s，等待空闲", agent.Status), "wait_time": &now})
+			return
+		}
+		if time.Now().After(target.WaitTime.Add(time.Duration(upgrade.HealthTimeout) * time.Second)) {
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": fmt.Sprintf("等待 agent 空闲超时，当前状态 %s", agent.Status)})
+		}
+		return
+	}
+
+	if err = s.applyAgentVersion(ctx, upgrade.Type, agent, upgrade.Image, upgrade.BinaryVersion); err != nil {
+		s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetChecking, "message": "等待健康检查", "upgrade_time": &now})
+}
+
+// applyAgentVersion 更新 agent 的镜像或二进制版本并同步执行升级，失败时 agent 置为异常
+func (s *ServerController) applyAgentVersion(ctx context.Context, upgradeType string, agent *model.Agent, image string, binaryVersion string) error {
+	provisioner, err := s.agentProvisioner(ctx, agent)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"status": model.UpgradeAgentType, "image": image}
+	// kubernetes 部署时版本会覆盖镜像 tag，镜像升级时清空，回滚时恢复为升级前的版本
+	if agent.Provisioner == model.KubernetesProvisioner {
+		updates["binary_version"] = binaryVersion
+	}
+	if upgradeType == model.BinaryAgentUpgrade {
+		updates = map[string]interface{}{"status": model.UpgradeAgentBinaryType, "binary_version": binaryVersion}
+	}
+	if err = s.factory.Agent().Update(ctx, agent.Id, agent.ResourceVersion, updates); err != nil {
+		return fmt.Errorf("更新 agent 版本失败 %v", err)
+	}
+	newAgent, err := s.factory.Agent().GetByName(ctx, agent.Name)
+	if err != nil {
+		return err
+	}
+
+	if err = s.ReconcileAgent(ctx, provisioner, newAgent); err != nil {
+		_ = s.factory.Agent().UpdateByName(ctx, agent.Name, map[string]interface{}{"status": model.ErrorAgentType, "message": fmt.Sprintf("升级失败 %v", err)})
+		return fmt.Errorf("升级失败 %v", err)
+	}
+	return nil
+}
+
+// checkAgentTarget 升级后的 agent 上报的版本与目标一致且心跳恢复，并按需等到下一个任务成功后视为健康
+func (s *ServerController) checkAgentTarget(ctx context.Context, upgrade *model.AgentUpgrade, target *model.AgentUpgradeTarget) {
+	if target.UpgradeTime == nil {
+		return
+	}
+	agent, err := s.factory.Agent().GetByName(ctx, target.AgentName)
+	if err != nil {
+		klog.Errorf("获取 agent(%s) 失败 %v", target.AgentName, err)
+		return
+	}
+
+	upgradeTime := *target.UpgradeTime
+	timeout := time.Now().After(upgradeTime.Add(time.Duration(upgrade.HealthTimeout) * time.Second))
+
+	healthy := agent.Status == model.RunAgentType && agent.LastTransitionTime.After(upgradeTime)
+	if !healthy {
+		if timeout {
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": fmt.Sprintf("健康检查超时，心跳未恢复，当前状态 %s", agent.Status)})
+		}
+		return
+	}
+	// 旧进程或旧 pod 在退出前仍可能上报心跳，需确认上报的版本已是升级目标
+	if reason := s.agentUpgradeApplied(upgrade, agent); len(reason) != 0 {
+		if timeout {
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": fmt.Sprintf("健康检查超时，%s", reason)})
+		}
+		return
+	}
+	if !upgrade.RequireTask {
+		s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetSucceeded, "message": "心跳已恢复，版本已生效"})
+		return
+	}
+
+	tasks, err := s.factory.Task().List(ctx, db.WithAgent(agent.Name), db.WithModifiedAfter(upgradeTime), db.WithOrderByASC())
+	if err != nil {
+		klog.Errorf("获取 agent(%s) 的任务失败 %v", agent.Name, err)
+		return
+	}
+	for _, task := range tasks {
+		if task.Process == 2 && task.Status == types.TaskSyncSucceededStatus {
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetSucceeded, "message": fmt.Sprintf("心跳已恢复，任务(%d)执行成功", task.Id)})
+			return
+		}
+		if task.Process == 2 || task.Process == 3 {
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": fmt.Sprintf("任务(%d)执行失败 %s", task.Id, task.Status)})
+			return
+		}
+	}
+	if timeout {
+		s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetFailed, "message": "健康检查超时，没有执行成功的任务"})
+	}
+}
+
+// agentUpgradeApplied 比较 agent 上报的镜像或程序摘要与升级目标，不一致时返回原因
+func (s *ServerController) agentUpgradeApplied(upgrade *model.AgentUpgrade, agent *model.Agent) string {
+	if agent.Inventory == nil {
+		return "agent 未上报能力清单"
+	}
+
+	switch upgrade.Type {
+	case model.ImageAgentUpgrade:
+		// 与选择 agent 时使用同一个镜像，确保运行的是升级指定的镜像
+		image := s.agentRunImage(agent)
+		if image != upgrade.Image {
+			return fmt.Sprintf("agent 的运行镜像 %s 与升级镜像 %s 不一致", image, upgrade.Image)
+		}
+		if agent.Inventory.Image != image {
+			return fmt.Sprintf("上报的镜像 %s 与目标镜像 %s 不一致", agent.Inventory.Image, image)
+		}
+	case model.BinaryAgentUpgrade:
+		digest, err := util.FileDigest(s.agentBinaryPath(agent))
+		if err != nil {
+			return fmt.Sprintf("计算目标程序摘要失败 %v", err)
+		}
+		if agent.Inventory.BinaryDigest != digest {
+			return fmt.Sprintf("上报的程序摘要与目标版本 %s 不一致", upgrade.BinaryVersion)
+		}
+	}
+	return ""
+}
+
+// rollbackAgentUpgrade 恢复已执行升级的 agent，未开始的 agent 保持不变
+func (s *ServerController) rollbackAgentUpgrade(ctx context.Context, upgrade *model.AgentUpgrade, targets []model.AgentUpgradeTarget) {
+	var failed []string
+	for i := range targets {
+		target := &targets[i]
+		if target.Status == model.UpgradeTargetPending || target.Status == model.UpgradeTargetRolledBack {
+			continue
+		}
+
+		agent, err := s.factory.Agent().GetByName(ctx, target.AgentName)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", target.AgentName, err))
+			continue
+		}
+		if s.IsAgentRunningStatus(agent.Status) {
+			failed = append(failed, fmt.Sprintf("%s: 状态为%s", target.AgentName, agent.Status))
+			continue
+		}
+		if err = s.applyAgentVersion(ctx, upgrade.Type, agent, target.PrevImage, target.PrevBinaryVersion); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", target.AgentName, err))
+			s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"message": fmt.Sprintf("回滚失败 %v", err)})
+			continue
+		}
+		s.updateAgentUpgradeTarget(ctx, target, map[string]interface{}{"status": model.UpgradeTargetRolledBack, "message": "已回滚"})
+	}
+
+	if len(failed) != 0 {
+		s.updateAgentUpgrade(ctx, upgrade, map[string]interface{}{"status": model.UpgradePausedStatus, "message": fmt.Sprintf("部分 agent 回滚失败 %s", strings.Join(failed, "; "))})
+		return
+	}
+	now := time.Now()
+	s.updateAgentUpgrade(ctx, upgrade, map[string]interface{}{"status": model.UpgradeRolledBackStatus, "end_time": &now})
+}
+
+// updateAgentUpgrade 更新升级计划，状态变化时发送通知
+func (s *ServerController) updateAgentUpgrade(ctx context.Context, upgrade *model.AgentUpgrade, updates map[string]interface{}) {
+	if err := s.factory.AgentUpgrade().Update(ctx, upgrade.Id, updates); err != nil {
+		klog.Errorf("更新升级计划(%s)失败 %v", upgrade.Name, err)
+		return
+	}
+
+	status, ok := updates["status"].(string)
+	if !ok || status == upgrade.Status {
+		return
+	}
+	message, _ := updates["message"].(string)
+	klog.Infof("升级计划(%s) 状态由 %s 变为 %s %s", upgrade.Name, upgrade.Status, status, message)
+	if err := s.SendNotify(ctx, &types.SendNotificationRequest{
+		Content: fmt.Sprintf("agent 升级计划(%s) 状态由 %s 变为 %s %s", upgrade.Name, upgrade.Status, status, message),
+		CreateNotificationRequest: types.CreateNotificationRequest{
+			Role: types.SystemNotifyRole,
+		},
+	}); err != nil {
+		klog.Errorf("发送升级计划(%s)通知失败 %v", upgrade.Name, err)
+	}
+}
+
+func (s *ServerController) updateAgentUpgradeTarget(ctx context.Context, target *model.AgentUpgradeTarget, updates map[string]interface{}) {
+	if err := s.factory.AgentUpgrade().UpdateTarget(ctx, target.Id, updates); err != nil {
+		klog.Errorf("更新 agent(%s) 升级状态失败 %v", target.AgentName, err)
+		return
+	}
+	if status, ok := updates["status"].(string); ok {
+		target.Status = status
+	}
+	if message, ok := updates["message"].(string); ok {
+		target.Message = message
+	}
+}
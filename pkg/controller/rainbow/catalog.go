@@ -0,0 +1,154 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util/errors"
+)
+
+// SearchCatalog 镜像目录的分面搜索，按镜像和版本的属性过滤，并返回各分面的取值统计
+func (s *ServerController) SearchCatalog(ctx context.Context, req types.CatalogSearchRequest) (interface{}, error) {
+	filter, err := s.makeCatalogFilter(&req)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.scopeCatalogFilter(ctx, req, &filter); err != nil {
+		return nil, err
+	}
+
+	images, total, err := s.factory.Catalog().Search(ctx, filter)
+	if err != nil {
+		klog.Errorf("搜索镜像目录失败 %v", err)
+		return nil, err
+	}
+	result := types.CatalogSearchResult{
+		PageResult: types.PageResult{
+			PageRequest: req.PageRequest,
+			Total:       total,
+			Items:       images,
+		},
+	}
+
+	if req.Facets {
+		facets, err := s.factory.Catalog().Facets(ctx, filter)
+		if err != nil {
+			klog.Errorf("统计镜像目录分面失败 %v", err)
+			return nil, err
+		}
+		result.Facets = make(map[string][]types.FacetCount, len(facets))
+		for facet, counts := range facets {
+			items := make([]types.FacetCount, 0, len(counts))
+			for _, c := range counts {
+				items = append(items, types.FacetCount{Value: c.Value, Label: c.Label, Count: c.Count})
+			}
+			result.Facets[facet] = items
+		}
+	}
+
+	go s.AfterListImages(ctx, images, 5*time.Second)
+	return result, nil
+}
+
+func (s *ServerController) makeCatalogFilter(req *types.CatalogSearchRequest) (db.CatalogFilter, error) {
+	labelIds, err := s.parseLabelIds(req.LabelIds)
+	if err != nil {
+		return db.CatalogFilter{}, err
+	}
+
+	switch req.SortBy {
+	case "", db.CatalogSortPulls, db.CatalogSortRecent, db.CatalogSortSize, db.CatalogSortName:
+	default:
+		return db.CatalogFilter{}, fmt.Errorf("不支持的排序方式 %s", req.SortBy)
+	}
+	if req.MaxSize > 0 && req.MinSize > req.MaxSize {
+		return db.CatalogFilter{}, fmt.Errorf("min_size 不能大于 max_size")
+	}
+
+	// 分页与 ListOptions 的默认值保持一致
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.Limit <= 0 {
+		req.Limit = 10
+	}
+	if req.Limit > 100 {
+		req.Limit = 100
+	}
+
+	filter := db.CatalogFilter{
+		Query:     strings.TrimSpace(req.Query),
+		FullText:  s.cfg.Catalog.FullText,
+		Namespace: req.Namespace,
+		LabelIds:  labelIds,
+		Owner:     req.Owner,
+		Public:    req.IsPublic,
+		Official:  req.IsOfficial,
+		MinSize:   req.MinSize,
+		MaxSize:   req.MaxSize,
+		Arch:      req.Arch,
+		Hub:       req.Hub,
+		TagStatus: req.TagStatus,
+		SortBy:    req.SortBy,
+		Asc:       strings.ToLower(req.Order) == "asc",
+		Offset:    (req.Page - 1) * req.Limit,
+		Limit:     req.Limit,
+	}
+	if req.SyncedAfter > 0 {
+		t := time.Unix(req.SyncedAfter, 0)
+		filter.SyncedAfter = &t
+	}
+	if req.SyncedBefore > 0 {
+		t := time.Unix(req.SyncedBefore, 0)
+		filter.SyncedBefore = &t
+	}
+	return filter, nil
+}
+
+// scopeCatalogFilter 非管理员只能查看公开镜像，查询自己的镜像时可以看到私有镜像
+func (s *ServerController) scopeCatalogFilter(ctx context.Context, req types.CatalogSearchRequest, filter *db.CatalogFilter) error {
+	admin, err := s.isAdminUser(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	if admin {
+		return nil
+	}
+
+	filter.Scoped = true
+	filter.Viewer = req.UserId
+	if len(req.UserId) == 0 || req.Owner != req.UserId {
+		public := true
+		filter.Public = &public
+	}
+	return nil
+}
+
+// isAdminUser 用户为管理员时可以查看全部镜像，未指定或不存在的用户按普通用户处理
+func (s *ServerController) isAdminUser(ctx context.Context, userId string) (bool, error) {
+	if len(userId) == 0 {
+		return false, nil
+	}
+	user, err := s.factory.Task().GetUser(ctx, userId)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		klog.Errorf("获取用户 %s 失败 %v", userId, err)
+		return false, err
+	}
+	return user.Role == types.AdminUserRole, nil
+}
+
+// ensureCatalogIndexes 补齐目录搜索的索引，已有数据量较大时建索引耗时较长，因此异步执行
+func (s *ServerController) ensureCatalogIndexes(ctx context.Context) {
+	if err := s.factory.Catalog().EnsureIndexes(ctx, s.cfg.Catalog.FullText); err != nil {
+		klog.Errorf("创建镜像目录索引失败 %v", err)
+	}
+}
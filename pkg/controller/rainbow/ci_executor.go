@@ -0,0 +1,635 @@
+package rainbow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	ciRequestTimeout = 30 * time.Second
+
+	defaultCIRepo = "plugin"
+
+	// github workflow_dispatch 默认使用的 workflow 和分支，workflow 模板见 hack/ci/github/plugin.yml
+	defaultCIWorkflow   = "plugin.yml"
+	defaultCIRef        = "master"
+	githubRunNamePrefix = "rainbow-task-"
+
+	// 查找运行记录时允许 agent 与 CI 后端的时钟偏差
+	ciClockSkew = time.Minute
+)
+
+// errCIRunLogsUnsupported CI 后端未提供获取运行日志的接口
+var errCIRunLogsUnsupported = errors.New("CI 后端不支持获取运行日志")
+
+// CIRun 任务对应的一次流水线运行，以任务 ID 作为分支名
+type CIRun struct {
+	TaskId  int64
+	Branch  string
+	RepoDir string // 本地 plugin 仓库目录
+
+	// TriggerTime 触发时间，为零值时查找任务最近一次运行
+	TriggerTime time.Time
+	// Token 和 Callback 用于 runner 从 server 获取任务配置
+	Token    string
+	Callback string
+}
+
+func newCIRun(baseDir string, taskId int64) *CIRun {
+	branch := fmt.Sprintf("%d", taskId)
+	return &CIRun{TaskId: taskId, Branch: branch, RepoDir: filepath.Join(baseDir, branch, "plugin")}
+}
+
+// CIExecutor agent 执行任务的 CI 后端，按 agent 配置的 ci_type 选择
+type CIExecutor interface {
+	// ListRepos 获取账号下已存在的仓库名称
+	ListRepos(ctx context.Context) ([]string, error)
+	// PrepareRepo 创建执行任务使用的私有仓库
+	PrepareRepo(ctx context.Context, repo string) error
+
+	// RemoteConfig 为 true 时 runner 使用任务凭证从 server 获取配置，触发时不下发配置
+	RemoteConfig() bool
+	// TriggerRun 触发任务的流水线运行，github 配置 workflow 时使用 workflow_dispatch，其他情况推送任务分支
+	TriggerRun(ctx context.Context, run *CIRun, config []byte) error
+	// GetRun 获取任务在触发时间之后最近一次流水线的状态
+	GetRun(ctx context.Context, run *CIRun) (*types.CIRunResult, error)
+	// GetRunLogs 获取流水线的运行日志，不支持时返回 errCIRunLogsUnsupported
+	GetRunLogs(ctx context.Context, run *CIRun, result *types.CIRunResult) (string, error)
+	// Cleanup 删除远端的任务分支，分支不存在时忽略
+	Cleanup(ctx context.Context, run *CIRun) error
+
+	// MonthlyUsage 获取账号当月的开销，单位美金，不计费的后端返回 0
+	MonthlyUsage(ctx context.Context) (float64, error)
+}
+
+func newCIExecutor(agent *model.Agent) (CIExecutor, error) {
+	base := ciBase{user: agent.GithubUser, token: agent.GithubToken, repo: ciRepoName(agent)}
+
+	switch agent.CIType {
+	case "", types.CIGithub:
+		switch agent.CITrigger {
+		case types.CITriggerPush:
+			return &githubExecutor{ciBase: base}, nil
+		case "", types.CITriggerDispatch:
+		default:
+			return nil, fmt.Errorf("agent(%s) 不支持的触发方式 %s", agent.Name, agent.CITrigger)
+		}
+		workflow, ref := agent.CIWorkflow, agent.CIRef
+		if len(workflow) == 0 {
+			workflow = defaultCIWorkflow
+		}
+		if len(ref) == 0 {
+			ref = defaultCIRef
+		}
+		return &githubExecutor{ciBase: base, workflow: workflow, ref: ref}, nil
+	case types.CIGitlab:
+		if len(agent.CIEndpoint) == 0 {
+			return nil, fmt.Errorf("agent(%s) 使用 gitlab 时需配置 ci_endpoint", agent.Name)
+		}
+		return &gitlabExecutor{ciBase: base, api: strings.TrimSuffix(agent.CIEndpoint, "/") + "/api/v4"}, nil
+	case types.CIGitea:
+		if len(agent.CIEndpoint) == 0 {
+			return nil, fmt.Errorf("agent(%s) 使用 gitea 时需配置 ci_endpoint", agent.Name)
+		}
+		return &giteaExecutor{ciBase: base, api: strings.TrimSuffix(agent.CIEndpoint, "/") + "/api/v1"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported ci type %s", agent.CIType)
+	}
+}
+
+// validateAgentCI 校验 agent 的 CI 后端配置
+func validateAgentCI(ciType string, endpoint string, trigger string) error {
+	switch ciType {
+	case "", types.CIGithub:
+		switch trigger {
+		case "", types.CITriggerDispatch, types.CITriggerPush:
+			return nil
+		default:
+			return fmt.Errorf("不支持的触发方式 %s", trigger)
+		}
+	case types.CIGitlab, types.CIGitea:
+		if len(endpoint) == 0 {
+			return fmt.Errorf("%s 需指定 ci_endpoint", ciType)
+		}
+		return nil
+	default:
+		return fmt.Errorf("不支持的 CI 后端 %s", ciType)
+	}
+}
+
+// ciRepoName 从仓库地址中解析仓库名称，未配置时使用 plugin
+func ciRepoName(agent *model.Agent) string {
+	repo := strings.TrimSuffix(strings.TrimSuffix(agent.GithubRepository, "/"), ".git")
+	if len(repo) == 0 {
+		return defaultCIRepo
+	}
+	return path.Base(repo)
+}
+
+// ciRepositoryURL 获取不带认证信息的仓库地址
+func ciRepositoryURL(ciType string, endpoint string, user string) string {
+	switch ciType {
+	case types.CIGitlab, types.CIGitea:
+		return fmt.Sprintf("%s/%s/%s.git", strings.TrimSuffix(endpoint, "/"), user, defaultCIRepo)
+	default:
+		return fmt.Sprintf("https://github.com/%s/%s.git", user, defaultCIRepo)
+	}
+}
+
+// ciRemoteURL 获取 agent plugin 仓库带认证信息的 git remote 地址
+func ciRemoteURL(agent *model.Agent) (string, error) {
+	repo := ciRepoName(agent)
+	switch agent.CIType {
+	case "", types.CIGithub:
+		return fmt.Sprintf("https://%s:%s@github.com/%s/%s.git", agent.GithubUser, agent.GithubToken, agent.GithubUser, repo), nil
+	case types.CIGitlab, types.CIGitea:
+		u, err := url.Parse(agent.CIEndpoint)
+		if err != nil || len(u.Host) == 0 {
+			return "", fmt.Errorf("agent(%s) ci_endpoint(%s) 不合法", agent.Name, agent.CIEndpoint)
+		}
+		// gitlab 使用 token 认证时用户名固定为 oauth2
+		username := agent.GithubUser
+		if agent.CIType == types.CIGitlab {
+			username = "oauth2"
+		}
+		u.User = url.UserPassword(username, agent.GithubToken)
+		u.Path = path.Join(u.Path, agent.GithubUser, repo+".git")
+		return u.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported ci type %s", agent.CIType)
+	}
+}
+
+// ciBase 各后端均通过推送任务分支触发流水线
+type ciBase struct {
+	user  string
+	token string
+	repo  string
+}
+
+func (b ciBase) RemoteConfig() bool {
+	return false
+}
+
+func (b ciBase) TriggerRun(ctx context.Context, run *CIRun, config []byte) error {
+	git := util.NewGit(run.RepoDir, run.Branch, run.Branch+"-"+time.Now().String())
+	if err := git.Checkout(); err != nil {
+		return err
+	}
+	if err := util.WriteIntoFile(string(config), run.RepoDir+"/config.yaml"); err != nil {
+		return err
+	}
+	return git.Push()
+}
+
+func (b ciBase) Cleanup(ctx context.Context, run *CIRun) error {
+	return util.NewGit(run.RepoDir, run.Branch, "").DeleteRemoteBranch()
+}
+
+// ciStatusError CI 后端接口返回的非成功状态码
+type ciStatusError struct {
+	code    int
+	message string
+}
+
+func (e *ciStatusError) Error() string {
+	return e.message
+}
+
+func isCIStatus(err error, codes ...int) bool {
+	var statusErr *ciStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	for _, code := range codes {
+		if statusErr.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ciRequest 调用 CI 后端接口，val 不为空时解析 json 结果
+func ciRequest(ctx context.Context, method string, url string, headers map[string]string, body interface{}, val interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: ciRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, &ciStatusError{code: resp.StatusCode, message: fmt.Sprintf("%s %s 失败 %s %s", method, url, resp.Status, string(data))}
+	}
+	if val != nil && len(data) != 0 {
+		if err = json.Unmarshal(data, val); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// githubExecutor 默认通过 workflow_dispatch 触发运行，不再为每个任务创建分支，
+// workflow 需声明 task_id, token 和 callback 输入，并设置 run-name 为 rainbow-task-${{ inputs.task_id }} 用于查找运行，
+// ci_trigger 配置为 push 时兼容已有仓库，推送任务分支触发
+type githubExecutor struct {
+	ciBase
+	workflow string
+	ref      string
+}
+
+func (e *githubExecutor) dispatch() bool {
+	return len(e.workflow) != 0
+}
+
+func (e *githubExecutor) runName(run *CIRun) string {
+	return fmt.Sprintf("%s%d", githubRunNamePrefix, run.TaskId)
+}
+
+// RemoteConfig workflow 输入在运行页面和接口中可见，仅下发任务凭证，由 runner 获取配置
+func (e *githubExecutor) RemoteConfig() bool {
+	return e.dispatch()
+}
+
+func (e *githubExecutor) TriggerRun(ctx context.Context, run *CIRun, config []byte) error {
+	if !e.dispatch() {
+		return e.ciBase.TriggerRun(ctx, run, config)
+	}
+
+	u := fmt.Sprintf("%s/repos/%s/%s/actions/workflows/%s/dispatches", types.GithubAPIBase, e.user, e.repo, e.workflow)
+	_, err := ciRequest(ctx, http.MethodPost, u, e.headers(), map[string]interface{}{
+		"ref": e.ref,
+		"inputs": map[string]string{
+			"task_id":  fmt.Sprintf("%d", run.TaskId),
+			"token":    run.Token,
+			"callback": run.Callback,
+		},
+	}, nil)
+	return err
+}
+
+// Cleanup 删除按任务创建的分支，分支不存在时忽略，workflow_dispatch 触发时不创建分支
+func (e *githubExecutor) Cleanup(ctx context.Context, run *CIRun) error {
+	if e.dispatch() {
+		return nil
+	}
+	u := fmt.Sprintf("%s/repos/%s/%s/git/refs/heads/%s", types.GithubAPIBase, e.user, e.repo, run.Branch)
+	if _, err := ciRequest(ctx, http.MethodDelete, u, e.headers(), nil, nil); err != nil && !isCIStatus(err, http.StatusNotFound, http.StatusUnprocessableEntity) {
+		return err
+	}
+	return nil
+}
+
+func (e *githubExecutor) headers() map[string]string {
+	return map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"Authorization":        fmt.Sprintf("Bearer %s", e.token),
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+}
+
+func (e *githubExecutor) ListRepos(ctx context.Context) ([]string, error) {
+	var repos []types.GitHubRepository
+	if _, err := ciRequest(ctx, http.MethodGet, types.GithubAPIBase+"/user/repos?per_page=100", e.headers(), nil, &repos); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return names, nil
+}
+
+func (e *githubExecutor) PrepareRepo(ctx context.Context, repo string) error {
+	_, err := ciRequest(ctx, http.MethodPost, types.GithubAPIBase+"/user/repos", e.headers(), map[string]interface{}{"name": repo, "private": true}, nil)
+	return err
+}
+
+func (e *githubExecutor) GetRun(ctx context.Context, run *CIRun) (*types.CIRunResult, error) {
+	var runs struct {
+		WorkflowRuns []struct {
+			Id           int64     `json:"id"`
+			DisplayTitle string    `json:"display_title"`
+			HeadBranch   string    `json:"head_branch"`
+			Status       string    `json:"status"`
+			Conclusion   string    `json:"conclusion"`
+			HtmlURL      string    `json:"html_url"`
+			CreatedAt    time.Time `json:"created_at"`
+		} `json:"workflow_runs"`
+	}
+	query := url.Values{"per_page": []string{"50"}}
+	if e.dispatch() {
+		query.Set("event", "workflow_dispatch")
+	} else {
+		query.Set("event", "push")
+		query.Set("branch", run.Branch)
+	}
+	after := run.TriggerTime.Add(-ciClockSkew)
+	if !run.TriggerTime.IsZero() {
+		query.Set("created", ">="+after.UTC().Format(time.RFC3339))
+	}
+	u := fmt.Sprintf("%s/repos/%s/%s/actions/runs?%s", types.GithubAPIBase, e.user, e.repo, query.Encode())
+	if e.dispatch() {
+		u = fmt.Sprintf("%s/repos/%s/%s/actions/workflows/%s/runs?%s", types.GithubAPIBase, e.user, e.repo, e.workflow, query.Encode())
+	}
+	if _, err := ciRequest(ctx, http.MethodGet, u, e.headers(), nil, &runs); err != nil {
+		return nil, err
+	}
+
+	// 按创建时间倒序返回，取触发之后任务最近一次运行，避免重新执行时取到上一次的运行
+	index := -1
+	for i, r := range runs.WorkflowRuns {
+		if !run.TriggerTime.IsZero() && r.CreatedAt.Before(after) {
+			continue
+		}
+		if (e.dispatch() && r.DisplayTitle == e.runName(run)) || (!e.dispatch() && r.HeadBranch == run.Branch) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return &types.CIRunResult{Status: types.CIRunNotFound}, nil
+	}
+
+	r := runs.WorkflowRuns[index]
+	result := &types.CIRunResult{Id: fmt.Sprintf("%d", r.Id), URL: r.HtmlURL}
+	switch r.Status {
+	case "in_progress":
+		result.Status = types.CIRunRunning
+	case "completed":
+		result.Status = types.CIRunFailed
+		if r.Conclusion == "success" {
+			result.Status = types.CIRunSucceeded
+		}
+	default:
+		result.Status = types.CIRunPending
+	}
+	return result, nil
+}
+
+func (e *githubExecutor) GetRunLogs(ctx context.Context, run *CIRun, result *types.CIRunResult) (string, error) {
+	var jobs struct {
+		Jobs []struct {
+			Id   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"jobs"`
+	}
+	u := fmt.Sprintf("%s/repos/%s/%s/actions/runs/%s/jobs", types.GithubAPIBase, e.user, e.repo, result.Id)
+	if _, err := ciRequest(ctx, http.MethodGet, u, e.headers(), nil, &jobs); err != nil {
+		return "", err
+	}
+
+	var logs strings.Builder
+	for _, job := range jobs.Jobs {
+		data, err := ciRequest(ctx, http.MethodGet, fmt.Sprintf("%s/repos/%s/%s/actions/jobs/%d/logs", types.GithubAPIBase, e.user, e.repo, job.Id), e.headers(), nil, nil)
+		if err != nil {
+			klog.Warningf("获取 job(%s) 日志失败 %v", job.Name, err)
+			continue
+		}
+		logs.WriteString(fmt.Sprintf("=== %s ===\n%s\n", job.Name, string(data)))
+	}
+	return logs.String(), nil
+}
+
+func (e *githubExecutor) MonthlyUsage(ctx context.Context) (float64, error) {
+	month := time.Now().Format("1")
+	u := fmt.Sprintf("%s/users/%s/settings/billing/usage?month=%s", types.GithubAPIBase, e.user, month)
+	klog.Infof("当前 %s 月, 将通过请求 %s 获取本月账单", month, u)
+
+	var ud UsageData
+	if _, err := ciRequest(ctx, http.MethodGet, u, e.headers(), nil, &ud); err != nil {
+		return 0, err
+	}
+
+	var grossAmount float64 = 0
+	for _, item := range ud.UsageItems {
+		grossAmount += item.GrossAmount
+	}
+	return math.Round(grossAmount*1000) / 1000, nil
+}
+
+type gitlabExecutor struct {
+	ciBase
+	api string
+}
+
+func (e *gitlabExecutor) headers() map[string]string {
+	return map[string]string{"PRIVATE-TOKEN": e.token}
+}
+
+func (e *gitlabExecutor) project() string {
+	return url.PathEscape(e.user + "/" + e.repo)
+}
+
+func (e *gitlabExecutor) ListRepos(ctx context.Context) ([]string, error) {
+	var projects []struct {
+		Path string `json:"path"`
+	}
+	if _, err := ciRequest(ctx, http.MethodGet, e.api+"/projects?owned=true&per_page=100", e.headers(), nil, &projects); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(projects))
+	for _, p := range projects {
+		names = append(names, p.Path)
+	}
+	return names, nil
+}
+
+func (e *gitlabExecutor) PrepareRepo(ctx context.Context, repo string) error {
+	_, err := ciRequest(ctx, http.MethodPost, e.api+"/projects", e.headers(), map[string]interface{}{"name": repo, "path": repo, "visibility": "private"}, nil)
+	return err
+}
+
+func (e *gitlabExecutor) GetRun(ctx context.Context, run *CIRun) (*types.CIRunResult, error) {
+	var pipelines []struct {
+		Id        int64     `json:"id"`
+		Status    string    `json:"status"`
+		WebURL    string    `json:"web_url"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	query := url.Values{}
+	query.Set("ref", run.Branch)
+	query.Set("per_page", "20")
+	after := run.TriggerTime.Add(-ciClockSkew)
+	if !run.TriggerTime.IsZero() {
+		query.Set("updated_after", after.UTC().Format(time.RFC3339))
+	}
+	u := fmt.Sprintf("%s/projects/%s/pipelines?%s", e.api, e.project(), query.Encode())
+	if _, err := ciRequest(ctx, http.MethodGet, u, e.headers(), nil, &pipelines); err != nil {
+		return nil, err
+	}
+
+	// 按 id 倒序返回，取触发之后任务分支最近一次的 pipeline，避免重新执行时取到上一次的 pipeline
+	index := -1
+	for i, p := range pipelines {
+		if !run.TriggerTime.IsZero() && p.CreatedAt.Before(after) {
+			continue
+		}
+		index = i
+		break
+	}
+	if index < 0 {
+		return &types.CIRunResult{Status: types.CIRunNotFound}, nil
+	}
+
+	p := pipelines[index]
+	result := &types.CIRunResult{Id: fmt.Sprintf("%d", p.Id), URL: p.WebURL}
+	switch p.Status {
+	case "running":
+		result.Status = types.CIRunRunning
+	case "success":
+		result.Status = types.CIRunSucceeded
+	case "failed", "canceled", "skipped":
+		result.Status = types.CIRunFailed
+	default:
+		result.Status = types.CIRunPending
+	}
+	return result, nil
+}
+
+func (e *gitlabExecutor) GetRunLogs(ctx context.Context, run *CIRun, result *types.CIRunResult) (string, error) {
+	var jobs []struct {
+		Id   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	if _, err := ciRequest(ctx, http.MethodGet, fmt.Sprintf("%s/projects/%s/pipelines/%s/jobs", e.api, e.project(), result.Id), e.headers(), nil, &jobs); err != nil {
+		return "", err
+	}
+
+	var logs strings.Builder
+	for _, job := range jobs {
+		data, err := ciRequest(ctx, http.MethodGet, fmt.Sprintf("%s/projects/%s/jobs/%d/trace", e.api, e.project(), job.Id), e.headers(), nil, nil)
+		if err != nil {
+			klog.Warningf("获取 job(%s) 日志失败 %v", job.Name, err)
+			continue
+		}
+		logs.WriteString(fmt.Sprintf("=== %s ===\n%s\n", job.Name, string(data)))
+	}
+	return logs.String(), nil
+}
+
+// MonthlyUsage 使用自建 runner，不产生开销
+func (e *gitlabExecutor) MonthlyUsage(ctx context.Context) (float64, error) {
+	return 0, nil
+}
+
+// giteaExecutor 同样适用于 forgejo
+type giteaExecutor struct {
+	ciBase
+	api string
+}
+
+func (e *giteaExecutor) headers() map[string]string {
+	return map[string]string{"Authorization": "token " + e.token}
+}
+
+func (e *giteaExecutor) ListRepos(ctx context.Context) ([]string, error) {
+	var repos []types.GitHubRepository
+	if _, err := ciRequest(ctx, http.MethodGet, e.api+"/user/repos?limit=50", e.headers(), nil, &repos); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return names, nil
+}
+
+func (e *giteaExecutor) PrepareRepo(ctx context.Context, repo string) error {
+	_, err := ciRequest(ctx, http.MethodPost, e.api+"/user/repos", e.headers(), map[string]interface{}{"name": repo, "private": true}, nil)
+	return err
+}
+
+func (e *giteaExecutor) GetRun(ctx context.Context, run *CIRun) (*types.CIRunResult, error) {
+	var tasks struct {
+		WorkflowRuns []struct {
+			Id         int64     `json:"id"`
+			HeadBranch string    `json:"head_branch"`
+			Status     string    `json:"status"`
+			URL        string    `json:"url"`
+			CreatedAt  time.Time `json:"created_at"`
+		} `json:"workflow_runs"`
+	}
+	u := fmt.Sprintf("%s/repos/%s/%s/actions/tasks?limit=50", e.api, e.user, e.repo)
+	if _, err := ciRequest(ctx, http.MethodGet, u, e.headers(), nil, &tasks); err != nil {
+		return nil, err
+	}
+
+	// 按创建时间倒序返回，取触发之后任务分支最近一次运行，避免重新执行时取到上一次的运行
+	after := run.TriggerTime.Add(-ciClockSkew)
+	for _, t := range tasks.WorkflowRuns {
+		if t.HeadBranch != run.Branch {
+			continue
+		}
+		if !run.TriggerTime.IsZero() && t.CreatedAt.Before(after) {
+			continue
+		}
+		result := &types.CIRunResult{Id: fmt.Sprintf("%d", t.Id), URL: t.URL}
+		switch t.Status {
+		case "running":
+			result.Status = types.CIRunRunning
+		case "success":
+			result.Status = types.CIRunSucceeded
+		case "failure", "cancelled", "skipped":
+			result.Status = types.CIRunFailed
+		default:
+			result.Status = types.CIRunPending
+		}
+		return result, nil
+	}
+	return &types.CIRunResult{Status: types.CIRunNotFound}, nil
+}
+
+// GetRunLogs gitea 的 actions 接口不提供运行日志，需在运行页面查看
+func (e *giteaExecutor) GetRunLogs(ctx context.Context, run *CIRun, result *types.CIRunResult) (string, error) {
+	return "", errCIRunLogsUnsupported
+}
+
+// MonthlyUsage 使用自建 runner，不产生开销
+func (e *giteaExecutor) MonthlyUsage(ctx context.Context) (float64, error) {
+	return 0, nil
+}
@@ -29,11 +29,15 @@ func (s *ServerController) CreateImage(ctx context.Context, req *types.CreateIma
 }
 
 func (s *ServerController) UpdateImage(ctx context.Context, req *types.UpdateImageRequest) error {
+	// 锁定状态只能通过锁定接口修改，以便记录审计事件
+	if req.IsLocked != nil {
+		return fmt.Errorf("不支持通过更新镜像修改锁定状态，请使用镜像锁定接口")
+	}
+
 	updates := make(map[string]interface{})
 	updates["logo"] = req.Logo
 	updates["description"] = req.Description
 	updates["is_public"] = req.IsPublic
-	updates["is_locked"] = req.IsLocked
 	return s.factory.Image().Update(ctx, req.Id, req.ResourceVersion, updates)
 }
 
@@ -98,13 +102,21 @@ func (s *ServerController) UpdateImageStatus(ctx context.Context, req *types.Upd
 
 	parts := strings.Split(req.Target, ":")
 	tag := parts[1]
-	if err = s.factory.Image().UpdateTag(ctx, req.ImageId, tag, map[string]interface{}{"status": req.Status, "message": req.Message}); err != nil {
+	tagUpdates := map[string]interface{}{"status": req.Status, "message": req.Message}
+	if len(req.SignatureStatus) != 0 {
+		tagUpdates["signature_status"] = req.SignatureStatus
+		tagUpdates["signature_message"] = req.SignatureMessage
+		tagUpdates["artifact_count"] = req.ArtifactCount
+	}
+	if err = s.factory.Image().UpdateTag(ctx, req.ImageId, tag, tagUpdates); err != nil {
 		klog.Errorf("更新镜像(%d)的版本(%d)状态失败:%v", req.ImageId, tag, err)
 		return err
 	}
 
 	// 当状态已经变成完成时，更新镜像的修改时间
 	if req.Status == types.SyncImageComplete {
+		s.enqueueImageTagScan(ctx, req.ImageId, tag)
+
 		targetName := old.Name
 		if strings.Contains(targetName, "/") {
 			targetName = strings.ReplaceAll(targetName, "/", "$")
@@ -201,10 +213,11 @@ func (s *ServerController) DeleteImage(ctx context.Context, imageId int64) error
 	image, err := s.factory.Image().Get(ctx, imageId, false)
 	if err != nil {
 		klog.Errorf("获取镜像(%d)失败: %v", imageId, err)
+		return err
 	}
-	// 检查 Lock 字段，如果为 true 则不允许删除
-	if image.IsLocked {
-		return fmt.Errorf("镜像被锁定，不允许删除")
+	// 镜像或其任一版本被锁定时不允许删除
+	if err = s.checkImageDeletable(ctx, image); err != nil {
+		return err
 	}
 
 	if err = s.factory.Image().Delete(ctx, imageId); err != nil {
@@ -463,6 +476,15 @@ func (s *ServerController) ListImagesByIds(ctx context.Context, ids []int64) (in
 }
 
 func (s *ServerController) DeleteImagesByIds(ctx context.Context, ids []int64) error {
+	images, err := s.factory.Image().List(ctx, db.WithIDIn(ids...))
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		if err = s.checkImageDeletable(ctx, &images[i]); err != nil {
+			return err
+		}
+	}
 	return s.factory.Image().DeleteInBatch(ctx, ids)
 }
 
@@ -546,10 +568,13 @@ func (s *ServerController) UpdateTagFromRemote(ctx context.Context, newTag swrmo
 }
 
 func (s *ServerController) UpdateImageInfoFromRemote(ctx context.Context, newImage *swrmodel.ShowRepositoryResponse, old *model.Image) error {
-	updates := make(map[string]interface{})
 	if old.Pull != *newImage.NumDownload {
-		updates["pull"] = *newImage.NumDownload
+		if err := s.syncImagePull(ctx, old, *newImage.NumDownload); err != nil {
+			return err
+		}
 	}
+
+	updates := make(map[string]interface{})
 	if old.Size != *newImage.Size {
 		updates["size"] = *newImage.Size
 		updates["read_size"] = ByteSizeSimple(*newImage.Size)
@@ -679,10 +704,17 @@ func (s *ServerController) afterDeleteImageTag(ctx context.Context, image *model
 }
 
 func (s *ServerController) DeleteImageTag(ctx context.Context, imageId int64, tagId int64) error {
+	if err := s.checkTagDeletable(ctx, imageId, tagId); err != nil {
+		return err
+	}
+
 	err := s.factory.Image().DeleteTag(ctx, tagId)
 	if err != nil {
 		return fmt.Errorf("删除镜像(%d) tag %s 失败:%v", imageId, tagId, err)
 	}
+	if err = s.factory.Scan().DeleteReport(ctx, tagId); err != nil {
+		klog.Warningf("删除镜像版本(%d)的扫描报告失败 %v", tagId, err)
+	}
 
 	delTag, err := s.factory.Image().GetTag(ctx, tagId, true)
 	if err != nil {
@@ -0,0 +1,281 @@
+package rainbow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	imageInspectPrefix = "image-inspect:"
+	// 已知 digest 的解析结果不会变化，缓存较长时间
+	imageInspectDigestTTL = 7 * 24 * time.Hour
+
+	dockerhubRegistryEndpoint = "https://registry-1.docker.io"
+)
+
+// ociImageConfig 镜像 config blob，兼容 OCI 和 docker 格式
+type ociImageConfig struct {
+	Created      time.Time `json:"created"`
+	Author       string    `json:"author"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant"`
+	Config       struct {
+		User         string              `json:"User"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		Labels       map[string]string   `json:"Labels"`
+		StopSignal   string              `json:"StopSignal"`
+	} `json:"config"`
+	History []struct {
+		Created    time.Time `json:"created"`
+		CreatedBy  string    `json:"created_by"`
+		Comment    string    `json:"comment"`
+		EmptyLayer bool      `json:"empty_layer"`
+	} `json:"history"`
+}
+
+// inspectImage 解析镜像的 manifest 和 config，多架构镜像逐个平台解析，arch 不为空时只解析指定平台
+func inspectImage(ctx context.Context, client *ociClient, repo string, reference string, arch string) (*types.ImageInspectResult, error) {
+	m, digest, err := client.GetManifest(ctx, repo, reference)
+	if err != nil {
+		return nil, err
+	}
+	result := &types.ImageInspectResult{Image: repo, Tag: reference, Digest: digest, MediaType: m.MediaType}
+
+	if !m.isIndex() {
+		platform, err := inspectPlatform(ctx, client, repo, digest, m)
+		if err != nil {
+			return nil, err
+		}
+		result.Platforms = append(result.Platforms, *platform)
+		return result, nil
+	}
+
+	for _, mf := range m.Manifests {
+		// 忽略 attestation 等非镜像 manifest
+		if mf.Platform.OS == "unknown" {
+			continue
+		}
+		var variant string
+		if mf.Platform.Variant != nil {
+			variant = *mf.Platform.Variant
+		}
+		if !matchPlatform(arch, mf.Platform.OS, mf.Platform.Architecture, variant) {
+			continue
+		}
+
+		sub, _, err := client.GetManifest(ctx, repo, mf.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("获取平台(%s/%s) manifest 失败 %v", mf.Platform.OS, mf.Platform.Architecture, err)
+		}
+		platform, err := inspectPlatform(ctx, client, repo, mf.Digest, sub)
+		if err != nil {
+			return nil, err
+		}
+		// config 中没有平台信息时以 index 为准
+		if len(platform.OS) == 0 {
+			platform.OS, platform.Architecture, platform.Variant = mf.Platform.OS, mf.Platform.Architecture, variant
+		}
+		result.Platforms = append(result.Platforms, *platform)
+	}
+	if len(result.Platforms) == 0 {
+		return nil, fmt.Errorf("镜像(%s:%s)不包含平台 %s", repo, reference, arch)
+	}
+
+	return result, nil
+}
+
+func inspectPlatform(ctx context.Context, client *ociClient, repo string, digest string, m *ociManifest) (*types.PlatformInspect, error) {
+	var cfg ociImageConfig
+	if err := client.GetBlob(ctx, repo, m.Config.Digest, &cfg); err != nil {
+		return nil, fmt.Errorf("获取镜像配置(%s)失败 %v", m.Config.Digest, err)
+	}
+
+	platform := &types.PlatformInspect{
+		OS:           cfg.OS,
+		Architecture: cfg.Architecture,
+		Variant:      cfg.Variant,
+		Digest:       digest,
+		Size:         manifestSize(m),
+		Created:      cfg.Created,
+		Author:       cfg.Author,
+		Config: types.ImageConfigInfo{
+			User:       cfg.Config.User,
+			Entrypoint: cfg.Config.Entrypoint,
+			Cmd:        cfg.Config.Cmd,
+			Env:        cfg.Config.Env,
+			WorkingDir: cfg.Config.WorkingDir,
+			Labels:     cfg.Config.Labels,
+			StopSignal: cfg.Config.StopSignal,
+		},
+	}
+	for port := range cfg.Config.ExposedPorts {
+		platform.Config.ExposedPorts = append(platform.Config.ExposedPorts, port)
+	}
+	sort.Strings(platform.Config.ExposedPorts)
+
+	for _, layer := range m.Layers {
+		platform.Layers = append(platform.Layers, types.LayerInfo{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size})
+	}
+	for _, h := range cfg.History {
+		platform.History = append(platform.History, types.HistoryInfo{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		})
+	}
+	return platform, nil
+}
+
+// matchPlatform arch 格式为 os/arch 或 os/arch/variant，为空时总是匹配
+func matchPlatform(arch string, os string, architecture string, variant string) bool {
+	parts := strings.Split(arch, "/")
+	if len(parts) < 2 {
+		return true
+	}
+	if parts[0] != os || parts[1] != architecture {
+		return false
+	}
+	return len(parts) < 3 || parts[2] == variant
+}
+
+// InspectTag agent 解析上游镜像，dockerhub 通过 registry 接口匿名获取
+func (s *AgentController) InspectTag(ctx context.Context, req *types.CallSearchRequest) (*types.ImageInspectResult, error) {
+	var (
+		registry types.OCIRegistry
+		repo     string
+	)
+	switch {
+	case req.Hub == types.ImageHubDocker:
+		registry = types.OCIRegistry{Name: types.ImageHubDocker, Endpoint: dockerhubRegistryEndpoint}
+		repo = fmt.Sprintf("%s/%s", req.Namespace, req.Repository)
+	case req.Registry != nil:
+		registry, repo = *req.Registry, ociRepoName(req)
+	default:
+		return nil, fmt.Errorf("unsupported hub type %s", req.Hub)
+	}
+
+	var arch string
+	if req.CustomConfig != nil {
+		arch = req.CustomConfig.Arch
+	}
+	klog.Infof("解析镜像源(%s)镜像(%s:%s)", registry.Name, repo, req.Tag)
+	return inspectImage(ctx, newOCIClient(registry), repo, req.Tag, arch)
+}
+
+// InspectRepositoryTag 解析上游镜像 tag 的配置、分层和构建历史，结果随搜索缓存一起缓存
+func (s *ServerController) InspectRepositoryTag(ctx context.Context, req types.CallSearchRequest) (interface{}, error) {
+	s.setRepoHubType(&req)
+	req.SetNamespace()
+
+	req.TargetType = types.InspectTypeTag
+	val, err := s.cachedSearch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var result types.ImageInspectResult
+	if err = json.Unmarshal(val, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// InspectImageTag 解析已同步到仓库的镜像 tag，由 server 直接访问目标仓库
+func (s *ServerController) InspectImageTag(ctx context.Context, imageId int64, tagId int64, arch string) (interface{}, error) {
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return nil, err
+	}
+	if tag.ImageId != imageId {
+		return nil, fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	image, err := s.factory.Image().Get(ctx, imageId, false)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := s.factory.Registry().Get(ctx, image.RegisterId)
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像仓库(%d)失败 %v", image.RegisterId, err)
+	}
+
+	mirror := tag.Mirror
+	if len(mirror) == 0 {
+		mirror = image.Mirror
+	}
+	parts := strings.SplitN(mirror, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("镜像(%s)地址不合法", mirror)
+	}
+	host, repo := parts[0], parts[1]
+
+	// 缓存 key 包含 digest，重新同步后 digest 变化时自动失效
+	key := fmt.Sprintf("%s%s:%s@%s/%s", imageInspectPrefix, mirror, tag.Name, tag.Digest, arch)
+	ttl := imageInspectDigestTTL
+	if len(tag.Digest) == 0 {
+		ttl = time.Duration(s.cfg.SearchCache.TTL) * time.Second
+	}
+	if result := s.getImageInspectCache(ctx, key); result != nil {
+		return result, nil
+	}
+
+	client := newOCIClient(types.OCIRegistry{
+		Name:     registry.Name,
+		Endpoint: "https://" + host,
+		Username: registry.Username,
+		Password: registry.Password,
+	})
+	result, err := inspectImage(ctx, client, repo, tag.Name, arch)
+	if err != nil {
+		klog.Errorf("解析镜像(%s:%s)失败 %v", mirror, tag.Name, err)
+		return nil, err
+	}
+	result.Image = mirror
+
+	s.setImageInspectCache(ctx, key, result, ttl)
+	return result, nil
+}
+
+func (s *ServerController) getImageInspectCache(ctx context.Context, key string) *types.ImageInspectResult {
+	if s.redisClient == nil {
+		return nil
+	}
+	data, err := s.redisClient.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			klog.Warningf("获取镜像解析缓存(%s)失败 %v", key, err)
+		}
+		return nil
+	}
+	var result types.ImageInspectResult
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return &result
+}
+
+func (s *ServerController) setImageInspectCache(ctx context.Context, key string, result *types.ImageInspectResult, ttl time.Duration) {
+	if s.redisClient == nil || ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err = s.redisClient.Set(ctx, key, data, ttl).Err(); err != nil {
+		klog.Warningf("写入镜像解析缓存(%s)失败 %v", key, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/google/uuid"
 	"k8s.io/klog/v2"
 
 	"github.com/caoyingjunz/rainbow/pkg/db"
@@ -51,21 +50,13 @@ func (s *ServerController) ListKubernetesVersions(ctx context.Context, listOptio
 }
 
 func (s *ServerController) SyncKubernetesTags(ctx context.Context, req *types.CallKubernetesTagRequest) (interface{}, error) {
-	key := uuid.NewString()
-
-	data, err := json.Marshal(types.CallMetaRequest{
+	val, err := s.CallRemote(ctx, req.ClientId, types.CallMetaRequest{
 		Type:                     types.CallKubernetesTagType,
-		Uid:                      key,
 		CallKubernetesTagRequest: req,
 	})
 	if err != nil {
 		return nil, err
 	}
-
-	val, err := s.Call(ctx, req.ClientId, key, data)
-	if err != nil {
-		return nil, err
-	}
 	var Tags []Tag
 	if err = json.Unmarshal(val, &Tags); err != nil {
 		klog.Errorf("序列号 k8s tag 失败 %v", err)
@@ -0,0 +1,409 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util/errors"
+)
+
+// lockActive 锁定未设置过期时间或尚未过期时生效，过期的锁不需要主动清理
+func lockActive(locked bool, expireTime *time.Time) bool {
+	if !locked {
+		return false
+	}
+	return expireTime == nil || time.Now().Before(*expireTime)
+}
+
+func lockMessage(target string, reason string, lockedBy string, expireTime *time.Time) string {
+	msg := fmt.Sprintf("%s已被 %s 锁定", target, lockedBy)
+	if len(reason) != 0 {
+		msg += "，原因: " + reason
+	}
+	if expireTime != nil {
+		msg += "，锁定至 " + expireTime.Format(time.RFC3339)
+	}
+	return msg
+}
+
+// matchImmutableRule 返回版本命中的不可变规则，只有同步完成的版本才不可变
+func matchImmutableRule(rules []model.ImmutableRule, imageName string, tag *model.Tag) *model.ImmutableRule {
+	if tag.Status != types.SyncImageComplete {
+		return nil
+	}
+	for i, rule := range rules {
+		if len(rule.ImagePattern) != 0 {
+			if ok, _ := path.Match(rule.ImagePattern, imageName); !ok {
+				continue
+			}
+		}
+		if ok, _ := path.Match(rule.TagPattern, tag.Name); ok {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func imageLocked(image *model.Image) error {
+	if !lockActive(image.IsLocked, image.LockExpireTime) {
+		return nil
+	}
+	return fmt.Errorf("%s", lockMessage(fmt.Sprintf("镜像(%s)", image.Name), image.LockReason, image.LockedBy, image.LockExpireTime))
+}
+
+// tagImmutable 镜像锁定、版本锁定或命中不可变规则时返回原因
+func tagImmutable(image *model.Image, tag *model.Tag, rules []model.ImmutableRule) error {
+	if err := imageLocked(image); err != nil {
+		return err
+	}
+	target := fmt.Sprintf("镜像版本(%s:%s)", image.Name, tag.Name)
+	if lockActive(tag.IsLocked, tag.LockExpireTime) {
+		return fmt.Errorf("%s", lockMessage(target, tag.LockReason, tag.LockedBy, tag.LockExpireTime))
+	}
+	if rule := matchImmutableRule(rules, image.Name, tag); rule != nil {
+		return fmt.Errorf("%s命中不可变规则(%s)", target, rule.Name)
+	}
+	return nil
+}
+
+// denyLocked 记录被拒绝的删除或覆盖操作
+func (s *ServerController) denyLocked(ctx context.Context, imageId int64, tagId int64, action string, err error) error {
+	if createErr := s.factory.Lock().CreateEvent(ctx, &model.LockEvent{
+		ImageId: imageId,
+		TagId:   tagId,
+		Action:  model.LockActionDeny,
+		Message: fmt.Sprintf("拒绝%s: %v", action, err),
+	}); createErr != nil {
+		klog.Warningf("记录锁定审计事件失败 %v", createErr)
+	}
+	return fmt.Errorf("%v，禁止%s", err, action)
+}
+
+// checkImageDeletable 镜像或其任一版本被锁定时不允许删除镜像
+func (s *ServerController) checkImageDeletable(ctx context.Context, image *model.Image) error {
+	if err := imageLocked(image); err != nil {
+		return s.denyLocked(ctx, image.Id, 0, "删除", err)
+	}
+
+	rules, err := s.factory.Lock().ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	tags, err := s.factory.Image().ListTags(ctx, db.WithImage(image.Id))
+	if err != nil {
+		return err
+	}
+	for i := range tags {
+		if err = tagImmutable(image, &tags[i], rules); err != nil {
+			return s.denyLocked(ctx, image.Id, tags[i].Id, "删除", err)
+		}
+	}
+	return nil
+}
+
+func (s *ServerController) checkTagDeletable(ctx context.Context, imageId int64, tagId int64) error {
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return err
+	}
+	if tag.ImageId != imageId {
+		return fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	return s.checkTagMutable(ctx, tag, "删除")
+}
+
+// checkTagWritable 已存在的版本重新同步前检查是否允许覆盖
+func (s *ServerController) checkTagWritable(ctx context.Context, imageId int64, tag *model.Tag) error {
+	if tag.ImageId != imageId {
+		return fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tag.Id)
+	}
+	return s.checkTagMutable(ctx, tag, "覆盖")
+}
+
+func (s *ServerController) checkTagMutable(ctx context.Context, tag *model.Tag, action string) error {
+	image, err := s.factory.Image().Get(ctx, tag.ImageId, false)
+	if err != nil {
+		return err
+	}
+	rules, err := s.factory.Lock().ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	if err = tagImmutable(image, tag, rules); err != nil {
+		return s.denyLocked(ctx, image.Id, tag.Id, action, err)
+	}
+	return nil
+}
+
+// clearLegacyLocks 早期版本创建镜像时默认锁定，启用锁定校验前清理，否则历史镜像均无法删除和覆盖
+func (s *ServerController) clearLegacyLocks(ctx context.Context) error {
+	cleared, err := s.factory.Lock().ClearLegacyLocks(ctx)
+	if err != nil {
+		klog.Errorf("清理历史镜像的默认锁定失败 %v", err)
+		return err
+	}
+	if cleared > 0 {
+		klog.Infof("已清理 %d 个历史镜像的默认锁定", cleared)
+	}
+	return nil
+}
+
+// getLockAdmin 锁定、解锁和不可变规则仅允许管理员操作，操作人取自用户记录
+func (s *ServerController) getLockAdmin(ctx context.Context, userId string) (*model.User, error) {
+	if len(userId) == 0 {
+		return nil, fmt.Errorf("未指定操作用户")
+	}
+	user, err := s.factory.Task().GetUser(ctx, userId)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("用户(%s)不存在", userId)
+		}
+		klog.Errorf("获取用户 %s 失败 %v", userId, err)
+		return nil, err
+	}
+	if user.Role != types.AdminUserRole {
+		return nil, fmt.Errorf("用户(%s)不是管理员，无权操作镜像锁定和不可变规则", userId)
+	}
+	return user, nil
+}
+
+// parseLockRequest 校验锁定请求，返回锁定的过期时间
+func parseLockRequest(req *types.LockRequest) (*time.Time, error) {
+	if req.ExpireTime == nil || len(*req.ExpireTime) == 0 {
+		return nil, nil
+	}
+	expireTime, err := parseTime(*req.ExpireTime)
+	if err != nil {
+		return nil, err
+	}
+	if !expireTime.After(time.Now()) {
+		return nil, fmt.Errorf("锁定过期时间(%s)必须晚于当前时间", *req.ExpireTime)
+	}
+	return &expireTime, nil
+}
+
+func (s *ServerController) LockImage(ctx context.Context, imageId int64, req *types.LockRequest) error {
+	admin, err := s.getLockAdmin(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	if _, err = s.factory.Image().Get(ctx, imageId, false); err != nil {
+		return err
+	}
+	expireTime, err := parseLockRequest(req)
+	if err != nil {
+		return err
+	}
+	if err = s.factory.Lock().UpdateImage(ctx, imageId, map[string]interface{}{
+		"is_locked":        true,
+		"lock_reason":      req.Reason,
+		"locked_by":        admin.Name,
+		"lock_expire_time": expireTime,
+	}); err != nil {
+		klog.Errorf("锁定镜像(%d)失败 %v", imageId, err)
+		return err
+	}
+
+	return s.factory.Lock().CreateEvent(ctx, &model.LockEvent{
+		ImageId:    imageId,
+		Action:     model.LockActionLock,
+		Operator:   admin.Name,
+		Reason:     req.Reason,
+		ExpireTime: expireTime,
+	})
+}
+
+func (s *ServerController) UnlockImage(ctx context.Context, imageId int64, req *types.UnlockRequest) error {
+	admin, err := s.getLockAdmin(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	if _, err = s.factory.Image().Get(ctx, imageId, false); err != nil {
+		return err
+	}
+	if err = s.factory.Lock().UpdateImage(ctx, imageId, map[string]interface{}{
+		"is_locked":        false,
+		"lock_reason":      "",
+		"locked_by":        "",
+		"lock_expire_time": nil,
+	}); err != nil {
+		klog.Errorf("解锁镜像(%d)失败 %v", imageId, err)
+		return err
+	}
+
+	return s.factory.Lock().CreateEvent(ctx, &model.LockEvent{
+		ImageId:  imageId,
+		Action:   model.LockActionUnlock,
+		Operator: admin.Name,
+		Reason:   req.Reason,
+	})
+}
+
+func (s *ServerController) LockImageTag(ctx context.Context, imageId int64, tagId int64, req *types.LockRequest) error {
+	admin, err := s.getLockAdmin(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return err
+	}
+	if tag.ImageId != imageId {
+		return fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	expireTime, err := parseLockRequest(req)
+	if err != nil {
+		return err
+	}
+	if err = s.factory.Lock().UpdateTag(ctx, tagId, map[string]interface{}{
+		"is_locked":        true,
+		"lock_reason":      req.Reason,
+		"locked_by":        admin.Name,
+		"lock_expire_time": expireTime,
+	}); err != nil {
+		klog.Errorf("锁定镜像版本(%d)失败 %v", tagId, err)
+		return err
+	}
+
+	return s.factory.Lock().CreateEvent(ctx, &model.LockEvent{
+		ImageId:    imageId,
+		TagId:      tagId,
+		Action:     model.LockActionLock,
+		Operator:   admin.Name,
+		Reason:     req.Reason,
+		ExpireTime: expireTime,
+	})
+}
+
+func (s *ServerController) UnlockImageTag(ctx context.Context, imageId int64, tagId int64, req *types.UnlockRequest) error {
+	admin, err := s.getLockAdmin(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return err
+	}
+	if tag.ImageId != imageId {
+		return fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	if err = s.factory.Lock().UpdateTag(ctx, tagId, map[string]interface{}{
+		"is_locked":        false,
+		"lock_reason":      "",
+		"locked_by":        "",
+		"lock_expire_time": nil,
+	}); err != nil {
+		klog.Errorf("解锁镜像版本(%d)失败 %v", tagId, err)
+		return err
+	}
+
+	return s.factory.Lock().CreateEvent(ctx, &model.LockEvent{
+		ImageId:  imageId,
+		TagId:    tagId,
+		Action:   model.LockActionUnlock,
+		Operator: admin.Name,
+		Reason:   req.Reason,
+	})
+}
+
+// ListLockEvents 获取镜像及其版本的锁定审计事件
+func (s *ServerController) ListLockEvents(ctx context.Context, imageId int64, listOption types.ListOptions) (interface{}, error) {
+	listOption.SetDefaultPageOption()
+
+	pageResult := types.PageResult{
+		PageRequest: types.PageRequest{
+			Page:  listOption.Page,
+			Limit: listOption.Limit,
+		},
+	}
+
+	opts := []db.Options{
+		db.WithImage(imageId),
+	}
+	var err error
+	pageResult.Total, err = s.factory.Lock().CountEvents(ctx, opts...)
+	if err != nil {
+		klog.Errorf("获取锁定审计事件总数失败 %v", err)
+		pageResult.Message = err.Error()
+	}
+
+	offset := (listOption.Page - 1) * listOption.Limit
+	opts = append(opts, []db.Options{
+		db.WithOrderByDesc(),
+		db.WithOffset(offset),
+		db.WithLimit(listOption.Limit),
+	}...)
+	pageResult.Items, err = s.factory.Lock().ListEvents(ctx, opts...)
+	if err != nil {
+		klog.Errorf("获取锁定审计事件失败 %v", err)
+		pageResult.Message = err.Error()
+		return pageResult, err
+	}
+	return pageResult, nil
+}
+
+func (s *ServerController) CreateImmutableRule(ctx context.Context, req *types.CreateImmutableRuleRequest) error {
+	admin, err := s.getLockAdmin(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range []string{req.ImagePattern, req.TagPattern} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("通配符(%s)不合法 %v", pattern, err)
+		}
+	}
+
+	_, err = s.factory.Lock().CreateRule(ctx, &model.ImmutableRule{
+		Name:         req.Name,
+		ImagePattern: req.ImagePattern,
+		TagPattern:   req.TagPattern,
+		Description:  req.Description,
+		CreatedBy:    admin.Name,
+	})
+	if err != nil {
+		klog.Errorf("创建不可变规则(%s)失败 %v", req.Name, err)
+	}
+	return err
+}
+
+func (s *ServerController) DeleteImmutableRule(ctx context.Context, ruleId int64, userId string) error {
+	if _, err := s.getLockAdmin(ctx, userId); err != nil {
+		return err
+	}
+	return s.factory.Lock().DeleteRule(ctx, ruleId)
+}
+
+func (s *ServerController) ListImmutableRules(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
+	return s.factory.Lock().ListRules(ctx, db.WithOrderByDesc())
+}
+
+// makeImmutableImages 标记任务中不允许覆盖的版本，由 plugin 在推送前检查目标仓库
+func makeImmutableImages(ctx context.Context, f db.ShareDaoFactory, images []model.Image, tags []model.Tag) (map[int64]bool, error) {
+	rules, err := f.Lock().ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	imageMap := make(map[int64]*model.Image)
+	for i := range images {
+		imageMap[images[i].Id] = &images[i]
+	}
+
+	immutable := make(map[int64]bool)
+	for i, tag := range tags {
+		image, ok := imageMap[tag.ImageId]
+		if !ok {
+			continue
+		}
+		if tagImmutable(image, &tags[i], rules) != nil {
+			immutable[tag.Id] = true
+		}
+	}
+	return immutable, nil
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/huaweicloud/huaweicloud-sdk-go-v3/services/swr/v2/model"
 	"k8s.io/klog/v2"
 
-	"github.com/caoyingjunz/rainbow/pkg/db"
 	rainbowmodel "github.com/caoyingjunz/rainbow/pkg/db/model"
 	"github.com/caoyingjunz/rainbow/pkg/types"
 )
@@ -79,12 +78,3 @@ func (s *ServerController) Store(ctx context.Context) (interface{}, error) {
 		Frequency:    model.GetShowDomainResourceReportsRequestFrequencyEnum().DAILY,
 	})
 }
-
-func (s *ServerController) ImageDownflow(ctx context.Context, downflowMeta types.DownflowMeta) (interface{}, error) {
-	_, err := s.factory.Image().List(ctx, db.WithId(downflowMeta.ImageId))
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
-}
@@ -0,0 +1,104 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"regexp"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+// dockerhubRepositoryRegex dockerhub 的仓库名称，如 library/nginx
+var dockerhubRepositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*/[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+const (
+	pluginTokenPrefix = "rpt-"
+
+	// runner 排队和执行的最长时间，与流水线跟踪超时一致
+	pluginTokenTTL = ciTrackTimeout
+)
+
+// issuePluginToken 为任务生成 runner 获取配置的凭证，重新触发时覆盖旧凭证，数据库中仅保存摘要
+func issuePluginToken(ctx context.Context, f db.ShareDaoFactory, taskId int64) (string, error) {
+	token, err := util.GenerateToken(pluginTokenPrefix)
+	if err != nil {
+		return "", err
+	}
+	if err = f.Task().UpdateDirectly(ctx, taskId, map[string]interface{}{
+		"plugin_token":             util.HashToken(token),
+		"plugin_token_expire_time": time.Now().Add(pluginTokenTTL),
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokePluginToken 流水线结束后吊销任务凭证
+func revokePluginToken(ctx context.Context, f db.ShareDaoFactory, taskId int64) error {
+	return f.Task().UpdateDirectly(ctx, taskId, map[string]interface{}{
+		"plugin_token":             "",
+		"plugin_token_expire_time": nil,
+	})
+}
+
+// authenticatePluginToken 校验 runner 的任务凭证
+func (s *ServerController) authenticatePluginToken(ctx context.Context, taskId int64, token string) (*model.Task, error) {
+	if len(token) == 0 {
+		return nil, fmt.Errorf("任务凭证为空")
+	}
+	task, err := s.factory.Task().Get(ctx, taskId)
+	if err != nil {
+		return nil, fmt.Errorf("任务(%d)不存在", taskId)
+	}
+	if len(task.PluginToken) == 0 || subtle.ConstantTimeCompare([]byte(task.PluginToken), []byte(util.HashToken(token))) != 1 {
+		return nil, fmt.Errorf("任务(%d)凭证校验失败", taskId)
+	}
+	if task.PluginTokenExpireTime == nil || time.Now().After(*task.PluginTokenExpireTime) {
+		return nil, fmt.Errorf("任务(%d)凭证已过期", taskId)
+	}
+	return task, nil
+}
+
+// GetPluginTaskConfig runner 使用任务凭证获取 plugin 配置，配置不经过 CI 后端的输入参数，回调地址由 runner 本地填充
+func (s *ServerController) GetPluginTaskConfig(ctx context.Context, taskId int64, token string) (interface{}, error) {
+	task, err := s.authenticatePluginToken(ctx, taskId, token)
+	if err != nil {
+		klog.Warningf("获取任务(%d)配置失败 %v", taskId, err)
+		return nil, err
+	}
+	return makePluginConfig(ctx, s.factory, "", *task)
+}
+
+// IssuePluginDockerhubToken runner 使用任务凭证申请 dockerhub 仓库的拉取 token，不下发账号密码
+func (s *ServerController) IssuePluginDockerhubToken(ctx context.Context, taskId int64, token string, req *types.DockerhubTokenRequest) (interface{}, error) {
+	if _, err := s.authenticatePluginToken(ctx, taskId, token); err != nil {
+		klog.Warningf("任务(%d)申请 dockerhub token 失败 %v", taskId, err)
+		return nil, err
+	}
+	if !dockerhubRepositoryRegex.MatchString(req.Repository) {
+		return nil, fmt.Errorf("不合法的仓库名称 %s", req.Repository)
+	}
+	return s.issueDockerhubPullToken(ctx, req.Repository)
+}
+
+// IssueAgentPluginToken api 模式下 agent 为已分配的任务申请 runner 凭证
+func (s *ServerController) IssueAgentPluginToken(ctx context.Context, agentName string, taskId int64) (interface{}, error) {
+	if _, err := s.getAgentTask(ctx, agentName, taskId); err != nil {
+		return nil, err
+	}
+	return issuePluginToken(ctx, s.factory, taskId)
+}
+
+func (s *ServerController) RevokeAgentPluginToken(ctx context.Context, agentName string, taskId int64) error {
+	if _, err := s.getAgentTask(ctx, agentName, taskId); err != nil {
+		return err
+	}
+	return revokePluginToken(ctx, s.factory, taskId)
+}
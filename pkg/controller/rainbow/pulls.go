@@ -0,0 +1,188 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	pullDateLayout      = "2006-01-02"
+	defaultPullDays     = 30
+	maxPullDays         = 366
+	defaultTrendingDays = 7
+)
+
+// recordPixiuctlPull 记录一次 pixiuctl 的镜像解析，直接累加到数据库，多副本部署时计数不会丢失
+func (s *ServerController) recordPixiuctlPull(ctx context.Context, tag *model.Tag) {
+	if err := s.factory.Downflow().AddPulls(ctx, tag.ImageId, tag.Id, model.DownflowSourcePixiuctl, time.Now().Format(pullDateLayout), 1); err != nil {
+		klog.Errorf("写入镜像(%d)版本(%d)的下载量失败 %v", tag.ImageId, tag.Id, err)
+	}
+}
+
+// ensurePullSchema 补齐下载量统计的表结构，需在写入下载量前完成
+func (s *ServerController) ensurePullSchema(ctx context.Context) error {
+	if err := s.factory.Downflow().EnsureSchema(ctx); err != nil {
+		klog.Errorf("更新下载量统计表结构失败 %v", err)
+		return err
+	}
+	return nil
+}
+
+// syncImagePull 更新镜像的累计下载量，并将与上次累计值的差值计入当天的下载量
+// 首次同步时没有基准值，只记录累计值；累计值变小时（远端仓库重建）不计入
+func (s *ServerController) syncImagePull(ctx context.Context, image *model.Image, pull int64) error {
+	ok, err := s.factory.Downflow().SetImagePull(ctx, image.Id, image.Pull, pull)
+	if err != nil {
+		return err
+	}
+	// 已被其他同步更新，差值由其统计
+	if !ok || image.Pull == 0 || pull <= image.Pull {
+		return nil
+	}
+
+	return s.factory.Downflow().AddPulls(ctx, image.Id, 0, model.DownflowSourceRegistry, time.Now().Format(pullDateLayout), int(pull-image.Pull))
+}
+
+// parsePullRange 解析统计的日期范围，默认最近 days 天
+func parsePullRange(startTime string, endTime string, days int) (string, string, error) {
+	end := time.Now()
+	if len(endTime) != 0 {
+		t, err := time.ParseInLocation(pullDateLayout, endTime, time.Local)
+		if err != nil {
+			return "", "", fmt.Errorf("解析结束日期(%s)失败，格式为 %s", endTime, pullDateLayout)
+		}
+		end = t
+	}
+	start := end.AddDate(0, 0, 1-days)
+	if len(startTime) != 0 {
+		t, err := time.ParseInLocation(pullDateLayout, startTime, time.Local)
+		if err != nil {
+			return "", "", fmt.Errorf("解析开始日期(%s)失败，格式为 %s", startTime, pullDateLayout)
+		}
+		start = t
+	}
+	if start.After(end) {
+		return "", "", fmt.Errorf("开始日期不能晚于结束日期")
+	}
+	if end.Sub(start) > maxPullDays*24*time.Hour {
+		return "", "", fmt.Errorf("统计范围不能超过 %d 天", maxPullDays)
+	}
+	return start.Format(pullDateLayout), end.Format(pullDateLayout), nil
+}
+
+// ImageDownflow 镜像或版本每天的下载量，无下载的日期补 0
+func (s *ServerController) ImageDownflow(ctx context.Context, downflowMeta types.DownflowMeta) (interface{}, error) {
+	if downflowMeta.ImageId == 0 {
+		return nil, fmt.Errorf("image_id 不能为空")
+	}
+	image, err := s.factory.Image().Get(ctx, downflowMeta.ImageId, false)
+	if err != nil {
+		return nil, err
+	}
+	// 与镜像目录一致，非管理员只能查看公开镜像和自己的镜像
+	if !image.IsPublic && (len(downflowMeta.UserId) == 0 || image.UserId != downflowMeta.UserId) {
+		admin, err := s.isAdminUser(ctx, downflowMeta.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if !admin {
+			return nil, fmt.Errorf("镜像(%d)不存在", downflowMeta.ImageId)
+		}
+	}
+	start, end, err := parsePullRange(downflowMeta.StartTime, downflowMeta.EndTime, defaultPullDays)
+	if err != nil {
+		return nil, err
+	}
+
+	dailies, err := s.factory.Downflow().ListDaily(ctx, downflowMeta.ImageId, downflowMeta.TagId, start, end)
+	if err != nil {
+		klog.Errorf("获取镜像(%d)的下载量失败 %v", downflowMeta.ImageId, err)
+		return nil, err
+	}
+	pointMap := make(map[string]*types.PullPoint)
+	for _, daily := range dailies {
+		point, ok := pointMap[daily.Date]
+		if !ok {
+			point = &types.PullPoint{Date: daily.Date}
+			pointMap[daily.Date] = point
+		}
+		switch daily.Source {
+		case model.DownflowSourceRegistry:
+			point.Registry += daily.Pulls
+		case model.DownflowSourcePixiuctl:
+			point.Pixiuctl += daily.Pulls
+		}
+	}
+
+	var points []types.PullPoint
+	t, _ := time.ParseInLocation(pullDateLayout, start, time.Local)
+	for ; t.Format(pullDateLayout) <= end; t = t.AddDate(0, 0, 1) {
+		date := t.Format(pullDateLayout)
+		if point, ok := pointMap[date]; ok {
+			points = append(points, *point)
+		} else {
+			points = append(points, types.PullPoint{Date: date})
+		}
+	}
+	return points, nil
+}
+
+// TopPulls 按命名空间或用户统计下载量排行，trending 为 true 时按与上一个等长窗口相比的增长量排序
+func (s *ServerController) TopPulls(ctx context.Context, req types.TopPullsRequest, trending bool) (interface{}, error) {
+	days := req.Days
+	if days <= 0 {
+		days = defaultPullDays
+		if trending {
+			days = defaultTrendingDays
+		}
+	}
+	if days > maxPullDays {
+		return nil, fmt.Errorf("统计范围不能超过 %d 天", maxPullDays)
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+	// 未指定来源时，使用远端仓库的统计，未配置远端仓库时只有 pixiuctl 的统计
+	source := req.Source
+	switch source {
+	case "":
+		source = model.DownflowSourcePixiuctl
+		if SwrClient != nil {
+			source = model.DownflowSourceRegistry
+		}
+	case model.DownflowSourceRegistry, model.DownflowSourcePixiuctl:
+	default:
+		return nil, fmt.Errorf("不支持的统计来源 %s", source)
+	}
+
+	now := time.Now()
+	filter := db.TopPullFilter{
+		Source:    source,
+		Namespace: req.Namespace,
+		Owner:     req.Owner,
+		Start:     now.AddDate(0, 0, 1-days).Format(pullDateLayout),
+		End:       now.Format(pullDateLayout),
+		Limit:     limit,
+	}
+	// 与镜像目录一致，非管理员只统计公开镜像和自己的镜像
+	admin, err := s.isAdminUser(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		filter.Scoped = true
+		filter.Viewer = req.UserId
+	}
+	if trending {
+		filter.PrevStart = now.AddDate(0, 0, 1-2*days).Format(pullDateLayout)
+	}
+	return s.factory.Downflow().TopImages(ctx, filter)
+}
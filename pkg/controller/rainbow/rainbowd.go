@@ -0,0 +1,457 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+	"github.com/caoyingjunz/rainbow/pkg/util/errors"
+	"github.com/caoyingjunz/rainbow/pkg/util/sshutil"
+)
+
+const (
+	rainbowdHeartbeatInterval = 60 * time.Second
+
+	// 磁盘使用率超过该比例时节点标记为异常
+	rainbowdDiskWarningRatio = 0.9
+)
+
+func (s *ServerController) CreateRainbowd(ctx context.Context, req *types.CreateRainbowdRequest) error {
+	if _, err := s.factory.Rainbowd().GetByName(ctx, req.Name); err == nil {
+		return fmt.Errorf("rainbowd(%s) 已存在", req.Name)
+	}
+	password, err := s.encryptSecret(req.Password)
+	if err != nil {
+		return err
+	}
+	jumpPassword, err := s.encryptSecret(req.JumpPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.factory.Rainbowd().Create(ctx, &model.Rainbowd{
+		Name:           req.Name,
+		Host:           req.Host,
+		Port:           req.Port,
+		User:           req.User,
+		Password:       password,
+		PrivateKey:     req.PrivateKey,
+		JumpHost:       req.JumpHost,
+		JumpPort:       req.JumpPort,
+		JumpUser:       req.JumpUser,
+		JumpPassword:   jumpPassword,
+		JumpPrivateKey: req.JumpPrivateKey,
+		Status:         model.UnknownAgentType,
+	})
+	return err
+}
+
+func (s *ServerController) UpdateRainbowd(ctx context.Context, req *types.UpdateRainbowdRequest) error {
+	old, err := s.factory.Rainbowd().Get(ctx, req.Id)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"host":             req.Host,
+		"port":             req.Port,
+		"user":             req.User,
+		"private_key":      req.PrivateKey,
+		"jump_host":        req.JumpHost,
+		"jump_port":        req.JumpPort,
+		"jump_user":        req.JumpUser,
+		"jump_private_key": req.JumpPrivateKey,
+	}
+	if len(req.Password) != 0 {
+		if updates["password"], err = s.encryptSecret(req.Password); err != nil {
+			return err
+		}
+	}
+	if len(req.JumpPassword) != 0 {
+		if updates["jump_password"], err = s.encryptSecret(req.JumpPassword); err != nil {
+			return err
+		}
+	}
+	// 地址变化后为新主机，下次连接时重新固定公钥
+	if old.Host != req.Host || old.Port != req.Port {
+		updates["host_key"] = ""
+	}
+	if old.JumpHost != req.JumpHost || old.JumpPort != req.JumpPort {
+		updates["jump_host_key"] = ""
+	}
+	return s.factory.Rainbowd().Update(ctx, req.Id, updates)
+}
+
+// RekeyRainbowd 节点重装或更换公钥后，清除固定的主机公钥并重新连接固定
+func (s *ServerController) RekeyRainbowd(ctx context.Context, rainbowdId int64) (interface{}, error) {
+	old, err := s.factory.Rainbowd().Get(ctx, rainbowdId)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.factory.Rainbowd().Update(ctx, rainbowdId, map[string]interface{}{"host_key": "", "jump_host_key": ""}); err != nil {
+		return nil, err
+	}
+	s.createRainbowdEvent(ctx, old, old.Status, "已清除固定的主机公钥，等待重新固定")
+
+	old.HostKey, old.JumpHostKey = "", ""
+	sshConfig, err := s.rainbowdSSHConfig(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	sshClient, err := sshutil.NewSSHClient(sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	_ = sshClient.Close()
+
+	return s.factory.Rainbowd().Get(ctx, rainbowdId)
+}
+
+// encryptSecret 加密保存 ssh 密码，未配置加密密钥时不允许保存
+func (s *ServerController) encryptSecret(plaintext string) (string, error) {
+	if len(plaintext) == 0 {
+		return "", nil
+	}
+	if len(s.cfg.Server.EncryptKey) == 0 {
+		return "", fmt.Errorf("未配置 server.encrypt_key，无法保存密码")
+	}
+	return util.Encrypt(s.cfg.Server.EncryptKey, plaintext)
+}
+
+func (s *ServerController) decryptSecret(ciphertext string) (string, error) {
+	if len(ciphertext) == 0 {
+		return "", nil
+	}
+	return util.Decrypt(s.cfg.Server.EncryptKey, ciphertext)
+}
+
+func (s *ServerController) createRainbowdEvent(ctx context.Context, rainbowd *model.Rainbowd, status string, message string) {
+	if _, err := s.factory.Rainbowd().CreateEvent(ctx, &model.RainbowdEvent{
+		RainbowdId: rainbowd.Id,
+		Status:     status,
+		Message:    message,
+	}); err != nil {
+		klog.Errorf("记录 rainbowd(%s) 事件失败 %v", rainbowd.Name, err)
+	}
+}
+
+// DeleteRainbowd 节点上仍有 agent 时不允许删除
+func (s *ServerController) DeleteRainbowd(ctx context.Context, rainbowdId int64) error {
+	old, err := s.factory.Rainbowd().Get(ctx, rainbowdId)
+	if err != nil {
+		return err
+	}
+	agents, err := s.factory.Agent().List(ctx, db.WithRainbowdName(old.Name))
+	if err != nil {
+		return err
+	}
+	if len(agents) != 0 {
+		return fmt.Errorf("rainbowd(%s) 上还有 %d 个 agent，请先删除", old.Name, len(agents))
+	}
+	return s.factory.Rainbowd().Delete(ctx, rainbowdId)
+}
+
+func (s *ServerController) GetRainbowd(ctx context.Context, rainbowdId int64) (interface{}, error) {
+	return s.factory.Rainbowd().Get(ctx, rainbowdId)
+}
+
+func (s *ServerController) ListRainbowds(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
+	return s.factory.Rainbowd().List(ctx)
+}
+
+func (s *ServerController) ListRainbowdEvents(ctx context.Context, rainbowdId int64, listOption types.ListOptions) (interface{}, error) {
+	listOption.SetDefaultPageOption()
+	return s.factory.Rainbowd().ListEvents(ctx, db.WithRainbowd(rainbowdId), db.WithOrderByDesc(), db.WithLimit(listOption.Limit), db.WithOffset((listOption.Page-1)*listOption.Limit))
+}
+
+// RegisterRainbowd 将配置文件中声明的节点导入数据库，已存在的节点以数据库为准
+func (s *ServerController) RegisterRainbowd(ctx context.Context) error {
+	for _, node := range s.cfg.Rainbowd.Nodes {
+		_, err := s.factory.Rainbowd().GetByName(ctx, node.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		if _, err = s.factory.Rainbowd().Create(ctx, &model.Rainbowd{
+			Name:       node.Name,
+			Host:       node.Host,
+			Port:       node.Port,
+			User:       node.User,
+			PrivateKey: node.PrivateKey,
+			Status:     model.UnknownAgentType,
+		}); err != nil {
+			return err
+		}
+		klog.Infof("已导入配置中的 rainbowd(%s)", node.Name)
+	}
+
+	return nil
+}
+
+// rainbowdSSHConfig 构造节点的 ssh 配置，未固定主机公钥时首次连接固定并记录事件
+func (s *ServerController) rainbowdSSHConfig(ctx context.Context, rainbowd *model.Rainbowd) (*sshutil.SSHConfig, error) {
+	password, err := s.decryptSecret(rainbowd.Password)
+	if err != nil {
+		return nil, fmt.Errorf("解密 rainbowd(%s) 密码失败 %v", rainbowd.Name, err)
+	}
+	sshConfig := &sshutil.SSHConfig{
+		Host:         rainbowd.Host,
+		Port:         rainbowd.Port,
+		Username:     rainbowd.User,
+		Password:     password,
+		PrivateKey:   rainbowd.PrivateKey,
+		HostKey:      rainbowd.HostKey,
+		OnNewHostKey: s.pinRainbowdHostKey(ctx, rainbowd, "host_key", rainbowd.Host),
+	}
+	if len(rainbowd.JumpHost) == 0 {
+		return sshConfig, nil
+	}
+
+	jumpPassword, err := s.decryptSecret(rainbowd.JumpPassword)
+	if err != nil {
+		return nil, fmt.Errorf("解密 rainbowd(%s) 跳板机密码失败 %v", rainbowd.Name, err)
+	}
+	sshConfig.Jump = &sshutil.SSHConfig{
+		Host:         rainbowd.JumpHost,
+		Port:         rainbowd.JumpPort,
+		Username:     rainbowd.JumpUser,
+		Password:     jumpPassword,
+		PrivateKey:   rainbowd.JumpPrivateKey,
+		HostKey:      rainbowd.JumpHostKey,
+		OnNewHostKey: s.pinRainbowdHostKey(ctx, rainbowd, "jump_host_key", rainbowd.JumpHost),
+	}
+	return sshConfig, nil
+}
+
+func (s *ServerController) pinRainbowdHostKey(ctx context.Context, rainbowd *model.Rainbowd, column string, host string) func(string) error {
+	return func(hostKey string) error {
+		if err := s.factory.Rainbowd().Update(ctx, rainbowd.Id, map[string]interface{}{column: hostKey}); err != nil {
+			return err
+		}
+		s.createRainbowdEvent(ctx, rainbowd, rainbowd.Status, fmt.Sprintf("首次连接 %s，已固定主机公钥 %s", host, sshutil.HostKeyFingerprint(hostKey)))
+		return nil
+	}
+}
+
+// getRainbowdSSHConfig 获取 agent 所在节点的 ssh 配置
+func (s *ServerController) getRainbowdSSHConfig(ctx context.Context, name string) (*sshutil.SSHConfig, error) {
+	rainbowd, err := s.factory.Rainbowd().GetByName(ctx, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("rainbowd(%s) 不存在", name)
+		}
+		return nil, err
+	}
+	return s.rainbowdSSHConfig(ctx, rainbowd)
+}
+
+func (s *ServerController) startRainbowdHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(rainbowdHeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		klog.V(1).Infof("即将进行 rainbowd 的状态检查")
+		rainbowds, err := s.factory.Rainbowd().List(ctx)
+		if err != nil {
+			klog.Errorf("获取 rainbowd 列表失败 %v，等待下一次检查", err)
+			continue
+		}
+		for i := range rainbowds {
+			if err = s.syncRainbowdHealth(ctx, &rainbowds[i]); err != nil {
+				klog.Errorf("同步 rainbowd(%s) 状态失败 %v 等待下一次同步", rainbowds[i].Name, err)
+			}
+		}
+	}
+}
+
+// syncRainbowdHealth 检查节点健康状态，状态变化时记录事件并发送通知
+func (s *ServerController) syncRainbowdHealth(ctx context.Context, old *model.Rainbowd) error {
+	health, status, message := s.probeRainbowd(ctx, old)
+	klog.V(1).Infof("rainbowd %s 的状态为 %s %s", old.Name, status, message)
+
+	updates := map[string]interface{}{
+		"last_transition_time": time.Now(),
+		"status":               status,
+		"message":              message,
+	}
+	if health != nil {
+		updates["health"] = health
+	}
+	if err := s.factory.Rainbowd().Update(ctx, old.Id, updates); err != nil {
+		return err
+	}
+	if old.Status == status {
+		return nil
+	}
+
+	klog.Infof("rainbowd(%s) 的状态由 %s 变为 %s", old.Name, old.Status, status)
+	s.createRainbowdEvent(ctx, old, status, fmt.Sprintf("状态由 %s 变为 %s %s", old.Status, status, message))
+
+	// 首次检查的状态变化不发送通知
+	if old.Status == model.UnknownAgentType && status == model.RunAgentType {
+		return nil
+	}
+	if err := s.SendNotify(ctx, &types.SendNotificationRequest{
+		Content: fmt.Sprintf("rainbowd(%s) 状态由 %s 变为 %s %s", old.Name, old.Status, status, message),
+		CreateNotificationRequest: types.CreateNotificationRequest{
+			Role: types.SystemNotifyRole,
+		},
+	}); err != nil {
+		klog.Errorf("发送 rainbowd(%s) 告警失败 %v", old.Name, err)
+	}
+	return nil
+}
+
+// probeRainbowd 通过 ssh 采集节点资源和 docker 状态，无法连接时返回离线
+func (s *ServerController) probeRainbowd(ctx context.Context, rainbowd *model.Rainbowd) (*model.RainbowdHealth, string, string) {
+	sshConfig, err := s.rainbowdSSHConfig(ctx, rainbowd)
+	if err != nil {
+		return nil, model.ErrorAgentType, err.Error()
+	}
+	sshClient, err := sshutil.NewSSHClient(sshConfig)
+	if err != nil {
+		// 主机公钥变化时不再连接，需确认后重新固定
+		if sshutil.IsHostKeyMismatch(err) {
+			return nil, model.ErrorAgentType, fmt.Sprintf("%v，确认节点可信后重新固定公钥", err)
+		}
+		return nil, model.UnRunAgentType, err.Error()
+	}
+	defer sshClient.Close()
+
+	health := &model.RainbowdHealth{ProbeTime: time.Now()}
+	run := func(cmd string) (string, bool) {
+		result, err := sshClient.RunCommand(cmd)
+		if err != nil || result.ExitCode != 0 {
+			klog.V(1).Infof("rainbowd(%s) 执行 %s 失败 %v", rainbowd.Name, cmd, err)
+			return "", false
+		}
+		return strings.TrimSpace(result.Stdout), true
+	}
+
+	if out, ok := run("nproc"); ok {
+		health.CPUCores, _ = strconv.Atoi(out)
+	}
+	if out, ok := run("head -n1 /proc/stat; sleep 1; head -n1 /proc/stat"); ok {
+		health.CPUUsage = parseCPUUsage(out)
+	}
+	if out, ok := run("free -b"); ok {
+		health.MemoryTotal, health.MemoryUsed = parseMemory(out)
+	}
+	dataDir := s.cfg.Rainbowd.DataDir
+	if len(dataDir) == 0 {
+		dataDir = "/"
+	}
+	if out, ok := run(fmt.Sprintf("df -P -B1 %s", dataDir)); ok {
+		health.DiskTotal, health.DiskUsed = parseDisk(out)
+	}
+	if out, ok := run("docker version --format '{{.Server.Version}}'"); ok {
+		health.DockerRunning = true
+		health.DockerVersion = out
+	}
+	if health.DockerRunning {
+		if out, ok := run("docker ps --format '{{.Names}}'"); ok {
+			health.AgentContainers = s.countAgentContainers(ctx, rainbowd.Name, out)
+		}
+	}
+
+	if !health.DockerRunning {
+		return health, model.ErrorAgentType, "docker 未运行"
+	}
+	if health.DiskTotal != 0 && float64(health.DiskUsed) >= float64(health.DiskTotal)*rainbowdDiskWarningRatio {
+		return health, model.ErrorAgentType, fmt.Sprintf("磁盘使用率 %.1f%%", float64(health.DiskUsed)*100/float64(health.DiskTotal))
+	}
+	return health, model.RunAgentType, ""
+}
+
+// countAgentContainers 统计节点上运行中且属于该节点的 agent 容器
+func (s *ServerController) countAgentContainers(ctx context.Context, name string, out string) int {
+	agents, err := s.factory.Agent().List(ctx, db.WithRainbowdName(name))
+	if err != nil {
+		klog.Errorf("获取 rainbowd(%s) 的 agent 失败 %v", name, err)
+		return 0
+	}
+	names := sets.NewString()
+	for _, agent := range agents {
+		names.Insert(agent.Name)
+	}
+
+	count := 0
+	for _, container := range strings.Split(out, "\n") {
+		if names.Has(strings.TrimSpace(container)) {
+			count++
+		}
+	}
+	return count
+}
+
+// parseCPUUsage 根据两次 /proc/stat 采样计算 cpu 使用率
+func parseCPUUsage(out string) float64 {
+	lines := strings.Split(out, "\n")
+	if len(lines) != 2 {
+		return 0
+	}
+	idle1, total1 := parseCPUStat(lines[0])
+	idle2, total2 := parseCPUStat(lines[1])
+	if total2 <= total1 {
+		return 0
+	}
+	return (1 - float64(idle2-idle1)/float64(total2-total1)) * 100
+}
+
+func parseCPUStat(line string) (uint64, uint64) {
+	fields := strings.Fields(line)
+	var idle, total uint64
+	for i, field := range fields {
+		if i == 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		total += v
+		// idle 和 iowait
+		if i == 4 || i == 5 {
+			idle += v
+		}
+	}
+	return idle, total
+}
+
+func parseMemory(out string) (uint64, uint64) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "Mem:" {
+			continue
+		}
+		total, _ := strconv.ParseUint(fields[1], 10, 64)
+		used, _ := strconv.ParseUint(fields[2], 10, 64)
+		return total, used
+	}
+	return 0, 0
+}
+
+func parseDisk(out string) (uint64, uint64) {
+	lines := strings.Split(out, "\n")
+	if len(lines) < 2 {
+		return 0, 0
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 3 {
+		return 0, 0
+	}
+	total, _ := strconv.ParseUint(fields[1], 10, 64)
+	used, _ := strconv.ParseUint(fields[2], 10, 64)
+	return total, used
+}
@@ -4,61 +4,46 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math/rand"
 	"strings"
 	"time"
 
 	"github.com/apache/rocketmq-client-go/v2/primitive"
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"k8s.io/klog/v2"
 
-	pb "github.com/caoyingjunz/rainbow/api/rpc/proto"
 	"github.com/caoyingjunz/rainbow/pkg/db"
 	"github.com/caoyingjunz/rainbow/pkg/types"
 )
 
-var (
-	RpcClients map[string]pb.Tunnel_ConnectServer
-)
-
-// Connect 提供 rpc 注册接口
-func (s *ServerController) Connect(stream pb.Tunnel_ConnectServer) error {
-	for {
-		req, err := stream.Recv()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			klog.Errorf("stream.Recv %v", err)
-			return err
-		}
-
-		s.lock.Lock()
-		if RpcClients == nil {
-			RpcClients = make(map[string]pb.Tunnel_ConnectServer)
-		}
-		old, ok := RpcClients[req.ClientId]
-		if !ok || old != stream {
-			RpcClients[req.ClientId] = stream
-			klog.Infof("client(%s) rpc 注册成功", req.ClientId)
-		}
-		s.lock.Unlock()
-		klog.V(2).Infof("Received %s from %s", string(req.Payload), req.ClientId)
-	}
-}
-
 func (s *ServerController) preRemoteSearch(ctx context.Context, req types.RemoteSearchRequest) error {
 	switch req.Hub {
 	case types.ImageHubDocker, types.ImageHubGCR, types.ImageHubQuay, types.ImageHubAll:
 	default:
-		return fmt.Errorf("unsupported image hub type %s", req.Hub)
+		if _, ok := s.getOCIHub(req.Hub); !ok {
+			return fmt.Errorf("unsupported image hub type %s", req.Hub)
+		}
 	}
 
 	return nil
 }
 
+// getOCIHub 获取已配置的通用 OCI 镜像源
+func (s *ServerController) getOCIHub(hub string) (types.OCIRegistry, bool) {
+	reg, ok := ociHubs[hub]
+	return reg, ok
+}
+
+// getOCIHubForPath 根据镜像地址的域名获取通用 OCI 镜像源，如 ghcr.io/org/repo
+func (s *ServerController) getOCIHubForPath(path string) (types.OCIRegistry, string, bool) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return types.OCIRegistry{}, "", false
+	}
+	reg, ok := s.getOCIHub(parts[0])
+	return reg, parts[1], ok
+}
+
 // 兼容前端缺陷
 func (s *ServerController) setSearchHubType(req *types.RemoteSearchRequest) {
 	// 设置默认仓库类型
@@ -85,6 +70,33 @@ func (s *ServerController) setRepoHubType(req *types.CallSearchRequest) {
 	if req.Hub == "quay" {
 		req.Hub = types.ImageHubQuay
 	}
+
+	// 非 dockerhub 时，由 server 下发通用 OCI 镜像源配置
+	if req.Hub != types.ImageHubDocker {
+		if reg, ok := s.getOCIHub(req.Hub); ok {
+			req.Registry = &reg
+		}
+	}
+}
+
+// scopeOCIRegistry 账号不下发给 agent，配置了账号的镜像源由 server 申请仓库级的 pull token 代替
+func (s *ServerController) scopeOCIRegistry(ctx context.Context, reg types.OCIRegistry, repo string) types.OCIRegistry {
+	if len(reg.Username) == 0 {
+		return reg
+	}
+
+	scoped := types.OCIRegistry{Name: reg.Name, Endpoint: reg.Endpoint, Insecure: reg.Insecure}
+	if len(repo) == 0 {
+		return scoped
+	}
+	token, err := newOCIClient(reg).PullToken(ctx, repo)
+	if err != nil {
+		// 申请失败时匿名访问
+		klog.Warningf("申请镜像源(%s)仓库(%s)的 token 失败 %v", reg.Name, repo, err)
+		return scoped
+	}
+	scoped.Token = token
+	return scoped
 }
 
 func (s *ServerController) SearchRepositories(ctx context.Context, req types.CallSearchRequest) (interface{}, error) {
@@ -97,18 +109,7 @@ func (s *ServerController) SearchRepositories(ctx context.Context, req types.Cal
 	req.SetDefaultPageOption()
 
 	req.TargetType = types.SearchTypeRepo
-	key := uuid.NewString()
-	data, err := json.Marshal(types.CallMetaRequest{
-		Type:              types.CallSearchType,
-		Uid:               key,
-		CallSearchRequest: &req,
-	})
-	if err != nil {
-		klog.Errorf("序列化(%v)失败 %v", req, err)
-		return nil, err
-	}
-
-	val, err := s.CallV2(ctx, req.ClientId, key, data)
+	val, err := s.cachedSearch(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -128,18 +129,7 @@ func (s *ServerController) SearchRepositoryTags(ctx context.Context, req types.C
 	req.SetNamespace()
 
 	req.TargetType = types.SearchTypeTag
-	key := uuid.NewString()
-	data, err := json.Marshal(types.CallMetaRequest{
-		Type:              types.CallSearchType,
-		Uid:               key,
-		CallSearchRequest: &req,
-	})
-	if err != nil {
-		klog.Errorf("序列化(%v)失败 %v", req, err)
-		return nil, err
-	}
-
-	val, err := s.CallV2(ctx, req.ClientId, key, data)
+	val, err := s.cachedSearch(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -155,19 +145,8 @@ func (s *ServerController) GetRepositoryTagInfo(ctx context.Context, req types.C
 	s.setRepoHubType(&req)
 	req.SetNamespace()
 
-	key := uuid.NewString()
 	req.TargetType = types.SearchTypeTagInfo
-	data, err := json.Marshal(types.CallMetaRequest{
-		Type:              types.CallSearchType,
-		Uid:               key,
-		CallSearchRequest: &req,
-	})
-	if err != nil {
-		klog.Errorf("序列化(%v)失败 %v", req, err)
-		return nil, err
-	}
-
-	val, err := s.CallV2(ctx, req.ClientId, key, data)
+	val, err := s.cachedSearch(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -178,27 +157,19 @@ func (s *ServerController) GetRepositoryTagInfo(ctx context.Context, req types.C
 	return infoResp, nil
 }
 
-func (s *ServerController) GetRepository(ctx context.Context, req types.CallSearchRequest) (*types.GetRepositoryResult, error) {
+func (s *ServerController) GetRepository(ctx context.Context, req types.CallSearchRequest) (*types.CommonRepositoryResult, error) {
 	s.setRepoHubType(&req)
 	req.SetNamespace()
 
-	key := uuid.NewString()
 	req.TargetType = types.GetTypeRepo
-	data, err := json.Marshal(types.CallMetaRequest{
+	val, err := s.CallRemote(ctx, req.ClientId, types.CallMetaRequest{
 		Type:              types.CallSearchType,
-		Uid:               key,
 		CallSearchRequest: &req,
 	})
-	if err != nil {
-		klog.Errorf("序列化(%v)失败 %v", req, err)
-		return nil, err
-	}
-
-	val, err := s.CallV2(ctx, req.ClientId, key, data)
 	if err != nil {
 		return nil, err
 	}
-	var resp types.GetRepositoryResult
+	var resp types.CommonRepositoryResult
 	if err = json.Unmarshal(val, &resp); err != nil {
 		return nil, err
 	}
@@ -227,28 +198,6 @@ func (s *ServerController) sendMessage(ctx context.Context, clientId string, dat
 	return nil
 }
 
-func (s *ServerController) doSearch(ctx context.Context, clientId string, key string, data []byte) ([]byte, error) {
-	if err := s.sendMessage(ctx, clientId, data); err != nil {
-		return nil, err
-	}
-
-	val, err := s.GetResult(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-	var sr types.SearchResult
-	if err = json.Unmarshal([]byte(val), &sr); err != nil {
-		klog.Errorf("反序列化（%v）失败 %v", val, err)
-		return nil, err
-	}
-	if sr.StatusCode != 0 {
-		klog.Errorf("doSearch 远程调用失败 %v", err)
-		return nil, fmt.Errorf(sr.ErrMessage)
-	}
-
-	return sr.Result, nil
-}
-
 func (s *ServerController) getActiveNodeName(ctx context.Context) (string, error) {
 	agents, err := s.factory.Agent().List(ctx, db.WithStatus("在线"))
 	if err != nil {
@@ -262,39 +211,6 @@ func (s *ServerController) getActiveNodeName(ctx context.Context) (string, error
 	return agents[index].Name, nil
 }
 
-// CallV2 使用 redis 作为中间件
-func (s *ServerController) CallV2(ctx context.Context, clientId string, key string, data []byte) ([]byte, error) {
-	// 填充 clientId
-	if len(clientId) == 0 {
-		var err error
-		clientId, err = s.getActiveNodeName(ctx)
-		if err != nil {
-			return nil, err
-		}
-		klog.V(0).Infof("agent(%s) selected", clientId)
-	}
-
-	if err := s.sendMessageV2(ctx, clientId, key, data); err != nil {
-		return nil, err
-	}
-
-	val, err := s.GetResult(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-	var sr types.CallResult
-	if err = json.Unmarshal([]byte(val), &sr); err != nil {
-		klog.Errorf("反序列化（%v）失败 %v", val, err)
-		return nil, err
-	}
-	if sr.StatusCode != 0 {
-		klog.Errorf("远程调用失败 %v", err)
-		return nil, fmt.Errorf(sr.ErrMessage)
-	}
-
-	return sr.Result, nil
-}
-
 func (s *ServerController) sendMessageV2(ctx context.Context, clientId string, key string, data []byte) error {
 	reqKey := fmt.Sprintf("req-%s", key)
 
@@ -311,29 +227,6 @@ func (s *ServerController) sendMessageV2(ctx context.Context, clientId string, k
 	return nil
 }
 
-// Call 使用 rocketmq 作为中间件
-func (s *ServerController) Call(ctx context.Context, clientId string, key string, data []byte) ([]byte, error) {
-	if err := s.sendMessage(ctx, clientId, data); err != nil {
-		return nil, err
-	}
-
-	val, err := s.GetResult(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-	var sr types.CallResult
-	if err = json.Unmarshal([]byte(val), &sr); err != nil {
-		klog.Errorf("反序列化（%v）失败 %v", val, err)
-		return nil, err
-	}
-	if sr.StatusCode != 0 {
-		klog.Errorf("远程调用失败 %v", err)
-		return nil, fmt.Errorf(sr.ErrMessage)
-	}
-
-	return sr.Result, nil
-}
-
 func (s *ServerController) GetResult(ctx context.Context, key string) (string, error) {
 	// 先尝试直接获取
 	val, err := s.redisClient.Get(ctx, key).Result()
@@ -359,8 +252,8 @@ func (s *ServerController) GetResult(ctx context.Context, key string) (string, e
 		return val, nil
 	}
 
-	// 60 秒超时
-	waitCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	// 以调用方的截止时间为准，未设置时使用默认的远程调用超时时间
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Remote.Timeout)*time.Second)
 	defer cancel()
 
 	ch := pubSub.Channel()
@@ -374,7 +267,7 @@ func (s *ServerController) GetResult(ctx context.Context, key string) (string, e
 				}
 			}
 		case <-waitCtx.Done():
-			return "", fmt.Errorf("wait timeout for call(%s)", key)
+			return "", fmt.Errorf("wait for call(%s): %w", key, waitCtx.Err())
 		}
 	}
 }
@@ -0,0 +1,209 @@
+package rainbow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+var (
+	ErrRemoteCallTimeout = errors.New("远程调用超时")
+	ErrAgentNotConnected = errors.New("agent 未建立隧道连接")
+
+	// ServerController 按需创建，调用指标在进程内共享
+	remoteMetrics = newRemoteCallMetrics()
+)
+
+// RemoteCaller server 调用 agent 的传输方式，由配置 remote.transport 选择
+type RemoteCaller interface {
+	// Call 将请求下发给 agent 并等待其返回调用结果，clientId 为空时由实现选择 agent
+	Call(ctx context.Context, clientId string, key string, data []byte) (types.CallResult, error)
+}
+
+func newRemoteCaller(s *ServerController, transport string) RemoteCaller {
+	switch transport {
+	case rainbowconfig.RemoteTransportRocketmq:
+		return &rocketmqCaller{s: s}
+	case rainbowconfig.RemoteTransportGRPC:
+		return &tunnelCaller{s: s}
+	default:
+		return &redisCaller{s: s}
+	}
+}
+
+// redisCaller 请求和结果均通过 redis 暂存，并使用 keyspace 通知
+type redisCaller struct {
+	s *ServerController
+}
+
+func (c *redisCaller) Call(ctx context.Context, clientId string, key string, data []byte) (types.CallResult, error) {
+	// 填充 clientId
+	if len(clientId) == 0 {
+		var err error
+		clientId, err = c.s.getActiveNodeName(ctx)
+		if err != nil {
+			return types.CallResult{}, err
+		}
+		klog.V(0).Infof("agent(%s) selected", clientId)
+	}
+
+	if err := c.s.sendMessageV2(ctx, clientId, key, data); err != nil {
+		return types.CallResult{}, err
+	}
+	return c.s.waitResult(ctx, key)
+}
+
+// rocketmqCaller 请求通过 rocketmq 下发，结果仍由 agent 暂存在 redis 中
+type rocketmqCaller struct {
+	s *ServerController
+}
+
+func (c *rocketmqCaller) Call(ctx context.Context, clientId string, key string, data []byte) (types.CallResult, error) {
+	if err := c.s.sendMessage(ctx, clientId, data); err != nil {
+		return types.CallResult{}, err
+	}
+	return c.s.waitResult(ctx, key)
+}
+
+// tunnelCaller 通过 agent 主动建立的 gRPC 隧道下发请求
+type tunnelCaller struct {
+	s *ServerController
+}
+
+func (c *tunnelCaller) Call(ctx context.Context, clientId string, key string, data []byte) (types.CallResult, error) {
+	// 未指定 agent 时只选择在线的 agent
+	if len(clientId) == 0 {
+		var err error
+		clientId, err = c.s.getTunnelAgentName(ctx)
+		if err != nil {
+			return types.CallResult{}, err
+		}
+	}
+
+	session, ok := c.s.getTunnelSession(clientId)
+	if !ok {
+		return types.CallResult{}, fmt.Errorf("agent(%s): %w", clientId, ErrAgentNotConnected)
+	}
+	return c.s.CallTunnel(ctx, session, key, data)
+}
+
+func (s *ServerController) waitResult(ctx context.Context, key string) (types.CallResult, error) {
+	val, err := s.GetResult(ctx, key)
+	if err != nil {
+		return types.CallResult{}, err
+	}
+
+	var result types.CallResult
+	if err = json.Unmarshal([]byte(val), &result); err != nil {
+		klog.Errorf("反序列化（%v）失败 %v", val, err)
+		return types.CallResult{}, err
+	}
+	return result, nil
+}
+
+// CallRemote 远程调用 agent 的统一入口，负责填充调用 ID、超时控制、错误转换和指标统计
+func (s *ServerController) CallRemote(ctx context.Context, clientId string, req types.CallMetaRequest) ([]byte, error) {
+	req.Uid = uuid.NewString()
+	if req.CallSearchRequest != nil && req.CallSearchRequest.Registry != nil {
+		search := *req.CallSearchRequest
+		reg := s.scopeOCIRegistry(ctx, *search.Registry, ociRepoName(&search))
+		search.Registry = &reg
+		req.CallSearchRequest = &search
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		klog.Errorf("序列化远程调用(%v)失败 %v", req, err)
+		return nil, err
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Remote.Timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	result, err := s.caller.Call(callCtx, clientId, req.Uid, data)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s 调用(%s)", ErrRemoteCallTimeout, types.CallTypeNames[req.Type], req.Uid)
+		}
+	} else if result.StatusCode != 0 {
+		err = errors.New(result.ErrMessage)
+	}
+	remoteMetrics.observe(req.Type, s.cfg.Remote.Transport, time.Since(start), err)
+
+	if err != nil {
+		klog.Errorf("远程调用 agent(%s) 失败 %v", clientId, err)
+		return nil, err
+	}
+	return result.Result, nil
+}
+
+// ListRemoteCallMetrics 获取按调用类型统计的远程调用指标
+func (s *ServerController) ListRemoteCallMetrics(ctx context.Context) (interface{}, error) {
+	return remoteMetrics.list(), nil
+}
+
+type remoteCallMetrics struct {
+	lock  sync.Mutex
+	items map[int]*types.RemoteCallMetric
+
+	// 累计耗时，用于计算平均耗时
+	latency map[int]time.Duration
+}
+
+func newRemoteCallMetrics() *remoteCallMetrics {
+	return &remoteCallMetrics{
+		items:   make(map[int]*types.RemoteCallMetric),
+		latency: make(map[int]time.Duration),
+	}
+}
+
+func (m *remoteCallMetrics) observe(callType int, transport string, latency time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	item, ok := m.items[callType]
+	if !ok {
+		item = &types.RemoteCallMetric{Type: callType, Name: types.CallTypeNames[callType]}
+		m.items[callType] = item
+	}
+	item.Transport = transport
+	item.Total++
+	item.LastCallTime = time.Now()
+	if err != nil {
+		item.Failed++
+		item.LastError = err.Error()
+		if errors.Is(err, ErrRemoteCallTimeout) {
+			item.Timeout++
+		}
+	}
+
+	m.latency[callType] += latency
+	item.AvgLatency = (m.latency[callType] / time.Duration(item.Total)).Milliseconds()
+	if latency.Milliseconds() > item.MaxLatency {
+		item.MaxLatency = latency.Milliseconds()
+	}
+}
+
+func (m *remoteCallMetrics) list() []types.RemoteCallMetric {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics := make([]types.RemoteCallMetric, 0, len(m.items))
+	for _, item := range m.items {
+		metrics = append(metrics, *item)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Type < metrics[j].Type
+	})
+	return metrics
+}
@@ -27,5 +27,9 @@ func (s *ServerController) SearchRepo(ctx *gin.Context, listOption types.ListOpt
 		return nil, fmt.Errorf("record not found")
 	}
 
+	if err = s.checkPullPolicy(&tags[0]); err != nil {
+		return nil, err
+	}
+	s.recordPixiuctlPull(ctx, &tags[0])
 	return tags[0], nil
 }
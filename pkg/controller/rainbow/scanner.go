@@ -0,0 +1,315 @@
+package rainbow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util/errors"
+)
+
+// Scanner 漏洞扫描器，扫描已同步到目标仓库的镜像
+type Scanner interface {
+	Name() string
+	// DBVersion 漏洞库版本，版本变化后已扫描的 tag 需要重新扫描
+	DBVersion(ctx context.Context) (string, error)
+	// Scan 扫描镜像，返回扫描时的漏洞库版本和漏洞列表
+	Scan(ctx context.Context, target scanTarget) (*scanResult, error)
+}
+
+type scanTarget struct {
+	Image    string // 带 tag 的完整镜像地址
+	Platform string // 多架构镜像扫描的平台，如 linux/amd64
+	Username string
+	Password string
+}
+
+type scanResult struct {
+	DBVersion       string
+	Vulnerabilities []types.Vulnerability
+}
+
+func (r *scanResult) Summary() types.ScanSummary {
+	var summary types.ScanSummary
+	for _, v := range r.Vulnerabilities {
+		switch strings.ToUpper(v.Severity) {
+		case "CRITICAL":
+			summary.Critical++
+		case "HIGH":
+			summary.High++
+		case "MEDIUM":
+			summary.Medium++
+		case "LOW":
+			summary.Low++
+		default:
+			summary.Unknown++
+		}
+	}
+	return summary
+}
+
+const (
+	scanQueueSize   = 1024
+	scanResyncBatch = 200
+)
+
+var (
+	// 待扫描的 tag，同步完成、手动触发和漏洞库更新时入队
+	scanQueue = make(chan int64, scanQueueSize)
+	// 排队或扫描中的 tag，避免重复扫描
+	scanPending sync.Map
+)
+
+func (s *ServerController) newScanner() (Scanner, error) {
+	switch s.cfg.Scanner.Type {
+	case scannerTrivy:
+		if len(s.cfg.Scanner.Endpoint) == 0 {
+			return nil, fmt.Errorf("trivy 扫描器需配置 endpoint")
+		}
+		return newTrivyScanner(s.cfg.Scanner), nil
+	default:
+		return nil, fmt.Errorf("unsupported scanner type %s", s.cfg.Scanner.Type)
+	}
+}
+
+func (s *ServerController) scannerEnabled() bool {
+	return len(s.cfg.Scanner.Type) != 0
+}
+
+// startScanController 启动扫描 worker，并定期检查漏洞库更新，补扫未使用当前漏洞库扫描的 tag
+func (s *ServerController) startScanController(ctx context.Context) {
+	if !s.scannerEnabled() {
+		return
+	}
+	scanner, err := s.newScanner()
+	if err != nil {
+		klog.Errorf("初始化漏洞扫描器失败 %v", err)
+		return
+	}
+	klog.Infof("starting %s scanner with %d workers", scanner.Name(), s.cfg.Scanner.Workers)
+
+	for i := 0; i < s.cfg.Scanner.Workers; i++ {
+		go s.runScanWorker(ctx, scanner)
+	}
+
+	ticker := time.NewTicker(time.Duration(s.cfg.Scanner.ResyncInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		s.resyncScan(ctx, scanner)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ServerController) resyncScan(ctx context.Context, scanner Scanner) {
+	dbVersion, err := scanner.DBVersion(ctx)
+	if err != nil {
+		klog.Warningf("获取漏洞库版本失败 %v", err)
+		return
+	}
+	tags, err := s.factory.Scan().ListPending(ctx, dbVersion, scanResyncBatch)
+	if err != nil {
+		klog.Errorf("获取待扫描的镜像版本失败 %v", err)
+		return
+	}
+	if len(tags) != 0 {
+		klog.Infof("漏洞库版本 %s，%d 个镜像版本待扫描", dbVersion, len(tags))
+	}
+	for _, tag := range tags {
+		s.enqueueTagScan(tag.Id)
+	}
+}
+
+func (s *ServerController) enqueueTagScan(tagId int64) {
+	if _, loaded := scanPending.LoadOrStore(tagId, struct{}{}); loaded {
+		return
+	}
+	select {
+	case scanQueue <- tagId:
+	default:
+		// 队列已满时由下一次补扫处理
+		scanPending.Delete(tagId)
+		klog.Warningf("扫描队列已满，镜像版本(%d)等待下次扫描", tagId)
+	}
+}
+
+// enqueueImageTagScan 镜像同步完成后扫描该版本的所有架构
+func (s *ServerController) enqueueImageTagScan(ctx context.Context, imageId int64, name string) {
+	if !s.scannerEnabled() {
+		return
+	}
+	tags, err := s.factory.Image().ListTags(ctx, db.WithImage(imageId), db.WithName(name))
+	if err != nil {
+		klog.Warningf("获取镜像(%d)版本(%s)失败 %v", imageId, name, err)
+		return
+	}
+	for _, tag := range tags {
+		s.enqueueTagScan(tag.Id)
+	}
+}
+
+func (s *ServerController) runScanWorker(ctx context.Context, scanner Scanner) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tagId := <-scanQueue:
+			if err := s.scanTag(ctx, scanner, tagId); err != nil {
+				klog.Errorf("扫描镜像版本(%d)失败 %v", tagId, err)
+			}
+			scanPending.Delete(tagId)
+		}
+	}
+}
+
+func (s *ServerController) scanTag(ctx context.Context, scanner Scanner, tagId int64) error {
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return err
+	}
+	if tag.Status != types.SyncImageComplete {
+		return nil
+	}
+	image, err := s.factory.Image().Get(ctx, tag.ImageId, false)
+	if err != nil {
+		return err
+	}
+	registry, err := s.factory.Registry().Get(ctx, image.RegisterId)
+	if err != nil {
+		return fmt.Errorf("获取镜像仓库(%d)失败 %v", image.RegisterId, err)
+	}
+
+	mirror := tag.Mirror
+	if len(mirror) == 0 {
+		mirror = image.Mirror
+	}
+	target := scanTarget{
+		Image:    mirror + ":" + tag.Name,
+		Platform: tag.Architecture,
+		Username: registry.Username,
+		Password: registry.Password,
+	}
+	if err = s.factory.Scan().UpdateTag(ctx, tagId, map[string]interface{}{"scan_status": model.TagScanningStatus, "scan_message": ""}); err != nil {
+		return err
+	}
+
+	klog.Infof("开始扫描镜像(%s) %s", target.Image, target.Platform)
+	scanCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Scanner.Timeout)*time.Second)
+	defer cancel()
+	result, err := scanner.Scan(scanCtx, target)
+	if err != nil {
+		_ = s.factory.Scan().UpdateTag(ctx, tagId, map[string]interface{}{"scan_status": model.TagScanErrorStatus, "scan_message": err.Error()})
+		return err
+	}
+
+	summary := result.Summary()
+	summaryData, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	reportData, err := json.Marshal(result.Vulnerabilities)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err = s.factory.Scan().SaveReport(ctx, &model.ScanReport{
+		TagId:     tagId,
+		ImageId:   tag.ImageId,
+		Image:     target.Image,
+		Scanner:   scanner.Name(),
+		DBVersion: result.DBVersion,
+		ScanTime:  &now,
+		Summary:   string(summaryData),
+		Report:    string(reportData),
+	}); err != nil {
+		return fmt.Errorf("保存扫描报告失败 %v", err)
+	}
+
+	if summary.Critical != 0 {
+		klog.Warningf("镜像(%s)存在 %d 个严重漏洞", target.Image, summary.Critical)
+	}
+	return s.factory.Scan().UpdateTag(ctx, tagId, map[string]interface{}{
+		"scan_status":     model.TagScannedStatus,
+		"scan_message":    "",
+		"scan_critical":   summary.Critical,
+		"scan_high":       summary.High,
+		"scan_medium":     summary.Medium,
+		"scan_low":        summary.Low,
+		"scan_unknown":    summary.Unknown,
+		"scan_db_version": result.DBVersion,
+		"scan_time":       now,
+	})
+}
+
+// ScanImageTag 手动触发镜像版本的扫描
+func (s *ServerController) ScanImageTag(ctx context.Context, imageId int64, tagId int64) error {
+	if !s.scannerEnabled() {
+		return fmt.Errorf("未配置漏洞扫描器")
+	}
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return err
+	}
+	if tag.ImageId != imageId {
+		return fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	if tag.Status != types.SyncImageComplete {
+		return fmt.Errorf("镜像版本(%s)未同步完成，无法扫描", tag.Name)
+	}
+
+	s.enqueueTagScan(tagId)
+	return nil
+}
+
+// GetImageTagScan 获取镜像版本最近一次的完整扫描报告
+func (s *ServerController) GetImageTagScan(ctx context.Context, imageId int64, tagId int64) (interface{}, error) {
+	tag, err := s.factory.Image().GetTag(ctx, tagId, false)
+	if err != nil {
+		return nil, err
+	}
+	if tag.ImageId != imageId {
+		return nil, fmt.Errorf("镜像(%d)不存在版本(%d)", imageId, tagId)
+	}
+	report, err := s.factory.Scan().GetReport(ctx, tagId)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("镜像版本(%s)尚未扫描", tag.Name)
+		}
+		return nil, err
+	}
+
+	result := types.ScanReportResult{
+		TagId:     report.TagId,
+		Image:     report.Image,
+		Scanner:   report.Scanner,
+		DBVersion: report.DBVersion,
+		ScanTime:  report.ScanTime,
+	}
+	if err = json.Unmarshal([]byte(report.Summary), &result.Summary); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(report.Report), &result.Vulnerabilities); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkPullPolicy 开启 block_critical 时禁止拉取存在严重漏洞的版本
+func (s *ServerController) checkPullPolicy(tag *model.Tag) error {
+	if !s.cfg.Scanner.BlockCritical || tag.ScanCritical == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: 镜像(%s:%s)存在 %d 个严重漏洞，禁止拉取", types.PullBlockedMessage, tag.Path, tag.Name, tag.ScanCritical)
+}
@@ -0,0 +1,276 @@
+package rainbow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+// fakeScanner 代替 trivy 的本地扫描器，返回预设的漏洞列表并记录扫描的镜像
+type fakeScanner struct {
+	lock            sync.Mutex
+	dbVersion       string
+	vulnerabilities []types.Vulnerability
+	err             error
+	scanned         []scanTarget
+}
+
+func (f *fakeScanner) Name() string {
+	return "fake"
+}
+
+func (f *fakeScanner) DBVersion(ctx context.Context) (string, error) {
+	return f.dbVersion, nil
+}
+
+func (f *fakeScanner) Scan(ctx context.Context, target scanTarget) (*scanResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.scanned = append(f.scanned, target)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &scanResult{DBVersion: f.dbVersion, Vulnerabilities: f.vulnerabilities}, nil
+}
+
+// fakeScanFactory 仅实现扫描流程用到的 dao，其余方法未实现
+type fakeScanFactory struct {
+	db.ShareDaoFactory
+
+	lock     sync.Mutex
+	images   map[int64]*model.Image
+	tags     map[int64]*model.Tag
+	registry *model.Registry
+	reports  map[int64]*model.ScanReport
+}
+
+func (f *fakeScanFactory) Image() db.ImageInterface       { return &fakeImageDao{f: f} }
+func (f *fakeScanFactory) Registry() db.RegistryInterface { return &fakeRegistryDao{f: f} }
+func (f *fakeScanFactory) Scan() db.ScanInterface         { return &fakeScanDao{f: f} }
+
+type fakeImageDao struct {
+	db.ImageInterface
+	f *fakeScanFactory
+}
+
+func (d *fakeImageDao) Get(ctx context.Context, imageId int64, del bool) (*model.Image, error) {
+	d.f.lock.Lock()
+	defer d.f.lock.Unlock()
+
+	image, ok := d.f.images[imageId]
+	if !ok {
+		return nil, fmt.Errorf("image %d not found", imageId)
+	}
+	object := *image
+	return &object, nil
+}
+
+func (d *fakeImageDao) GetTag(ctx context.Context, tagId int64, del bool) (*model.Tag, error) {
+	d.f.lock.Lock()
+	defer d.f.lock.Unlock()
+
+	tag, ok := d.f.tags[tagId]
+	if !ok {
+		return nil, fmt.Errorf("tag %d not found", tagId)
+	}
+	object := *tag
+	return &object, nil
+}
+
+type fakeRegistryDao struct {
+	db.RegistryInterface
+	f *fakeScanFactory
+}
+
+func (d *fakeRegistryDao) Get(ctx context.Context, registryId int64) (*model.Registry, error) {
+	return d.f.registry, nil
+}
+
+type fakeScanDao struct {
+	db.ScanInterface
+	f *fakeScanFactory
+}
+
+// UpdateTag 将扫描状态和摘要写回 tag，与数据库中的字段一致
+func (d *fakeScanDao) UpdateTag(ctx context.Context, tagId int64, updates map[string]interface{}) error {
+	d.f.lock.Lock()
+	defer d.f.lock.Unlock()
+
+	tag, ok := d.f.tags[tagId]
+	if !ok {
+		return fmt.Errorf("tag %d not found", tagId)
+	}
+	for key, value := range updates {
+		switch key {
+		case "scan_status":
+			tag.ScanStatus = value.(string)
+		case "scan_critical":
+			tag.ScanCritical = value.(int)
+		case "scan_high":
+			tag.ScanHigh = value.(int)
+		case "scan_db_version":
+			tag.ScanDBVersion = value.(string)
+		}
+	}
+	return nil
+}
+
+func (d *fakeScanDao) SaveReport(ctx context.Context, object *model.ScanReport) error {
+	d.f.lock.Lock()
+	defer d.f.lock.Unlock()
+
+	d.f.reports[object.TagId] = object
+	return nil
+}
+
+func newFakeScanFactory() *fakeScanFactory {
+	image := &model.Image{Name: "nginx", Mirror: "harbor.example.com/pixiuio/nginx", RegisterId: 1}
+	image.Id = 1
+	tag := &model.Tag{ImageId: 1, Name: "1.27", Path: "nginx", Architecture: "linux/amd64", Status: types.SyncImageComplete}
+	tag.Id = 10
+	registry := &model.Registry{Username: "admin", Password: "secret"}
+	registry.Id = 1
+
+	return &fakeScanFactory{
+		images:   map[int64]*model.Image{image.Id: image},
+		tags:     map[int64]*model.Tag{tag.Id: tag},
+		registry: registry,
+		reports:  make(map[int64]*model.ScanReport),
+	}
+}
+
+// waitScanned 等待 worker 处理完队列中的 tag
+func waitScanned(t *testing.T, f *fakeScanFactory, tagId int64) *model.Tag {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.lock.Lock()
+		tag := *f.tags[tagId]
+		f.lock.Unlock()
+		if _, pending := scanPending.Load(tagId); !pending && tag.ScanStatus != "" && tag.ScanStatus != model.TagScanningStatus {
+			return &tag
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("tag %d was not scanned in time", tagId)
+	return nil
+}
+
+// startScanWorker 启动扫描 worker，返回的函数等待 worker 退出，避免影响后续用例的全局队列
+func startScanWorker(s *ServerController, scanner Scanner) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runScanWorker(ctx, scanner)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestScanQueueResultPolicy(t *testing.T) {
+	f := newFakeScanFactory()
+	scanner := &fakeScanner{
+		dbVersion: "v2-2026-10-01T00:00:00Z",
+		vulnerabilities: []types.Vulnerability{
+			{ID: "CVE-2026-0001", Severity: "CRITICAL"},
+			{ID: "CVE-2026-0002", Severity: "high"},
+			{ID: "CVE-2026-0003", Severity: "LOW"},
+		},
+	}
+	s := &ServerController{
+		factory: f,
+		cfg: rainbowconfig.Config{
+			Scanner: rainbowconfig.ScannerOption{Type: "fake", Workers: 1, Timeout: 10, BlockCritical: true},
+		},
+	}
+
+	stop := startScanWorker(s, scanner)
+	defer stop()
+
+	// 同一个 tag 在扫描前重复入队只扫描一次
+	s.enqueueTagScan(10)
+	s.enqueueTagScan(10)
+	tag := waitScanned(t, f, 10)
+
+	if tag.ScanStatus != model.TagScannedStatus {
+		t.Fatalf("expected scan status %s, got %s", model.TagScannedStatus, tag.ScanStatus)
+	}
+	if tag.ScanCritical != 1 || tag.ScanHigh != 1 {
+		t.Errorf("expected 1 critical and 1 high, got %d critical and %d high", tag.ScanCritical, tag.ScanHigh)
+	}
+	if tag.ScanDBVersion != scanner.dbVersion {
+		t.Errorf("expected db version %s, got %s", scanner.dbVersion, tag.ScanDBVersion)
+	}
+
+	scanner.lock.Lock()
+	scanned := append([]scanTarget{}, scanner.scanned...)
+	scanner.lock.Unlock()
+	if len(scanned) != 1 {
+		t.Fatalf("expected 1 scan, got %d", len(scanned))
+	}
+	if scanned[0].Image != "harbor.example.com/pixiuio/nginx:1.27" || scanned[0].Platform != "linux/amd64" || scanned[0].Username != "admin" {
+		t.Errorf("unexpected scan target %+v", scanned[0])
+	}
+
+	f.lock.Lock()
+	report, ok := f.reports[10]
+	f.lock.Unlock()
+	if !ok {
+		t.Fatalf("expected scan report to be saved")
+	}
+	if report.Scanner != "fake" || !strings.Contains(report.Summary, `"critical":1`) {
+		t.Errorf("unexpected scan report scanner %s summary %s", report.Scanner, report.Summary)
+	}
+
+	// 开启 block_critical 时禁止拉取存在严重漏洞的版本
+	err := s.checkPullPolicy(tag)
+	if err == nil || !strings.Contains(err.Error(), types.PullBlockedMessage) {
+		t.Errorf("expected pull to be blocked, got %v", err)
+	}
+	s.cfg.Scanner.BlockCritical = false
+	if err = s.checkPullPolicy(tag); err != nil {
+		t.Errorf("expected pull to be allowed without block_critical, got %v", err)
+	}
+}
+
+func TestScanErrorStatus(t *testing.T) {
+	f := newFakeScanFactory()
+	scanner := &fakeScanner{err: fmt.Errorf("trivy server unavailable")}
+	s := &ServerController{
+		factory: f,
+		cfg: rainbowconfig.Config{
+			Scanner: rainbowconfig.ScannerOption{Type: "fake", Workers: 1, Timeout: 10, BlockCritical: true},
+		},
+	}
+
+	stop := startScanWorker(s, scanner)
+	defer stop()
+
+	s.enqueueTagScan(10)
+	tag := waitScanned(t, f, 10)
+
+	if tag.ScanStatus != model.TagScanErrorStatus {
+		t.Fatalf("expected scan status %s, got %s", model.TagScanErrorStatus, tag.ScanStatus)
+	}
+	f.lock.Lock()
+	_, ok := f.reports[10]
+	f.lock.Unlock()
+	if ok {
+		t.Errorf("expected no scan report when scan failed")
+	}
+	// 扫描失败时没有漏洞统计，不拦截拉取
+	if err := s.checkPullPolicy(tag); err != nil {
+		t.Errorf("expected pull to be allowed, got %v", err)
+	}
+}
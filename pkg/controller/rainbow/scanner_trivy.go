@@ -0,0 +1,138 @@
+package rainbow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+const (
+	scannerTrivy = "trivy"
+
+	defaultTrivyBinary = "trivy"
+	trivyTokenHeader   = "Trivy-Token"
+)
+
+// trivyScanner trivy 以 client 模式连接 trivy server 扫描，漏洞库由 server 维护
+// https://trivy.dev/latest/docs/references/modes/client-server/
+type trivyScanner struct {
+	endpoint string
+	token    string
+	binary   string
+}
+
+func newTrivyScanner(opt rainbowconfig.ScannerOption) *trivyScanner {
+	binary := opt.Binary
+	if len(binary) == 0 {
+		binary = defaultTrivyBinary
+	}
+	return &trivyScanner{endpoint: strings.TrimSuffix(opt.Endpoint, "/"), token: opt.Token, binary: binary}
+}
+
+func (t *trivyScanner) Name() string {
+	return scannerTrivy
+}
+
+// trivyVersion trivy server /version 接口的返回
+type trivyVersion struct {
+	Version         string `json:"Version"`
+	VulnerabilityDB *struct {
+		Version   int       `json:"Version"`
+		UpdatedAt time.Time `json:"UpdatedAt"`
+	} `json:"VulnerabilityDB"`
+}
+
+// DBVersion 以漏洞库的更新时间作为版本
+func (t *trivyScanner) DBVersion(ctx context.Context) (string, error) {
+	var version trivyVersion
+	httpClient := util.HttpClientV2{URL: t.endpoint + "/version"}
+	httpClient.Method(http.MethodGet).WithTimeout(10 * time.Second)
+	if len(t.token) != 0 {
+		httpClient.WithHeader(map[string]string{trivyTokenHeader: t.token})
+	}
+	if err := httpClient.Do(&version); err != nil {
+		return "", err
+	}
+	if version.VulnerabilityDB == nil {
+		return "", fmt.Errorf("trivy server(%s) 未返回漏洞库信息", t.endpoint)
+	}
+	return fmt.Sprintf("v%d-%s", version.VulnerabilityDB.Version, version.VulnerabilityDB.UpdatedAt.UTC().Format(time.RFC3339)), nil
+}
+
+// trivyReport trivy --format json 的输出，仅解析漏洞部分
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+			PrimaryURL       string `json:"PrimaryURL"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func (t *trivyScanner) Scan(ctx context.Context, target scanTarget) (*scanResult, error) {
+	dbVersion, err := t.DBVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("获取漏洞库版本失败 %v", err)
+	}
+
+	args := []string{"image", "--server", t.endpoint, "--format", "json", "--quiet", "--scanners", "vuln"}
+	if deadline, ok := ctx.Deadline(); ok {
+		args = append(args, "--timeout", time.Until(deadline).Round(time.Second).String())
+	}
+	if len(target.Platform) != 0 {
+		args = append(args, "--platform", target.Platform)
+	}
+	args = append(args, target.Image)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.binary, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// token 和仓库凭据通过环境变量传递，避免出现在进程参数中
+	cmd.Env = os.Environ()
+	if len(t.token) != 0 {
+		cmd.Env = append(cmd.Env, "TRIVY_TOKEN="+t.token)
+	}
+	if len(target.Username) != 0 {
+		cmd.Env = append(cmd.Env, "TRIVY_USERNAME="+target.Username, "TRIVY_PASSWORD="+target.Password)
+	}
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var report trivyReport
+	if err = json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		return nil, fmt.Errorf("解析 trivy 报告失败 %v", err)
+	}
+	result := &scanResult{DBVersion: dbVersion}
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			result.Vulnerabilities = append(result.Vulnerabilities, types.Vulnerability{
+				ID:               v.VulnerabilityID,
+				Target:           r.Target,
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Severity:         v.Severity,
+				Title:            v.Title,
+				PrimaryURL:       v.PrimaryURL,
+			})
+		}
+	}
+	return result, nil
+}
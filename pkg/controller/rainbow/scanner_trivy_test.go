@@ -0,0 +1,110 @@
+package rainbow
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+)
+
+// fakeTrivyScript 代替 trivy 客户端，记录参数和环境变量后输出预设的 json 报告
+const fakeTrivyScript = `#!/bin/sh
+printf '%s\n' "$@" > "$TRIVY_TEST_DIR/args"
+printf 'TRIVY_TOKEN=%s\nTRIVY_USERNAME=%s\nTRIVY_PASSWORD=%s\n' "$TRIVY_TOKEN" "$TRIVY_USERNAME" "$TRIVY_PASSWORD" > "$TRIVY_TEST_DIR/env"
+cat <<'EOF'
+{
+  "Results": [
+    {
+      "Target": "nginx:1.25 (debian 12.5)",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2024-0001", "PkgName": "openssl", "InstalledVersion": "3.0.11", "FixedVersion": "3.0.13", "Severity": "CRITICAL", "Title": "openssl issue", "PrimaryURL": "https://avd.aquasec.com/nvd/cve-2024-0001"},
+        {"VulnerabilityID": "CVE-2024-0002", "PkgName": "zlib", "InstalledVersion": "1.2.13", "Severity": "LOW"}
+      ]
+    },
+    {"Target": "usr/local/bin/app", "Vulnerabilities": null}
+  ]
+}
+EOF
+`
+
+// TestTrivyScan 使用假的 trivy 客户端和 server，token 通过环境变量传递，不出现在进程参数中
+func TestTrivyScan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake trivy script requires sh")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" || r.Header.Get(trivyTokenHeader) != "secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Version":"0.50.0","VulnerabilityDB":{"Version":2,"UpdatedAt":"2024-05-01T06:00:00Z"}}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "trivy"), []byte(fakeTrivyScript), 0755); err != nil {
+		t.Fatalf("failed to write fake trivy: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TRIVY_TEST_DIR", dir)
+
+	scanner := newTrivyScanner(rainbowconfig.ScannerOption{Endpoint: server.URL + "/", Token: "secret-token"})
+	result, err := scanner.Scan(context.TODO(), scanTarget{
+		Image:    "harbor.example.com/library/nginx:1.25",
+		Platform: "linux/arm64",
+		Username: "robot",
+		Password: "robot-password",
+	})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+
+	argsData, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatalf("failed to read trivy args: %v", err)
+	}
+	args := strings.Split(strings.TrimSpace(string(argsData)), "\n")
+	expected := []string{"image", "--server", server.URL, "--format", "json", "--quiet", "--scanners", "vuln", "--platform", "linux/arm64", "harbor.example.com/library/nginx:1.25"}
+	if strings.Join(args, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected args %v, got %v", expected, args)
+	}
+	for _, arg := range args {
+		if arg == "--token" || strings.Contains(arg, "secret-token") || strings.Contains(arg, "robot-password") {
+			t.Errorf("credential leaked in trivy args: %v", args)
+		}
+	}
+
+	envData, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatalf("failed to read trivy env: %v", err)
+	}
+	for _, env := range []string{"TRIVY_TOKEN=secret-token", "TRIVY_USERNAME=robot", "TRIVY_PASSWORD=robot-password"} {
+		if !strings.Contains(string(envData), env+"\n") {
+			t.Errorf("expected env %s, got %s", env, envData)
+		}
+	}
+
+	if result.DBVersion != "v2-2024-05-01T06:00:00Z" {
+		t.Errorf("unexpected db version %s", result.DBVersion)
+	}
+	if len(result.Vulnerabilities) != 2 {
+		t.Fatalf("expected 2 vulnerabilities, got %d", len(result.Vulnerabilities))
+	}
+	v := result.Vulnerabilities[0]
+	if v.ID != "CVE-2024-0001" || v.Target != "nginx:1.25 (debian 12.5)" || v.Package != "openssl" ||
+		v.InstalledVersion != "3.0.11" || v.FixedVersion != "3.0.13" || v.Severity != "CRITICAL" ||
+		v.Title != "openssl issue" || v.PrimaryURL != "https://avd.aquasec.com/nvd/cve-2024-0001" {
+		t.Errorf("unexpected vulnerability %+v", v)
+	}
+	if v := result.Vulnerabilities[1]; v.ID != "CVE-2024-0002" || v.FixedVersion != "" || v.Severity != "LOW" {
+		t.Errorf("unexpected vulnerability %+v", v)
+	}
+}
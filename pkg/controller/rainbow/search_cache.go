@@ -0,0 +1,251 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+const (
+	searchCachePrefix      = "search-cache:"
+	searchCacheIndexPrefix = "search-cache-index:" // 仓库关联的缓存 key 集合，用于失效
+	searchCacheLockPrefix  = "search-cache-lock:"  // 后台刷新的锁，避免多个请求同时刷新
+)
+
+// ServerController 按需创建，缓存指标在进程内共享
+var searchMetrics = newSearchCacheMetrics()
+
+// searchCacheEntry 缓存的搜索结果，远端不存在时只保存错误信息
+type searchCacheEntry struct {
+	Data       json.RawMessage `json:"data,omitempty"`
+	NotFound   string          `json:"not_found,omitempty"`
+	FreshUntil time.Time       `json:"fresh_until"`
+}
+
+func (e *searchCacheEntry) result() ([]byte, error) {
+	if len(e.NotFound) != 0 {
+		return nil, errors.New(e.NotFound)
+	}
+	return e.Data, nil
+}
+
+// searchCacheKey 按镜像源、命名空间、仓库、查询条件、分页和架构生成缓存 key，不区分执行的 agent
+func searchCacheKey(req types.CallSearchRequest) string {
+	var arch, policy string
+	if req.CustomConfig != nil {
+		arch, policy = req.CustomConfig.Arch, req.CustomConfig.Policy
+	}
+	raw := strings.Join([]string{
+		fmt.Sprintf("%d", req.TargetType), req.Namespace, req.Repository, req.Tag,
+		req.Query, fmt.Sprintf("%d/%d", req.Page, req.PageSize), arch, policy,
+	}, "|")
+	return fmt.Sprintf("%s%s:%x", searchCachePrefix, req.Hub, sha1.Sum([]byte(raw)))
+}
+
+func searchCacheIndexKey(hub, namespace, repository string) string {
+	return fmt.Sprintf("%s%s:%s/%s", searchCacheIndexPrefix, hub, namespace, repository)
+}
+
+func (s *ServerController) searchCacheEnabled() bool {
+	return !s.cfg.SearchCache.Disable && s.redisClient != nil
+}
+
+// cachedSearch 优先返回缓存的搜索结果，过期后在有效的旧结果期间后台刷新
+func (s *ServerController) cachedSearch(ctx context.Context, req types.CallSearchRequest) ([]byte, error) {
+	if !s.searchCacheEnabled() {
+		return s.callSearch(ctx, req)
+	}
+
+	key := searchCacheKey(req)
+	entry, err := s.getSearchCache(ctx, key)
+	if err != nil {
+		klog.Warningf("获取搜索缓存(%s)失败 %v", key, err)
+	}
+	if entry == nil {
+		searchMetrics.observe(req.Hub, func(m *types.SearchCacheMetric) { m.Misses++ })
+		return s.refreshSearchCache(ctx, key, req)
+	}
+
+	if time.Now().After(entry.FreshUntil) {
+		searchMetrics.observe(req.Hub, func(m *types.SearchCacheMetric) { m.StaleHits++ })
+		go s.revalidateSearchCache(key, req)
+	} else if len(entry.NotFound) != 0 {
+		searchMetrics.observe(req.Hub, func(m *types.SearchCacheMetric) { m.NotFoundHits++ })
+	} else {
+		searchMetrics.observe(req.Hub, func(m *types.SearchCacheMetric) { m.Hits++ })
+	}
+	return entry.result()
+}
+
+func (s *ServerController) callSearch(ctx context.Context, req types.CallSearchRequest) ([]byte, error) {
+	return s.CallRemote(ctx, req.ClientId, types.CallMetaRequest{
+		Type:              types.CallSearchType,
+		CallSearchRequest: &req,
+	})
+}
+
+func (s *ServerController) getSearchCache(ctx context.Context, key string) (*searchCacheEntry, error) {
+	data, err := s.redisClient.Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entry searchCacheEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// refreshSearchCache 调用 agent 搜索并写入缓存，远端不存在时缓存较短时间，其他错误不缓存
+func (s *ServerController) refreshSearchCache(ctx context.Context, key string, req types.CallSearchRequest) ([]byte, error) {
+	val, err := s.callSearch(ctx, req)
+
+	opt := s.cfg.SearchCache
+	entry := searchCacheEntry{Data: val}
+	ttl := time.Duration(opt.HubCacheTTL(req.Hub)) * time.Second
+	expiration := ttl + time.Duration(opt.StaleTTL)*time.Second
+	if err != nil {
+		if !isSubscribeNotFoundError(err) {
+			return nil, err
+		}
+		entry = searchCacheEntry{NotFound: err.Error()}
+		ttl = time.Duration(opt.NotFoundTTL) * time.Second
+		expiration = ttl
+	}
+	entry.FreshUntil = time.Now().Add(ttl)
+
+	if err2 := s.setSearchCache(ctx, key, req, &entry, expiration); err2 != nil {
+		klog.Warningf("写入搜索缓存(%s)失败 %v", key, err2)
+	}
+	return entry.result()
+}
+
+func (s *ServerController) setSearchCache(ctx context.Context, key string, req types.CallSearchRequest, entry *searchCacheEntry, expiration time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, expiration)
+		// 指定仓库的查询记录到仓库索引中，订阅或任务变更仓库时失效
+		if len(req.Repository) != 0 {
+			indexKey := searchCacheIndexKey(req.Hub, req.Namespace, req.Repository)
+			pipe.SAdd(ctx, indexKey, key)
+			pipe.Expire(ctx, indexKey, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+// revalidateSearchCache 后台刷新过期的缓存，同一个 key 同时只有一个刷新
+func (s *ServerController) revalidateSearchCache(key string, req types.CallSearchRequest) {
+	ctx := context.Background()
+	lockKey := searchCacheLockPrefix + key
+	ok, err := s.redisClient.SetNX(ctx, lockKey, 1, time.Duration(s.cfg.Remote.Timeout)*time.Second).Result()
+	if err != nil || !ok {
+		return
+	}
+	defer s.redisClient.Del(ctx, lockKey)
+
+	searchMetrics.observe(req.Hub, func(m *types.SearchCacheMetric) { m.Refreshes++ })
+	if _, err = s.refreshSearchCache(ctx, key, req); err != nil {
+		klog.Warningf("后台刷新搜索缓存(%s)失败 %v", key, err)
+	}
+}
+
+// invalidateSearchCache 删除指定仓库的搜索缓存
+func (s *ServerController) invalidateSearchCache(ctx context.Context, hub, namespace, repository string) {
+	if !s.searchCacheEnabled() || len(repository) == 0 {
+		return
+	}
+
+	indexKey := searchCacheIndexKey(hub, namespace, repository)
+	keys, err := s.redisClient.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		klog.Warningf("获取仓库(%s)的搜索缓存失败 %v", indexKey, err)
+		return
+	}
+	if err = s.redisClient.Del(ctx, append(keys, indexKey)...).Err(); err != nil {
+		klog.Warningf("删除仓库(%s)的搜索缓存失败 %v", indexKey, err)
+		return
+	}
+	searchMetrics.observe(hub, func(m *types.SearchCacheMetric) { m.Invalidations++ })
+	klog.V(1).Infof("仓库(%s)的 %d 条搜索缓存已失效", indexKey, len(keys))
+}
+
+// invalidateImageSearchCache 按镜像地址失效搜索缓存，如 nginx:1.0、ghcr.io/org/repo:tag
+func (s *ServerController) invalidateImageSearchCache(ctx context.Context, image string) {
+	path, _, _ := ParseImageItem(image)
+	if reg, repository, ok := s.getOCIHubForPath(path); ok {
+		s.invalidateSearchCache(ctx, reg.Name, "", repository)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch len(parts) {
+	case 1:
+		s.invalidateSearchCache(ctx, types.ImageHubDocker, types.DefaultDockerhubNamespace, parts[0])
+	case 2:
+		s.invalidateSearchCache(ctx, types.ImageHubDocker, parts[0], parts[1])
+	}
+}
+
+// ListSearchCacheMetrics 获取按镜像源统计的搜索缓存指标
+func (s *ServerController) ListSearchCacheMetrics(ctx context.Context) (interface{}, error) {
+	return searchMetrics.list(), nil
+}
+
+type searchCacheMetrics struct {
+	lock  sync.Mutex
+	items map[string]*types.SearchCacheMetric
+}
+
+func newSearchCacheMetrics() *searchCacheMetrics {
+	return &searchCacheMetrics{items: make(map[string]*types.SearchCacheMetric)}
+}
+
+func (m *searchCacheMetrics) observe(hub string, fn func(m *types.SearchCacheMetric)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	item, ok := m.items[hub]
+	if !ok {
+		item = &types.SearchCacheMetric{Hub: hub}
+		m.items[hub] = item
+	}
+	fn(item)
+
+	hits := item.Hits + item.StaleHits + item.NotFoundHits
+	if total := hits + item.Misses; total != 0 {
+		item.HitRatio = float64(hits) / float64(total)
+	}
+}
+
+func (m *searchCacheMetrics) list() []types.SearchCacheMetric {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics := make([]types.SearchCacheMetric, 0, len(m.items))
+	for _, item := range m.items {
+		metrics = append(metrics, *item)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Hub < metrics[j].Hub
+	})
+	return metrics
+}
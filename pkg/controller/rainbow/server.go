@@ -6,12 +6,12 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/apache/rocketmq-client-go/v2"
-	"github.com/caoyingjunz/rainbow/pkg/util/sshutil"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	v2client "github.com/goharbor/go-client/pkg/sdk/v2.0/client"
@@ -72,9 +72,33 @@ type ServerInterface interface {
 	GetAgent(ctx context.Context, agentId int64) (interface{}, error)
 	ListAgents(ctx context.Context, listOption types.ListOptions) (interface{}, error)
 	UpdateAgentStatus(ctx context.Context, req *types.UpdateAgentStatusRequest) error
+	CreateAgentBootstrapToken(ctx context.Context, agentName string) (interface{}, error)
+	RevokeAgentCredential(ctx context.Context, agentName string) error
+	ListAgentUsages(ctx context.Context, agentId int64) (interface{}, error)
+
+	// api 模式下 agent 调用的接口
+	RegisterAgent(ctx context.Context, req *types.RegisterAgentRequest) (interface{}, error)
+	AuthenticateAgent(ctx context.Context, agentName string, credential string) error
+	AgentHeartbeat(ctx context.Context, agentName string, req *types.AgentHeartbeatRequest) error
+	GetAgentSelf(ctx context.Context, agentName string) (interface{}, error)
+	UpdateAgentUsage(ctx context.Context, agentName string, req *types.UpdateAgentUsageRequest) error
+	ListAgentTasks(ctx context.Context, agentName string) (interface{}, error)
+	ClaimAgentTask(ctx context.Context, agentName string, taskId int64, req *types.ClaimAgentTaskRequest) (interface{}, error)
+	ListOwnedAgentTasks(ctx context.Context, agentName string, req *types.ListOwnedAgentTasksRequest) (interface{}, error)
+	ReleaseAgentTask(ctx context.Context, agentName string, taskId int64, req *types.ReleaseAgentTaskRequest) error
+	UpdateAgentTaskStatus(ctx context.Context, agentName string, taskId int64, req *types.UpdateAgentTaskStatusRequest) error
+	CreateAgentTaskMessage(ctx context.Context, agentName string, req types.CreateTaskMessageRequest) error
+	GetAgentTaskConfig(ctx context.Context, agentName string, taskId int64) (interface{}, error)
+	IssueAgentPluginToken(ctx context.Context, agentName string, taskId int64) (interface{}, error)
+	RevokeAgentPluginToken(ctx context.Context, agentName string, taskId int64) error
+	GetPluginTaskConfig(ctx context.Context, taskId int64, token string) (interface{}, error)
+	IssuePluginDockerhubToken(ctx context.Context, taskId int64, token string, req *types.DockerhubTokenRequest) (interface{}, error)
+	AcquireAgentAccount(ctx context.Context, agentName string, req *types.AcquireAccountRequest) (interface{}, error)
+	ReportAgentAccountUsage(ctx context.Context, agentName string, accountId int64, req *types.ReportAccountUsageRequest) error
 
 	CreateAgentRepo(ctx context.Context, req *types.CallGithubRequest) (interface{}, error)
 	SyncAgentRepos(ctx context.Context, req *types.CallGithubRequest) error
+	GetTaskRun(ctx context.Context, taskId int64) (interface{}, error)
 
 	CreateImage(ctx context.Context, req *types.CreateImageRequest) error
 	UpdateImage(ctx context.Context, req *types.UpdateImageRequest) error
@@ -90,11 +114,25 @@ type ServerInterface interface {
 	DeleteImagesByIds(ctx context.Context, ids []int64) error
 
 	SearchImages(ctx context.Context, listOption types.ListOptions) (interface{}, error)
+	SearchCatalog(ctx context.Context, req types.CatalogSearchRequest) (interface{}, error)
 
 	UpdateImageStatus(ctx context.Context, req *types.UpdateImageStatusRequest) error
 	CreateImages(ctx context.Context, req *types.CreateImagesRequest) ([]model.Image, error)
 	DeleteImageTag(ctx context.Context, imageId int64, TagId int64) error
 	GetImageTag(ctx context.Context, imageId int64, tagId int64) (interface{}, error)
+	InspectImageTag(ctx context.Context, imageId int64, tagId int64, arch string) (interface{}, error)
+	ScanImageTag(ctx context.Context, imageId int64, tagId int64) error
+	GetImageTagScan(ctx context.Context, imageId int64, tagId int64) (interface{}, error)
+
+	LockImage(ctx context.Context, imageId int64, req *types.LockRequest) error
+	UnlockImage(ctx context.Context, imageId int64, req *types.UnlockRequest) error
+	LockImageTag(ctx context.Context, imageId int64, tagId int64, req *types.LockRequest) error
+	UnlockImageTag(ctx context.Context, imageId int64, tagId int64, req *types.UnlockRequest) error
+	ListLockEvents(ctx context.Context, imageId int64, listOption types.ListOptions) (interface{}, error)
+
+	CreateImmutableRule(ctx context.Context, req *types.CreateImmutableRuleRequest) error
+	DeleteImmutableRule(ctx context.Context, ruleId int64, userId string) error
+	ListImmutableRules(ctx context.Context, listOption types.ListOptions) (interface{}, error)
 
 	BindImageLabels(ctx context.Context, imageId int64, req types.BindImageLabels) error
 	ListImageLabels(ctx context.Context, imageId int64, listOption types.ListOptions) (interface{}, error)
@@ -125,10 +163,12 @@ type ServerInterface interface {
 	Downflow(ctx context.Context) (interface{}, error)
 	Store(ctx context.Context) (interface{}, error)
 	ImageDownflow(ctx context.Context, downflowMeta types.DownflowMeta) (interface{}, error)
+	TopPulls(ctx context.Context, req types.TopPullsRequest, trending bool) (interface{}, error)
 
 	SearchRepositories(ctx context.Context, req types.CallSearchRequest) (interface{}, error)
 	SearchRepositoryTags(ctx context.Context, req types.CallSearchRequest) (interface{}, error)
 	GetRepositoryTagInfo(ctx context.Context, req types.CallSearchRequest) (interface{}, error)
+	InspectRepositoryTag(ctx context.Context, req types.CallSearchRequest) (interface{}, error)
 
 	CreateTaskMessage(ctx context.Context, req types.CreateTaskMessageRequest) error
 	ListTaskMessages(ctx context.Context, taskId int64) (interface{}, error)
@@ -157,7 +197,31 @@ type ServerInterface interface {
 	ListKubernetesVersions(ctx context.Context, listOption types.ListOptions) (interface{}, error)
 	SyncKubernetesTags(ctx context.Context, req *types.CallKubernetesTagRequest) (interface{}, error)
 
+	CreateRainbowd(ctx context.Context, req *types.CreateRainbowdRequest) error
+	UpdateRainbowd(ctx context.Context, req *types.UpdateRainbowdRequest) error
+	DeleteRainbowd(ctx context.Context, rainbowdId int64) error
+	GetRainbowd(ctx context.Context, rainbowdId int64) (interface{}, error)
+	RekeyRainbowd(ctx context.Context, rainbowdId int64) (interface{}, error)
 	ListRainbowds(ctx context.Context, listOption types.ListOptions) (interface{}, error)
+	ListRainbowdEvents(ctx context.Context, rainbowdId int64, listOption types.ListOptions) (interface{}, error)
+
+	CreateAgentUpgrade(ctx context.Context, req *types.CreateAgentUpgradeRequest) error
+	DeleteAgentUpgrade(ctx context.Context, upgradeId int64) error
+	GetAgentUpgrade(ctx context.Context, upgradeId int64) (interface{}, error)
+	ListAgentUpgrades(ctx context.Context, listOption types.ListOptions) (interface{}, error)
+	PauseAgentUpgrade(ctx context.Context, upgradeId int64) error
+	ResumeAgentUpgrade(ctx context.Context, upgradeId int64) error
+	RollbackAgentUpgrade(ctx context.Context, upgradeId int64) error
+
+	CreateAccount(ctx context.Context, req *types.CreateAccountRequest) error
+	UpdateAccount(ctx context.Context, req *types.UpdateAccountRequest) error
+	DeleteAccount(ctx context.Context, accountId int64) error
+	GetAccount(ctx context.Context, accountId int64) (interface{}, error)
+	ListAccounts(ctx context.Context, listOption types.ListOptions) (interface{}, error)
+
+	CreateSigningKey(ctx context.Context, req *types.CreateSigningKeyRequest) error
+	DeleteSigningKey(ctx context.Context, keyId int64) error
+	ListSigningKeys(ctx context.Context, listOption types.ListOptions) (interface{}, error)
 
 	Fix(ctx context.Context, req *types.FixRequest) (interface{}, error)
 
@@ -186,6 +250,8 @@ type ServerInterface interface {
 	UpdateBuildStatus(ctx context.Context, req *types.UpdateBuildStatusRequest) error
 
 	ListMetrics(ctx context.Context, listOption types.ListOptions) (interface{}, error)
+	ListRemoteCallMetrics(ctx context.Context) (interface{}, error)
+	ListSearchCacheMetrics(ctx context.Context) (interface{}, error)
 
 	CreateAccess(ctx context.Context, req *types.CreateAccessRequest) error
 	DeleteAccess(ctx context.Context, ak string) error
@@ -203,6 +269,10 @@ type ServerInterface interface {
 var (
 	SwrClient  *swr.SwrClient
 	RegistryId *int64
+
+	// 通用 OCI 镜像源，内置镜像源和配置 hubs 合并后的结果
+	ociHubs     map[string]types.OCIRegistry
+	ociHubsOnce sync.Once
 )
 
 type ServerController struct {
@@ -211,20 +281,17 @@ type ServerController struct {
 	redisClient  *redis.Client
 	Producer     rocketmq.Producer
 	chartRepoAPI *v2client.HarborAPI
-	sshConfigMap map[string]sshutil.SSHConfig
+
+	caller RemoteCaller
 
 	lock sync.RWMutex
 }
 
 func NewServer(f db.ShareDaoFactory, cfg rainbowconfig.Config, redisClient *redis.Client, p rocketmq.Producer, cr *v2client.HarborAPI) *ServerController {
-	// 初始化 rainbow 节点配置
-	sshCfgMap := make(map[string]sshutil.SSHConfig)
-	for _, sshConfig := range cfg.Rainbowd.Nodes {
-		sshCfgMap[sshConfig.Name] = sshutil.SSHConfig{
-			Host: sshConfig.Host,
-			Port: sshConfig.Port,
-		}
-	}
+	// ServerController 按需创建，镜像源只在首次创建时根据配置初始化
+	ociHubsOnce.Do(func() {
+		ociHubs = newOCIHubs(cfg.Hubs)
+	})
 
 	sc := &ServerController{
 		factory:      f,
@@ -232,8 +299,8 @@ func NewServer(f db.ShareDaoFactory, cfg rainbowconfig.Config, redisClient *redi
 		redisClient:  redisClient,
 		Producer:     p,
 		chartRepoAPI: cr,
-		sshConfigMap: sshCfgMap,
 	}
+	sc.caller = newRemoteCaller(sc, cfg.Remote.Transport)
 
 	if SwrClient == nil || RegistryId == nil {
 		reg, err := f.Registry().GetDefaultRegistry(context.TODO())
@@ -262,143 +329,93 @@ func NewServer(f db.ShareDaoFactory, cfg rainbowconfig.Config, redisClient *redi
 	return sc
 }
 
-func (s *ServerController) RegisterRainbowd(ctx context.Context) error {
-	if len(s.cfg.Rainbowd.Nodes) == 0 {
-		return fmt.Errorf("rainbowd not found")
+// newOCIHubs 初始化通用 OCI 镜像源，配置中的同名镜像源覆盖内置镜像源
+func newOCIHubs(hubs []rainbowconfig.HubOption) map[string]types.OCIRegistry {
+	registries := make(map[string]types.OCIRegistry)
+	for name, endpoint := range types.DefaultOCIRegistries {
+		registries[name] = types.OCIRegistry{Name: name, Endpoint: endpoint}
 	}
-
-	for _, node := range s.cfg.Rainbowd.Nodes {
-		var err error
-		_, err = s.factory.Rainbowd().GetByName(ctx, node.Name)
-		if err == nil {
-			return nil
+	for _, hub := range hubs {
+		if len(hub.Name) == 0 || len(hub.Endpoint) == 0 {
+			klog.Warningf("忽略不完整的镜像源配置(%s)", hub.Name)
+			continue
 		}
-		_, err = s.factory.Rainbowd().Create(ctx, &model.Rainbowd{
-			Name:   node.Name,
-			Host:   node.Host,
-			Status: model.RunAgentType,
-		})
-		if err != nil {
-			return err
+		registries[hub.Name] = types.OCIRegistry{
+			Name:     hub.Name,
+			Endpoint: strings.TrimSuffix(hub.Endpoint, "/"),
+			Username: hub.Username,
+			Password: hub.Password,
+			Insecure: hub.Insecure,
 		}
 	}
-
-	return nil
+	return registries
 }
 
 func (s *ServerController) Run(ctx context.Context, workers int) error {
+	// 在提供服务前完成，避免历史镜像的默认锁定被当作有效锁定
+	if err := s.clearLegacyLocks(ctx); err != nil {
+		return err
+	}
+	// 下载量直接累加到数据库，依赖唯一索引
+	if err := s.ensurePullSchema(ctx); err != nil {
+		return err
+	}
+
 	go s.schedule(ctx)
 	go s.sync(ctx)
 	go s.startSyncDailyPulls(ctx)
 	go s.startSyncMetrics(ctx)
 	go s.startAgentHeartbeat(ctx)
+	go s.startAgentBudgetController(ctx)
 	go s.startSyncKubernetesTags(ctx)
 	go s.startSubscribeController(ctx)
+	go s.startAgentWorkloadSync(ctx)
+	go s.startAgentUpgradeController(ctx)
+	go s.startAccountRefresher(ctx)
+	go s.startScanController(ctx)
+	go s.ensureCatalogIndexes(ctx)
+	if s.cfg.Tunnel.Listen != 0 {
+		go s.startTunnelServer(ctx)
+	}
 
-	//klog.Infof("starting rocketmq producer")
-	//if err := s.Producer.Start(); err != nil {
-	//	return err
-	//}
+	switch s.cfg.Remote.Transport {
+	case rainbowconfig.RemoteTransportRocketmq:
+		klog.Infof("starting rocketmq producer")
+		if err := s.Producer.Start(); err != nil {
+			return err
+		}
+	case rainbowconfig.RemoteTransportGRPC:
+		if s.cfg.Tunnel.Listen == 0 {
+			return fmt.Errorf("远程调用使用 grpc 时需配置 tunnel.listen")
+		}
+	}
 	// 初始化 agent 属性
 	klog.Infof("starting register rainbowd")
 	if err := s.RegisterRainbowd(ctx); err != nil {
 		return err
 	}
 	// 启动 rainbow 检查进程
-	//go s.startRainbowdHeartbeat(ctx)
+	go s.startRainbowdHeartbeat(ctx)
 
 	return nil
 }
 
-func (s *ServerController) startRainbowdHeartbeat(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		klog.V(1).Infof("即将进行 rainbowd 的状态检查")
-		for nodeName, sshConfig := range s.sshConfigMap {
-			_, err := s.factory.Rainbowd().GetByName(ctx, nodeName)
-			if err != nil {
-				klog.Errorf("获取 rainbowd %s 失败 %v ", nodeName, err)
-				klog.Errorf("等待 %s 下一次检查", nodeName)
-				continue
-			}
-
-			status := model.RunAgentType
-			if !s.IsRainbowReachable(&sshConfig, nodeName) {
-				status = model.UnRunAgentType
-			}
-			klog.V(1).Infof("rainbowd %s 的状态为 %s", nodeName, status)
-
-			//updates := map[string]interface{}{"last_transition_time": time.Now()}
-			//if old.Status != status {
-			//	updates["status"] = status
-			//	klog.Infof("rainbowd 的状态发生改变，即将同步")
-			//} else {
-			//	klog.V(1).Infof("rainbowd(%s)的状态未发生变化，等待下一次更新", nodeName)
-			//}
-			//if err = s.factory.Rainbowd().Update(ctx, old.Id, updates); err != nil {
-			//	klog.Errorf("同步 rainbowd(%s) 状态失败 %v 等待下一次同步", nodeName, err)
-			//}
-		}
-	}
-}
-
-func (s *ServerController) IsRainbowReachable(sshConfig *sshutil.SSHConfig, nodeName string) bool {
-	sshClient, err := sshutil.NewSSHClient(sshConfig)
-	if err != nil {
-		klog.Errorf("创建(%s) ssh client 失败 %v", nodeName, err)
-		return false
-	}
-	defer sshClient.Close()
-
-	if err = sshClient.Ping(); err != nil {
-		klog.Infof("检查节点 %s 连通性失败 %v", nodeName, err)
-		return false
-	}
-	return true
-}
-
 func (s *ServerController) Stop(ctx context.Context) {
-	//klog.Infof("rocketmq producer 停止服务!!!")
-	//_ = s.Producer.Shutdown()
+	if s.cfg.Remote.Transport == rainbowconfig.RemoteTransportRocketmq {
+		klog.Infof("rocketmq producer 停止服务!!!")
+		_ = s.Producer.Shutdown()
+	}
 }
 
 func (s *ServerController) startSubscribeController(ctx context.Context) {
 	klog.Infof("starting subscribe controller")
 
-	ticker := time.NewTicker(10 * time.Minute)
+	ticker := time.NewTicker(time.Duration(s.cfg.Subscribe.ResyncInterval) * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		subscribes, err := s.factory.Task().ListSubscribes(ctx, db.WithEnable(1), db.WithFailTimes(6))
-		if err != nil {
-			klog.Errorf("获取全部订阅失败 %v 15分钟后重新执行订阅", err)
-			continue
-		}
-
-		for _, sub := range subscribes {
-			if sub.FailTimes > 5 {
-				klog.Warningf("订阅 (%s) 失败超过限制，已终止订阅", sub.Path)
-				s.DisableSubscribeWithMessage(ctx, sub, fmt.Sprintf("订阅(%s)失败已超过限制，终止订阅", sub.Path))
-				continue
-			}
-			now := time.Now()
-			if now.Sub(sub.LastNotifyTime) < sub.Interval*time.Second {
-				klog.V(1).Infof("订阅 (%s) 时间间隔 %v 暂时无需执行", sub.Path, sub.Interval*time.Second)
-				continue
-			}
-
-			if err = s.RunSubscribe(ctx, &types.RunSubscribeRequest{SubscribeId: sub.Id}); err != nil {
-				klog.Error("failed to do Subscribe(%s) %v", sub.Path, err)
-				s.CreateSubscribeMessageAndFailTimesAdd(ctx, sub, err.Error())
-			} else {
-				s.CreateSubscribeMessageWithLog(ctx, sub, fmt.Sprintf("%s 在 %v 订阅触发成功", sub.Path, time.Now().Format("2006-01-02 15:04:05")))
-			}
-
-			// 仅保留最新的 n 个事件
-			_ = s.cleanSubscribeMessages(ctx, sub.Id, 5)
-		}
+		s.reconcileSubscribes(ctx)
+		s.probeSuspendedSubscribes(ctx)
 	}
 }
 
@@ -489,7 +506,7 @@ func (s *ServerController) doSchedule(ctx context.Context) error {
 	}
 	klog.Infof("获取待处理任务 %v", item)
 
-	targetAgent, err := s.assignAgent(ctx)
+	targetAgent, err := s.assignAgent(ctx, item)
 	if err != nil {
 		return err
 	}
@@ -556,21 +573,45 @@ func (s *ServerController) sync(ctx context.Context) {
 			}
 
 			klog.Infof("镜像(%s)下载量已发生变量，延迟更新", targetImage.Name)
-			err = s.factory.Image().Update(ctx, targetImage.Id, targetImage.ResourceVersion, map[string]interface{}{"pull": pull})
-			if err != nil {
+			if err = s.syncImagePull(ctx, &targetImage, pull); err != nil {
 				klog.Errorf("更新镜像(%s)的下载量失败 %v", targetImage.Name, err)
 			}
 		}
 	}
 }
 
-func (s *ServerController) assignAgent(ctx context.Context) (string, error) {
-	agents, err := s.factory.Agent().ListForSchedule(ctx)
+// assignAgent 按 agent 上报的能力清单过滤后，选择负载最低的 agent
+func (s *ServerController) assignAgent(ctx context.Context, task *model.Task) (string, error) {
+	all, err := s.factory.Agent().ListForSchedule(ctx)
 	if err != nil {
 		return "", err
 	}
+	var (
+		agents, overSoftBudget []model.Agent
+		blocked                []string
+	)
+	for _, agent := range all {
+		if reason := unschedulableReason(agent, task); len(reason) != 0 {
+			klog.V(1).Infof("agent(%s) 无法处理任务(%s): %s", agent.Name, task.Name, reason)
+			blocked = append(blocked, fmt.Sprintf("agent(%s) %s", agent.Name, reason))
+			continue
+		}
+		if s.isOverSoftBudget(agent) {
+			overSoftBudget = append(overSoftBudget, agent)
+			continue
+		}
+		agents = append(agents, agent)
+	}
+	// 开销达到预算软阈值的 agent 仅在没有其他可用 agent 时参与调度
 	if len(agents) == 0 {
-		klog.Warningf("不存在可用工作节点，等待下一次调度")
+		agents = overSoftBudget
+	}
+	if len(agents) == 0 {
+		if len(blocked) != 0 {
+			klog.Warningf("任务(%s)不存在可用工作节点，等待下一次调度: %s", task.Name, strings.Join(blocked, "; "))
+		} else {
+			klog.Warningf("不存在可用工作节点，等待下一次调度")
+		}
 		return "", nil
 	}
 
@@ -629,6 +670,22 @@ func (s *ServerController) assignAgent(ctx context.Context) (string, error) {
 	}
 }
 
+// minScheduleDiskFree agent 数据目录的最小可用空间
+const minScheduleDiskFree = 1 << 30
+
+// unschedulableReason 返回 agent 无法处理任务的原因，未上报能力清单的 agent 不做限制
+func unschedulableReason(agent model.Agent, task *model.Task) string {
+	inventory := agent.Inventory
+	if inventory == nil {
+		return ""
+	}
+	// 同步驱动在 CI runner 中执行，与 agent 主机上安装的工具和 buildx 支持的平台无关，因此不按驱动和平台过滤
+	if inventory.Disk.Total != 0 && inventory.Disk.Free < minScheduleDiskFree {
+		return fmt.Sprintf("磁盘可用空间不足(%d)", inventory.Disk.Free)
+	}
+	return ""
+}
+
 func (s *ServerController) startAgentHeartbeat(ctx context.Context) {
 	klog.Infof("starting agent heartbeat")
 
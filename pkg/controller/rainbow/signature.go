@@ -0,0 +1,70 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	rainbowconfig "github.com/caoyingjunz/rainbow/cmd/app/config"
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+)
+
+func (s *ServerController) CreateSigningKey(ctx context.Context, req *types.CreateSigningKeyRequest) error {
+	publicKey := strings.TrimSpace(req.PublicKey)
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return fmt.Errorf("公钥不是合法的 PEM 格式")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return fmt.Errorf("解析公钥失败 %v", err)
+	}
+
+	olds, err := s.factory.SigningKey().List(ctx, db.WithName(req.Name))
+	if err != nil {
+		return err
+	}
+	if len(olds) != 0 {
+		return fmt.Errorf("公钥(%s)已存在", req.Name)
+	}
+	_, err = s.factory.SigningKey().Create(ctx, &model.SigningKey{
+		Name:        req.Name,
+		PublicKey:   publicKey,
+		Description: req.Description,
+	})
+	return err
+}
+
+func (s *ServerController) DeleteSigningKey(ctx context.Context, keyId int64) error {
+	return s.factory.SigningKey().Delete(ctx, keyId)
+}
+
+func (s *ServerController) ListSigningKeys(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
+	return s.factory.SigningKey().List(ctx, db.WithOrderByDesc())
+}
+
+// makeSignatureOption 根据任务的签名策略生成 plugin 配置，开启校验时下发全部公钥
+func makeSignatureOption(ctx context.Context, f db.ShareDaoFactory, task model.Task) (rainbowconfig.SignatureOption, error) {
+	opt := rainbowconfig.SignatureOption{Copy: task.CopySignatures, Verify: task.VerifySignature}
+	if !task.VerifySignature {
+		return opt, nil
+	}
+
+	keys, err := f.SigningKey().List(ctx)
+	if err != nil {
+		klog.Errorf("获取签名公钥失败 %v", err)
+		return opt, err
+	}
+	if len(keys) == 0 {
+		return opt, fmt.Errorf("任务(%d)开启了签名校验，但未配置公钥", task.Id)
+	}
+	for _, key := range keys {
+		opt.PublicKeys = append(opt.PublicKeys, key.PublicKey)
+	}
+	return opt, nil
+}
@@ -3,15 +3,20 @@ package rainbow
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
 	"github.com/caoyingjunz/rainbow/pkg/db"
 	"github.com/caoyingjunz/rainbow/pkg/db/model"
 	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
 	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
 	"github.com/caoyingjunz/rainbow/pkg/util/errors"
 	"github.com/caoyingjunz/rainbow/pkg/util/uuid"
 )
@@ -36,33 +41,93 @@ func (s *ServerController) RunSubscribe(ctx context.Context, req *types.RunSubsc
 
 	s.CreateSubscribeMessageWithLog(ctx, *sub, "手动执行镜像订阅")
 	if sub.Rewrite {
-		return s.runSubscribeFull(ctx, sub)
+		err = s.runSubscribeFull(ctx, sub)
+	} else {
+		err = s.runSubscribeIncrement(ctx, sub)
+	}
+	if err != nil {
+		return err
 	}
-	return s.runSubscribeIncrement(ctx, sub)
+
+	// 订阅执行后按保留策略清理历史版本
+	s.pruneSubscribeTags(ctx, sub)
+	return nil
 }
 
-// 全量同步
-func (s *ServerController) runSubscribeFull(ctx context.Context, sub *model.Subscribe) error {
-	klog.Infof("开始执行%s全量同步,策略 %s", sub.Path, sub.Policy)
+// pruneSubscribeTags 按保留策略清理订阅镜像的历史版本，仅处理匹配订阅策略且已结束同步的版本
+func (s *ServerController) pruneSubscribeTags(ctx context.Context, sub *model.Subscribe) {
+	if sub.RetainCount <= 0 && sub.RetainDays <= 0 {
+		return
+	}
 
-	var ns, repo string
-	parts := strings.Split(sub.RawPath, "/")
-	if len(parts) == 2 {
-		ns, repo = parts[0], parts[1]
+	exists, err := s.factory.Image().ListImagesWithTag(ctx, db.WithUser(sub.UserId), db.WithName(sub.DestPath))
+	if err != nil {
+		klog.Errorf("获取订阅镜像(%s)失败 %v", sub.Path, err)
+		return
 	}
-	size := sub.Size
-	if size > 100 {
-		size = 100 // 最大并发是 100
+	if len(exists) == 0 {
+		return
 	}
+	subImage := exists[0]
 
-	klog.Infof("开始搜索远端最新镜像")
-	newImages, err := s.SearchRepositoryTags(ctx, types.CallSearchRequest{
-		Namespace:    ns,
-		Repository:   repo,
-		Query:        sub.Policy,
-		PageSize:     size,
-		CustomConfig: &types.SearchCustomConfig{Policy: sub.Policy, Arch: sub.Arch},
+	pinned := sets.NewString(util.TrimAndFilter(strings.Split(sub.PinnedTags, ","))...)
+	candidates := make([]model.Tag, 0)
+	for _, tag := range subImage.Tags {
+		// 同步中的版本不做清理
+		if tag.Status != types.SyncImageComplete && tag.Status != types.SyncImageError {
+			continue
+		}
+		if pinned.Has(tag.Name) || !matchSubscribePolicy(sub.Policy, tag.Name) {
+			continue
+		}
+		candidates = append(candidates, tag)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].GmtCreate.After(candidates[j].GmtCreate)
 	})
+
+	deadline := time.Now().AddDate(0, 0, -sub.RetainDays)
+	var removed []string
+	for index, tag := range candidates {
+		if sub.RetainCount > 0 && index < sub.RetainCount {
+			continue
+		}
+		if sub.RetainDays > 0 && tag.GmtCreate.After(deadline) {
+			continue
+		}
+
+		if err = s.DeleteImageTag(ctx, subImage.Id, tag.Id); err != nil {
+			klog.Errorf("清理订阅镜像(%s)版本(%s)失败 %v", sub.Path, tag.Name, err)
+			continue
+		}
+		removed = append(removed, tag.Name)
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	klog.Infof("订阅镜像(%s)按保留策略清理版本 %v", sub.Path, removed)
+	s.CreateSubscribeMessageWithLog(ctx, *sub, fmt.Sprintf("按保留策略清理版本: %s", strings.Join(removed, ",")))
+}
+
+// matchSubscribePolicy 订阅策略支持正则表达式，无法解析时按包含匹配
+func matchSubscribePolicy(policy string, tag string) bool {
+	if len(policy) == 0 {
+		return true
+	}
+	reg, err := regexp.Compile(policy)
+	if err != nil {
+		return strings.Contains(tag, policy)
+	}
+	return reg.MatchString(tag)
+}
+
+// 全量同步
+func (s *ServerController) runSubscribeFull(ctx context.Context, sub *model.Subscribe) error {
+	klog.Infof("开始执行%s全量同步,策略 %s", sub.Path, sub.Policy)
+
+	klog.Infof("开始搜索远端最新镜像")
+	newImages, err := s.searchSubscribeTags(ctx, sub)
 	if err != nil {
 		return s.HandlerSearchRepositoryTags(ctx, sub, err)
 	}
@@ -151,24 +216,8 @@ func (s *ServerController) runSubscribeIncrement(ctx context.Context, sub *model
 		klog.Errorf("重新触发异常tag失败: %v", err)
 	}
 
-	var ns, repo string
-	parts := strings.Split(sub.RawPath, "/")
-	if len(parts) == 2 {
-		ns, repo = parts[0], parts[1]
-	}
-	size := sub.Size
-	if size > 100 {
-		size = 100 // 最大并发是 100
-	}
-
 	klog.Infof("开始搜索远端最新镜像")
-	newImages, err := s.SearchRepositoryTags(ctx, types.CallSearchRequest{
-		Namespace:    ns,
-		Repository:   repo,
-		Query:        sub.Policy,
-		PageSize:     size,
-		CustomConfig: &types.SearchCustomConfig{Policy: sub.Policy, Arch: sub.Arch},
-	})
+	newImages, err := s.searchSubscribeTags(ctx, sub)
 	if err != nil {
 		return s.HandlerSearchRepositoryTags(ctx, sub, err)
 	}
@@ -223,6 +272,50 @@ func (s *ServerController) runSubscribeIncrement(ctx context.Context, sub *model
 	return s.afterRunSubscribe(ctx, sub)
 }
 
+// buildSubscribeSearchRequest 构造订阅的远端镜像版本查询请求
+func (s *ServerController) buildSubscribeSearchRequest(sub *model.Subscribe) types.CallSearchRequest {
+	size := sub.Size
+	if size > 100 {
+		size = 100 // 最大并发是 100
+	}
+	req := types.CallSearchRequest{
+		Hub:          sub.ImageFrom,
+		Query:        sub.Policy,
+		PageSize:     size,
+		CustomConfig: &types.SearchCustomConfig{Policy: sub.Policy, Arch: sub.Arch},
+	}
+
+	// 通用 OCI 镜像源的仓库名可能包含多级路径
+	if s.isOCIImageFrom(sub.ImageFrom) {
+		req.Repository = strings.TrimPrefix(sub.RawPath, sub.ImageFrom+"/")
+		return req
+	}
+
+	parts := strings.Split(sub.RawPath, "/")
+	if len(parts) == 2 {
+		req.Namespace, req.Repository = parts[0], parts[1]
+	}
+	return req
+}
+
+// searchSubscribeTags 订阅需要远端最新的版本，查询前先失效该仓库的搜索缓存
+func (s *ServerController) searchSubscribeTags(ctx context.Context, sub *model.Subscribe) (interface{}, error) {
+	req := s.buildSubscribeSearchRequest(sub)
+	s.setRepoHubType(&req)
+	req.SetNamespace()
+	s.invalidateSearchCache(ctx, req.Hub, req.Namespace, req.Repository)
+
+	return s.SearchRepositoryTags(ctx, req)
+}
+
+func (s *ServerController) isOCIImageFrom(imageFrom string) bool {
+	if len(imageFrom) == 0 || imageFrom == types.ImageHubDocker {
+		return false
+	}
+	_, ok := s.getOCIHub(imageFrom)
+	return ok
+}
+
 func (s *ServerController) afterRunSubscribe(ctx context.Context, sub *model.Subscribe) error {
 	updates := make(map[string]interface{})
 	updates["last_notify_time"] = time.Now()
@@ -232,51 +325,149 @@ func (s *ServerController) afterRunSubscribe(ctx context.Context, sub *model.Sub
 	return nil
 }
 
+// HandlerSearchRepositoryTags 远端镜像不存在时关闭订阅，其他异常返回由订阅控制器退避重试
 func (s *ServerController) HandlerSearchRepositoryTags(ctx context.Context, sub *model.Subscribe, err error) error {
-	klog.Errorf("获取 dockerhub 镜像(%s)最新镜像版本失败 %v", sub.Path, err)
+	klog.Errorf("获取远端镜像(%s)最新镜像版本失败 %v", sub.Path, err)
 	// 如果返回报错是 404 Not Found 则说明远端进行不存在，终止订阅
-	if strings.Contains(err.Error(), "404 Not Found") {
+	if isSubscribeNotFoundError(err) {
 		klog.Infof("订阅镜像(%s)不存在，关闭订阅", sub.Path)
-		if err = s.factory.Task().UpdateSubscribe(ctx, sub.Id, sub.ResourceVersion, map[string]interface{}{"status": "镜像不存在", "enable": false}); err != nil {
-			klog.Infof("镜像(%s)不存在关闭订阅失败 %v", sub.Path, err)
+		if err2 := s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{"status": model.SubscribeNotFoundStatus, "enable": false}); err2 != nil {
+			klog.Infof("镜像(%s)不存在关闭订阅失败 %v", sub.Path, err2)
+		}
+		s.CreateSubscribeMessageWithLog(ctx, *sub, fmt.Sprintf("订阅镜像(%s)不存在，已自动关闭 %v", sub.Path, err.Error()))
+	}
+	return err
+}
+
+func isSubscribeNotFoundError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404 Not Found")
+}
+
+// reconcileSubscribes 执行到期的订阅，失败时指数退避
+func (s *ServerController) reconcileSubscribes(ctx context.Context) {
+	subscribes, err := s.factory.Task().ListSubscribes(ctx, db.WithEnable(1))
+	if err != nil {
+		klog.Errorf("获取全部订阅失败 %v", err)
+		return
+	}
+
+	for _, sub := range subscribes {
+		if sub.FailTimes >= s.cfg.Subscribe.MaxFailTimes {
+			klog.Warningf("订阅 (%s) 失败超过限制，暂停订阅", sub.Path)
+			s.SuspendSubscribeWithMessage(ctx, sub, fmt.Sprintf("订阅(%s)连续失败 %d 次，暂停订阅并定期探测恢复", sub.Path, sub.FailTimes))
+			continue
+		}
+		now := time.Now()
+		if now.Before(sub.NextRunTime) {
+			klog.V(1).Infof("订阅 (%s) 失败退避中，%v 后执行", sub.Path, sub.NextRunTime.Sub(now))
+			continue
+		}
+		if now.Sub(sub.LastNotifyTime) < sub.Interval*time.Second {
+			klog.V(1).Infof("订阅 (%s) 时间间隔 %v 暂时无需执行", sub.Path, sub.Interval*time.Second)
+			continue
 		}
-		if err2 := s.factory.Task().CreateSubscribeMessage(ctx, &model.SubscribeMessage{
-			SubscribeId: sub.Id, Message: fmt.Sprintf("订阅镜像(%s)不存在，已自动关闭 %v", sub.Path, err.Error()),
-		}); err2 != nil {
-			klog.Errorf("创建订阅限制事件失败 %v", err)
+
+		if err = s.RunSubscribe(ctx, &types.RunSubscribeRequest{SubscribeId: sub.Id}); err != nil {
+			klog.Errorf("failed to do Subscribe(%s) %v", sub.Path, err)
+			// 远端镜像不存在时已关闭订阅，无需退避
+			if !isSubscribeNotFoundError(err) {
+				s.BackoffSubscribeWithMessage(ctx, sub, err)
+			}
+		} else {
+			if sub.FailTimes != 0 {
+				if err = s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{"fail_times": 0}); err != nil {
+					klog.Errorf("重置订阅(%s)失败次数失败 %v", sub.Path, err)
+				}
+			}
+			s.CreateSubscribeMessageWithLog(ctx, sub, fmt.Sprintf("%s 在 %v 订阅触发成功", sub.Path, time.Now().Format("2006-01-02 15:04:05")))
 		}
+
+		_ = s.cleanSubscribeMessages(ctx, sub.Id)
 	}
-	return nil
 }
 
-func (s *ServerController) DisableSubscribeWithMessage(ctx context.Context, sub model.Subscribe, msg string) {
-	if err := s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{
-		"enable": false,
-	}); err != nil {
-		klog.Errorf("自动关闭订阅失败 %v", err)
+// probeSuspendedSubscribes 探测暂停的订阅，远端恢复后自动启用
+func (s *ServerController) probeSuspendedSubscribes(ctx context.Context) {
+	subscribes, err := s.factory.Task().ListSubscribes(ctx, db.WithEnable(0), db.WithStatus(model.SubscribeSuspendedStatus))
+	if err != nil {
+		klog.Errorf("获取暂停订阅失败 %v", err)
 		return
 	}
-	if err := s.factory.Task().CreateSubscribeMessage(ctx, &model.SubscribeMessage{
-		SubscribeId: sub.Id,
-		Message:     msg,
-	}); err != nil {
-		klog.Errorf("创建订阅限制事件失败 %v", err)
+
+	for _, sub := range subscribes {
+		now := time.Now()
+		if now.Before(sub.NextRunTime) {
+			continue
+		}
+
+		req := s.buildSubscribeSearchRequest(&sub)
+		req.PageSize = 1
+		_, err = s.SearchRepositoryTags(ctx, req)
+		switch {
+		case err == nil:
+			klog.Infof("订阅(%s)探测成功，自动恢复", sub.Path)
+			err = s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{
+				"enable":        true,
+				"status":        "",
+				"fail_times":    0,
+				"next_run_time": now,
+			})
+			s.CreateSubscribeMessageWithLog(ctx, sub, "探测远端镜像成功，自动恢复订阅")
+		case isSubscribeNotFoundError(err):
+			err = s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{"status": model.SubscribeNotFoundStatus})
+			s.CreateSubscribeMessageWithLog(ctx, sub, fmt.Sprintf("订阅镜像(%s)不存在，停止探测", sub.Path))
+		default:
+			next := now.Add(time.Duration(s.cfg.Subscribe.ProbeInterval) * time.Second)
+			s.CreateSubscribeMessageWithLog(ctx, sub, fmt.Sprintf("探测远端镜像失败 %v，%s 再次探测", err, next.Format("2006-01-02 15:04:05")))
+			err = s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{"next_run_time": next})
+		}
+		if err != nil {
+			klog.Errorf("更新订阅(%s)探测结果失败 %v", sub.Path, err)
+		}
+
+		_ = s.cleanSubscribeMessages(ctx, sub.Id)
 	}
 }
 
-func (s *ServerController) CreateSubscribeMessageAndFailTimesAdd(ctx context.Context, sub model.Subscribe, msg string) {
-	if err := s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{
-		"fail_times": sub.FailTimes + 1,
-	}); err != nil {
-		klog.Errorf("订阅次数+1失败 %v", err)
+// subscribeBackoff 按失败次数指数退避，并添加随机抖动避免集中重试
+func (s *ServerController) subscribeBackoff(failTimes int) time.Duration {
+	base := time.Duration(s.cfg.Subscribe.BackoffBase) * time.Second
+	max := time.Duration(s.cfg.Subscribe.BackoffMax) * time.Second
+
+	delay := base
+	for i := 1; i < failTimes && delay < max; i++ {
+		delay *= 2
 	}
+	delay = wait.Jitter(delay, 0.5)
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
 
-	if err := s.factory.Task().CreateSubscribeMessage(ctx, &model.SubscribeMessage{
-		SubscribeId: sub.Id,
-		Message:     msg,
+func (s *ServerController) BackoffSubscribeWithMessage(ctx context.Context, sub model.Subscribe, err error) {
+	failTimes := sub.FailTimes + 1
+	next := time.Now().Add(s.subscribeBackoff(failTimes))
+	if err2 := s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{
+		"fail_times":    failTimes,
+		"next_run_time": next,
+	}); err2 != nil {
+		klog.Errorf("订阅失败退避更新失败 %v", err2)
+	}
+
+	s.CreateSubscribeMessageWithLog(ctx, sub, fmt.Sprintf("第 %d 次执行失败 %v，%s 后重试", failTimes, err, next.Format("2006-01-02 15:04:05")))
+}
+
+func (s *ServerController) SuspendSubscribeWithMessage(ctx context.Context, sub model.Subscribe, msg string) {
+	if err := s.factory.Task().UpdateSubscribeDirectly(ctx, sub.Id, map[string]interface{}{
+		"enable":        false,
+		"status":        model.SubscribeSuspendedStatus,
+		"next_run_time": time.Now().Add(time.Duration(s.cfg.Subscribe.ProbeInterval) * time.Second),
 	}); err != nil {
-		klog.Errorf("创建订阅限制事件失败 %v", err)
+		klog.Errorf("自动暂停订阅失败 %v", err)
+		return
 	}
+	s.CreateSubscribeMessageWithLog(ctx, sub, msg)
 }
 
 func (s *ServerController) CreateSubscribeMessageWithLog(ctx context.Context, sub model.Subscribe, msg string) {
@@ -288,8 +479,10 @@ func (s *ServerController) CreateSubscribeMessageWithLog(ctx context.Context, su
 	}
 }
 
-func (s *ServerController) cleanSubscribeMessages(ctx context.Context, subId int64, retains int) error {
-	return s.factory.Task().DeleteSubscribeMessage(ctx, subId)
+// cleanSubscribeMessages 按配置的条数和天数保留订阅事件
+func (s *ServerController) cleanSubscribeMessages(ctx context.Context, subId int64) error {
+	before := time.Now().AddDate(0, 0, -s.cfg.Subscribe.MessageRetainDays)
+	return s.factory.Task().DeleteSubscribeMessage(ctx, subId, s.cfg.Subscribe.MessageRetains, before)
 }
 
 func (s *ServerController) reRunSubErrTags(ctx context.Context, errTags []model.Tag) error {
@@ -375,10 +568,24 @@ func (s *ServerController) preCreateSubscribe(ctx context.Context, req *types.Cr
 	if err := ValidateArch(req.Arch); err != nil {
 		return err
 	}
+	if err := ValidateSubscribeRetention(req.Size, req.SubscribeRetention); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func ValidateSubscribeRetention(size int, retention types.SubscribeRetention) error {
+	if retention.RetainCount < 0 || retention.RetainDays < 0 {
+		return fmt.Errorf("保留版本数和保留天数不得小于 0")
+	}
+	// 保留数小于同步数时，清理的版本会在下次订阅时被重新同步
+	if retention.RetainCount > 0 && retention.RetainCount < size {
+		return fmt.Errorf("保留版本数(%d)不得小于同步版本数(%d)", retention.RetainCount, size)
+	}
+	return nil
+}
+
 func (s *ServerController) ValidateSubscribeSize(ctx context.Context, size int, userId string) error {
 	if size < 0 {
 		return fmt.Errorf("订阅镜像版本数不得定于 0")
@@ -407,6 +614,21 @@ func (s *ServerController) ValidateSubscribeSize(ctx context.Context, size int,
 }
 
 func (s *ServerController) CreateSubscribe(ctx context.Context, req *types.CreateSubscribeRequest) error {
+	// 初始化镜像来源
+	if len(req.ImageFrom) == 0 {
+		req.ImageFrom = types.ImageHubDocker
+	}
+	if req.ImageFrom != types.ImageHubDocker && !s.isOCIImageFrom(req.ImageFrom) {
+		return fmt.Errorf("不支持的镜像来源 %s", req.ImageFrom)
+	}
+
+	rawPath := req.Path
+	if s.isOCIImageFrom(req.ImageFrom) {
+		// 通用 OCI 镜像源的订阅地址统一带上镜像源域名，便于 agent 直接拉取
+		rawPath = strings.TrimPrefix(req.Path, req.ImageFrom+"/")
+		req.Path = req.ImageFrom + "/" + rawPath
+	}
+
 	if err := s.preCreateSubscribe(ctx, req); err != nil {
 		return err
 	}
@@ -422,12 +644,6 @@ func (s *ServerController) CreateSubscribe(ctx context.Context, req *types.Creat
 		return err
 	}
 
-	// 初始化镜像来源
-	if len(req.ImageFrom) == 0 {
-		req.ImageFrom = types.ImageHubDocker
-	}
-
-	rawPath := req.Path
 	// 默认dockerhub不指定 ns时，会添加默认值
 	if req.ImageFrom == types.ImageHubDocker {
 		parts := strings.Split(rawPath, "/")
@@ -453,6 +669,10 @@ func (s *ServerController) CreateSubscribe(ctx context.Context, req *types.Creat
 		Policy:     strings.TrimSpace(req.Policy),
 		Arch:       req.Arch,
 		Rewrite:    req.Rewrite,
+
+		RetainCount: req.RetainCount,
+		RetainDays:  req.RetainDays,
+		PinnedTags:  strings.Join(util.TrimAndFilter(req.PinnedTags), ","),
 	})
 }
 
@@ -463,6 +683,9 @@ func (s *ServerController) preUpdateSubscribe(ctx context.Context, req *types.Up
 	if err := ValidateArch(req.Arch); err != nil {
 		return err
 	}
+	if err := ValidateSubscribeRetention(req.Size, req.SubscribeRetention); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -478,6 +701,10 @@ func (s *ServerController) UpdateSubscribe(ctx context.Context, req *types.Updat
 		"policy":     req.Policy,
 		"arch":       req.Arch,
 		"rewrite":    req.Rewrite,
+
+		"retain_count": req.RetainCount,
+		"retain_days":  req.RetainDays,
+		"pinned_tags":  strings.Join(util.TrimAndFilter(req.PinnedTags), ","),
 	}
 
 	enable := req.Enable
@@ -491,6 +718,10 @@ func (s *ServerController) UpdateSubscribe(ctx context.Context, req *types.Updat
 			// 原先是关闭，最新开启，则刷新 sub message 为开启
 			if !old.Enable && enable {
 				msg = fmt.Sprintf("手动启动制品订阅")
+				// 手动启用时重置失败退避
+				update["status"] = ""
+				update["fail_times"] = 0
+				update["next_run_time"] = time.Now()
 			}
 			if old.Enable && !enable {
 				msg = fmt.Sprintf("手动关闭制品订阅")
@@ -20,8 +20,9 @@ import (
 )
 
 const (
-	TaskWaitStatus  = "调度中"
-	HuaweiNamespace = "pixiu-public" // pixiuHub 内置默认外部命名空间
+	TaskWaitStatus   = "调度中"
+	TaskFailedStatus = "同步失败"
+	HuaweiNamespace  = "pixiu-public" // pixiuHub 内置默认外部命名空间
 
 	DemandPaymentType  = 0 // 按需付费
 	PackagePaymentType = 1 // 包年包月
@@ -157,12 +158,17 @@ func (s *ServerController) CreateTask(ctx context.Context, req *types.CreateTask
 			Architecture:      req.Architecture, // 通用镜像架构，会被镜像自身的架构覆盖
 			OwnerRef:          req.OwnerRef,
 			SubscribeId:       req.SubscribeId,
+			CopySignatures:    req.CopySignatures,
+			VerifySignature:   req.VerifySignature,
 		})
 		if err != nil {
 			return err
 		}
 		taskId := object.Id
 		s.CreateTaskMessages(ctx, taskId, "同步已启动", "数据校验中，预计等待 1 分钟")
+		for _, image := range req.Images {
+			s.invalidateImageSearchCache(ctx, image)
+		}
 
 		if err = s.CreateImageWithTag(ctx, taskId, req); err != nil {
 			s.CreateTaskMessages(ctx, taskId, fmt.Sprintf("创建镜像和版本失败 %v", err))
@@ -191,6 +197,8 @@ func (s *ServerController) CreateTask(ctx context.Context, req *types.CreateTask
 				Architecture:      req.Architecture,
 				OwnerRef:          req.OwnerRef,
 				SubscribeId:       req.SubscribeId,
+				CopySignatures:    req.CopySignatures,
+				VerifySignature:   req.VerifySignature,
 			})
 			if err != nil {
 				return err
@@ -284,7 +292,6 @@ func (s *ServerController) CreateImageWithTag(ctx context.Context, taskId int64,
 					IsPublic:     req.PublicImage,
 					IsOfficial:   req.IsOfficial,
 					LastSyncTime: time.Now(),
-					IsLocked:     true,
 				})
 				if err != nil {
 					klog.Errorf("创建镜像(%s)失败: %v", path, err)
@@ -326,6 +333,10 @@ func (s *ServerController) CreateImageWithTag(ctx context.Context, taskId int64,
 					return err
 				}
 			} else {
+				// 锁定或命中不可变规则的版本不允许覆盖
+				if err = s.checkTagWritable(ctx, imageId, oldTag); err != nil {
+					return err
+				}
 				// 已经存在则写入新关联的 taskId
 				newTaskIds := strings.Join([]string{oldTag.TaskIds, fmt.Sprintf("%d", taskId)}, ",")
 				update := map[string]interface{}{"task_ids": newTaskIds, "status": types.SyncImageInitializing}
@@ -367,6 +378,10 @@ func (s *ServerController) tryToUpdateImageInfo(ctx context.Context, imageId int
 	if len(labels) != 0 {
 		return
 	}
+	// 通用 OCI 镜像源无镜像描述和分类信息
+	if _, _, ok := s.getOCIHubForPath(path); ok {
+		return
+	}
 
 	var (
 		namespace string
@@ -655,12 +670,19 @@ func (s *ServerController) GetTask(ctx context.Context, taskId int64) (interface
 }
 
 func (s *ServerController) ReRunTask(ctx context.Context, req *types.UpdateTaskRequest) error {
+	// 重新执行会覆盖任务已有的版本，需要和创建任务一样校验锁定状态
+	if err := s.checkTaskTagsWritable(ctx, req.Id, req.OnlyPushError); err != nil {
+		return err
+	}
+
 	updates := map[string]interface{}{
-		"agent_name":      "",
-		"status":          TaskWaitStatus,
-		"process":         0,
-		"message":         "触发重新执行",
-		"only_push_error": req.OnlyPushError,
+		"agent_name":        "",
+		"status":            TaskWaitStatus,
+		"process":           0,
+		"message":           "触发重新执行",
+		"only_push_error":   req.OnlyPushError,
+		"lease_holder":      "",
+		"lease_expire_time": nil,
 	}
 	if err := s.factory.Task().Update(ctx, req.Id, req.ResourceVersion, updates); err != nil {
 		klog.Errorf("重新执行任务 %d 失败 %v", req.Id, err)
@@ -676,6 +698,38 @@ func (s *ServerController) ReRunTask(ctx context.Context, req *types.UpdateTaskR
 	return nil
 }
 
+// checkTaskTagsWritable 检查任务关联的版本是否允许覆盖，仅重新推送失败的版本时跳过已完成的版本
+func (s *ServerController) checkTaskTagsWritable(ctx context.Context, taskId int64, onlyPushError bool) error {
+	tags, err := s.factory.Image().ListTags(ctx, db.WithTaskLike(taskId))
+	if err != nil {
+		klog.Errorf("获取任务(%d)关联的版本失败 %v", taskId, err)
+		return err
+	}
+
+	id := fmt.Sprintf("%d", taskId)
+	for i := range tags {
+		tag := &tags[i]
+		// task_ids 为模糊匹配，需要排除其他任务的版本
+		related := false
+		for _, t := range strings.Split(tag.TaskIds, ",") {
+			if t == id {
+				related = true
+				break
+			}
+		}
+		if !related {
+			continue
+		}
+		if onlyPushError && tag.Status == types.SyncImageComplete {
+			continue
+		}
+		if err = s.checkTagWritable(ctx, tag.ImageId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *ServerController) ListTaskImages(ctx context.Context, taskId int64, listOption types.ListOptions) (interface{}, error) {
 	return s.factory.Image().ListTags(ctx, db.WithTaskLike(taskId), db.WithNameLike(listOption.NameSelector))
 }
@@ -719,6 +773,12 @@ func (s *ServerController) preCreateAgent(ctx context.Context, req *types.Create
 	if len(req.GithubEmail) == 0 {
 		return fmt.Errorf("github email不能为空")
 	}
+	if err := validateAgentCI(req.CIType, req.CIEndpoint, req.CITrigger); err != nil {
+		return err
+	}
+	if err := validateAgentProvisioner(req.Provisioner, req.RainbowdName); err != nil {
+		return err
+	}
 
 	// 检查agent是否存在
 	_, err := s.factory.Agent().GetByName(ctx, req.AgentName)
@@ -736,7 +796,7 @@ func (s *ServerController) CreateAgent(ctx context.Context, req *types.CreateAge
 	}
 
 	if len(req.GithubRepository) == 0 {
-		req.GithubRepository = fmt.Sprintf("https://github.com/%s/plugin.git", req.GithubUser)
+		req.GithubRepository = ciRepositoryURL(req.CIType, req.CIEndpoint, req.GithubUser)
 	}
 	// 创建新的agent记录
 	agent := &model.Agent{
@@ -745,9 +805,19 @@ func (s *ServerController) CreateAgent(ctx context.Context, req *types.CreateAge
 		GithubToken:      req.GithubToken,
 		GithubRepository: req.GithubRepository,
 		GithubEmail:      req.GithubEmail,
+		CIType:           req.CIType,
+		CIEndpoint:       req.CIEndpoint,
+		CITrigger:        req.CITrigger,
+		CIWorkflow:       req.CIWorkflow,
+		CIRef:            req.CIRef,
 		Type:             req.Type,
 		RainbowdName:     req.RainbowdName,
+		Provisioner:      req.Provisioner,
+		Image:            req.Image,
+		BinaryVersion:    req.BinaryVersion,
+		Labels:           req.Labels,
 		Status:           model.UnStartType,
+		TunnelToken:      util.HashToken(req.TunnelToken),
 	}
 	if _, err := s.factory.Agent().Create(ctx, agent); err != nil {
 		return fmt.Errorf("创建agent失败: %v", err)
@@ -780,7 +850,3 @@ func (s *ServerController) DeleteAgent(ctx context.Context, agentId int64) error
 
 	return nil
 }
-
-func (s *ServerController) ListRainbowds(ctx context.Context, listOption types.ListOptions) (interface{}, error) {
-	return s.factory.Rainbowd().List(ctx)
-}
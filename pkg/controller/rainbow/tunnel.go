@@ -0,0 +1,286 @@
+package rainbow
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	pb "github.com/caoyingjunz/rainbow/api/rpc/proto"
+	"github.com/caoyingjunz/rainbow/pkg/db"
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
+	"github.com/caoyingjunz/rainbow/pkg/util"
+)
+
+var (
+	RpcClients map[string]*tunnelSession
+
+	// ServerController 按需创建，隧道会话需要进程级的锁保护
+	rpcLock sync.RWMutex
+)
+
+// tunnelSession agent 的隧道会话，按调用 ID 关联下发的请求和返回的结果
+type tunnelSession struct {
+	name   string
+	stream pb.Tunnel_ConnectServer
+
+	// grpc stream 不支持并发 Send
+	sendLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[string]chan types.TunnelMessage
+}
+
+func newTunnelSession(name string, stream pb.Tunnel_ConnectServer) *tunnelSession {
+	return &tunnelSession{
+		name:    name,
+		stream:  stream,
+		pending: make(map[string]chan types.TunnelMessage),
+	}
+}
+
+func (t *tunnelSession) send(msg types.TunnelMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+	return t.stream.Send(&pb.Response{Result: data})
+}
+
+func (t *tunnelSession) addPending(id string) chan types.TunnelMessage {
+	ch := make(chan types.TunnelMessage, 1)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[id] = ch
+	return ch
+}
+
+func (t *tunnelSession) removePending(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pending, id)
+}
+
+// resolve 将结果投递给等待中的调用，调用已超时则丢弃
+func (t *tunnelSession) resolve(msg types.TunnelMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ch, ok := t.pending[msg.Id]
+	if !ok {
+		klog.Warningf("agent(%s) 返回的调用(%s)已失效，忽略", t.name, msg.Id)
+		return
+	}
+	delete(t.pending, msg.Id)
+	ch <- msg
+}
+
+// close 隧道断开时，结束全部等待中的调用
+func (t *tunnelSession) close(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for id, ch := range t.pending {
+		ch <- types.TunnelMessage{Id: id, Type: types.TunnelResultType, CallResult: types.CallResult{StatusCode: 1, ErrMessage: err.Error()}}
+		delete(t.pending, id)
+	}
+}
+
+type tunnelServer struct {
+	pb.UnimplementedTunnelServer
+
+	s *ServerController
+}
+
+func (t *tunnelServer) Connect(stream pb.Tunnel_ConnectServer) error {
+	return t.s.Connect(stream)
+}
+
+func (s *ServerController) startTunnelServer(ctx context.Context) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.Tunnel.Listen))
+	if err != nil {
+		klog.Errorf("隧道监听端口(%d)失败 %v", s.cfg.Tunnel.Listen, err)
+		return
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+	}
+	if len(s.cfg.Tunnel.CertFile) != 0 && len(s.cfg.Tunnel.KeyFile) != 0 {
+		creds, err := credentials.NewServerTLSFromFile(s.cfg.Tunnel.CertFile, s.cfg.Tunnel.KeyFile)
+		if err != nil {
+			klog.Errorf("加载隧道证书失败 %v", err)
+			return
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else if !s.cfg.Tunnel.AllowInsecure {
+		klog.Errorf("隧道未配置证书，agent 凭证将明文传输，如需在测试环境中使用请开启 tunnel.allow_insecure")
+		return
+	} else {
+		klog.Warningf("隧道未启用 TLS，agent 凭证将明文传输")
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterTunnelServer(srv, &tunnelServer{s: s})
+
+	klog.Infof("starting tunnel server on :%d", s.cfg.Tunnel.Listen)
+	if err = srv.Serve(lis); err != nil {
+		klog.Errorf("隧道服务异常退出 %v", err)
+	}
+}
+
+// Connect 提供 rpc 注册接口，agent 首条消息需为携带认证凭证的注册消息
+func (s *ServerController) Connect(stream pb.Tunnel_ConnectServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	var msg types.TunnelMessage
+	if err = json.Unmarshal(req.Payload, &msg); err != nil || msg.Type != types.TunnelRegisterType {
+		return status.Errorf(codes.InvalidArgument, "first message must be register")
+	}
+	if err = s.authenticateTunnel(stream.Context(), req.ClientId, msg.Token); err != nil {
+		klog.Warningf("client(%s) rpc 认证失败 %v", req.ClientId, err)
+		return status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+
+	clientId := req.ClientId
+	session := newTunnelSession(clientId, stream)
+	rpcLock.Lock()
+	if RpcClients == nil {
+		RpcClients = make(map[string]*tunnelSession)
+	}
+	RpcClients[clientId] = session
+	rpcLock.Unlock()
+	klog.Infof("client(%s) rpc 注册成功", clientId)
+
+	defer func() {
+		rpcLock.Lock()
+		if RpcClients[clientId] == session {
+			delete(RpcClients, clientId)
+		}
+		rpcLock.Unlock()
+		session.close(fmt.Errorf("agent(%s) 隧道已断开", clientId))
+		klog.Infof("client(%s) rpc 已断开", clientId)
+	}()
+
+	for {
+		req, err = stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			klog.Errorf("stream.Recv %v", err)
+			return err
+		}
+
+		var msg types.TunnelMessage
+		if err = json.Unmarshal(req.Payload, &msg); err != nil {
+			klog.Errorf("反序列化 client(%s) 隧道消息失败 %v", clientId, err)
+			continue
+		}
+		switch msg.Type {
+		case types.TunnelResultType:
+			session.resolve(msg)
+		case types.TunnelHeartbeatType:
+			klog.V(2).Infof("Received heartbeat from %s", clientId)
+		}
+	}
+}
+
+func (s *ServerController) authenticateTunnel(ctx context.Context, name string, token string) error {
+	if len(name) == 0 || len(token) == 0 {
+		return fmt.Errorf("agent 名称或凭证为空")
+	}
+	agent, err := s.factory.Agent().GetByName(ctx, name)
+	if err != nil {
+		return fmt.Errorf("agent(%s) 不存在", name)
+	}
+	// api 模式下 agent 使用颁发的 agent 凭证建立隧道
+	hashed := []byte(util.HashToken(token))
+	for _, expected := range []string{agent.TunnelToken, agent.Credential} {
+		if len(expected) != 0 && subtle.ConstantTimeCompare([]byte(expected), hashed) == 1 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("agent(%s) 凭证校验失败", name)
+}
+
+// getTunnelSession 获取 agent 的隧道会话
+func (s *ServerController) getTunnelSession(clientId string) (*tunnelSession, bool) {
+	rpcLock.RLock()
+	defer rpcLock.RUnlock()
+
+	session, ok := RpcClients[clientId]
+	return session, ok
+}
+
+// getTunnelAgentName 从已建立隧道的 agent 中任选一个在线且未因超出预算下线的 agent
+func (s *ServerController) getTunnelAgentName(ctx context.Context) (string, error) {
+	agents, err := s.factory.Agent().List(ctx, db.WithStatus(model.RunAgentType))
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, agent := range agents {
+		if len(agent.SuspendedMonth) != 0 {
+			continue
+		}
+		if _, ok := s.getTunnelSession(agent.Name); ok {
+			names = append(names, agent.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", ErrAgentNotConnected
+	}
+	return names[rand.Intn(len(names))], nil
+}
+
+// CallTunnel 通过 gRPC 隧道调用 agent，调用截止时间随请求下发
+func (s *ServerController) CallTunnel(ctx context.Context, session *tunnelSession, key string, data []byte) (types.CallResult, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Duration(s.cfg.Remote.Timeout) * time.Second)
+	}
+	waitCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	ch := session.addPending(key)
+	defer session.removePending(key)
+
+	if err := session.send(types.TunnelMessage{
+		Id:       key,
+		Type:     types.TunnelCallType,
+		Deadline: deadline.UnixMilli(),
+		Payload:  data,
+	}); err != nil {
+		klog.Errorf("隧道下发调用(%s)到 agent(%s) 失败 %v", key, session.name, err)
+		return types.CallResult{}, err
+	}
+	klog.V(4).Infof("tunnel call sent, clientId=%s, key=%s", session.name, key)
+
+	select {
+	case msg := <-ch:
+		return msg.CallResult, nil
+	case <-waitCtx.Done():
+		return types.CallResult{}, fmt.Errorf("wait for call(%s): %w", key, waitCtx.Err())
+	}
+}
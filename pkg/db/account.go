@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+// accountPullResetWindow 分配时扣减到 0 的账号移出分配的时长，与 dockerhub 的拉取限流窗口一致
+const accountPullResetWindow = 6 * time.Hour
+
+type AccountInterface interface {
+	Create(ctx context.Context, object *model.Account) (*model.Account, error)
+	Update(ctx context.Context, accountId int64, updates map[string]interface{}) error
+	Delete(ctx context.Context, accountId int64) error
+	Get(ctx context.Context, accountId int64) (*model.Account, error)
+	List(ctx context.Context, opts ...Options) ([]model.Account, error)
+
+	// Acquire 分配剩余次数最多且最久未使用的正常账号，没有可用账号时返回 ErrRecordNotFound
+	Acquire(ctx context.Context, accountType string) (*model.Account, error)
+	// AcquireForPull 按 registry 的剩余拉取次数分配账号，hub api 次数耗尽的账号仍可用于拉取
+	AcquireForPull(ctx context.Context, accountType string) (*model.Account, error)
+}
+
+func newAccount(db *gorm.DB) AccountInterface {
+	return &account{db}
+}
+
+type account struct {
+	db *gorm.DB
+}
+
+func (a *account) Create(ctx context.Context, object *model.Account) (*model.Account, error) {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	if err := a.db.WithContext(ctx).Create(object).Error; err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (a *account) Update(ctx context.Context, accountId int64, updates map[string]interface{}) error {
+	updates["gmt_modified"] = time.Now()
+	f := a.db.WithContext(ctx).Model(&model.Account{}).Where("id = ?", accountId).Updates(updates)
+	if f.Error != nil {
+		return f.Error
+	}
+	if f.RowsAffected == 0 {
+		return fmt.Errorf("record not updated")
+	}
+
+	return nil
+}
+
+func (a *account) Delete(ctx context.Context, accountId int64) error {
+	return a.db.WithContext(ctx).Where("id = ?", accountId).Delete(&model.Account{}).Error
+}
+
+func (a *account) Get(ctx context.Context, accountId int64) (*model.Account, error) {
+	var object model.Account
+	if err := a.db.WithContext(ctx).Where("id = ?", accountId).First(&object).Error; err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+func (a *account) List(ctx context.Context, opts ...Options) ([]model.Account, error) {
+	var objects []model.Account
+	tx := a.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Acquire 在事务中选择并占用账号，剩余次数预先扣减，避免并发请求集中到同一账号
+func (a *account) Acquire(ctx context.Context, accountType string) (*model.Account, error) {
+	var object model.Account
+	err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("type = ? AND status = ? AND token_expire_time > ?", accountType, model.AccountHealthyStatus, now).
+			Order("retain_times DESC").Order("last_used_time ASC").
+			First(&object).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"used_times":     gorm.Expr("used_times + 1"),
+			"last_used_time": now,
+			"gmt_modified":   now,
+		}
+		if object.RetainTimes > 0 {
+			updates["retain_times"] = gorm.Expr("retain_times - 1")
+			object.RetainTimes--
+		}
+		object.UsedTimes++
+		object.LastUsedTime = &now
+		return tx.Model(&model.Account{}).Where("id = ?", object.Id).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+func (a *account) AcquireForPull(ctx context.Context, accountType string) (*model.Account, error) {
+	var object model.Account
+	err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("type = ? AND status IN ? AND token_expire_time > ?", accountType, []string{model.AccountHealthyStatus, model.AccountExhaustedStatus}, now).
+			Where("pull_retain_times != 0 OR (pull_reset_time IS NOT NULL AND pull_reset_time <= ?)", now).
+			Order("pull_retain_times DESC").Order("last_used_time ASC").
+			First(&object).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"used_times":     gorm.Expr("used_times + 1"),
+			"last_used_time": now,
+			"gmt_modified":   now,
+		}
+		switch {
+		case object.PullRetainTimes > 0:
+			updates["pull_retain_times"] = gorm.Expr("pull_retain_times - 1")
+			object.PullRetainTimes--
+			// 次数耗尽后移出分配，直到限流窗口结束或刷新时重新探测
+			if object.PullRetainTimes == 0 {
+				resetTime := now.Add(accountPullResetWindow)
+				updates["pull_reset_time"] = resetTime
+				object.PullResetTime = &resetTime
+			}
+		case object.PullRetainTimes == 0:
+			// 已过限流窗口，剩余次数未知，由后续探测更新
+			updates["pull_retain_times"] = -1
+			updates["pull_reset_time"] = nil
+			object.PullRetainTimes = -1
+			object.PullResetTime = nil
+		}
+		object.UsedTimes++
+		object.LastUsedTime = &now
+		return tx.Model(&model.Account{}).Where("id = ?", object.Id).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/caoyingjunz/rainbow/pkg/db/model"
 )
@@ -21,6 +22,9 @@ type AgentInterface interface {
 	List(ctx context.Context, opts ...Options) ([]model.Agent, error)
 	ListForSchedule(ctx context.Context, opts ...Options) ([]model.Agent, error)
 	Count(ctx context.Context, opts ...Options) (int64, error)
+
+	CreateOrUpdateUsage(ctx context.Context, object *model.AgentUsage) error
+	ListUsages(ctx context.Context, agentName string) ([]model.AgentUsage, error)
 }
 
 func newAgent(db *gorm.DB) AgentInterface {
@@ -143,3 +147,23 @@ func (a *agent) Count(ctx context.Context, opts ...Options) (int64, error) {
 
 	return total, nil
 }
+
+// CreateOrUpdateUsage 按 agent 和月份记录开销，已存在时更新
+func (a *agent) CreateOrUpdateUsage(ctx context.Context, object *model.AgentUsage) error {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	return a.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "agent_name"}, {Name: "month"}},
+		DoUpdates: clause.AssignmentColumns([]string{"gmt_modified", "gross_amount", "budget"}),
+	}).Create(object).Error
+}
+
+func (a *agent) ListUsages(ctx context.Context, agentName string) ([]model.AgentUsage, error) {
+	var audits []model.AgentUsage
+	if err := a.db.WithContext(ctx).Where("agent_name = ?", agentName).Order("month DESC").Find(&audits).Error; err != nil {
+		return nil, err
+	}
+	return audits, nil
+}
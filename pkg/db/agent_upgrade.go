@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+type AgentUpgradeInterface interface {
+	Create(ctx context.Context, object *model.AgentUpgrade, targets []model.AgentUpgradeTarget) (*model.AgentUpgrade, error)
+	Update(ctx context.Context, upgradeId int64, updates map[string]interface{}) error
+	Delete(ctx context.Context, upgradeId int64) error
+	Get(ctx context.Context, upgradeId int64) (*model.AgentUpgrade, error)
+	List(ctx context.Context, opts ...Options) ([]model.AgentUpgrade, error)
+	Count(ctx context.Context, opts ...Options) (int64, error)
+
+	UpdateTarget(ctx context.Context, targetId int64, updates map[string]interface{}) error
+	ListTargets(ctx context.Context, opts ...Options) ([]model.AgentUpgradeTarget, error)
+}
+
+func newAgentUpgrade(db *gorm.DB) AgentUpgradeInterface {
+	return &agentUpgrade{db}
+}
+
+type agentUpgrade struct {
+	db *gorm.DB
+}
+
+// Create 创建升级计划及其选中的 agent
+func (a *agentUpgrade) Create(ctx context.Context, object *model.AgentUpgrade, targets []model.AgentUpgradeTarget) (*model.AgentUpgrade, error) {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(object).Error; err != nil {
+			return err
+		}
+		for i := range targets {
+			targets[i].UpgradeId = object.Id
+			targets[i].GmtCreate = now
+			targets[i].GmtModified = now
+		}
+		if len(targets) == 0 {
+			return nil
+		}
+		return tx.Create(&targets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (a *agentUpgrade) Update(ctx context.Context, upgradeId int64, updates map[string]interface{}) error {
+	updates["gmt_modified"] = time.Now()
+	f := a.db.WithContext(ctx).Model(&model.AgentUpgrade{}).Where("id = ?", upgradeId).Updates(updates)
+	if f.Error != nil {
+		return f.Error
+	}
+	if f.RowsAffected == 0 {
+		return fmt.Errorf("record not updated")
+	}
+
+	return nil
+}
+
+func (a *agentUpgrade) Delete(ctx context.Context, upgradeId int64) error {
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upgrade_id = ?", upgradeId).Delete(&model.AgentUpgradeTarget{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", upgradeId).Delete(&model.AgentUpgrade{}).Error
+	})
+}
+
+func (a *agentUpgrade) Get(ctx context.Context, upgradeId int64) (*model.AgentUpgrade, error) {
+	var audit model.AgentUpgrade
+	if err := a.db.WithContext(ctx).Where("id = ?", upgradeId).First(&audit).Error; err != nil {
+		return nil, err
+	}
+	return &audit, nil
+}
+
+func (a *agentUpgrade) List(ctx context.Context, opts ...Options) ([]model.AgentUpgrade, error) {
+	var audits []model.AgentUpgrade
+	tx := a.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&audits).Error; err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
+func (a *agentUpgrade) Count(ctx context.Context, opts ...Options) (int64, error) {
+	tx := a.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+
+	var total int64
+	if err := tx.Model(&model.AgentUpgrade{}).Count(&total).Error; err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (a *agentUpgrade) UpdateTarget(ctx context.Context, targetId int64, updates map[string]interface{}) error {
+	updates["gmt_modified"] = time.Now()
+	return a.db.WithContext(ctx).Model(&model.AgentUpgradeTarget{}).Where("id = ?", targetId).Updates(updates).Error
+}
+
+func (a *agentUpgrade) ListTargets(ctx context.Context, opts ...Options) ([]model.AgentUpgradeTarget, error) {
+	var audits []model.AgentUpgradeTarget
+	tx := a.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&audits).Error; err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
@@ -0,0 +1,319 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+// 目录搜索的分面
+const (
+	FacetNamespace = "namespace"
+	FacetLabel     = "label"
+	FacetArch      = "architecture"
+	FacetHub       = "hub"
+	FacetPublic    = "public"
+	FacetOfficial  = "official"
+	FacetTagStatus = "tag_status"
+	FacetOwner     = "owner"
+	FacetSize      = "size"
+	FacetSynced    = "synced"
+)
+
+// 目录搜索的排序方式
+const (
+	CatalogSortPulls  = "pulls"
+	CatalogSortRecent = "recent"
+	CatalogSortSize   = "size"
+	CatalogSortName   = "name"
+)
+
+const (
+	fullTextIndexName = "idx_image_fulltext"
+	// 分面最多返回的取值数量
+	facetLimit = 50
+
+	// tag 的源镜像仓库，path 第一段为域名时取域名，否则为 dockerhub
+	tagHubExpr = "IF(LOCATE('/', tags.path) > 0 AND (LOCATE('.', SUBSTRING_INDEX(tags.path, '/', 1)) > 0 OR LOCATE(':', SUBSTRING_INDEX(tags.path, '/', 1)) > 0), SUBSTRING_INDEX(tags.path, '/', 1), 'docker.io')"
+
+	imageSizeBucketExpr = "CASE WHEN images.size < 104857600 THEN '0-100MB' WHEN images.size < 524288000 THEN '100MB-500MB' WHEN images.size < 1073741824 THEN '500MB-1GB' ELSE '1GB+' END"
+)
+
+// CatalogFilter 镜像目录的搜索条件，空值表示不过滤
+type CatalogFilter struct {
+	Query    string
+	FullText bool // 使用全文索引搜索名称和描述
+
+	Namespace    string
+	LabelIds     []int64
+	Owner        string
+	Public       *bool
+	Official     *bool
+	Scoped       bool   // 仅返回公开镜像和 Viewer 的镜像，分面统计时同样生效
+	Viewer       string // 当前用户 id
+	MinSize      int64
+	MaxSize      int64
+	SyncedAfter  *time.Time
+	SyncedBefore *time.Time
+
+	// 镜像存在同时满足以下条件的 tag
+	Arch      string
+	Hub       string
+	TagStatus string
+
+	SortBy string
+	Asc    bool
+	Offset int
+	Limit  int
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"`
+	Count int64  `json:"count"`
+}
+
+type CatalogInterface interface {
+	Search(ctx context.Context, f CatalogFilter) ([]model.Image, int64, error)
+	// Facets 统计各分面的取值数量，每个分面的统计不受自身条件过滤
+	Facets(ctx context.Context, f CatalogFilter) (map[string][]FacetCount, error)
+
+	// EnsureIndexes 补齐搜索使用的索引，migrator 只建表，已存在的表需单独创建
+	EnsureIndexes(ctx context.Context, fullText bool) error
+}
+
+func newCatalog(db *gorm.DB) CatalogInterface {
+	return &catalog{db}
+}
+
+type catalog struct {
+	db *gorm.DB
+}
+
+func (c *catalog) Search(ctx context.Context, f CatalogFilter) ([]model.Image, int64, error) {
+	var total int64
+	if err := c.imageScope(ctx, f, "").Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	tx := c.imageScope(ctx, f, "")
+	order := "DESC"
+	if f.Asc {
+		order = "ASC"
+	}
+	switch f.SortBy {
+	case CatalogSortPulls:
+		tx = tx.Order("images.pull " + order)
+	case CatalogSortSize:
+		tx = tx.Order("images.size " + order)
+	case CatalogSortName:
+		tx = tx.Order("images.name " + order)
+	case CatalogSortRecent:
+		tx = tx.Order("images.gmt_modified " + order)
+	default:
+		// 全文搜索默认按相关度排序
+		if f.FullText && len(f.Query) != 0 {
+			tx = tx.Order(gorm.Expr("MATCH(images.name, images.description) AGAINST (? IN BOOLEAN MODE) DESC", f.Query))
+		}
+		tx = tx.Order("images.gmt_modified DESC")
+	}
+	tx = tx.Order("images.id DESC").Offset(f.Offset)
+	if f.Limit > 0 {
+		tx = tx.Limit(f.Limit)
+	}
+
+	var images []model.Image
+	if err := tx.Find(&images).Error; err != nil {
+		return nil, 0, err
+	}
+	return images, total, nil
+}
+
+// imageScope 镜像级条件，skip 为统计中的分面，统计时不使用该分面的条件
+func (c *catalog) imageScope(ctx context.Context, f CatalogFilter, skip string) *gorm.DB {
+	tx := c.db.WithContext(ctx).Model(&model.Image{})
+	if len(f.Query) != 0 {
+		if f.FullText {
+			tx = tx.Where("MATCH(images.name, images.description) AGAINST (? IN BOOLEAN MODE)", f.Query)
+		} else {
+			like := "%" + f.Query + "%"
+			tx = tx.Where("images.name LIKE ? OR images.description LIKE ?", like, like)
+		}
+	}
+	if f.Scoped {
+		tx = tx.Where("images.is_public = ? OR images.user_id = ?", true, f.Viewer)
+	}
+	if len(f.Namespace) != 0 && skip != FacetNamespace {
+		tx = tx.Where("images.namespace = ?", f.Namespace)
+	}
+	if len(f.Owner) != 0 && skip != FacetOwner {
+		tx = tx.Where("images.user_id = ?", f.Owner)
+	}
+	if f.Public != nil && skip != FacetPublic {
+		tx = tx.Where("images.is_public = ?", *f.Public)
+	}
+	if f.Official != nil && skip != FacetOfficial {
+		tx = tx.Where("images.is_official = ?", *f.Official)
+	}
+	if skip != FacetSize {
+		if f.MinSize > 0 {
+			tx = tx.Where("images.size >= ?", f.MinSize)
+		}
+		if f.MaxSize > 0 {
+			tx = tx.Where("images.size < ?", f.MaxSize)
+		}
+	}
+	if skip != FacetSynced {
+		if f.SyncedAfter != nil {
+			tx = tx.Where("images.gmt_modified >= ?", *f.SyncedAfter)
+		}
+		if f.SyncedBefore != nil {
+			tx = tx.Where("images.gmt_modified < ?", *f.SyncedBefore)
+		}
+	}
+	if len(f.LabelIds) != 0 && skip != FacetLabel {
+		labelQuery := c.db.Table("image_labels").
+			Select("image_id").
+			Where("label_id IN ?", f.LabelIds).
+			Group("image_id").
+			Having("COUNT(DISTINCT label_id) = ?", len(f.LabelIds))
+		tx = tx.Where("images.id IN (?)", labelQuery)
+	}
+	if c.hasTagFilter(f, skip) {
+		tx = tx.Where("images.id IN (?)", c.tagScope(ctx, f, skip).Select("tags.image_id"))
+	}
+	return tx
+}
+
+func (c *catalog) hasTagFilter(f CatalogFilter, skip string) bool {
+	return (len(f.Arch) != 0 && skip != FacetArch) ||
+		(len(f.Hub) != 0 && skip != FacetHub) ||
+		(len(f.TagStatus) != 0 && skip != FacetTagStatus)
+}
+
+// tagScope tag 级条件，同一个 tag 需同时满足
+func (c *catalog) tagScope(ctx context.Context, f CatalogFilter, skip string) *gorm.DB {
+	tx := c.db.WithContext(ctx).Model(&model.Tag{})
+	if len(f.Arch) != 0 && skip != FacetArch {
+		tx = tx.Where("tags.architecture = ?", f.Arch)
+	}
+	if len(f.TagStatus) != 0 && skip != FacetTagStatus {
+		tx = tx.Where("tags.status = ?", f.TagStatus)
+	}
+	if len(f.Hub) != 0 && skip != FacetHub {
+		if f.Hub == "docker.io" {
+			tx = tx.Where(tagHubExpr+" = ?", f.Hub)
+		} else {
+			// 前缀匹配可以使用 path 索引
+			tx = tx.Where("tags.path LIKE ?", f.Hub+"/%")
+		}
+	}
+	return tx
+}
+
+func (c *catalog) Facets(ctx context.Context, f CatalogFilter) (map[string][]FacetCount, error) {
+	facets := make(map[string][]FacetCount)
+
+	imageFacets := map[string]string{
+		FacetNamespace: "images.namespace",
+		FacetOwner:     "images.user_id",
+		FacetPublic:    "images.is_public",
+		FacetOfficial:  "images.is_official",
+		FacetSize:      imageSizeBucketExpr,
+		FacetSynced:    syncedBucketExpr(time.Now()),
+	}
+	for facet, expr := range imageFacets {
+		tx := c.imageScope(ctx, f, facet)
+		if facet == FacetOwner {
+			tx = tx.Select(fmt.Sprintf("%s AS value, MAX(images.user_name) AS label, COUNT(*) AS count", expr))
+		} else {
+			tx = tx.Select(fmt.Sprintf("%s AS value, COUNT(*) AS count", expr))
+		}
+		var counts []FacetCount
+		if err := tx.Group("value").Order("count DESC").Limit(facetLimit).Scan(&counts).Error; err != nil {
+			return nil, fmt.Errorf("统计分面(%s)失败 %v", facet, err)
+		}
+		facets[facet] = counts
+	}
+
+	// tag 级分面按镜像去重计数
+	tagFacets := map[string]string{
+		FacetArch:      "tags.architecture",
+		FacetHub:       tagHubExpr,
+		FacetTagStatus: "tags.status",
+	}
+	// tag 级条件由外层按分面应用，镜像范围保留其余条件，包括可见范围
+	scope := f
+	scope.Arch, scope.Hub, scope.TagStatus = "", "", ""
+	imageIds := c.imageScope(ctx, scope, "").Select("images.id")
+	for facet, expr := range tagFacets {
+		var counts []FacetCount
+		if err := c.tagScope(ctx, f, facet).
+			Where("tags.image_id IN (?)", imageIds).
+			Select(fmt.Sprintf("%s AS value, COUNT(DISTINCT tags.image_id) AS count", expr)).
+			Group("value").Order("count DESC").Limit(facetLimit).
+			Scan(&counts).Error; err != nil {
+			return nil, fmt.Errorf("统计分面(%s)失败 %v", facet, err)
+		}
+		facets[facet] = counts
+	}
+
+	var labels []FacetCount
+	if err := c.db.WithContext(ctx).Table("image_labels").
+		Joins("JOIN labels ON labels.id = image_labels.label_id").
+		Where("image_labels.image_id IN (?)", c.imageScope(ctx, f, FacetLabel).Select("images.id")).
+		Select("labels.id AS value, labels.name AS label, COUNT(*) AS count").
+		Group("labels.id, labels.name").Order("count DESC").Limit(facetLimit).
+		Scan(&labels).Error; err != nil {
+		return nil, fmt.Errorf("统计分面(%s)失败 %v", FacetLabel, err)
+	}
+	facets[FacetLabel] = labels
+
+	return facets, nil
+}
+
+// syncedBucketExpr 按最近同步时间分桶
+func syncedBucketExpr(now time.Time) string {
+	format := "2006-01-02 15:04:05"
+	return fmt.Sprintf("CASE WHEN images.gmt_modified >= '%s' THEN '24h' WHEN images.gmt_modified >= '%s' THEN '7d' WHEN images.gmt_modified >= '%s' THEN '30d' ELSE 'older' END",
+		now.Add(-24*time.Hour).Format(format), now.AddDate(0, 0, -7).Format(format), now.AddDate(0, 0, -30).Format(format))
+}
+
+func (c *catalog) EnsureIndexes(ctx context.Context, fullText bool) error {
+	tx := c.db.WithContext(ctx)
+	indexes := []struct {
+		model interface{}
+		name  string
+	}{
+		{&model.Image{}, "idx_image_user"},
+		{&model.Image{}, "idx_image_namespace"},
+		{&model.Image{}, "idx_image_size"},
+		{&model.Image{}, "idx_image_pull"},
+		{&model.Image{}, "idx_image_public"},
+		{&model.Tag{}, "idx_tag_path"},
+		{&model.Tag{}, "idx_tag_arch_status"},
+	}
+	for _, index := range indexes {
+		if tx.Migrator().HasIndex(index.model, index.name) {
+			continue
+		}
+		klog.Infof("creating index %s", index.name)
+		if err := tx.Migrator().CreateIndex(index.model, index.name); err != nil {
+			return fmt.Errorf("创建索引(%s)失败 %v", index.name, err)
+		}
+	}
+
+	if fullText && !tx.Migrator().HasIndex(&model.Image{}, fullTextIndexName) {
+		// ngram 分词支持中文描述
+		klog.Infof("creating full-text index %s", fullTextIndexName)
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE images ADD FULLTEXT INDEX %s (name, description) WITH PARSER ngram", fullTextIndexName)).Error; err != nil {
+			return fmt.Errorf("创建全文索引失败 %v", err)
+		}
+	}
+	return nil
+}
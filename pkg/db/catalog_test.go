@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func init() {
+	sql.Register("catalog-test", emptyDriver{})
+}
+
+// emptyDriver 不连接数据库，所有查询均返回空结果
+type emptyDriver struct{}
+
+func (emptyDriver) Open(name string) (driver.Conn, error) { return emptyConn{}, nil }
+
+type emptyConn struct{}
+
+func (emptyConn) Prepare(query string) (driver.Stmt, error) { return emptyStmt{}, nil }
+func (emptyConn) Close() error                              { return nil }
+func (emptyConn) Begin() (driver.Tx, error)                 { return emptyTx{}, nil }
+
+type emptyTx struct{}
+
+func (emptyTx) Commit() error   { return nil }
+func (emptyTx) Rollback() error { return nil }
+
+type emptyStmt struct{}
+
+func (emptyStmt) Close() error                                    { return nil }
+func (emptyStmt) NumInput() int                                   { return -1 }
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (emptyStmt) Query(args []driver.Value) (driver.Rows, error)  { return emptyRows{}, nil }
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+// newRecordDB 使用空结果的数据库，记录执行的查询语句
+func newRecordDB(t *testing.T) (*gorm.DB, *[]string) {
+	t.Helper()
+
+	conn, err := sql.Open("catalog-test", "")
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	tx, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm db: %v", err)
+	}
+
+	var queries []string
+	record := func(tx *gorm.DB) {
+		// 子查询以 dry run 方式生成，已包含在外层查询中
+		if tx.DryRun {
+			return
+		}
+		queries = append(queries, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	}
+	if err = tx.Callback().Query().After("gorm:query").Register("test:record_query", record); err != nil {
+		t.Fatalf("failed to register query callback: %v", err)
+	}
+	if err = tx.Callback().Row().After("gorm:row").Register("test:record_row", record); err != nil {
+		t.Fatalf("failed to register row callback: %v", err)
+	}
+	return tx, &queries
+}
+
+// TestFacetsScopedToViewer 非镜像所有者统计分面时，所有分面都只统计公开镜像和自己的镜像，不泄露其他用户私有镜像的数量
+func TestFacetsScopedToViewer(t *testing.T) {
+	tx, queries := newRecordDB(t)
+
+	c := newCatalog(tx)
+	if _, err := c.Facets(context.TODO(), CatalogFilter{Scoped: true, Viewer: "viewer-user", Arch: "amd64"}); err != nil {
+		t.Fatalf("failed to count facets: %v", err)
+	}
+
+	scope := "images.is_public = true OR images.user_id = 'viewer-user'"
+	var tagFacets int
+	for _, query := range *queries {
+		if strings.Contains(query, "COUNT(DISTINCT tags.image_id)") {
+			tagFacets++
+		}
+		if !strings.Contains(query, scope) {
+			t.Errorf("facet query is not scoped to viewer: %s", query)
+		}
+	}
+	if tagFacets != 3 {
+		t.Errorf("expected 3 tag facet queries, got %d", tagFacets)
+	}
+}
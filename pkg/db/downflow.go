@@ -0,0 +1,214 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+// DailyPull 某一天某个来源的下载量
+type DailyPull struct {
+	Date   string `json:"date"`
+	Source string `json:"source"`
+	Pulls  int64  `json:"pulls"`
+}
+
+// ImagePull 镜像在统计窗口内的下载量，Previous 为上一个等长窗口的下载量
+type ImagePull struct {
+	ImageId   int64  `json:"image_id"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UserId    string `json:"user_id"`
+	UserName  string `json:"user_name"`
+	Logo      string `json:"logo"`
+	Pulls     int64  `json:"pulls"`
+	Previous  int64  `json:"previous"`
+}
+
+// TopPullFilter 下载量排行的条件，日期格式为 2006-01-02
+type TopPullFilter struct {
+	Source    string
+	Namespace string
+	Owner     string
+	Scoped    bool   // 仅统计公开镜像和 Viewer 的镜像
+	Viewer    string // 当前用户 id
+	Start     string
+	End       string
+	// PrevStart 不为空时同时统计 [PrevStart, Start) 的下载量，按增长量排序
+	PrevStart string
+	Limit     int
+}
+
+type DownflowInterface interface {
+	// EnsureSchema downflows 表早期只有镜像级别的字段，补齐统计需要的字段，合并重复数据后创建唯一索引
+	EnsureSchema(ctx context.Context) error
+
+	// SetImagePull 仅当镜像的累计下载量仍为 old 时更新，避免并发同步时重复统计差值
+	SetImagePull(ctx context.Context, imageId int64, old int64, pull int64) (bool, error)
+	// AddPulls 累加当天的下载量
+	AddPulls(ctx context.Context, imageId int64, tagId int64, source string, date string, pulls int) error
+	ListDaily(ctx context.Context, imageId int64, tagId int64, start string, end string) ([]DailyPull, error)
+	TopImages(ctx context.Context, f TopPullFilter) ([]ImagePull, error)
+}
+
+func newDownflow(db *gorm.DB) DownflowInterface {
+	return &downflow{db}
+}
+
+type downflow struct {
+	db *gorm.DB
+}
+
+func (d *downflow) EnsureSchema(ctx context.Context) error {
+	m := d.db.WithContext(ctx).Migrator()
+	if !m.HasTable(&model.Downflow{}) || m.HasIndex(&model.Downflow{}, "idx_downflow_day") {
+		return m.AutoMigrate(&model.Downflow{})
+	}
+
+	// 先补齐字段和历史数据，否则已有的重复数据会导致唯一索引创建失败
+	for _, field := range []string{"TagId", "Source"} {
+		if m.HasColumn(&model.Downflow{}, field) {
+			continue
+		}
+		if err := m.AddColumn(&model.Downflow{}, field); err != nil {
+			return err
+		}
+	}
+	// 早期的数据均为远端仓库的镜像级别统计
+	if err := d.db.WithContext(ctx).Model(&model.Downflow{}).
+		Where("source IS NULL OR source = ?", "").
+		UpdateColumn("source", model.DownflowSourceRegistry).Error; err != nil {
+		return err
+	}
+	if err := d.db.WithContext(ctx).Model(&model.Downflow{}).
+		Where("tag_id IS NULL").
+		UpdateColumn("tag_id", 0).Error; err != nil {
+		return err
+	}
+	if err := d.mergeDuplicates(ctx); err != nil {
+		return err
+	}
+
+	return m.AutoMigrate(&model.Downflow{})
+}
+
+// mergeDuplicates 同一天的重复统计合并到 id 最小的一条，下载量累加
+func (d *downflow) mergeDuplicates(ctx context.Context) error {
+	var groups []struct {
+		Id       int64
+		ImageId  int64
+		TagId    int64
+		Source   string
+		CreateAt string
+		Pulls    int64
+	}
+	if err := d.db.WithContext(ctx).Model(&model.Downflow{}).
+		Select("MIN(id) AS id, image_id, tag_id, source, create_at, SUM(pull_num) AS pulls").
+		Group("image_id, tag_id, source, create_at").
+		Having("COUNT(*) > 1").
+		Scan(&groups).Error; err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if err := d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.Downflow{}).Where("id = ?", g.Id).UpdateColumn("pull_num", g.Pulls).Error; err != nil {
+				return err
+			}
+			return tx.Where("image_id = ? AND tag_id = ? AND source = ? AND create_at = ? AND id <> ?", g.ImageId, g.TagId, g.Source, g.CreateAt, g.Id).
+				Delete(&model.Downflow{}).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *downflow) SetImagePull(ctx context.Context, imageId int64, old int64, pull int64) (bool, error) {
+	tx := d.db.WithContext(ctx).Model(&model.Image{}).
+		Where("id = ? AND pull = ?", imageId, old).
+		UpdateColumns(map[string]interface{}{"pull": pull, "gmt_modified": time.Now()})
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+func (d *downflow) AddPulls(ctx context.Context, imageId int64, tagId int64, source string, date string, pulls int) error {
+	now := time.Now()
+	object := &model.Downflow{
+		ImageId:  imageId,
+		TagId:    tagId,
+		Source:   source,
+		CreateAt: date,
+		PullNum:  pulls,
+	}
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"pull_num":     gorm.Expr("pull_num + ?", pulls),
+			"gmt_modified": now,
+		}),
+	}).Create(object).Error
+}
+
+func (d *downflow) ListDaily(ctx context.Context, imageId int64, tagId int64, start string, end string) ([]DailyPull, error) {
+	var objects []DailyPull
+	tx := d.db.WithContext(ctx).Model(&model.Downflow{}).
+		Select("create_at AS date, source, SUM(pull_num) AS pulls").
+		Where("image_id = ? AND create_at >= ? AND create_at <= ?", imageId, start, end)
+	// 指定版本时只有 pixiuctl 的统计
+	if tagId != 0 {
+		tx = tx.Where("tag_id = ?", tagId)
+	}
+	if err := tx.Group("create_at, source").Order("create_at").Scan(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (d *downflow) TopImages(ctx context.Context, f TopPullFilter) ([]ImagePull, error) {
+	start := f.Start
+	if len(f.PrevStart) != 0 {
+		start = f.PrevStart
+	}
+
+	tx := d.db.WithContext(ctx).Model(&model.Downflow{}).
+		Joins("JOIN images ON images.id = downflows.image_id AND images.gmt_deleted IS NULL").
+		Where("downflows.source = ? AND downflows.create_at >= ? AND downflows.create_at <= ?", f.Source, start, f.End)
+	if len(f.Namespace) != 0 {
+		tx = tx.Where("images.namespace = ?", f.Namespace)
+	}
+	if len(f.Owner) != 0 {
+		tx = tx.Where("images.user_id = ?", f.Owner)
+	}
+	if f.Scoped {
+		if len(f.Viewer) == 0 {
+			tx = tx.Where("images.is_public = ?", true)
+		} else {
+			tx = tx.Where("images.is_public = ? OR images.user_id = ?", true, f.Viewer)
+		}
+	}
+
+	order := "pulls DESC"
+	if len(f.PrevStart) != 0 {
+		order = "pulls - previous DESC, pulls DESC"
+	}
+	var objects []ImagePull
+	if err := tx.Select("downflows.image_id, images.name, images.namespace, images.user_id, images.user_name, images.logo, "+
+		"SUM(CASE WHEN downflows.create_at >= ? THEN downflows.pull_num ELSE 0 END) AS pulls, "+
+		"SUM(CASE WHEN downflows.create_at < ? THEN downflows.pull_num ELSE 0 END) AS previous", f.Start, f.Start).
+		Group("downflows.image_id, images.name, images.namespace, images.user_id, images.user_name, images.logo").
+		Order(order).
+		Limit(f.Limit).
+		Scan(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestTopImagesScopedToViewer 非管理员的下载量排行只统计公开镜像和自己的镜像
+func TestTopImagesScopedToViewer(t *testing.T) {
+	tx, queries := newRecordDB(t)
+
+	d := newDownflow(tx)
+	if _, err := d.TopImages(context.TODO(), TopPullFilter{Source: "registry", Start: "2026-10-01", End: "2026-10-19", Scoped: true, Viewer: "viewer-user", Limit: 10}); err != nil {
+		t.Fatalf("failed to list top images: %v", err)
+	}
+	if _, err := d.TopImages(context.TODO(), TopPullFilter{Source: "registry", Start: "2026-10-01", End: "2026-10-19", Scoped: true, Limit: 10}); err != nil {
+		t.Fatalf("failed to list top images: %v", err)
+	}
+
+	if len(*queries) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(*queries))
+	}
+	if !strings.Contains((*queries)[0], "images.is_public = true OR images.user_id = 'viewer-user'") {
+		t.Errorf("top images query is not scoped to viewer: %s", (*queries)[0])
+	}
+	if !strings.Contains((*queries)[1], "images.is_public = true") || strings.Contains((*queries)[1], "images.user_id = ''") {
+		t.Errorf("anonymous top images query is not limited to public images: %s", (*queries)[1])
+	}
+}
@@ -31,6 +31,13 @@ type ShareDaoFactory interface {
 	Rainbowd() RainbowdInterface
 	Metrics() MetricsInterface
 	Access() AccessInterface
+	AgentUpgrade() AgentUpgradeInterface
+	Account() AccountInterface
+	Scan() ScanInterface
+	SigningKey() SigningKeyInterface
+	Catalog() CatalogInterface
+	Lock() LockInterface
+	Downflow() DownflowInterface
 }
 
 type shareDaoFactory struct {
@@ -47,6 +54,21 @@ func (f *shareDaoFactory) Notify() NotifyInterface     { return newNotify(f.db)
 func (f *shareDaoFactory) Rainbowd() RainbowdInterface { return newRainbowd(f.db) }
 func (f *shareDaoFactory) Metrics() MetricsInterface   { return newMetrics(f.db) }
 func (f *shareDaoFactory) Access() AccessInterface     { return newAccess(f.db) }
+func (f *shareDaoFactory) Account() AccountInterface   { return newAccount(f.db) }
+func (f *shareDaoFactory) Scan() ScanInterface         { return newScan(f.db) }
+func (f *shareDaoFactory) SigningKey() SigningKeyInterface {
+	return newSigningKey(f.db)
+}
+func (f *shareDaoFactory) Catalog() CatalogInterface {
+	return newCatalog(f.db)
+}
+func (f *shareDaoFactory) Lock() LockInterface { return newLock(f.db) }
+func (f *shareDaoFactory) Downflow() DownflowInterface {
+	return newDownflow(f.db)
+}
+func (f *shareDaoFactory) AgentUpgrade() AgentUpgradeInterface {
+	return newAgentUpgrade(f.db)
+}
 
 func NewDaoFactory(db *gorm.DB, migrate bool) (ShareDaoFactory, error) {
 	if migrate {
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+type LockInterface interface {
+	// UpdateImage 和 UpdateTag 只更新锁定信息，不修改 gmt_modified，避免影响按同步时间排序
+	UpdateImage(ctx context.Context, imageId int64, updates map[string]interface{}) error
+	UpdateTag(ctx context.Context, tagId int64, updates map[string]interface{}) error
+	// ClearLegacyLocks 清理早期创建镜像时默认写入的锁定状态，返回清理的镜像数量
+	ClearLegacyLocks(ctx context.Context) (int64, error)
+
+	CreateRule(ctx context.Context, object *model.ImmutableRule) (*model.ImmutableRule, error)
+	DeleteRule(ctx context.Context, ruleId int64) error
+	ListRules(ctx context.Context, opts ...Options) ([]model.ImmutableRule, error)
+
+	CreateEvent(ctx context.Context, object *model.LockEvent) error
+	ListEvents(ctx context.Context, opts ...Options) ([]model.LockEvent, error)
+	CountEvents(ctx context.Context, opts ...Options) (int64, error)
+}
+
+func newLock(db *gorm.DB) LockInterface {
+	return &lock{db}
+}
+
+type lock struct {
+	db *gorm.DB
+}
+
+func (l *lock) UpdateImage(ctx context.Context, imageId int64, updates map[string]interface{}) error {
+	return l.db.WithContext(ctx).Model(&model.Image{}).Where("id = ?", imageId).UpdateColumns(updates).Error
+}
+
+func (l *lock) UpdateTag(ctx context.Context, tagId int64, updates map[string]interface{}) error {
+	return l.db.WithContext(ctx).Model(&model.Tag{}).Where("id = ?", tagId).UpdateColumns(updates).Error
+}
+
+// 锁定接口要求填写操作人，锁定人为空的只能是早期默认锁定的镜像
+func (l *lock) ClearLegacyLocks(ctx context.Context) (int64, error) {
+	tx := l.db.WithContext(ctx).Model(&model.Image{}).
+		Where("is_locked = ? AND (locked_by = ? OR locked_by IS NULL)", true, "").
+		UpdateColumn("is_locked", false)
+	return tx.RowsAffected, tx.Error
+}
+
+func (l *lock) CreateRule(ctx context.Context, object *model.ImmutableRule) (*model.ImmutableRule, error) {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	if err := l.db.WithContext(ctx).Create(object).Error; err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (l *lock) DeleteRule(ctx context.Context, ruleId int64) error {
+	return l.db.WithContext(ctx).Where("id = ?", ruleId).Delete(&model.ImmutableRule{}).Error
+}
+
+func (l *lock) ListRules(ctx context.Context, opts ...Options) ([]model.ImmutableRule, error) {
+	var objects []model.ImmutableRule
+	tx := l.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *lock) CreateEvent(ctx context.Context, object *model.LockEvent) error {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+	return l.db.WithContext(ctx).Create(object).Error
+}
+
+func (l *lock) ListEvents(ctx context.Context, opts ...Options) ([]model.LockEvent, error) {
+	var objects []model.LockEvent
+	tx := l.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *lock) CountEvents(ctx context.Context, opts ...Options) (int64, error) {
+	var total int64
+	tx := l.db.WithContext(ctx).Model(&model.LockEvent{})
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Count(&total).Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
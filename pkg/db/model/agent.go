@@ -1,13 +1,17 @@
 package model
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
 )
 
 func init() {
-	register(&Agent{}, &Account{})
+	register(&Agent{}, &Account{}, &AgentUsage{})
 }
 
 const (
@@ -29,6 +33,10 @@ const (
 
 	PublicAgentType  string = "public"
 	PrivateAgentType string = "private"
+
+	// agent 的部署方式
+	SSHProvisioner        string = "ssh"
+	KubernetesProvisioner string = "kubernetes"
 )
 
 type Agent struct {
@@ -40,29 +48,272 @@ type Agent struct {
 	Status             string    `gorm:"column:status;" json:"status"`
 	Message            string    `json:"message"`
 	RainbowdName       string    `json:"rainbowd_name"`
+	Provisioner        string    `json:"provisioner"` // ssh 通过 rainbowd 节点的 docker 部署，kubernetes 部署为工作负载，默认 ssh
+
+	Workload *AgentWorkload `gorm:"type:text" json:"workload,omitempty"` // kubernetes 部署时工作负载和 pod 的状态
+
+	Image         string      `json:"image"`          // agent 运行的镜像，为空时使用 rainbowd 配置的 agent_image
+	BinaryVersion string      `json:"binary_version"` // agent 二进制版本，对应模板目录的 agent-<version>，为空时使用 agent，kubernetes 部署时作为镜像 tag
+	Labels        AgentLabels `gorm:"type:text" json:"labels,omitempty"`
+
+	CIType     string `json:"ci_type"`     // 执行任务的 CI 后端，github, gitlab 或 gitea，默认 github
+	CIEndpoint string `json:"ci_endpoint"` // gitlab 或 gitea 的服务地址，如 https://gitlab.example.com
+	CITrigger  string `json:"ci_trigger"`  // github 触发方式，dispatch 或 push，默认 dispatch
+	CIWorkflow string `json:"ci_workflow"` // github workflow_dispatch 使用的 workflow 文件，默认 plugin.yml
+	CIRef      string `json:"ci_ref"`      // github workflow_dispatch 使用的分支，默认 master
 
+	// 以下账号信息用于所选的 CI 后端
 	GithubUser       string  `json:"github_user"`       // github 后端用户名
 	GithubEmail      string  `json:"github_email"`      // github 邮箱
 	GithubRepository string  `json:"github_repository"` // github 仓库地址
 	GithubToken      string  `json:"github_token"`      // github token
-	GrossAmount      float64 `json:"gross_amount"`      // github 账号开销金额，每个账号上限 16 美金，达到之后自动下线 agent
+	GrossAmount      float64 `json:"gross_amount"`      // github 账号开销金额，达到预算之后自动下线 agent
+
+	MonthlyBudget  float64 `json:"monthly_budget"`  // 每月开销预算，为 0 时使用全局配置
+	UsageMonth     string  `json:"usage_month"`     // 开销金额所属的月份，如 2026-01
+	SuspendedMonth string  `json:"suspended_month"` // 因超出预算被下线的月份，跨月后自动恢复上线
+
+	TunnelToken string `json:"-"` // 隧道认证凭证的 sha256 摘要
+
+	// api 模式下 agent 的认证信息，均只保存 sha256 摘要
+	BootstrapToken      string     `json:"-"`                               // 首次注册使用的引导凭证，注册成功后清空
+	BootstrapExpireTime *time.Time `json:"bootstrap_expire_time,omitempty"` // 引导凭证过期时间
+	Credential          string     `json:"-"`                               // 注册后颁发的 agent 凭证
+	CredentialIssueTime *time.Time `json:"credential_issue_time,omitempty"` // agent 凭证颁发时间，为空表示未颁发或已吊销
+
+	Inventory *AgentInventory `gorm:"type:text" json:"inventory,omitempty"` // agent 注册和心跳时上报的能力清单
+}
+
+// AgentInventory agent 探测上报的能力清单，以 json 格式存储
+type AgentInventory struct {
+	OS            string              `json:"os"`
+	Arch          string              `json:"arch"`
+	Tools         []AgentTool         `json:"tools"`         // docker, skopeo, buildx, git 等工具
+	Drivers       []string            `json:"drivers"`       // agent 主机上可用的 docker 或 skopeo，仅用于展示
+	Architectures []string            `json:"architectures"` // 可构建的平台，来自 buildx
+	Disk          AgentDisk           `json:"disk"`
+	Reachability  []AgentReachability `json:"reachability"`            // 镜像源网络连通性
+	RecentTasks   []AgentTaskOutcome  `json:"recent_tasks"`            // 最近处理的任务结果
+	GC            *AgentGCReport      `json:"gc,omitempty"`            // 最近一次垃圾回收的结果
+	Image         string              `json:"image,omitempty"`         // 部署 agent 使用的镜像
+	BinaryDigest  string              `json:"binary_digest,omitempty"` // agent 程序的 sha256 摘要
+	ProbeTime     time.Time           `json:"probe_time"`
+}
+
+type AgentGCReport struct {
+	StartTime       time.Time `json:"start_time"`
+	Duration        int64     `json:"duration"`   // 回收耗时，单位毫秒
+	DiskUsage       uint64    `json:"disk_usage"` // 回收后任务目录的占用
+	FreedBytes      uint64    `json:"freed_bytes"`
+	RemovedDirs     []string  `json:"removed_dirs,omitempty"`
+	SkippedDirs     []string  `json:"skipped_dirs,omitempty"` // 任务仍在处理中，未回收的目录
+	ImageReclaimed  string    `json:"image_reclaimed,omitempty"`
+	DeletedBranches []string  `json:"deleted_branches,omitempty"`
+	Errors          []string  `json:"errors,omitempty"`
+}
+
+type AgentTool struct {
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	Available bool   `json:"available"`
+}
+
+type AgentDisk struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+type AgentReachability struct {
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	Latency   int64  `json:"latency"` // 单位毫秒
+	Error     string `json:"error,omitempty"`
+}
+
+type AgentTaskOutcome struct {
+	TaskId  int64     `json:"task_id"`
+	Success bool      `json:"success"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (i AgentInventory) Value() (driver.Value, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (i *AgentInventory) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported agent inventory type %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, i)
+}
+
+// AgentWorkload kubernetes 部署的 agent 工作负载状态
+type AgentWorkload struct {
+	Namespace     string     `json:"namespace"`
+	Name          string     `json:"name"`
+	Replicas      int32      `json:"replicas"`
+	ReadyReplicas int32      `json:"ready_replicas"`
+	Pods          []AgentPod `json:"pods,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	UpdateTime    time.Time  `json:"update_time"`
+}
+
+type AgentPod struct {
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	Reason   string `json:"reason,omitempty"` // 容器未就绪的原因，如 CrashLoopBackOff
+}
+
+func (w AgentWorkload) Value() (driver.Value, error) {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (w *AgentWorkload) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported agent workload type %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, w)
 }
 
 func (a *Agent) TableName() string {
 	return "agents"
 }
 
+// AgentUsage agent 每月的 GitHub Actions 开销记录
+type AgentUsage struct {
+	rainbow.Model
+
+	AgentName   string  `gorm:"index:idx_agent_month,unique" json:"agent_name"`
+	Month       string  `gorm:"index:idx_agent_month,unique" json:"month"`
+	GrossAmount float64 `json:"gross_amount"`
+	Budget      float64 `json:"budget"`
+}
+
+func (a *AgentUsage) TableName() string {
+	return "agent_usages"
+}
+
+const (
+	DockerhubAccountType string = "dockerhub"
+
+	// 账号状态，仅正常状态的账号参与 hub api 的分配，已耗尽指 hub api 次数耗尽
+	AccountHealthyStatus   string = "正常"
+	AccountExhaustedStatus string = "已耗尽"
+	AccountErrorStatus     string = "异常"
+	AccountDisabledStatus  string = "已停用"
+)
+
 type Account struct {
 	rainbow.Model
 
 	Type            string    `json:"type"` // dockerhub
 	UserName        string    `json:"user_name"`
-	Password        string    `json:"password"`
+	Password        string    `json:"password"` // 密码或 personal access token，加密保存
 	Token           string    `json:"token"`
 	TokenExpireTime time.Time `json:"token_expire_time"` // Token 过期时间
-	RetainTimes     int       `json:"retain_times"`      // 剩余可查询次数
+	RetainTimes     int       `json:"retain_times"`      // hub api 剩余可查询次数，来自 x-ratelimit 响应头，-1 表示未知
+
+	Status       string     `json:"status"`
+	Message      string     `json:"message"`
+	RateLimit    int        `json:"rate_limit"`     // hub api 限流窗口内的总次数
+	UsedTimes    int64      `json:"used_times"`     // 累计分配次数
+	LastUsedTime *time.Time `json:"last_used_time"` // 最近一次分配时间
+	ResetTime    *time.Time `json:"reset_time"`     // hub api 次数耗尽后恢复的时间
+
+	// registry 的拉取限额，来自 ratelimit 响应头，与 hub api 的限流分别统计
+	PullRetainTimes int        `json:"pull_retain_times"` // 剩余拉取次数，-1 表示未知
+	PullRateLimit   int        `json:"pull_rate_limit"`   // 限流窗口内的拉取总次数
+	PullResetTime   *time.Time `json:"pull_reset_time"`   // 拉取次数耗尽后恢复的时间
 }
 
 func (a *Account) TableName() string {
 	return "accounts"
 }
+
+// AgentLabels agent 的标签，用于升级等批量操作时选择 agent
+type AgentLabels map[string]string
+
+// Matches 判断标签是否满足 k1=v1,k2=v2 格式的选择器，选择器为空时总是满足
+func (l AgentLabels) Matches(selector string) bool {
+	for _, item := range strings.Split(selector, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			if _, ok := l[kv[0]]; !ok {
+				return false
+			}
+			continue
+		}
+		if v, ok := l[strings.TrimSpace(kv[0])]; !ok || v != strings.TrimSpace(kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l AgentLabels) Value() (driver.Value, error) {
+	if l == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *AgentLabels) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported agent labels type %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, l)
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"time"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
+)
+
+func init() {
+	register(&AgentUpgrade{}, &AgentUpgradeTarget{})
+}
+
+const (
+	// 升级的对象
+	ImageAgentUpgrade  string = "image"
+	BinaryAgentUpgrade string = "binary"
+
+	// 失败时的处理策略
+	PauseUpgradePolicy    string = "pause"
+	RollbackUpgradePolicy string = "rollback"
+
+	// 升级计划的状态
+	UpgradeRunningStatus     string = "执行中"
+	UpgradePausedStatus      string = "已暂停"
+	UpgradeCompletedStatus   string = "已完成"
+	UpgradeRollingBackStatus string = "回滚中"
+	UpgradeRolledBackStatus  string = "已回滚"
+
+	// 单个 agent 的升级状态
+	UpgradeTargetPending    string = "等待中"
+	UpgradeTargetChecking   string = "检查中"
+	UpgradeTargetSucceeded  string = "成功"
+	UpgradeTargetFailed     string = "失败"
+	UpgradeTargetRolledBack string = "已回滚"
+)
+
+// AgentUpgrade agent 的分批升级计划，第一批为金丝雀批次
+type AgentUpgrade struct {
+	rainbow.Model
+
+	Name          string `gorm:"index:idx_name,unique" json:"name"`
+	Type          string `json:"type"`           // image 或 binary
+	Image         string `json:"image"`          // image 升级的目标镜像
+	BinaryVersion string `json:"binary_version"` // binary 升级的目标版本
+
+	// 选择升级的 agent，均为空时选择全部在线的 agent
+	Selector     string `json:"selector"` // 标签选择器，格式 k1=v1,k2=v2
+	RainbowdName string `json:"rainbowd_name"`
+
+	CanarySize    int    `json:"canary_size"`
+	BatchSize     int    `json:"batch_size"`
+	RequireTask   bool   `json:"require_task"`   // 健康检查需等待升级后的下一个任务成功
+	HealthTimeout int    `json:"health_timeout"` // 健康检查超时时间，单位秒
+	FailurePolicy string `json:"failure_policy"` // pause 或 rollback
+
+	Status    string     `json:"status"`
+	Message   string     `json:"message"`
+	Batch     int        `json:"batch"`      // 当前执行的批次，从 0 开始
+	BatchNum  int        `json:"batch_num"`  // 批次总数
+	StartTime *time.Time `json:"start_time"` // 开始时间
+	EndTime   *time.Time `json:"end_time"`   // 完成、回滚时间
+}
+
+func (t *AgentUpgrade) TableName() string {
+	return "agent_upgrades"
+}
+
+// AgentUpgradeTarget 升级计划中的 agent，记录升级前的版本用于回滚
+type AgentUpgradeTarget struct {
+	rainbow.Model
+
+	UpgradeId         int64      `json:"upgrade_id" gorm:"index:idx"`
+	AgentName         string     `json:"agent_name"`
+	Batch             int        `json:"batch"`
+	PrevImage         string     `json:"prev_image"`
+	PrevBinaryVersion string     `json:"prev_binary_version"`
+	Status            string     `json:"status"`
+	Message           string     `json:"message"`
+	WaitTime          *time.Time `json:"wait_time"`    // 开始等待 agent 空闲的时间，超过健康检查超时时间视为失败
+	UpgradeTime       *time.Time `json:"upgrade_time"` // 完成升级动作的时间，健康检查从此刻开始
+}
+
+func (t *AgentUpgradeTarget) TableName() string {
+	return "agent_upgrade_targets"
+}
@@ -18,26 +18,31 @@ type Image struct {
 	GmtDeleted gorm.DeletedAt
 
 	Name       string `json:"name"`
-	UserId     string `json:"user_id"`
+	UserId     string `gorm:"index:idx_image_user,length:64" json:"user_id"`
 	UserName   string `json:"user_name"`
 	RegisterId int64  `json:"register_id"`
 
 	Logo        string  `json:"logo"`
 	Labels      []Label `json:"labels" gorm:"many2many:image_labels;constraint:OnDelete:CASCADE"` // 标记镜像类型，比如 ai，k8s
-	Namespace   string  `json:"namespace"`
+	Namespace   string  `gorm:"index:idx_image_namespace,length:64" json:"namespace"`
 	Mirror      string  `json:"mirror"`
-	Size        int64   `json:"size"`
-	Pull        int64   `json:"pull"`
+	Size        int64   `gorm:"index:idx_image_size" json:"size"`
+	Pull        int64   `gorm:"index:idx_image_pull" json:"pull"`
 	Tags        []Tag   `json:"tags" gorm:"foreignKey:ImageId;constraint:OnDelete:CASCADE;"`
 	TagsCount   int64   `json:"tags_count"`
 	Description string  `json:"description"`
 
-	IsPublic      bool      `json:"is_public"`
-	IsOfficial    bool      `json:"is_official"`
+	IsPublic      bool      `gorm:"index:idx_image_public" json:"is_public"`
+	IsOfficial    bool      `gorm:"index:idx_image_public" json:"is_official"`
 	PublicUpdated bool      `json:"public_updated"` // 是否已经同步过远端仓库状态
 	ReadSize      string    `json:"read_size"`      // 转换之后的，方便人读的大小
 	LastSyncTime  time.Time `json:"last_sync_time"` // 上次同步时间，超过10分钟则同步一次
 	IsLocked      bool      `json:"is_locked"`      // 锁字段，默认 false 表示未锁定
+
+	// 锁定信息，锁定的镜像不允许删除，已存在的版本不允许覆盖
+	LockReason     string     `json:"lock_reason"`
+	LockedBy       string     `json:"locked_by"`
+	LockExpireTime *time.Time `json:"lock_expire_time"` // 为空表示永久锁定
 }
 
 func (t *Image) TableName() string {
@@ -51,27 +56,58 @@ type Tag struct {
 
 	ImageId      int64  `gorm:"index:idx_image" json:"image_id"`
 	TaskIds      string `json:"task_ids"` // 关联的任务IDs 多个id以逗号隔开
-	Path         string `json:"path"`
+	Path         string `gorm:"index:idx_tag_path,length:128" json:"path"`
 	Mirror       string `json:"mirror"`
 	Name         string `json:"name"`
 	Size         int64  `json:"size"`
-	Status       string `json:"status"`
+	Status       string `gorm:"index:idx_tag_arch_status,priority:2,length:32" json:"status"`
 	Message      string `json:"message"` // 错误信息
 	Manifest     string `json:"manifest"`
 	Digest       string `json:"digest"`
-	Architecture string `json:"architecture"` // 版本对应的架构，默认是 arm64，也可以是 amd64
-	ReadSize     string `json:"read_size"`    // 转换之后的，方便人读的大小
+	Architecture string `gorm:"index:idx_tag_arch_status,priority:1,length:32" json:"architecture"` // 版本对应的架构，默认是 arm64，也可以是 amd64
+	ReadSize     string `json:"read_size"`                                                          // 转换之后的，方便人读的大小
+
+	// 漏洞扫描结果摘要，完整报告见 ScanReport
+	ScanStatus    string     `json:"scan_status"`
+	ScanMessage   string     `json:"scan_message"`
+	ScanCritical  int        `json:"scan_critical"`
+	ScanHigh      int        `json:"scan_high"`
+	ScanMedium    int        `json:"scan_medium"`
+	ScanLow       int        `json:"scan_low"`
+	ScanUnknown   int        `json:"scan_unknown"`
+	ScanDBVersion string     `json:"scan_db_version"` // 扫描时的漏洞库版本，漏洞库更新后重新扫描
+	ScanTime      *time.Time `json:"scan_time"`
+
+	// 签名校验结果和随镜像复制的签名、证明、SBOM 数量
+	SignatureStatus  string `json:"signature_status"`
+	SignatureMessage string `json:"signature_message"`
+	ArtifactCount    int    `json:"artifact_count"`
+
+	// 版本锁定信息，锁定的版本不允许删除和覆盖
+	IsLocked       bool       `json:"is_locked"`
+	LockReason     string     `json:"lock_reason"`
+	LockedBy       string     `json:"locked_by"`
+	LockExpireTime *time.Time `json:"lock_expire_time"`
 }
 
 func (t *Tag) TableName() string {
 	return "tags"
 }
 
+// 下载量的统计来源
+const (
+	DownflowSourceRegistry = "registry" // 远端仓库累计下载量的每日差值，仅统计到镜像
+	DownflowSourcePixiuctl = "pixiuctl" // pixiuctl 解析镜像地址的次数，统计到版本
+)
+
+// Downflow 镜像或版本每天的下载量，同一天同一来源只有一条记录
 type Downflow struct {
 	rainbow.Model
 
-	ImageId  int64  `gorm:"index:idx_image" json:"image_id"`
-	CreateAt string `json:"create_at"`
+	ImageId  int64  `gorm:"index:idx_image;uniqueIndex:idx_downflow_day,priority:1" json:"image_id"`
+	TagId    int64  `gorm:"uniqueIndex:idx_downflow_day,priority:2" json:"tag_id"` // 为 0 表示镜像级别
+	Source   string `gorm:"type:varchar(32);uniqueIndex:idx_downflow_day,priority:3" json:"source"`
+	CreateAt string `gorm:"type:varchar(16);uniqueIndex:idx_downflow_day,priority:4" json:"create_at"` // 日期，如 2025-01-02
 	PullNum  int    `json:"pull_num"`
 }
 
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"time"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
+)
+
+func init() {
+	register(&ImmutableRule{}, &LockEvent{})
+}
+
+// 锁定审计事件的类型
+const (
+	LockActionLock   = "Lock"
+	LockActionUnlock = "Unlock"
+	LockActionDeny   = "Deny" // 删除或覆盖被锁定的内容时拒绝
+)
+
+// ImmutableRule 按名称匹配的不可变规则，匹配的版本同步完成后不允许删除和覆盖
+type ImmutableRule struct {
+	rainbow.Model
+
+	Name         string `gorm:"index:idx_name,unique" json:"name"`
+	ImagePattern string `json:"image_pattern"` // 镜像名称的通配符，为空表示全部镜像
+	TagPattern   string `json:"tag_pattern"`   // 版本名称的通配符，如 v*
+	Description  string `json:"description"`
+	CreatedBy    string `json:"created_by"`
+}
+
+func (r *ImmutableRule) TableName() string {
+	return "immutable_rules"
+}
+
+// LockEvent 镜像和版本锁定的审计事件
+type LockEvent struct {
+	rainbow.Model
+
+	ImageId    int64      `gorm:"index:idx_image" json:"image_id"`
+	TagId      int64      `json:"tag_id"` // 为 0 表示镜像级别
+	Action     string     `json:"action"`
+	Operator   string     `json:"operator"`
+	Reason     string     `json:"reason"`
+	ExpireTime *time.Time `json:"expire_time"`
+	Message    string     `json:"message"`
+}
+
+func (e *LockEvent) TableName() string {
+	return "lock_events"
+}
@@ -1,6 +1,9 @@
 package model
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
@@ -13,20 +16,80 @@ func init() {
 type Rainbowd struct {
 	rainbow.Model
 
-	Name               string    `json:"name"`
+	Name               string    `gorm:"index:idx_name,unique" json:"name"`
 	Host               string    `json:"host"`
 	Status             string    `gorm:"column:status;" json:"status"`
+	Message            string    `json:"message"`
 	LastTransitionTime time.Time `gorm:"column:last_transition_time;type:datetime;default:current_timestamp;not null" json:"last_transition_time"`
+
+	// ssh 连接配置，密码加密保存
+	Port       int    `json:"port"`
+	User       string `json:"user"`
+	Password   string `json:"-"`
+	PrivateKey string `json:"private_key"` // server 上的私钥路径
+	HostKey    string `json:"host_key"`    // 首次连接时固定的主机公钥，authorized_keys 格式
+
+	// 跳板机配置，JumpHost 为空时直连
+	JumpHost       string `json:"jump_host"`
+	JumpPort       int    `json:"jump_port"`
+	JumpUser       string `json:"jump_user"`
+	JumpPassword   string `json:"-"`
+	JumpPrivateKey string `json:"jump_private_key"`
+	JumpHostKey    string `json:"jump_host_key"`
+
+	Health *RainbowdHealth `gorm:"type:text" json:"health,omitempty"` // 最近一次健康检查的结果
 }
 
 func (t *Rainbowd) TableName() string {
 	return "rainbowds"
 }
 
+// RainbowdHealth rainbowd 节点的资源和 docker 状态
+type RainbowdHealth struct {
+	CPUCores        int       `json:"cpu_cores"`
+	CPUUsage        float64   `json:"cpu_usage"` // cpu 使用率，百分比
+	MemoryTotal     uint64    `json:"memory_total"`
+	MemoryUsed      uint64    `json:"memory_used"`
+	DiskTotal       uint64    `json:"disk_total"` // agent 数据目录所在磁盘
+	DiskUsed        uint64    `json:"disk_used"`
+	DockerRunning   bool      `json:"docker_running"`
+	DockerVersion   string    `json:"docker_version,omitempty"`
+	AgentContainers int       `json:"agent_containers"` // 运行中的 agent 容器数量
+	ProbeTime       time.Time `json:"probe_time"`
+}
+
+func (h RainbowdHealth) Value() (driver.Value, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (h *RainbowdHealth) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported rainbowd health type %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, h)
+}
+
+// RainbowdEvent rainbowd 状态变化的事件
 type RainbowdEvent struct {
 	rainbow.Model
 
 	RainbowdId int64  `json:"rainbowd_id" gorm:"index:idx"`
+	Status     string `json:"status"` // 变化后的状态
 	Message    string `json:"message"`
 }
 
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"time"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
+)
+
+func init() {
+	register(&ScanReport{})
+}
+
+const (
+	TagScanningStatus  = "Scanning"
+	TagScannedStatus   = "Scanned"
+	TagScanErrorStatus = "Error"
+)
+
+// ScanReport tag 最近一次的漏洞扫描报告，每个 tag 只保留一份
+type ScanReport struct {
+	rainbow.Model
+
+	TagId     int64      `gorm:"uniqueIndex:idx_tag" json:"tag_id"`
+	ImageId   int64      `gorm:"index:idx_image" json:"image_id"`
+	Image     string     `json:"image"`
+	Scanner   string     `json:"scanner"`
+	DBVersion string     `json:"db_version"`
+	ScanTime  *time.Time `json:"scan_time"`
+	Summary   string     `gorm:"type:text" json:"summary"`
+	Report    string     `gorm:"type:longtext" json:"report"` // 归一化的漏洞列表
+}
+
+func (s *ScanReport) TableName() string {
+	return "scan_reports"
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"github.com/caoyingjunz/rainbow/pkg/db/model/rainbow"
+)
+
+func init() {
+	register(&SigningKey{})
+}
+
+// 同步前签名校验的结果
+const (
+	SignatureVerified   = "Verified"
+	SignatureUnsigned   = "Unsigned"
+	SignatureInvalid    = "Invalid"
+	SignatureUnverified = "Unverified" // 未开启校验，仅复制签名
+)
+
+// SigningKey 校验镜像 cosign 签名的公钥
+type SigningKey struct {
+	rainbow.Model
+
+	Name        string `gorm:"index:idx_name,unique" json:"name"`
+	PublicKey   string `gorm:"type:text" json:"public_key"` // PEM 格式的公钥
+	Description string `json:"description"`
+}
+
+func (s *SigningKey) TableName() string {
+	return "signing_keys"
+}
@@ -33,6 +33,18 @@ type Task struct {
 	Architecture      string `json:"architecture"`
 	OwnerRef          int    `json:"owner_ref"`    // 任务所属，直接创建 0，订阅创建 1
 	SubscribeId       int64  `json:"subscribe_id"` // 所属关联订阅ID，默认为 0 手动创建 1 订阅创建
+
+	// 同步时复制镜像的签名、证明和 SBOM，开启校验时同步前使用已配置的公钥校验签名，校验失败不同步
+	CopySignatures  bool `json:"copy_signatures"`
+	VerifySignature bool `json:"verify_signature"`
+
+	// agent 处理任务时持有的租约，避免多个 worker 或 agent 重复处理
+	LeaseHolder     string     `json:"lease_holder"`
+	LeaseExpireTime *time.Time `json:"lease_expire_time"`
+
+	// runner 获取任务配置使用的凭证摘要，任务结束或过期后失效
+	PluginToken           string     `json:"-"`
+	PluginTokenExpireTime *time.Time `json:"-"`
 }
 
 func (t *Task) TableName() string {
@@ -50,6 +62,11 @@ func (t *TaskMessage) TableName() string {
 	return "task_messages"
 }
 
+const (
+	SubscribeNotFoundStatus  = "镜像不存在"
+	SubscribeSuspendedStatus = "失败暂停" // 连续失败超过限制，等待探测恢复
+)
+
 type Subscribe struct { // 同步远端镜像更新状态
 	rainbow.Model
 	rainbow.UserModel
@@ -65,10 +82,16 @@ type Subscribe struct { // 同步远端镜像更新状态
 	LastNotifyTime time.Time     `json:"last_notify_time" gorm:"column:last_notify_time;type:datetime;default:current_timestamp;not null"` // 上次触发时间
 	Interval       time.Duration `json:"interval"`                                                                                         // 间隔多久同步一次
 	FailTimes      int           `json:"fail_times"`                                                                                       // 失败次数
-	ImageFrom      string        `json:"image_from"`                                                                                       // 镜像来源，支持 dockerhub, gcr, quay.io
+	NextRunTime    time.Time     `json:"next_run_time" gorm:"column:next_run_time;type:datetime;default:current_timestamp;not null"`       // 失败退避或探测的下次执行时间
+	ImageFrom      string        `json:"image_from"`                                                                                       // 镜像来源，支持 dockerhub 及通用 OCI 镜像源（如 ghcr.io, registry.k8s.io）
 	Policy         string        `json:"policy"`                                                                                           // 默认定义所有版本镜像，支持正则表达式，比如 v1.*
 	Arch           string        `json:"arch"`
 	Rewrite        bool          `json:"rewrite"`
+
+	// 保留策略，每次订阅执行后清理
+	RetainCount int    `json:"retain_count"` // 保留最新多少个匹配策略的版本，0 表示不限制
+	RetainDays  int    `json:"retain_days"`  // 保留最近多少天内同步的版本，0 表示不限制
+	PinnedTags  string `json:"pinned_tags"`  // 固定保留的版本，多个以逗号隔开
 }
 
 func (t *Subscribe) TableName() string {
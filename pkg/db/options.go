@@ -63,6 +63,12 @@ func WithCreatedAfter(t time.Time) Options {
 	}
 }
 
+func WithModifiedAfter(t time.Time) Options {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("gmt_modified > ?", t)
+	}
+}
+
 func WithLastSyncBefore(t time.Time) Options {
 	return func(tx *gorm.DB) *gorm.DB {
 		return tx.Where("last_sync_time < ?", t)
@@ -81,15 +87,6 @@ func WithEnable(enable int) Options {
 	}
 }
 
-func WithFailTimes(t int) Options {
-	return func(tx *gorm.DB) *gorm.DB {
-		if t == 0 {
-			return tx
-		}
-		return tx.Where("fail_times <= ?", t)
-	}
-}
-
 func WithRole(role int) Options {
 	return func(tx *gorm.DB) *gorm.DB {
 		return tx.Where("role = ?", role)
@@ -230,6 +227,24 @@ func WithTask(taskId int64) Options {
 	}
 }
 
+func WithRainbowd(rainbowdId int64) Options {
+	return func(tx *gorm.DB) *gorm.DB {
+		if rainbowdId == 0 {
+			return tx
+		}
+		return tx.Where("rainbowd_id = ?", rainbowdId)
+	}
+}
+
+func WithUpgrade(upgradeId int64) Options {
+	return func(tx *gorm.DB) *gorm.DB {
+		if upgradeId == 0 {
+			return tx
+		}
+		return tx.Where("upgrade_id = ?", upgradeId)
+	}
+}
+
 func WithBuild(buildId int64) Options {
 	return func(tx *gorm.DB) *gorm.DB {
 		if buildId == 0 {
@@ -335,6 +350,21 @@ func WithStatus(status string) Options {
 	}
 }
 
+func WithType(t string) Options {
+	return func(tx *gorm.DB) *gorm.DB {
+		if len(t) == 0 {
+			return tx
+		}
+		return tx.Where("type = ?", t)
+	}
+}
+
+func WithUserName(name string) Options {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_name = ?", name)
+	}
+}
+
 func WithUserType(userType int) Options {
 	return func(tx *gorm.DB) *gorm.DB {
 		return tx.Where("user_type = ?", userType)
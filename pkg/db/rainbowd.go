@@ -44,6 +44,7 @@ func (rain *rainbowd) Create(ctx context.Context, object *model.Rainbowd) (*mode
 }
 
 func (rain *rainbowd) Update(ctx context.Context, rainbowdId int64, updates map[string]interface{}) error {
+	updates["gmt_modified"] = time.Now()
 	f := rain.db.WithContext(ctx).Model(&model.Rainbowd{}).Where("id = ?", rainbowdId).Updates(updates)
 	if f.Error != nil {
 		return f.Error
@@ -56,7 +57,12 @@ func (rain *rainbowd) Update(ctx context.Context, rainbowdId int64, updates map[
 }
 
 func (rain *rainbowd) Delete(ctx context.Context, rainbowdId int64) error {
-	return nil
+	return rain.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rainbowd_id = ?", rainbowdId).Delete(&model.RainbowdEvent{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", rainbowdId).Delete(&model.Rainbowd{}).Error
+	})
 }
 
 func (rain *rainbowd) Get(ctx context.Context, rainbowdId int64) (*model.Rainbowd, error) {
@@ -89,13 +95,29 @@ func (rain *rainbowd) List(ctx context.Context, opts ...Options) ([]model.Rainbo
 }
 
 func (rain *rainbowd) CreateEvent(ctx context.Context, object *model.RainbowdEvent) (*model.RainbowdEvent, error) {
-	return nil, nil
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	if err := rain.db.WithContext(ctx).Create(object).Error; err != nil {
+		return nil, err
+	}
+	return object, nil
 }
 
 func (rain *rainbowd) DeleteEvent(ctx context.Context, eid int64) error {
-	return nil
+	return rain.db.WithContext(ctx).Where("id = ?", eid).Delete(&model.RainbowdEvent{}).Error
 }
 
 func (rain *rainbowd) ListEvents(ctx context.Context, opts ...Options) ([]model.RainbowdEvent, error) {
-	return nil, nil
+	var audits []model.RainbowdEvent
+	tx := rain.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&audits).Error; err != nil {
+		return nil, err
+	}
+
+	return audits, nil
 }
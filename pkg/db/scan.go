@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+type ScanInterface interface {
+	// UpdateTag 按 tag id 更新扫描状态和摘要
+	UpdateTag(ctx context.Context, tagId int64, updates map[string]interface{}) error
+	// ListPending 获取已同步完成且未使用当前漏洞库扫描过的 tag
+	ListPending(ctx context.Context, dbVersion string, limit int) ([]model.Tag, error)
+
+	SaveReport(ctx context.Context, object *model.ScanReport) error
+	GetReport(ctx context.Context, tagId int64) (*model.ScanReport, error)
+	DeleteReport(ctx context.Context, tagId int64) error
+}
+
+func newScan(db *gorm.DB) ScanInterface {
+	return &scan{db}
+}
+
+type scan struct {
+	db *gorm.DB
+}
+
+func (s *scan) UpdateTag(ctx context.Context, tagId int64, updates map[string]interface{}) error {
+	updates["gmt_modified"] = time.Now()
+	return s.db.WithContext(ctx).Model(&model.Tag{}).Where("id = ?", tagId).Updates(updates).Error
+}
+
+func (s *scan) ListPending(ctx context.Context, dbVersion string, limit int) ([]model.Tag, error) {
+	var objects []model.Tag
+	tx := s.db.WithContext(ctx).
+		Where("status = ?", "Completed").
+		Where("scan_db_version IS NULL OR scan_db_version != ?", dbVersion).
+		Order("scan_time ASC").Order("id DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Find(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// SaveReport 每个 tag 只保留最近一次的报告
+func (s *scan) SaveReport(ctx context.Context, object *model.ScanReport) error {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tag_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"image_id", "image", "scanner", "db_version", "scan_time", "summary", "report", "gmt_modified"}),
+	}).Create(object).Error
+}
+
+func (s *scan) GetReport(ctx context.Context, tagId int64) (*model.ScanReport, error) {
+	var object model.ScanReport
+	if err := s.db.WithContext(ctx).Where("tag_id = ?", tagId).First(&object).Error; err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+func (s *scan) DeleteReport(ctx context.Context, tagId int64) error {
+	return s.db.WithContext(ctx).Where("tag_id = ?", tagId).Delete(&model.ScanReport{}).Error
+}
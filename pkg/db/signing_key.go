@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
+
+type SigningKeyInterface interface {
+	Create(ctx context.Context, object *model.SigningKey) (*model.SigningKey, error)
+	Delete(ctx context.Context, keyId int64) error
+	List(ctx context.Context, opts ...Options) ([]model.SigningKey, error)
+}
+
+func newSigningKey(db *gorm.DB) SigningKeyInterface {
+	return &signingKey{db}
+}
+
+type signingKey struct {
+	db *gorm.DB
+}
+
+func (s *signingKey) Create(ctx context.Context, object *model.SigningKey) (*model.SigningKey, error) {
+	now := time.Now()
+	object.GmtCreate = now
+	object.GmtModified = now
+
+	if err := s.db.WithContext(ctx).Create(object).Error; err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *signingKey) Delete(ctx context.Context, keyId int64) error {
+	return s.db.WithContext(ctx).Where("id = ?", keyId).Delete(&model.SigningKey{}).Error
+}
+
+func (s *signingKey) List(ctx context.Context, opts ...Options) ([]model.SigningKey, error) {
+	var objects []model.SigningKey
+	tx := s.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Find(&objects).Error; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
@@ -21,10 +21,14 @@ type TaskInterface interface {
 
 	DeleteInBatch(ctx context.Context, taskIds []int64) error
 	UpdateDirectly(ctx context.Context, taskId int64, updates map[string]interface{}) error
+	UpdateIfProcess(ctx context.Context, taskId int64, process int, updates map[string]interface{}) (bool, error)
 
 	DeleteBySubscribe(ctx context.Context, subId int64) error
 
 	GetOne(ctx context.Context, taskId int64, resourceVersion int64) (*model.Task, error)
+	Lease(ctx context.Context, taskId int64, agentName string, holder string, ttl time.Duration) (*model.Task, error)
+	ReleaseLease(ctx context.Context, taskId int64, holder string) error
+	ListLeasable(ctx context.Context, agentName string, opts ...Options) ([]model.Task, error)
 	AssignToAgent(ctx context.Context, taskId int64, agentName string) error
 	ListWithAgent(ctx context.Context, agentName string, process int, opts ...Options) ([]model.Task, error)
 	ListWithNoAgent(ctx context.Context, process int, opts ...Options) ([]model.Task, error)
@@ -71,7 +75,7 @@ type TaskInterface interface {
 	UpdateSubscribeDirectly(ctx context.Context, subId int64, updates map[string]interface{}) error
 
 	CreateSubscribeMessage(ctx context.Context, object *model.SubscribeMessage) error
-	DeleteSubscribeMessage(ctx context.Context, subId int64) error
+	DeleteSubscribeMessage(ctx context.Context, subId int64, retains int, before time.Time) error
 	ListSubscribeMessages(ctx context.Context, opts ...Options) ([]model.SubscribeMessage, error)
 }
 
@@ -122,6 +126,16 @@ func (a *task) UpdateDirectly(ctx context.Context, taskId int64, updates map[str
 	return nil
 }
 
+// UpdateIfProcess 仅在任务处于指定进度时更新，返回是否已更新
+func (a *task) UpdateIfProcess(ctx context.Context, taskId int64, process int, updates map[string]interface{}) (bool, error) {
+	updates["gmt_modified"] = time.Now()
+	f := a.db.WithContext(ctx).Model(&model.Task{}).Where("id = ? and process = ?", taskId, process).Updates(updates)
+	if f.Error != nil {
+		return false, f.Error
+	}
+	return f.RowsAffected != 0, nil
+}
+
 func (a *task) Delete(ctx context.Context, taskId int64) error {
 	return a.db.WithContext(ctx).Where("id = ?", taskId).Delete(&model.Task{}).Error
 }
@@ -159,6 +173,57 @@ func (a *task) GetOne(ctx context.Context, taskId int64, resourceVersion int64)
 	return a.Get(ctx, taskId)
 }
 
+// Lease 获取任务租约，任务未处理、租约已过期或已由 holder 持有时成功，否则返回 ErrRecordNotUpdate
+func (a *task) Lease(ctx context.Context, taskId int64, agentName string, holder string, ttl time.Duration) (*model.Task, error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"gmt_modified":      now,
+		"resource_version":  gorm.Expr("resource_version + 1"),
+		"process":           1,
+		"lease_holder":      holder,
+		"lease_expire_time": now.Add(ttl),
+	}
+
+	f := a.db.WithContext(ctx).Model(&model.Task{}).
+		Where("id = ? and agent_name = ?", taskId, agentName).
+		Where(a.db.Where("process = ?", 0).
+			Or("process = ? and lease_holder = ?", 1, holder).
+			Or("process = ? and lease_holder <> ? and lease_expire_time < ?", 1, "", now)).
+		Updates(updates)
+	if f.Error != nil {
+		return nil, f.Error
+	}
+	if f.RowsAffected == 0 {
+		return nil, errors.ErrRecordNotUpdate
+	}
+
+	return a.Get(ctx, taskId)
+}
+
+// ReleaseLease 释放 holder 持有的任务租约
+func (a *task) ReleaseLease(ctx context.Context, taskId int64, holder string) error {
+	return a.db.WithContext(ctx).Model(&model.Task{}).
+		Where("id = ? and lease_holder = ?", taskId, holder).
+		Updates(map[string]interface{}{"gmt_modified": time.Now(), "lease_holder": "", "lease_expire_time": nil}).Error
+}
+
+// ListLeasable 获取 agent 可获取租约的任务，包括未处理和租约已过期的任务
+func (a *task) ListLeasable(ctx context.Context, agentName string, opts ...Options) ([]model.Task, error) {
+	var audits []model.Task
+	tx := a.db.WithContext(ctx)
+	for _, opt := range opts {
+		tx = opt(tx)
+	}
+	if err := tx.Where("agent_name = ?", agentName).
+		Where(a.db.Where("process = ?", 0).
+			Or("process = ? and lease_holder <> ? and lease_expire_time < ?", 1, "", time.Now())).
+		Find(&audits).Error; err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
 func (a *task) List(ctx context.Context, opts ...Options) ([]model.Task, error) {
 	var audits []model.Task
 	tx := a.db.WithContext(ctx)
@@ -575,19 +640,21 @@ func (a *task) DeleteSubscribeAllMessage(ctx context.Context, subId int64) error
 	return a.db.WithContext(ctx).Where("subscribe_id = ?", subId).Delete(&model.SubscribeMessage{}).Error
 }
 
-func (a *task) DeleteSubscribeMessage(ctx context.Context, subId int64) error {
-	result := a.db.Exec(`
+// DeleteSubscribeMessage 清理订阅事件，保留最新的 retains 条及 before 之后的事件
+func (a *task) DeleteSubscribeMessage(ctx context.Context, subId int64, retains int, before time.Time) error {
+	result := a.db.WithContext(ctx).Exec(`
 	DELETE FROM subscribe_messages
 	WHERE subscribe_id = ?
+	AND gmt_create < ?
 	AND id NOT IN (
 		SELECT id FROM (
 		SELECT id
 	FROM subscribe_messages
 	WHERE subscribe_id = ?
 	ORDER BY id DESC
-	LIMIT 5
+	LIMIT ?
 	) AS temp
-	)`, subId, subId)
+	)`, subId, before, subId, retains)
 	return result.Error
 }
 
@@ -385,6 +385,9 @@ func (o *PullOptions) waitForCached(repo string) (*model.Tag, error) {
 			// 执行轮询：获取镜像当前状态
 			cacheTag, err := o.SearchRepo(repo)
 			if err != nil {
+				if ErrorIsPullBlocked(err) {
+					return nil, err
+				}
 				klog.V(1).Infof("获取构建失败(%v)，等待下一次查询", err)
 				continue
 			}
@@ -3,9 +3,11 @@ package cmd
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/caoyingjunz/rainbow/pkg/db/model"
+	"github.com/caoyingjunz/rainbow/pkg/types"
 	"github.com/caoyingjunz/rainbow/pkg/util"
 )
 
@@ -13,6 +15,11 @@ func ErrorIsNotFound(err error) bool {
 	return err.Error() == "record not found"
 }
 
+// ErrorIsPullBlocked 镜像因漏洞策略被禁止拉取
+func ErrorIsPullBlocked(err error) bool {
+	return strings.HasPrefix(err.Error(), types.PullBlockedMessage)
+}
+
 func GetUserInfoByAccessKey(baseURL, accessKey, signature string) (*model.User, error) {
 	url := fmt.Sprintf("%s/api/v2/users?access_key=%s", baseURL, accessKey)
 
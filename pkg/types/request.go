@@ -1,6 +1,10 @@
 package types
 
-import "time"
+import (
+	"time"
+
+	"github.com/caoyingjunz/rainbow/pkg/db/model"
+)
 
 type (
 	UserMetaRequest struct {
@@ -81,6 +85,8 @@ type (
 		Architecture      string   `json:"architecture"`
 		OwnerRef          int      `json:"owner_ref"` // 任务所属，直接创建 0，订阅创建 1
 		SubscribeId       int64    `json:"subscribe_id"`
+		CopySignatures    bool     `json:"copy_signatures"`
+		VerifySignature   bool     `json:"verify_signature"`
 	}
 
 	UpdateTaskRequest struct {
@@ -141,7 +147,6 @@ type (
 		Status     string `json:"status"`
 		Message    string `json:"message"`
 		IsPublic   bool   `json:"is_public"`
-		IsLocked   bool   `json:"is_locked"`
 		Arch       string `json:"arch"`
 	}
 
@@ -158,9 +163,9 @@ type (
 		Namespace       string `json:"namespace"`
 		Label           string `json:"label"`
 		IsPublic        bool   `json:"is_public"`
+		IsLocked        *bool  `json:"is_locked"` // 已废弃，锁定状态通过锁定接口修改
 		Logo            string `json:"logo"`
 		Description     string `json:"description"`
-		IsLocked        bool   `json:"is_locked"`
 	}
 
 	UpdateImageStatusRequest struct {
@@ -171,6 +176,60 @@ type (
 		Status     string `json:"status"`
 		Message    string `json:"message"`
 		Target     string `json:"target"`
+
+		// 签名校验结果，未开启签名复制和校验时为空
+		SignatureStatus  string `json:"signature_status,omitempty"`
+		SignatureMessage string `json:"signature_message,omitempty"`
+		ArtifactCount    int    `json:"artifact_count,omitempty"`
+	}
+
+	CreateSigningKeyRequest struct {
+		Name        string `json:"name" binding:"required"`
+		PublicKey   string `json:"public_key" binding:"required"`
+		Description string `json:"description"`
+	}
+
+	// LockRequest 锁定镜像或版本
+	LockRequest struct {
+		UserId     string  `json:"user_id" binding:"required"` // 操作的管理员 id，锁定人取自该用户
+		Reason     string  `json:"reason" binding:"required"`
+		ExpireTime *string `json:"expire_time"` // RFC3339 格式，为空表示永久锁定
+	}
+
+	UnlockRequest struct {
+		UserId string `json:"user_id" binding:"required"`
+		Reason string `json:"reason"`
+	}
+
+	CreateImmutableRuleRequest struct {
+		Name         string `json:"name" binding:"required"`
+		ImagePattern string `json:"image_pattern"` // 为空表示全部镜像
+		TagPattern   string `json:"tag_pattern" binding:"required"`
+		Description  string `json:"description"`
+		UserId       string `json:"user_id" binding:"required"`
+	}
+
+	// CatalogSearchRequest 镜像目录的分面搜索，空值表示不过滤
+	CatalogSearchRequest struct {
+		Query        string `form:"q"`
+		Namespace    string `form:"namespace"`
+		LabelIds     string `form:"label_ids"` // 多个标签以逗号隔开，需同时满足
+		Arch         string `form:"arch"`      // 存在该架构的版本，如 linux/amd64
+		Hub          string `form:"hub"`       // 源镜像仓库，如 docker.io，quay.io
+		IsPublic     *bool  `form:"is_public"`
+		IsOfficial   *bool  `form:"is_official"`
+		MinSize      int64  `form:"min_size"` // 单位字节
+		MaxSize      int64  `form:"max_size"`
+		SyncedAfter  int64  `form:"synced_after"` // 最近同步时间范围，unix 秒
+		SyncedBefore int64  `form:"synced_before"`
+		TagStatus    string `form:"tag_status"`
+		Owner        string `form:"owner"`   // 镜像所属的用户 id
+		UserId       string `form:"user_id"` // 当前用户 id，非管理员仅能查看公开镜像和自己的镜像
+		SortBy       string `form:"sort_by"` // pulls，recent，size，name，默认最近同步
+		Order        string `form:"order"`   // asc 或 desc，默认 desc
+		Facets       bool   `form:"facets"`  // 是否返回分面统计
+
+		PageRequest `json:",inline"`
 	}
 
 	CreateAccessRequest struct {
@@ -238,6 +297,17 @@ type (
 		GithubToken      string `json:"github_token"`      // github token
 		GithubEmail      string `json:"github_email"`
 		RainbowdName     string `json:"rainbowd_name"`
+		TunnelToken      string `json:"tunnel_token"` // 隧道认证凭证，需与 agent 配置一致
+		CIType           string `json:"ci_type"`      // github, gitlab 或 gitea，默认 github
+		CIEndpoint       string `json:"ci_endpoint"`  // gitlab 或 gitea 的服务地址
+		CITrigger        string `json:"ci_trigger"`   // github 触发方式，dispatch 或 push，默认 dispatch
+		CIWorkflow       string `json:"ci_workflow"`  // github workflow 文件，默认 plugin.yml
+		CIRef            string `json:"ci_ref"`       // github workflow 所在分支，默认 master
+		Provisioner      string `json:"provisioner"`  // ssh 或 kubernetes，默认 ssh
+
+		Image         string            `json:"image"`          // agent 镜像，为空时使用 rainbowd 配置的 agent_image
+		BinaryVersion string            `json:"binary_version"` // agent 二进制版本，为空时使用模板目录的 agent
+		Labels        map[string]string `json:"labels"`
 	}
 
 	UpdateAgentRequest struct {
@@ -248,6 +318,18 @@ type (
 		GithubToken      string `json:"github_token"`      // github token
 		GithubEmail      string `json:"github_email"`
 		RainbowdName     string `json:"rainbowd_name"`
+
+		MonthlyBudget float64 `json:"monthly_budget"` // 每月开销预算，单位美金，为 0 时使用全局配置
+		CIType        string  `json:"ci_type"`
+		CIEndpoint    string  `json:"ci_endpoint"`
+		CITrigger     string  `json:"ci_trigger"`
+		CIWorkflow    string  `json:"ci_workflow"`
+		CIRef         string  `json:"ci_ref"`
+		Provisioner   string  `json:"provisioner"`
+
+		Image         string            `json:"image"`
+		BinaryVersion string            `json:"binary_version"`
+		Labels        map[string]string `json:"labels"`
 	}
 
 	UpdateAgentStatusRequest struct {
@@ -255,6 +337,116 @@ type (
 		Status    string `json:"status"`
 	}
 
+	// CreateAgentUpgradeRequest 创建 agent 分批升级计划，第一批为金丝雀批次
+	CreateAgentUpgradeRequest struct {
+		Name          string `json:"name" binding:"required"`
+		Type          string `json:"type" binding:"required"` // image 或 binary
+		Image         string `json:"image"`
+		BinaryVersion string `json:"binary_version"`
+
+		Selector     string `json:"selector"` // 标签选择器，格式 k1=v1,k2=v2
+		RainbowdName string `json:"rainbowd_name"`
+
+		CanarySize    int    `json:"canary_size"`    // 金丝雀批次的数量，默认 1
+		BatchSize     int    `json:"batch_size"`     // 后续每批的数量，默认 1
+		RequireTask   bool   `json:"require_task"`   // 健康检查需等待升级后的下一个任务成功
+		HealthTimeout int    `json:"health_timeout"` // 健康检查超时时间，单位秒，默认 600
+		FailurePolicy string `json:"failure_policy"` // pause 或 rollback，默认 pause
+	}
+
+	RainbowdSSHRequest struct {
+		Host       string `json:"host" binding:"required"`
+		Port       int    `json:"port"` // ssh 端口，默认 22
+		User       string `json:"user"` // ssh 用户，默认 root
+		Password   string `json:"password"`
+		PrivateKey string `json:"private_key"` // server 上的私钥路径
+
+		// 跳板机，jump_host 为空时直连
+		JumpHost       string `json:"jump_host"`
+		JumpPort       int    `json:"jump_port"`
+		JumpUser       string `json:"jump_user"`
+		JumpPassword   string `json:"jump_password"`
+		JumpPrivateKey string `json:"jump_private_key"`
+	}
+
+	CreateRainbowdRequest struct {
+		Name string `json:"name" binding:"required"`
+
+		RainbowdSSHRequest `json:",inline"`
+	}
+
+	// UpdateRainbowdRequest 密码为空时不修改，主机或端口变化时重新固定主机公钥
+	UpdateRainbowdRequest struct {
+		Id int64 `json:"id"`
+
+		RainbowdSSHRequest `json:",inline"`
+	}
+
+	RegisterAgentRequest struct {
+		AgentName      string `json:"agent_name" binding:"required"`
+		BootstrapToken string `json:"bootstrap_token" binding:"required"`
+	}
+
+	AgentHeartbeatRequest struct {
+		Inventory *model.AgentInventory `json:"inventory,omitempty"`
+	}
+
+	UpdateAgentUsageRequest struct {
+		GrossAmount float64 `json:"gross_amount"`
+	}
+
+	CreateAccountRequest struct {
+		Type     string `json:"type"` // 默认 dockerhub
+		UserName string `json:"user_name" binding:"required"`
+		Password string `json:"password" binding:"required"` // 密码或 personal access token
+	}
+
+	// UpdateAccountRequest 密码为空时不修改，修改后重新登陆
+	UpdateAccountRequest struct {
+		Id int64 `json:"id"`
+
+		Password string `json:"password"`
+		Disable  bool   `json:"disable"` // 停用后不再参与分配
+	}
+
+	AcquireAccountRequest struct {
+		Type string `json:"type" binding:"required"`
+	}
+
+	// ReportAccountUsageRequest agent 上报从 ratelimit-* 响应头解析的剩余次数
+	ReportAccountUsageRequest struct {
+		Remaining int `json:"remaining"`
+		Limit     int `json:"limit"`
+		Window    int `json:"window"` // 限流窗口或距离恢复的时间，单位秒
+	}
+
+	// ClaimAgentTaskRequest holder 为 agent 内的租约持有者，同一持有者可重复获取以续约
+	ClaimAgentTaskRequest struct {
+		Holder string `json:"holder" binding:"required"`
+	}
+
+	ReleaseAgentTaskRequest struct {
+		Holder string `json:"holder" binding:"required"`
+	}
+
+	// DockerhubTokenRequest plugin 申请 dockerhub 仓库的拉取 token，repository 如 library/nginx
+	DockerhubTokenRequest struct {
+		Repository string `json:"repository" binding:"required"`
+	}
+
+	// ListOwnedAgentTasksRequest 过滤出分配给 agent 的任务，用于清理共享仓库中的任务分支
+	ListOwnedAgentTasksRequest struct {
+		TaskIds []int64 `json:"task_ids"`
+	}
+
+	UpdateAgentTaskStatusRequest struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Process int    `json:"process"`
+		// OnlyIfRunning 仅在任务仍处于运行中时更新，避免覆盖 plugin 已上报的结果
+		OnlyIfRunning bool `json:"only_if_running"`
+	}
+
 	CreateNotificationRequest struct {
 		UserMetaRequest `json:",inline"`
 
@@ -390,6 +582,8 @@ type (
 		Op    int      `json:"op,omitempty"` // 操作类型
 		Repo  string   `json:"repo,omitempty"`
 		Repos []string `json:"repos,omitempty"`
+
+		TaskId int64 `json:"task_id,omitempty"` // 查询任务流水线时指定
 	}
 
 	CallSearchRequest struct {
@@ -408,6 +602,9 @@ type (
 		PageSize int    `json:"page_size" form:"page_size"`
 
 		CustomConfig *SearchCustomConfig `json:"custom_config,omitempty" form:"custom_config,omitempty"`
+
+		// 通用 OCI 镜像源，由 server 根据 hub 填充，agent 无需额外配置
+		Registry *OCIRegistry `json:"registry,omitempty" form:"-"`
 	}
 
 	SearchCustomConfig struct {
@@ -451,10 +648,12 @@ type (
 		RegisterId int64         `json:"register_id"`
 		Namespace  string        `json:"namespace"`
 		Interval   time.Duration `json:"interval"`   // 间隔多久同步一次
-		ImageFrom  string        `json:"image_from"` // 镜像来源，支持 dockerhub, gcr, quay.io
+		ImageFrom  string        `json:"image_from"` // 镜像来源，支持 dockerhub 及通用 OCI 镜像源（如 ghcr.io, registry.k8s.io）
 		Policy     string        `json:"policy"`     // 默认定义所有版本镜像，支持正则表达式，比如 v1.*
 		Arch       string        `json:"arch"`       // 支持的架构，默认不限制  linux/amd64
 		Rewrite    bool          `json:"rewrite"`    // 是否覆盖推送
+
+		SubscribeRetention
 	}
 
 	UpdateSubscribeRequest struct {
@@ -465,11 +664,20 @@ type (
 		Enable          bool          `json:"enable"`     // 启动或者关闭
 		Size            int           `json:"size"`       // 同步最新多少个版本
 		Interval        time.Duration `json:"interval"`   // 间隔多久同步一次
-		ImageFrom       string        `json:"image_from"` // 镜像来源，支持 dockerhub, gcr, quay.io
+		ImageFrom       string        `json:"image_from"` // 镜像来源，支持 dockerhub 及通用 OCI 镜像源（如 ghcr.io, registry.k8s.io）
 		Policy          string        `json:"policy"`     // 默认定义所有版本镜像，支持正则表达式，比如 v1.*
 		Arch            string        `json:"arch"`       // 支持的架构，默认不限制  linux/amd64
 		Rewrite         bool          `json:"rewrite"`    // 是否覆盖推送
 		Namespace       string        `json:"namespace"`
+
+		SubscribeRetention
+	}
+
+	// SubscribeRetention 订阅镜像版本保留策略，满足任一保留条件的版本不会被清理
+	SubscribeRetention struct {
+		RetainCount int      `json:"retain_count"` // 保留最新多少个匹配策略的版本，0 表示不限制，不得小于同步版本数
+		RetainDays  int      `json:"retain_days"`  // 保留最近多少天内同步的版本，0 表示不限制
+		PinnedTags  []string `json:"pinned_tags"`  // 固定保留的版本
 	}
 
 	RunSubscribeRequest struct {
@@ -502,6 +710,10 @@ func (o *CallSearchRequest) SetDefaultPageOption() {
 }
 
 func (o *CallSearchRequest) SetNamespace() {
+	// 通用 OCI 镜像源不存在默认命名空间
+	if o.Registry != nil {
+		return
+	}
 	if len(o.Namespace) == 0 {
 		o.Namespace = DefaultDockerhubNamespace
 	}
@@ -30,11 +30,23 @@ type IdNameMeta struct {
 }
 
 type DownflowMeta struct {
+	UserId    string `form:"user_id"` // 当前用户 id，非管理员仅能查看公开镜像和自己的镜像
 	ImageId   int64  `form:"image_id"`
-	StartTime string `form:"startTime"`
+	TagId     int64  `form:"tag_id"`    // 指定版本时只统计 pixiuctl 的下载量
+	StartTime string `form:"startTime"` // 日期，如 2025-01-02，默认最近 30 天
 	EndTime   string `form:"endTime"`
 }
 
+// TopPullsRequest 下载量排行，可按命名空间或镜像所属用户过滤
+type TopPullsRequest struct {
+	UserId    string `form:"user_id"` // 当前用户 id，非管理员仅能查看公开镜像和自己的镜像
+	Namespace string `form:"namespace"`
+	Owner     string `form:"owner"`  // 镜像所属的用户 id
+	Days      int    `form:"days"`   // 统计最近几天
+	Source    string `form:"source"` // registry 或 pixiuctl
+	Limit     int    `form:"limit"`
+}
+
 type Response struct {
 	Code    int           `json:"code"`              // 返回的状态码
 	Result  []model.Image `json:"result,omitempty"`  // 正常返回时的数据，可以为任意数据结构
@@ -48,6 +60,12 @@ const (
 	SyncImageComplete     = "Completed"
 )
 
+// TaskSyncSucceededStatus plugin 全部镜像同步成功时上报的任务状态，agent 升级的健康检查据此判断任务成功
+const TaskSyncSucceededStatus = "镜像同步完成"
+
+// PullBlockedMessage 镜像因漏洞策略禁止拉取时的错误信息前缀，pixiuctl 据此停止等待
+const PullBlockedMessage = "pull blocked by vulnerability policy"
+
 const (
 	SyncNamespaceLogoType        = 0
 	SyncNamespaceLabelType       = 1
@@ -78,9 +96,33 @@ const (
 	ImageHubDocker = "dockerhub"
 	ImageHubGCR    = "gcr.io"
 	ImageHubQuay   = "quay.io"
+	ImageHubGHCR   = "ghcr.io"
+	ImageHubK8s    = "registry.k8s.io"
+	ImageHubECR    = "public.ecr.aws"
+	ImageHubMCR    = "mcr.microsoft.com"
 	ImageHubAll    = "all"
 )
 
+// DefaultOCIRegistries 内置的通用 OCI 镜像源，可通过配置 hubs 覆盖或新增
+var DefaultOCIRegistries = map[string]string{
+	ImageHubGCR:  "https://gcr.io",
+	ImageHubQuay: "https://quay.io",
+	ImageHubGHCR: "https://ghcr.io",
+	ImageHubK8s:  "https://registry.k8s.io",
+	ImageHubECR:  "https://public.ecr.aws",
+	ImageHubMCR:  "https://mcr.microsoft.com",
+}
+
+// OCIRegistry 通用 OCI distribution 镜像源
+type OCIRegistry struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Username string `json:"-"` // 账号只保存在 server，不随请求下发给 agent
+	Password string `json:"-"`
+	Token    string `json:"token,omitempty"` // server 申请的仓库级只读 token，下发给 agent 代替账号
+	Insecure bool   `json:"insecure,omitempty"`
+}
+
 const (
 	FuzzySearch    = 0 // 模糊查询
 	AccurateSearch = 1 // 精准查询
@@ -95,6 +137,7 @@ const (
 	OpCreateAction = iota + 1
 	OpGetAction
 	OpCreateIfNotAction
+	OpGetRunAction
 )
 
 const (
@@ -102,6 +145,7 @@ const (
 	SearchTypeTag
 	SearchTypeTagInfo
 	GetTypeRepo
+	InspectTypeTag // 解析镜像的配置和分层
 )
 
 const (
@@ -110,10 +154,45 @@ const (
 	CallSearchType        = 7
 )
 
+var CallTypeNames = map[int]string{
+	CallGithubType:        "github",
+	CallKubernetesTagType: "kubernetes_tag",
+	CallSearchType:        "search",
+}
+
 const (
 	GithubAPIBase = "https://api.github.com"
 )
 
+// agent 执行任务的 CI 后端
+const (
+	CIGithub = "github"
+	CIGitlab = "gitlab"
+	CIGitea  = "gitea"
+)
+
+// github 后端触发任务运行的方式
+const (
+	CITriggerDispatch = "dispatch" // 通过 workflow_dispatch 触发，默认方式
+	CITriggerPush     = "push"     // 兼容已有仓库，推送任务分支触发
+)
+
+// CI 流水线的运行状态，由各后端的状态归一化得到
+const (
+	CIRunNotFound  = "not_found"
+	CIRunPending   = "pending"
+	CIRunRunning   = "running"
+	CIRunSucceeded = "succeeded"
+	CIRunFailed    = "failed"
+)
+
+type CIRunResult struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Logs   string `json:"logs,omitempty"`
+}
+
 type SearchResult struct {
 	Result     []byte
 	ErrMessage string
@@ -126,6 +205,87 @@ type CallResult struct {
 	StatusCode int
 }
 
+const (
+	TunnelRegisterType  = iota + 1 // agent 注册隧道，携带认证凭证
+	TunnelHeartbeatType            // agent 心跳，保持隧道存活
+	TunnelCallType                 // server 下发远程调用
+	TunnelResultType               // agent 返回调用结果
+)
+
+const (
+	AgentAPIPrefix  = "/rainbow/agent-api"
+	AgentNameHeader = "X-Rainbow-Agent"
+
+	// runner 使用任务凭证获取配置的接口
+	PluginAPIPrefix = "/rainbow/plugin-api"
+
+	// RainbowImageLabel rainbow 构建的镜像均带有该标签，agent 回收镜像时按标签过滤
+	RainbowImageLabel = "io.pixiuio.rainbow"
+)
+
+// AgentBootstrapToken agent 的引导凭证，仅在生成时返回一次
+type AgentBootstrapToken struct {
+	AgentName      string    `json:"agent_name"`
+	BootstrapToken string    `json:"bootstrap_token"`
+	ExpireTime     time.Time `json:"expire_time"`
+}
+
+// AgentCredential agent 使用引导凭证注册后颁发的凭证
+type AgentCredential struct {
+	AgentName  string `json:"agent_name"`
+	Credential string `json:"credential"`
+}
+
+// DockerhubTokenResult plugin 拉取 dockerhub 镜像使用的短期 token，为空时匿名拉取
+type DockerhubTokenResult struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"` // 有效期，单位秒
+}
+
+// AgentUpgradeDetail 升级计划及其中每个 agent 的升级进度
+type AgentUpgradeDetail struct {
+	model.AgentUpgrade `json:",inline"`
+
+	Targets []model.AgentUpgradeTarget `json:"targets"`
+}
+
+// RemoteCallMetric 按调用类型统计的远程调用指标
+type RemoteCallMetric struct {
+	Type         int       `json:"type"`
+	Name         string    `json:"name"`
+	Transport    string    `json:"transport"`
+	Total        int64     `json:"total"`
+	Failed       int64     `json:"failed"`
+	Timeout      int64     `json:"timeout"`
+	AvgLatency   int64     `json:"avg_latency"` // 平均耗时，单位毫秒
+	MaxLatency   int64     `json:"max_latency"` // 最大耗时，单位毫秒
+	LastError    string    `json:"last_error,omitempty"`
+	LastCallTime time.Time `json:"last_call_time"`
+}
+
+// SearchCacheMetric 按镜像源统计的搜索缓存命中情况
+type SearchCacheMetric struct {
+	Hub           string  `json:"hub"`
+	Hits          int64   `json:"hits"`
+	StaleHits     int64   `json:"stale_hits"`     // 返回过期结果并后台刷新的次数
+	NotFoundHits  int64   `json:"not_found_hits"` // 命中远端不存在的缓存的次数
+	Misses        int64   `json:"misses"`
+	Refreshes     int64   `json:"refreshes"` // 后台刷新次数
+	Invalidations int64   `json:"invalidations"`
+	HitRatio      float64 `json:"hit_ratio"`
+}
+
+// TunnelMessage 隧道消息，序列化后放在 Request.payload 或 Response.result 中传输
+type TunnelMessage struct {
+	Id       string `json:"id,omitempty"` // 调用 ID，用于关联请求和结果
+	Type     int    `json:"type"`
+	Token    string `json:"token,omitempty"`
+	Deadline int64  `json:"deadline,omitempty"` // 调用截止时间，unix 毫秒
+	Payload  []byte `json:"payload,omitempty"`
+
+	CallResult
+}
+
 type ImageTag struct {
 	Features     string    `json:"features"`
 	Variant      *string   `json:"variant"` // 可能是 null
@@ -261,19 +421,38 @@ type Avatar struct {
 	Kind  string `json:"kind"`
 }
 
+// SearchGCRResult gcr 和 artifact registry 的 tags/list 返回结构，manifest 以 digest 为 key
 type SearchGCRResult struct {
 	Child    []string               `json:"child"`
-	Manifest map[string]interface{} `json:"manifest"`
+	Manifest map[string]GCRManifest `json:"manifest"`
 	Name     string                 `json:"name"`
 	Tags     []string               `json:"tags"`
 }
 
+type GCRManifest struct {
+	ImageSizeBytes string   `json:"imageSizeBytes"`
+	MediaType      string   `json:"mediaType"`
+	Tag            []string `json:"tag"`
+	TimeCreatedMs  string   `json:"timeCreatedMs"`
+	TimeUploadedMs string   `json:"timeUploadedMs"`
+}
+
 type QuaySearchTagResult struct {
 	Tags          []QuayTag `json:"tags"`
 	Page          int       `json:"page"`
 	HasAdditional bool      `json:"has_additional"`
 }
 
+// QuayRepositoryResult quay 仓库详情
+type QuayRepositoryResult struct {
+	Namespace   string  `json:"namespace"`
+	Name        string  `json:"name"`
+	Kind        string  `json:"kind"`
+	Description *string `json:"description"`
+	IsPublic    bool    `json:"is_public"`
+	IsStarred   bool    `json:"is_starred"`
+}
+
 //"0.12.0": {
 //"name": "0.12.0",
 //"size": 16995121,
@@ -313,6 +492,54 @@ type CommonSearchTagInfoResult struct {
 	Images   []Image `json:"images"`
 }
 
+// ImageInspectResult 镜像 tag 的解析结果，多架构镜像按平台分别解析
+type ImageInspectResult struct {
+	Image     string            `json:"image"`
+	Tag       string            `json:"tag"`
+	Digest    string            `json:"digest"`
+	MediaType string            `json:"media_type"`
+	Platforms []PlatformInspect `json:"platforms"`
+}
+
+type PlatformInspect struct {
+	OS           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Variant      string    `json:"variant,omitempty"`
+	Digest       string    `json:"digest"` // 平台 manifest 的 digest
+	Size         int64     `json:"size"`   // 配置和全部分层的大小
+	Created      time.Time `json:"created"`
+	Author       string    `json:"author,omitempty"`
+
+	Config  ImageConfigInfo `json:"config"`
+	Layers  []LayerInfo     `json:"layers"`
+	History []HistoryInfo   `json:"history"`
+}
+
+// ImageConfigInfo 镜像的运行配置
+type ImageConfigInfo struct {
+	User         string            `json:"user,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	ExposedPorts []string          `json:"exposed_ports,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	StopSignal   string            `json:"stop_signal,omitempty"`
+}
+
+type LayerInfo struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+type HistoryInfo struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
 type SearchDockerhubTagInfoResult struct {
 	Name                string    `json:"name"`
 	Creator             int64     `json:"creator,omitempty"`
@@ -363,6 +590,11 @@ const (
 	WebhookNotifyType  = "webhook"
 )
 
+const (
+	NormalUserRole = 0
+	AdminUserRole  = 1
+)
+
 type PushConfig struct {
 	Webhook  *WebhookConfig  `json:"webhook,omitempty"`
 	Dingtalk *DingtalkConfig `json:"dingtalk,omitempty"`
@@ -498,6 +730,19 @@ type GitHubRepository struct {
 	Private  bool   `json:"private"`
 }
 
+// CommonRepositoryResult 各镜像源统一的仓库信息，字段名与 dockerhub 保持一致
+type CommonRepositoryResult struct {
+	Hub          string     `json:"hub"`
+	Namespace    string     `json:"namespace"`
+	Name         string     `json:"name"`
+	Description  string     `json:"description"`
+	IsPrivate    bool       `json:"is_private"`
+	StarCount    int        `json:"star_count"`
+	PullCount    int64      `json:"pull_count"`
+	LastModified string     `json:"last_modified"`
+	Categories   []Category `json:"categories"`
+}
+
 type GetRepositoryResult struct {
 	User              string      `json:"user"`
 	Name              string      `json:"name"`
@@ -547,3 +792,54 @@ type PixiuctlDownloadItem struct {
 	Version string   `json:"version"`
 	Items   []string `json:"items"`
 }
+
+// ScanSummary 漏洞扫描按严重级别的统计
+type ScanSummary struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Unknown  int `json:"unknown"`
+}
+
+// Vulnerability 归一化的漏洞信息，与具体扫描器无关
+type Vulnerability struct {
+	ID               string `json:"id"`
+	Target           string `json:"target"` // 漏洞所在的系统包或应用依赖文件
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installed_version"`
+	FixedVersion     string `json:"fixed_version"`
+	Severity         string `json:"severity"`
+	Title            string `json:"title"`
+	PrimaryURL       string `json:"primary_url"`
+}
+
+type ScanReportResult struct {
+	TagId           int64           `json:"tag_id"`
+	Image           string          `json:"image"`
+	Scanner         string          `json:"scanner"`
+	DBVersion       string          `json:"db_version"`
+	ScanTime        *time.Time      `json:"scan_time"`
+	Summary         ScanSummary     `json:"summary"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+// FacetCount 分面的取值及命中的镜像数量
+type FacetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"` // 取值的展示名称，如标签名，用户名
+	Count int64  `json:"count"`
+}
+
+type CatalogSearchResult struct {
+	PageResult `json:",inline"`
+
+	Facets map[string][]FacetCount `json:"facets,omitempty"`
+}
+
+// PullPoint 下载量时间序列中的一天
+type PullPoint struct {
+	Date     string `json:"date"`
+	Registry int64  `json:"registry"` // 远端仓库统计的下载量
+	Pixiuctl int64  `json:"pixiuctl"` // pixiuctl 解析镜像的次数
+}
@@ -23,3 +23,12 @@ func GenerateSK() (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(b), nil
 }
+
+// GenerateToken 生成随机凭证 (含前缀)
+func GenerateToken(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
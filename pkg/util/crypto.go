@@ -0,0 +1,64 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Encrypt 使用 AES-GCM 加密，密钥由 secret 的 sha256 摘要派生，结果为 base64 编码
+func Encrypt(secret string, plaintext string) (string, error) {
+	if len(plaintext) == 0 {
+		return "", nil
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// Decrypt 解密 Encrypt 的结果
+func Decrypt(secret string, ciphertext string) (string, error) {
+	if len(ciphertext) == 0 {
+		return "", nil
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid ciphertext")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %v", err)
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(secret string) (cipher.AEAD, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("encrypt key missing")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
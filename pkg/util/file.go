@@ -1,6 +1,11 @@
 package util
 
-import "os"
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
 
 func IsDirectoryExists(path string) bool {
 	stat, err := os.Stat(path)
@@ -54,3 +59,18 @@ func WriteIntoFile(content string, fileName string) error {
 func ReadFromFile(fileName string) ([]byte, error) {
 	return os.ReadFile(fileName)
 }
+
+// FileDigest 计算文件内容的 sha256 摘要
+func FileDigest(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
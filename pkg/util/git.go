@@ -71,6 +71,39 @@ func (g *Git) Push() error {
 	return nil
 }
 
+// DeleteRemoteBranch 删除远端的分支
+func (g *Git) DeleteRemoteBranch() error {
+	cmd := g.executor.Command("git", "push", "origin", "--delete", g.Branch)
+	cmd.SetDir(g.RepoDir)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, string(out))
+	}
+	return nil
+}
+
+// RemoteBranches 获取远端的分支名称
+func (g *Git) RemoteBranches() ([]string, error) {
+	cmd := g.executor.Command("git", "ls-remote", "--heads", "origin")
+	cmd.SetDir(g.RepoDir)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v %s", err, string(out))
+	}
+
+	var branches []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		branches = append(branches, strings.TrimPrefix(fields[1], "refs/heads/"))
+	}
+	return branches, nil
+}
+
 func (g *Git) Add() error {
 	cmd := g.executor.Command("git", "add", ".")
 	cmd.SetDir(g.RepoDir)
@@ -32,6 +32,8 @@ type HttpClientV2 struct {
 	body     io.Reader
 	headers  map[string]string
 	timeout  time.Duration
+
+	respHeader *http.Header
 }
 
 func (c *HttpClientV2) Method(method string) *HttpClientV2 {
@@ -80,6 +82,15 @@ func (c *HttpClientV2) WithHeader(headers map[string]string) *HttpClientV2 {
 	return c
 }
 
+// WithResponseHeader 请求完成后保存响应头，请求失败时同样保存，用于解析限流等信息
+func (c *HttpClientV2) WithResponseHeader(header *http.Header) *HttpClientV2 {
+	if c == nil {
+		return nil
+	}
+	c.respHeader = header
+	return c
+}
+
 func (c *HttpClientV2) WithFile(filename string) *HttpClientV2 {
 	if c == nil {
 		return nil
@@ -118,6 +129,9 @@ func (c *HttpClientV2) Do(val interface{}) *HttpError {
 		}
 	}
 	defer resp.Body.Close()
+	if c.respHeader != nil {
+		*c.respHeader = resp.Header
+	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		d, err := io.ReadAll(resp.Body)
@@ -2,11 +2,13 @@ package sshutil
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,15 +18,40 @@ import (
 type SSHConfig struct {
 	Host       string        // 主机地址
 	Port       int           // 端口
-	Username   string        // 用户名
+	Username   string        // 用户名，默认 root
 	Password   string        // 密码
 	PrivateKey string        // 私钥路径（如果使用密钥认证）
 	Timeout    time.Duration // 连接超时时间
+
+	// HostKey 固定的主机公钥，authorized_keys 格式，与实际公钥不一致时拒绝连接
+	HostKey string
+	// OnNewHostKey 未固定主机公钥时首次连接回调，用于保存公钥，为空时拒绝连接
+	OnNewHostKey func(hostKey string) error
+
+	// Jump 跳板机配置，不为空时经跳板机连接
+	Jump *SSHConfig
+}
+
+// HostKeyMismatchError 主机公钥与固定的公钥不一致，可能存在中间人攻击，确认后需重新固定公钥
+type HostKeyMismatchError struct {
+	Host     string
+	Expected string
+	Actual   string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("主机 %s 的公钥 %s 与固定的公钥 %s 不一致", e.Host, e.Actual, e.Expected)
+}
+
+func IsHostKeyMismatch(err error) bool {
+	var mismatch *HostKeyMismatchError
+	return errors.As(err, &mismatch)
 }
 
 type SSHClient struct {
 	config *SSHConfig
 	client *ssh.Client
+	jump   *SSHClient
 }
 
 type CommandResult struct {
@@ -58,39 +85,94 @@ func (s *SSHClient) connect() error {
 	}
 	if s.config.PrivateKey != "" {
 		keyAuth, err := s.privateKeyAuthFromFile(s.config.PrivateKey)
-		if err == nil {
-			authMethods = append(authMethods, keyAuth)
-		}
-	}
-
-	// 尝试获取私钥
-	if len(authMethods) == 0 {
-		keyAuth, err := s.tryDefaultPrivateKeys()
-		if err == nil {
-			authMethods = append(authMethods, keyAuth)
+		if err != nil {
+			return err
 		}
+		authMethods = append(authMethods, keyAuth)
 	}
-
 	if len(authMethods) == 0 {
 		return fmt.Errorf("必须提供密码或私钥")
 	}
 
+	user := s.config.Username
+	if len(user) == 0 {
+		user = "root"
+	}
 	sshConfig := &ssh.ClientConfig{
-		User:            "root",
+		User:            user,
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // 生产环境应该验证主机密钥
+		HostKeyCallback: s.hostKeyCallback(),
 		Timeout:         s.config.Timeout,
 	}
-	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+	addr := net.JoinHostPort(s.config.Host, fmt.Sprintf("%d", s.config.Port))
+
+	if s.config.Jump == nil {
+		client, err := ssh.Dial("tcp", addr, sshConfig)
+		if err != nil {
+			return fmt.Errorf("连接SSH服务器失败: %w", err)
+		}
+		s.client = client
+		return nil
+	}
+
+	jump, err := NewSSHClient(s.config.Jump)
+	if err != nil {
+		return fmt.Errorf("连接跳板机失败: %w", err)
+	}
+	conn, err := jump.client.Dial("tcp", addr)
+	if err != nil {
+		jump.Close()
+		return fmt.Errorf("经跳板机连接 %s 失败: %w", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
 	if err != nil {
+		conn.Close()
+		jump.Close()
 		return fmt.Errorf("连接SSH服务器失败: %w", err)
 	}
 
-	s.client = client
+	s.client = ssh.NewClient(c, chans, reqs)
+	s.jump = jump
 	return nil
 }
 
+// hostKeyCallback 校验固定的主机公钥，未固定时首次信任并回调保存
+func (s *SSHClient) hostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		actual := MarshalHostKey(key)
+		if len(s.config.HostKey) != 0 {
+			if s.config.HostKey != actual {
+				return &HostKeyMismatchError{Host: hostname, Expected: s.config.HostKey, Actual: actual}
+			}
+			return nil
+		}
+
+		if s.config.OnNewHostKey == nil {
+			return fmt.Errorf("主机 %s 未固定公钥", hostname)
+		}
+		klog.Infof("首次连接主机 %s，信任并固定公钥 %s", hostname, ssh.FingerprintSHA256(key))
+		if err := s.config.OnNewHostKey(actual); err != nil {
+			return fmt.Errorf("保存主机 %s 公钥失败: %w", hostname, err)
+		}
+		s.config.HostKey = actual
+		return nil
+	}
+}
+
+// MarshalHostKey 将主机公钥转换为 authorized_keys 格式
+func MarshalHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// HostKeyFingerprint 获取 authorized_keys 格式公钥的 SHA256 指纹
+func HostKeyFingerprint(hostKey string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
 // RunCommand 执行单个命令
 func (s *SSHClient) RunCommand(cmd string) (*CommandResult, error) {
 	if s.client == nil {
@@ -236,33 +318,14 @@ func (s *SSHClient) Ping() error {
 
 // Close 关闭SSH连接
 func (s *SSHClient) Close() error {
+	var err error
 	if s.client != nil {
-		return s.client.Close()
-	}
-	return nil
-}
-
-func (s *SSHClient) tryDefaultPrivateKeys() (ssh.AuthMethod, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("获取用户主目录失败: %w", err)
-	}
-
-	sshDir := filepath.Join(homeDir, ".ssh")
-	defaultKeys := []string{
-		filepath.Join(sshDir, "id_rsa"),
-		filepath.Join(sshDir, "id_dsa"),
+		err = s.client.Close()
 	}
-	for _, keyPath := range defaultKeys {
-		if _, err := os.Stat(keyPath); err == nil {
-			auth, err := s.privateKeyAuthFromFile(keyPath)
-			if err == nil {
-				return auth, nil
-			}
-		}
+	if s.jump != nil {
+		_ = s.jump.Close()
 	}
-
-	return nil, fmt.Errorf("没有找到默认私钥文件")
+	return err
 }
 
 func (s *SSHClient) privateKeyAuthFromFile(privateKeyPath string) (ssh.AuthMethod, error) {
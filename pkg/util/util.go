@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"k8s.io/klog/v2"
 	"math/rand"
@@ -92,3 +93,11 @@ func RunCmd(exec exec.Interface, cmd []string) ([]byte, error) {
 
 	return out, nil
 }
+
+// HashToken 计算凭证的 sha256 摘要，数据库中仅保存摘要
+func HashToken(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}